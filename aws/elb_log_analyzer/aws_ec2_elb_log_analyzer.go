@@ -1,22 +1,22 @@
 package main
 
 /*
-This tool analyzes access logs for classic ELB access logs and pushes them
-inside a MySQL/MariaDB database so that you can generate some reporting on it.
+This tool analyzes the access logs of Classic, Application and Network (TLS
+listeners) Load Balancers and pushes them inside a local SQLite database or a
+MySQL/MariaDB database so that you can generate some reporting on it.
 */
 
 import (
-	"bufio"
 	"bytes"
 	"database/sql"
 	"encoding/csv"
 	"flag"
 	"fmt"
 	"log"
-	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,74 +24,134 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gobike/envflag"
 )
 
 var wg, s3wg sync.WaitGroup
 var classicELBPattern = regexp.MustCompile(`^([^ ]*) ([^ ]*) ([^ ]*):([0-9]*) ([^ ]*)[:\-]([0-9]*) ([-.0-9]*) ([-.0-9]*) ([-.0-9]*) (|[-0-9]*) (-|[-0-9]*) ([-0-9]*) ([-0-9]*) "([^ ]*) ([^ ]*) (- |[^ ]*)" "([^"]*)" ([A-Z0-9-]+) ([A-Za-z0-9.-]*)$`)
 
+// accessLogEntry is a line of access logs. The fields a format does not log
+// are left empty, the durations it does not log being -1.
 type accessLogEntry struct {
+	timestamp                                                                              time.Time
 	year, month, day, hour                                                                 int
 	sourceIP, method, domain, scheme, uri, userAgent, elbResponseCode, backendResponseCode string
+	format, requestType, elb, backendIP, sslCipher, sslProtocol                            string
+	sourcePort, backendPort                                                                int
+	// processing times of the Classic ELB and ALB lines in seconds
+	requestProcessingTime, backendProcessingTime, responseProcessingTime float64
+	receivedBytes, sentBytes                                             int64
+	// fields of the ALB lines
+	targetGroupARN, traceID, sniDomain, chosenCertARN, actionsExecuted, redirectURL, errorReason string
+	// fields of the NLB TLS lines, the times being in milliseconds
+	connectionTime, tlsHandshakeTime float64
+	incomingTLSAlert                 string
+	// fields derived from the others so that the report queries do not
+	// depend on the string functions of a database
+	path, rootURI, shortURI, shortUserAgent, requestDate, requestHour string
+	// key of the file the entry was read from
+	sourceFile string
+	// event is set on the entries sent around the entries of a file, which
+	// are not written in the table
+	event *fileEvent
 }
 
-// processLine takes a line and the compiled regex and returns a accessLogEntry
-func processLine(re *regexp.Regexp, line string) *accessLogEntry {
-	entry := accessLogEntry{}
-
-	result := re.FindStringSubmatch(line)
+// accessLogColumns lists the columns of the table of the access logs, in the
+// order of accessLogEntry.values
+var accessLogColumns = []struct{ name, definition string }{
+	{"year", "INT(4)"},
+	{"month", "INT(2)"},
+	{"day", "INT(2)"},
+	{"hour", "INT(2)"},
+	{"sourceIP", "VARCHAR(128)"},
+	{"method", "VARCHAR(8)"},
+	{"domain", "VARCHAR(256)"},
+	{"scheme", "VARCHAR(8)"},
+	{"uri", "VARCHAR(512)"},
+	{"userAgent", "VARCHAR(512)"},
+	{"elbResponseCode", "VARCHAR(4)"},
+	{"backendResponseCode", "VARCHAR(4)"},
+	{"logFormat", "VARCHAR(8)"},
+	{"requestType", "VARCHAR(8)"},
+	{"elb", "VARCHAR(256)"},
+	{"sourcePort", "INT"},
+	{"backendIP", "VARCHAR(128)"},
+	{"backendPort", "INT"},
+	{"requestProcessingTime", "DOUBLE"},
+	{"backendProcessingTime", "DOUBLE"},
+	{"responseProcessingTime", "DOUBLE"},
+	{"receivedBytes", "BIGINT"},
+	{"sentBytes", "BIGINT"},
+	{"sslCipher", "VARCHAR(128)"},
+	{"sslProtocol", "VARCHAR(32)"},
+	{"targetGroupArn", "VARCHAR(512)"},
+	{"traceId", "VARCHAR(128)"},
+	{"sniDomain", "VARCHAR(256)"},
+	{"chosenCertArn", "VARCHAR(512)"},
+	{"actionsExecuted", "VARCHAR(256)"},
+	{"redirectUrl", "VARCHAR(512)"},
+	{"errorReason", "VARCHAR(128)"},
+	{"connectionTime", "DOUBLE"},
+	{"tlsHandshakeTime", "DOUBLE"},
+	{"incomingTlsAlert", "VARCHAR(32)"},
+	{"path", "VARCHAR(512)"},
+	{"rootUri", "VARCHAR(512)"},
+	{"shortUri", "VARCHAR(512)"},
+	{"shortUserAgent", "VARCHAR(512)"},
+	{"requestDate", "VARCHAR(10)"},
+	{"requestHour", "VARCHAR(16)"},
+	{"sourceFile", "VARCHAR(2048)"},
+}
 
-	// do not process incorrect lines
-	if len(result) < 18 {
-		return nil
-	}
-	layout := "2006-01-02T15:04:05.000000Z"
-	mDate, err := time.Parse(layout, result[1])
-	if err != nil {
-		log.Println(err)
+// truncate cuts a string to the size of its column
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
 	}
-	entry.year = mDate.Year()
-	entry.month = int(mDate.Month())
-	entry.day = mDate.Day()
-	entry.hour = mDate.Hour()
-
-	entry.sourceIP = result[3]
-	entry.method = result[14]
-	entry.elbResponseCode = result[10]
-	entry.backendResponseCode = result[11]
+	return s
+}
 
-	u, err := url.Parse(result[15])
-	if err != nil {
-		log.Println(err)
-	} else {
-		entry.domain = u.Hostname()
-		entry.scheme = u.Scheme
-		entry.uri = u.RequestURI()
+// values returns the values of the columns of the entry
+func (e *accessLogEntry) values() []interface{} {
+	return []interface{}{
+		e.year, e.month, e.day, e.hour, e.sourceIP, e.method, e.domain, e.scheme,
+		truncate(e.uri, 511), truncate(e.userAgent, 511), e.elbResponseCode, e.backendResponseCode,
+		e.format, e.requestType, e.elb, e.sourcePort, e.backendIP, e.backendPort,
+		e.requestProcessingTime, e.backendProcessingTime, e.responseProcessingTime, e.receivedBytes, e.sentBytes,
+		e.sslCipher, e.sslProtocol, e.targetGroupARN, e.traceID, e.sniDomain, e.chosenCertARN,
+		e.actionsExecuted, truncate(e.redirectURL, 511), e.errorReason,
+		e.connectionTime, e.tlsHandshakeTime, e.incomingTLSAlert,
+		truncate(e.path, 511), truncate(e.rootURI, 511), truncate(e.shortURI, 511), truncate(e.shortUserAgent, 511), e.requestDate, e.requestHour,
+		e.sourceFile,
 	}
-
-	entry.userAgent = result[17]
-	return &entry
 }
 
-// processS3Files processes each file found in the given key
-func processS3Files(bucket, path string, dataPipe chan *accessLogEntry) {
+// processS3Files processes each file found in the given key that is not
+// already loaded nor out of the time window of the filter
+func processS3Files(bucket, path string, ledger *fileLedger, format *logFormat, filter *entryFilter, dataPipe chan *accessLogEntry) {
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
-	fchan := make(chan string)
+	fchan := make(chan *s3.Object)
 	// s3 files are processed in parallel by groups of C5maxParallelFiles
 	for i := 0; i <= 5; i++ {
 		s3wg.Add(1)
-		go processS3File(bucket, sess, dataPipe, fchan)
+		go processS3File(bucket, sess, ledger, format, filter, dataPipe, fchan)
 	}
 
 	svc := s3.New(sess)
 	params := &s3.ListObjectsInput{Bucket: &bucket, Prefix: &path}
+	outOfWindow := 0
 	errLst := svc.ListObjectsPages(params, func(page *s3.ListObjectsOutput, lastPage bool) bool {
 		for _, obj := range page.Contents {
-			fchan <- *obj.Key
+			if filter.skipsS3Key(*obj.Key) {
+				outOfWindow++
+				continue
+			}
+			if !ledger.isLoaded(s3FileKey(bucket, *obj.Key), aws.StringValue(obj.ETag)) {
+				fchan <- obj
+			}
 		}
 
 		return !lastPage
@@ -101,12 +161,21 @@ func processS3Files(bucket, path string, dataPipe chan *accessLogEntry) {
 	}
 	close(fchan)
 	s3wg.Wait()
+	if outOfWindow > 0 {
+		log.Printf("Skipped %d s3 files out of the time window\n", outOfWindow)
+	}
+}
+
+// s3FileKey returns the key of an s3 file in the ledger and the table
+func s3FileKey(bucket, path string) string {
+	return "s3://" + bucket + "/" + path
 }
 
 // processS3File process a single s3 file and sends its content to the channel
-func processS3File(bucket string, sess *session.Session, dataPipe chan *accessLogEntry, fchan chan string) {
+func processS3File(bucket string, sess *session.Session, ledger *fileLedger, format *logFormat, filter *entryFilter, dataPipe chan *accessLogEntry, fchan chan *s3.Object) {
 	s3dl := s3manager.NewDownloader(sess)
-	for path := range fchan {
+	for obj := range fchan {
+		path := *obj.Key
 		log.Printf("Processing s3 file: s3://%s/%s", bucket, path)
 		buff := &aws.WriteAtBuffer{}
 		_, err := s3dl.Download(buff, &s3.GetObjectInput{
@@ -115,46 +184,50 @@ func processS3File(bucket string, sess *session.Session, dataPipe chan *accessLo
 		})
 		if err != nil {
 			log.Println(err)
+			continue
 		}
-
-		rdr := bytes.NewReader(buff.Bytes())
-		scanner := bufio.NewScanner(rdr)
-		scanner.Split(bufio.ScanLines)
-
-		for scanner.Scan() {
-			// Avoid filling up memory too much
-			if len(dataPipe) > 50000 {
-				time.Sleep(500 * time.Millisecond)
-			}
-			dataPipe <- processLine(classicELBPattern, scanner.Text())
-		}
+		ledger.loadFile(s3FileKey(bucket, path), aws.StringValue(obj.ETag), bytes.NewReader(buff.Bytes()), format, filter, dataPipe)
 	}
 	s3wg.Done()
 }
 
 // processLocalFile reads a file and process each of the lines and sends them to the
-// given open channel
-func processLocalFile(path string, dataPipe chan *accessLogEntry) {
+// given open channel, unless the file is already loaded
+func processLocalFile(path string, ledger *fileLedger, format *logFormat, filter *entryFilter, dataPipe chan *accessLogEntry) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		log.Printf("Error while reading file %s: %s\n", path, err)
+		return
+	}
 	inFile, err := os.Open(path)
 	if err != nil {
 		log.Printf("Error while reading file %s: %s\n", path, err)
+		return
 	}
 	defer inFile.Close()
-	scanner := bufio.NewScanner(inFile)
-	scanner.Split(bufio.ScanLines)
-
-	for scanner.Scan() {
-		// Avoid filling up memory too much
-		if len(dataPipe) > 50000 {
-			time.Sleep(500 * time.Millisecond)
-		}
-		dataPipe <- processLine(classicELBPattern, scanner.Text())
+	info, err := inFile.Stat()
+	if err != nil {
+		log.Printf("Error while reading file %s: %s\n", path, err)
+		return
 	}
+	// the modification time is the version of the local files
+	version := info.ModTime().UTC().Format(time.RFC3339Nano)
+	if ledger.isLoaded(key, version) {
+		return
+	}
+	log.Printf("Processing file %s\n", path)
+	ledger.loadFile(key, version, inFile, format, filter, dataPipe)
 }
 
-// dbCreateTable creates the table if it does not exists
-func dbCreateTable(db *sql.DB, tableName string) {
-	crStmt, err := db.Prepare(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (`year` INT(4), `month` INT(2), `day` INT(2), `hour` INT(2), `sourceIP` VARCHAR(128), `method` VARCHAR(8), `domain` VARCHAR(256), `scheme` VARCHAR(8), `uri` VARCHAR(512), `userAgent` VARCHAR(512), `elbResponseCode` VARCHAR(4), `backendResponseCode` VARCHAR(4))", tableName))
+// dbCreateTable creates the table if it does not exists and adds the columns
+// missing from the tables created by previous versions, computing the derived
+// ones for the rows already loaded
+func dbCreateTable(db *sql.DB, store logStore, tableName string) {
+	defs := make([]string, len(accessLogColumns))
+	for i, c := range accessLogColumns {
+		defs[i] = fmt.Sprintf("`%s` %s", c.name, c.definition)
+	}
+	crStmt, err := db.Prepare(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (%s)", tableName, strings.Join(defs, ", ")))
 	if err != nil {
 		log.Println(err)
 	}
@@ -165,25 +238,44 @@ func dbCreateTable(db *sql.DB, tableName string) {
 	if err = crStmt.Close(); err != nil {
 		log.Println(err)
 	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM `%s` LIMIT 0", tableName))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	found := make(map[string]bool, len(existing))
+	for _, c := range existing {
+		found[strings.ToLower(c)] = true
+	}
+	for _, c := range accessLogColumns {
+		if found[strings.ToLower(c.name)] {
+			continue
+		}
+		if _, err = db.Exec(fmt.Sprintf("ALTER TABLE `%s` ADD COLUMN `%s` %s", tableName, c.name, c.definition)); err != nil {
+			log.Println(err)
+			continue
+		}
+		if expr := store.backfill(c.name); len(expr) > 0 {
+			log.Printf("Computing the column %s of the rows already loaded\n", c.name)
+			if _, err = db.Exec(fmt.Sprintf("UPDATE `%s` SET `%s` = %s", tableName, c.name, expr)); err != nil {
+				log.Println(err)
+			}
+		}
+	}
 }
 
 // dbInsertElt adds an accesslog entry to the table
 func dbInsertElt(stmt *sql.Stmt, elem *accessLogEntry) {
-	var err error
-
-	// sanity
-	uriLen := len(elem.uri)
-	if uriLen > 511 {
-		uriLen = 511
-	}
-	agentLen := len(elem.userAgent)
-	if agentLen > 511 {
-		agentLen = 511
-	}
-	if _, err = stmt.Exec(elem.year, elem.month, elem.day, elem.hour, elem.sourceIP, elem.method, elem.domain, elem.scheme, elem.uri[:uriLen], elem.userAgent[:agentLen], elem.elbResponseCode, elem.backendResponseCode); err != nil {
+	if _, err := stmt.Exec(elem.values()...); err != nil {
 		log.Println(err)
 	}
-
 }
 
 // dbCheckForCommit commits the transaction if idx is over maxIdx and resets idx to 0
@@ -200,16 +292,25 @@ func dbCheckForCommit(idx *int, maxIdx int, stmt *sql.Stmt, tx *sql.Tx) {
 	}
 }
 
-// Takes the data out of the given channel and pushes it to the given mysql
-// table
-func channelToDB(user, pwd, host, database, tableName string, dataPipe chan *accessLogEntry) {
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@%s/%s?charset=utf8", user, pwd, host, database))
+// insertQuery returns the statement inserting an entry in the table
+func insertQuery(tableName string) string {
+	names := make([]string, len(accessLogColumns))
+	for i, c := range accessLogColumns {
+		names[i] = "`" + c.name + "`"
+	}
+	return fmt.Sprintf("insert into `%s` (%s) VALUES (?%s)", tableName, strings.Join(names, ", "), strings.Repeat(", ?", len(names)-1))
+}
+
+// Takes the data out of the given channel and pushes it to the given table of
+// the store
+func channelToDB(store logStore, tableName string, dataPipe chan *accessLogEntry) {
+	db, err := store.open()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	dbCreateTable(db, tableName)
+	dbCreateTable(db, store, tableName)
 
 	var (
 		tx   *sql.Tx
@@ -229,13 +330,17 @@ func channelToDB(user, pwd, host, database, tableName string, dataPipe chan *acc
 			if err != nil {
 				log.Println(err)
 			}
-			stmt, err = tx.Prepare(fmt.Sprintf("insert into `%s` (`year`, `month`, `day`, `hour`, `sourceIP`, `method`, `domain`, `scheme`, `uri`, `userAgent`, `elbResponseCode`, `backendResponseCode`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", tableName))
+			stmt, err = tx.Prepare(insertQuery(tableName))
 			if err != nil {
 				log.Println(err)
 			}
 		}
 
-		dbInsertElt(stmt, elem)
+		if elem.event != nil {
+			dbFileEvent(tx, tableName, elem)
+		} else {
+			dbInsertElt(stmt, elem)
+		}
 
 		flagIdx++
 		dbCheckForCommit(&flagIdx, 10000, stmt, tx)
@@ -337,13 +442,13 @@ func dbQueryToCSV(db *sql.DB, query string, csvWriter *csv.Writer) error {
 }
 
 // generateReport generates a standard report in a summary file
-func generateReport(user, pwd, host, database, tableName, reportPath string) {
+func generateReport(store logStore, tableName, reportPath string) {
 	if len(reportPath) == 0 {
 		log.Println("-report-path flag empty. Skipping report generation")
 		return
 	}
 
-	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@%s/%s?charset=utf8", user, pwd, host, database))
+	db, err := store.open()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -351,27 +456,32 @@ func generateReport(user, pwd, host, database, tableName, reportPath string) {
 
 	f, errF := os.Create(reportPath)
 	if errF != nil {
-		log.Fatal(err)
+		log.Fatal(errF)
 	}
 	defer f.Close()
 
 	csvWriter := csv.NewWriter(f)
+	// The queries only use standard SQL, the values previously computed with
+	// the string functions of MySQL being derived columns
+	from := " from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu'"
 	queries := []struct {
 		title, query string
 	}{
-		{"Requests per day", "select CONCAT(year, '-', month, '-', day) as date, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by year, month, day order by year, month, day, nbrcalls"},
-		{"Requests per method and scheme", "select method, scheme, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by method, scheme order by nbrcalls desc"},
-		{"Requests per HTTP response code", "select elbResponseCode, backendResponseCode, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by elbResponseCode, backendResponseCode order by nbrcalls desc"},
-		{"Top 10 source IP", "select * from (select sourceIP, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by sourceIP order by nbrcalls desc) t limit 10"},
-		{"Top 10 full user agent", "select * from (select userAgent, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by userAgent order by nbrcalls desc) t limit 10"},
-		{"Top 10 short user agent", "select * from (select SUBSTRING_INDEX(SUBSTRING_INDEX(userAgent, ' ', 1),'(',1) as userAgent, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by SUBSTRING_INDEX(SUBSTRING_INDEX(userAgent, ' ', 1),'(',1) order by nbrcalls desc) t limit 10"},
-		{"Top 10 root uri path", "select * from (select SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 2) as root_uri, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 2) order by nbrcalls desc) t limit 10"},
-		{"Top 10 short uri path", "select * from (select SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 3) as short_uri, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 3) order by nbrcalls desc) t limit 10"},
-		{"Top 10 raw uri path", "select * from (select SUBSTRING_INDEX(uri,'?', 1) as uri, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by SUBSTRING_INDEX(uri, '?', 1) order by nbrcalls desc) t limit 10"},
-		{"Top 10 source IP and response code", "select * from (select sourceIP, elbResponseCode, backendResponseCode, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by sourceIP, elbResponseCode, backendResponseCode order by nbrcalls desc) t limit 10"},
-		{"Top 10 short uri path and response code", "select * from (select SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 3) as short_uri, elbResponseCode, backendResponseCode, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 3), elbResponseCode, backendResponseCode order by nbrcalls desc) t limit 10"},
-		{"Top 10 domains used to call the uri and response code", "select * from (select domain, elbResponseCode, backendResponseCode, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' group by domain, elbResponseCode, backendResponseCode order by nbrcalls desc) t limit 10"},
-		{"Domains and uri that returned a 200 return code", "select domain, uri, count(*) as nbrcalls from `" + tableName + "` where userAgent not like 'Pingdom%' and userAgent != 'ZmEu' and backendResponseCode=200 group by domain, uri order by nbrcalls desc"},
+		{"Requests per day", "select requestDate as date, count(*) as nbrcalls" + from + " group by requestDate order by requestDate"},
+		{"Requests per method and scheme", "select method, scheme, count(*) as nbrcalls" + from + " group by method, scheme order by nbrcalls desc"},
+		{"Requests per HTTP response code", "select elbResponseCode, backendResponseCode, count(*) as nbrcalls" + from + " group by elbResponseCode, backendResponseCode order by nbrcalls desc"},
+		{"Top 10 source IP", "select sourceIP, count(*) as nbrcalls" + from + " group by sourceIP order by nbrcalls desc limit 10"},
+		{"Top 10 full user agent", "select userAgent, count(*) as nbrcalls" + from + " group by userAgent order by nbrcalls desc limit 10"},
+		{"Top 10 short user agent", "select shortUserAgent as userAgent, count(*) as nbrcalls" + from + " group by shortUserAgent order by nbrcalls desc limit 10"},
+		{"Top 10 root uri path", "select rootUri as root_uri, count(*) as nbrcalls" + from + " group by rootUri order by nbrcalls desc limit 10"},
+		{"Top 10 short uri path", "select shortUri as short_uri, count(*) as nbrcalls" + from + " group by shortUri order by nbrcalls desc limit 10"},
+		{"Top 10 raw uri path", "select path as uri, count(*) as nbrcalls" + from + " group by path order by nbrcalls desc limit 10"},
+		{"Top 10 source IP and response code", "select sourceIP, elbResponseCode, backendResponseCode, count(*) as nbrcalls" + from + " group by sourceIP, elbResponseCode, backendResponseCode order by nbrcalls desc limit 10"},
+		{"Top 10 short uri path and response code", "select shortUri as short_uri, elbResponseCode, backendResponseCode, count(*) as nbrcalls" + from + " group by shortUri, elbResponseCode, backendResponseCode order by nbrcalls desc limit 10"},
+		{"Top 10 domains used to call the uri and response code", "select domain, elbResponseCode, backendResponseCode, count(*) as nbrcalls" + from + " group by domain, elbResponseCode, backendResponseCode order by nbrcalls desc limit 10"},
+		{"Domains and uri that returned a 200 return code", "select domain, uri, count(*) as nbrcalls" + from + " and backendResponseCode = '200' group by domain, uri order by nbrcalls desc"},
+		{"Top 10 slowest raw uri path by average backend latency (seconds)", "select path as uri, count(*) as nbrcalls, avg(backendProcessingTime) as avg_latency, max(backendProcessingTime) as max_latency" + from + " and backendProcessingTime >= 0 group by path order by avg_latency desc limit 10"},
+		{"Bytes served per domain", "select domain, count(*) as nbrcalls, sum(sentBytes) as bytes_sent, sum(receivedBytes) as bytes_received" + from + " group by domain order by bytes_sent desc"},
 	}
 	for _, q := range queries {
 		if err = csvWriter.Write([]string{q.title}); err != nil {
@@ -385,28 +495,83 @@ func generateReport(user, pwd, host, database, tableName, reportPath string) {
 		}
 		csvWriter.Flush()
 	}
+
+	// The latency percentiles are computed from the latencies of each group,
+	// sorted by the database, as neither SQLite nor MySQL have a percentile
+	// function. The requests that were not sent to a backend have a latency of
+	// -1.
+	latencyQueries := []struct {
+		title, keyColumn, query string
+		top                     int
+	}{
+		{"Backend latency percentiles of the top 20 root uri path (seconds)", "root_uri", "select rootUri, backendProcessingTime" + from + " and backendProcessingTime >= 0 order by rootUri, backendProcessingTime", 20},
+		{"Backend latency percentiles per hour (seconds)", "date_hour", "select requestHour, backendProcessingTime" + from + " and backendProcessingTime >= 0 order by requestHour, backendProcessingTime", 0},
+	}
+	for _, q := range latencyQueries {
+		if err = csvWriter.Write([]string{q.title}); err != nil {
+			log.Fatal(err)
+		}
+		if err = dbLatencyToCSV(db, q.query, q.keyColumn, q.top, csvWriter); err != nil {
+			log.Fatal(err)
+		}
+		if err = csvWriter.Write(nil); err != nil {
+			log.Fatal(err)
+		}
+		csvWriter.Flush()
+	}
 }
 
 func main() {
 	var (
-		fPath, dbName, dbHost, dbUser, dbPassword, dbTable, reportFile, s3Bucket, s3Path string
-		recursive                                                                        bool
+		fPath, dbName, dbHost, dbUser, dbPassword, dbTable, reportFile, s3Bucket, s3Path, formatName, storage, sqlitePath string
+		since, until, includeDomains, excludeDomains, includeNets, excludeNets, includeStatus, excludeStatus              string
+		recursive, force                                                                                                  bool
 	)
 	flag.BoolVar(&recursive, "recursive", false, "Considers the -file-path input as directory and will search for files to process inside. Environment variable: RECURSIVE")
+	flag.BoolVar(&force, "force", false, "Loads again the files already loaded, replacing their rows. By default, the files recorded in the ledger table (the -db-table name suffixed by _files) with the same ETag or modification time are skipped. Environment variable: FORCE")
 	flag.StringVar(&fPath, "file-path", "", "Path to the log file. If -recursive flag is set, this is considered as a directory. Environment variable: FILE_PATH")
+	flag.StringVar(&storage, "storage", "", "Database the access logs are loaded in: 'sqlite' (a local file given by -sqlite-path) or 'mysql' (a MySQL/MariaDB server given by -db-host). Defaults to mysql if -db-host is set and to sqlite otherwise. Environment variable: STORAGE")
+	flag.StringVar(&sqlitePath, "sqlite-path", "accesslogs.db", "Path to the SQLite database file, created if it does not exist. Environment variable: SQLITE_PATH")
 	flag.StringVar(&dbName, "db-name", "accesslogs", "Name of the DB to connect to. Environment variable: DB_NAME")
-	flag.StringVar(&dbHost, "db-host", "", "Name of the DB server to connect to. Environment variable: DB_HOST")
+	flag.StringVar(&dbHost, "db-host", "", "Name of the MySQL DB server to connect to. Environment variable: DB_HOST")
 	flag.StringVar(&dbUser, "db-user", "", "User name to use to connect to the DB. Environment variable: DB_USER")
 	flag.StringVar(&dbPassword, "db-pwd", "", "Password to use to connect to the DB. Environment variable: DB_PWD")
-	flag.StringVar(&dbTable, "db-table", "", "Name of the table to import the data in. Environment variable: DB_TABLE")
+	flag.StringVar(&dbTable, "db-table", "accesslogs", "Name of the table to import the data in. Environment variable: DB_TABLE")
 	flag.StringVar(&reportFile, "report-path", "", "Path of the standard report summary you want to generate. If left empty, the report won't be generated. Environment variable: REPORT_PATH")
 	flag.StringVar(&s3Bucket, "s3-bucket", "", "Name of the bucket where your access logs are stored. Incompatible with -file-path. Only specify it if you want to read your access logs directly from s3. Environment variable: S3_BUCKET")
 	flag.StringVar(&s3Path, "s3-path", "", "Path in the s3 bucket where the access logs are stored. Important: -recursive is not needed for s3. The script will look for all the files in the directory if the provided s3-path is a folder. Environment variable: S3_PATH")
+	flag.StringVar(&formatName, "format", "auto", "Format of the access logs: 'classic' (Classic ELB), 'alb' (Application Load Balancer), 'nlb' (Network Load Balancer TLS listeners) or 'auto' to detect the format of each file from its first line. Environment variable: FORMAT")
+	flag.StringVar(&since, "since", "", "Only loads the entries logged at or after this time, like 2018-07-02, 2018-07-02T22:00 (UTC) or 2018-07-02T22:00:00+02:00. The s3 files stored in the folders of the days before are skipped. Environment variable: SINCE")
+	flag.StringVar(&until, "until", "", "Only loads the entries logged before this time, in the same format as -since. The s3 files stored in the folders of the days after are skipped. Environment variable: UNTIL")
+	flag.StringVar(&includeDomains, "include-domains", "", "Comma separated list of the domains of the entries to load, *.example.com matching the subdomains of example.com. Environment variable: INCLUDE_DOMAINS")
+	flag.StringVar(&excludeDomains, "exclude-domains", "", "Comma separated list of the domains of the entries not to load, *.example.com matching the subdomains of example.com. Environment variable: EXCLUDE_DOMAINS")
+	flag.StringVar(&includeNets, "include-cidrs", "", "Comma separated list of the CIDR blocks or IP addresses of the sources of the entries to load. Environment variable: INCLUDE_CIDRS")
+	flag.StringVar(&excludeNets, "exclude-cidrs", "", "Comma separated list of the CIDR blocks or IP addresses of the sources of the entries not to load. Environment variable: EXCLUDE_CIDRS")
+	flag.StringVar(&includeStatus, "include-status", "", "Comma separated list of the status codes returned by the load balancer of the entries to load, like 404 or 5xx. Environment variable: INCLUDE_STATUS")
+	flag.StringVar(&excludeStatus, "exclude-status", "", "Comma separated list of the status codes returned by the load balancer of the entries not to load, like 404 or 5xx. Environment variable: EXCLUDE_STATUS")
 	envflag.Parse()
 
+	format, err := getLogFormat(formatName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter, err := newEntryFilter(since, until, includeDomains, excludeDomains, includeNets, excludeNets, includeStatus, excludeStatus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := newLogStore(storage, sqlitePath, dbUser, dbPassword, dbHost, dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ledger, err := newFileLedger(store, dbTable, force, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	dp := make(chan *accessLogEntry)
 	wg.Add(1)
-	go channelToDB(dbUser, dbPassword, dbHost, dbName, dbTable, dp)
+	go channelToDB(store, dbTable, dp)
 
 	if len(fPath) > 0 {
 		fInput := []*string{&fPath}
@@ -414,15 +579,17 @@ func main() {
 			fInput = getLocalFiles(fPath)
 		}
 		for _, f := range fInput {
-			log.Printf("Processing file %s\n", *f)
-			processLocalFile(*f, dp)
+			processLocalFile(*f, ledger, format, filter, dp)
 		}
 	}
 	if len(s3Bucket) > 0 {
-		processS3Files(s3Bucket, s3Path, dp)
+		processS3Files(s3Bucket, s3Path, ledger, format, filter, dp)
 	}
 	close(dp)
 	wg.Wait()
+	if ledger.skipped > 0 {
+		log.Printf("Skipped %d files already loaded\n", ledger.skipped)
+	}
 	log.Printf("Generating report")
-	generateReport(dbUser, dbPassword, dbHost, dbName, dbTable, reportFile)
+	generateReport(store, dbTable, reportFile)
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3KeyDatePattern matches the date of the folder of the access logs files in
+// the standard AWSLogs/<account>/elasticloadbalancing/<region>/YYYY/MM/DD/
+// layout
+var s3KeyDatePattern = regexp.MustCompile(`(?:^|/)AWSLogs/[^/]+/elasticloadbalancing/[^/]+/([0-9]{4})/([0-9]{2})/([0-9]{2})/`)
+
+// s3KeyMargin is how long before the day of its folder the first entries of a
+// file can be, the files being stored in the folder of the end of the
+// interval they cover
+const s3KeyMargin = time.Hour
+
+// statusPattern matches a status code of the filters, like 404 or 5xx
+var statusPattern = regexp.MustCompile(`^[0-9][0-9x]{2}$`)
+
+// timeLayouts are the layouts accepted for the bounds of the time window, in
+// UTC if no time zone is given
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// entryFilter selects the entries loaded in the table. The zero value keeps
+// all the entries.
+type entryFilter struct {
+	// since and until bound the time window, until being excluded
+	since, until                   time.Time
+	includeDomains, excludeDomains []string
+	includeNets, excludeNets       []*net.IPNet
+	includeStatus, excludeStatus   []string
+}
+
+// parseTime parses a bound of the time window, the zero time if it is empty
+func parseTime(s string) (time.Time, error) {
+	if len(s) == 0 {
+		return time.Time{}, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expecting a date like 2018-07-02, 2018-07-02T22:00 or 2018-07-02T22:00:00Z", s)
+}
+
+// splitList returns the elements of a comma separated list
+func splitList(s string) []string {
+	var result []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); len(e) > 0 {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// parseNets parses a comma separated list of CIDR blocks, the single IP
+// addresses being accepted as well
+func parseNets(s string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, e := range splitList(s) {
+		if !strings.Contains(e, "/") {
+			if ip := net.ParseIP(e); ip != nil && ip.To4() != nil {
+				e += "/32"
+			} else {
+				e += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+// parseStatus parses a comma separated list of status codes, like 404 or 5xx
+func parseStatus(s string) ([]string, error) {
+	result := splitList(strings.ToLower(s))
+	for _, e := range result {
+		if !statusPattern.MatchString(e) {
+			return nil, fmt.Errorf("invalid status code %q, expecting a code like 404 or 5xx", e)
+		}
+	}
+	return result, nil
+}
+
+// newEntryFilter parses the time window and the comma separated lists of
+// domains, CIDR blocks and status codes to include or exclude
+func newEntryFilter(since, until, includeDomains, excludeDomains, includeNets, excludeNets, includeStatus, excludeStatus string) (*entryFilter, error) {
+	f := &entryFilter{
+		includeDomains: splitList(strings.ToLower(includeDomains)),
+		excludeDomains: splitList(strings.ToLower(excludeDomains)),
+	}
+	var err error
+	if f.since, err = parseTime(since); err != nil {
+		return nil, err
+	}
+	if f.until, err = parseTime(until); err != nil {
+		return nil, err
+	}
+	if !f.since.IsZero() && !f.until.IsZero() && !f.since.Before(f.until) {
+		return nil, fmt.Errorf("-since must be before -until")
+	}
+	if f.includeNets, err = parseNets(includeNets); err != nil {
+		return nil, err
+	}
+	if f.excludeNets, err = parseNets(excludeNets); err != nil {
+		return nil, err
+	}
+	if f.includeStatus, err = parseStatus(includeStatus); err != nil {
+		return nil, err
+	}
+	if f.excludeStatus, err = parseStatus(excludeStatus); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// String returns the canonical form of the filter, the same for all the
+// filters keeping the same entries whatever the order of the elements of their
+// lists. It is empty if all the entries are kept.
+func (f *entryFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	var parts []string
+	add := func(name string, values []string) {
+		if len(values) > 0 {
+			sorted := append([]string(nil), values...)
+			sort.Strings(sorted)
+			parts = append(parts, name+"="+strings.Join(sorted, ","))
+		}
+	}
+	nets := func(l []*net.IPNet) []string {
+		var result []string
+		for _, n := range l {
+			result = append(result, n.String())
+		}
+		return result
+	}
+	if !f.since.IsZero() {
+		parts = append(parts, "since="+f.since.UTC().Format(time.RFC3339Nano))
+	}
+	if !f.until.IsZero() {
+		parts = append(parts, "until="+f.until.UTC().Format(time.RFC3339Nano))
+	}
+	add("include-domains", f.includeDomains)
+	add("exclude-domains", f.excludeDomains)
+	add("include-cidrs", nets(f.includeNets))
+	add("exclude-cidrs", nets(f.excludeNets))
+	add("include-status", f.includeStatus)
+	add("exclude-status", f.excludeStatus)
+	return strings.Join(parts, " ")
+}
+
+// matchDomain tells whether the domain is in the list, "*.example.com"
+// matching the subdomains of example.com
+func matchDomain(domain string, domains []string) bool {
+	domain = strings.ToLower(domain)
+	for _, d := range domains {
+		if d == domain || (strings.HasPrefix(d, "*.") && strings.HasSuffix(domain, d[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchNet tells whether the IP address is in one of the blocks
+func matchNet(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	for _, n := range nets {
+		if parsed != nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchStatus tells whether the status code is in the list, "5xx" matching
+// all the 5XX codes
+func matchStatus(status string, codes []string) bool {
+	for _, c := range codes {
+		if len(status) != len(c) {
+			continue
+		}
+		match := true
+		for i := range c {
+			if c[i] != 'x' && c[i] != status[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// match tells whether the entry is kept. The status code is the one returned
+// by the load balancer to the client.
+func (f *entryFilter) match(e *accessLogEntry) bool {
+	if f == nil {
+		return true
+	}
+	if (!f.since.IsZero() && e.timestamp.Before(f.since)) || (!f.until.IsZero() && !e.timestamp.Before(f.until)) {
+		return false
+	}
+	if (len(f.includeDomains) > 0 && !matchDomain(e.domain, f.includeDomains)) || matchDomain(e.domain, f.excludeDomains) {
+		return false
+	}
+	if (len(f.includeNets) > 0 && !matchNet(e.sourceIP, f.includeNets)) || matchNet(e.sourceIP, f.excludeNets) {
+		return false
+	}
+	if (len(f.includeStatus) > 0 && !matchStatus(e.elbResponseCode, f.includeStatus)) || matchStatus(e.elbResponseCode, f.excludeStatus) {
+		return false
+	}
+	return true
+}
+
+// skipsS3Key tells whether the s3 file only holds entries out of the time
+// window, from the date of its folder. The files stored out of the standard
+// layout are never skipped.
+func (f *entryFilter) skipsS3Key(key string) bool {
+	if f == nil || (f.since.IsZero() && f.until.IsZero()) {
+		return false
+	}
+	result := s3KeyDatePattern.FindStringSubmatch(key)
+	if result == nil {
+		return false
+	}
+	day, err := time.Parse("2006/01/02", result[1]+"/"+result[2]+"/"+result[3])
+	if err != nil {
+		return false
+	}
+	if !f.since.IsZero() && !day.Add(24*time.Hour).After(f.since) {
+		return true
+	}
+	return !f.until.IsZero() && !day.Add(-s3KeyMargin).Before(f.until)
+}
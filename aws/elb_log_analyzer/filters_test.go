@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEntryFilter(t *testing.T) {
+	entry := &accessLogEntry{
+		timestamp:       time.Date(2018, 7, 2, 22, 23, 0, 0, time.UTC),
+		domain:          "api.example.com",
+		sourceIP:        "10.1.2.3",
+		elbResponseCode: "502",
+	}
+	for _, d := range []struct {
+		since, until, includeDomains, excludeDomains, includeNets, excludeNets, includeStatus, excludeStatus string
+		expected                                                                                             bool
+	}{
+		{"", "", "", "", "", "", "", "", true},
+		{"2018-07-02T22:00", "2018-07-03", "", "", "", "", "", "", true},
+		{"2018-07-02T22:23:00Z", "", "", "", "", "", "", "", true},
+		{"", "2018-07-02T22:23:00Z", "", "", "", "", "", "", false},
+		{"2018-07-02T22:30", "", "", "", "", "", "", "", false},
+		{"2018-07-03T00:00:00+02:00", "", "", "", "", "", "", "", true},
+		{"", "", "*.example.com", "", "", "", "", "", true},
+		{"", "", "www.example.com, API.example.com", "", "", "", "", "", true},
+		{"", "", "example.com", "", "", "", "", "", false},
+		{"", "", "", "*.example.com", "", "", "", "", false},
+		{"", "", "", "", "10.0.0.0/8", "", "", "", true},
+		{"", "", "", "", "192.168.0.0/16,10.1.2.4", "", "", "", false},
+		{"", "", "", "", "10.0.0.0/8", "10.1.2.3", "", "", false},
+		{"", "", "", "", "", "", "5xx", "", true},
+		{"", "", "", "", "", "", "200,404", "", false},
+		{"", "", "", "", "", "", "", "50x", false},
+		{"", "", "", "", "", "", "", "504", true},
+	} {
+		f, err := newEntryFilter(d.since, d.until, d.includeDomains, d.excludeDomains, d.includeNets, d.excludeNets, d.includeStatus, d.excludeStatus)
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %s", d, err)
+			continue
+		}
+		if got := f.match(entry); got != d.expected {
+			t.Errorf("%+v: expecting %v got %v", d, d.expected, got)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"yesterday", "", "", "", "", "", "", ""},
+		{"2018-07-03", "2018-07-02", "", "", "", "", "", ""},
+		{"", "", "", "", "10.0.0.0/33", "", "", ""},
+		{"", "", "", "", "", "", "", "50"},
+	} {
+		if _, err := newEntryFilter(args[0], args[1], args[2], args[3], args[4], args[5], args[6], args[7]); err == nil {
+			t.Errorf("%v: expecting an error", args)
+		}
+	}
+	if !(*entryFilter)(nil).match(entry) {
+		t.Errorf("Expecting a nil filter to keep the entries")
+	}
+}
+
+func TestEntryFilterString(t *testing.T) {
+	f, err := newEntryFilter("2018-07-03T00:00:00+02:00", "", "www.example.com,API.example.com", "", "10.1.2.3", "", "5xx,404", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "since=2018-07-02T22:00:00Z include-domains=api.example.com,www.example.com include-cidrs=10.1.2.3/32 include-status=404,5xx"
+	if got := f.String(); got != expected {
+		t.Errorf("Expecting %q got %q", expected, got)
+	}
+	// The same filter written another way has the same canonical form
+	same, err := newEntryFilter("2018-07-02T22:00", "", "api.example.com, www.example.com", "", "10.1.2.3/32", "", "404,5xx", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if same.String() != f.String() {
+		t.Errorf("Expecting %q got %q", f.String(), same.String())
+	}
+	empty, err := newEntryFilter("", "", "", "", "", "", "", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if empty.String() != "" || (*entryFilter)(nil).String() != "" {
+		t.Errorf("Expecting an empty canonical form without filter got %q", empty.String())
+	}
+}
+
+func TestSkipsS3Key(t *testing.T) {
+	f, err := newEntryFilter("2018-07-02T10:00", "2018-07-03T12:00", "", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := "logs/AWSLogs/123456789012/elasticloadbalancing/us-east-1/"
+	for _, d := range []struct {
+		key      string
+		expected bool
+	}{
+		{prefix + "2018/07/01/123456789012_elasticloadbalancing_us-east-1_my-lb_20180701T2355Z_10.0.0.1_abc.log", true},
+		{prefix + "2018/07/02/123456789012_elasticloadbalancing_us-east-1_my-lb_20180702T0005Z_10.0.0.1_abc.log", false},
+		{prefix + "2018/07/03/123456789012_elasticloadbalancing_us-east-1_my-lb_20180703T0005Z_10.0.0.1_abc.log", false},
+		{prefix + "2018/07/04/123456789012_elasticloadbalancing_us-east-1_my-lb_20180704T0005Z_10.0.0.1_abc.log", true},
+		{"logs/2018/07/01/access.log", false},
+	} {
+		if got := f.skipsS3Key(d.key); got != d.expected {
+			t.Errorf("%s: expecting %v got %v", d.key, d.expected, got)
+		}
+	}
+
+	// The first entries of the files of a day can be logged the day before
+	f, _ = newEntryFilter("", "2018-07-03T23:30", "", "", "", "", "", "")
+	if f.skipsS3Key(prefix + "2018/07/04/123456789012_elasticloadbalancing_us-east-1_my-lb_20180704T0005Z_10.0.0.1_abc.log") {
+		t.Errorf("Expecting the files of the day after -until to be kept within the margin")
+	}
+	if (&entryFilter{}).skipsS3Key(prefix + "2018/07/01/access.log") {
+		t.Errorf("Expecting the files not to be skipped without time window")
+	}
+}
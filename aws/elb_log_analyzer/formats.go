@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var albPattern = regexp.MustCompile(`^(http|https|h2|grpcs|ws|wss) ([^ ]*) ([^ ]*) ([^ ]*):([0-9]*) ([^ ]*)[:\-]([0-9]*) ([-.0-9]*) ([-.0-9]*) ([-.0-9]*) (|[-0-9]*) (-|[-0-9]*) ([-0-9]*) ([-0-9]*) "([^ ]*) ([^ ]*) (- |[^ ]*)" "([^"]*)" ([A-Za-z0-9_-]+) ([A-Za-z0-9.-]*) ([^ ]*) "([^"]*)" "([^"]*)" "([^"]*)" ([-.0-9]*) ([^ ]*) "([^"]*)" "([^"]*)" "([^"]*)"(?: .*)?$`)
+var nlbTLSPattern = regexp.MustCompile(`^tls ([^ ]*) ([^ ]*) ([^ ]*) ([^ ]*) ([^ ]*):([0-9]*) ([^ ]*):([0-9]*) ([-0-9]*) ([-0-9]*) ([-0-9]*) ([-0-9]*) ([^ ]*) ([^ ]*) ([^ ]*) ([^ ]*) ([^ ]*) ([^ ]*) ([^ ]*)(?: .*)?$`)
+
+// logFormat is a format of access logs: the regex matching its lines and the
+// function building an accessLogEntry from the submatches of the regex
+type logFormat struct {
+	name    string
+	pattern *regexp.Regexp
+	parse   func(result []string) *accessLogEntry
+}
+
+// logFormats lists the supported formats in the order they are tried when the
+// format of a file is detected
+var logFormats = []*logFormat{
+	{"classic", classicELBPattern, parseClassic},
+	{"alb", albPattern, parseALB},
+	{"nlb", nlbTLSPattern, parseNLB},
+}
+
+// getLogFormat returns the format of the given name, nil for auto-detection
+func getLogFormat(name string) (*logFormat, error) {
+	if name == "auto" {
+		return nil, nil
+	}
+	for _, f := range logFormats {
+		if f.name == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown log format %q", name)
+}
+
+// detectFormat returns the first format matching the line, nil if none does
+func detectFormat(line string) *logFormat {
+	for _, f := range logFormats {
+		if f.pattern.MatchString(line) {
+			return f
+		}
+	}
+	return nil
+}
+
+// processLine parses a line in the given format and returns nil if it does
+// not match or if its entry is not kept by the filter
+func (f *logFormat) processLine(line string, filter *entryFilter) *accessLogEntry {
+	result := f.pattern.FindStringSubmatch(line)
+	// do not process incorrect lines
+	if result == nil {
+		return nil
+	}
+	entry := f.parse(result)
+	if !filter.match(entry) {
+		return nil
+	}
+	entry.format = f.name
+	entry.setDerived()
+	return entry
+}
+
+// uriPrefix returns the first n-1 folders of the path of an uri, the prefix of
+// "/api/v1/users?id=1" being "/api/v1" for n=3
+func uriPrefix(uri string, n int) string {
+	p := strings.SplitN(strings.Replace(uri, "//", "/", -1), "?", 2)[0]
+	parts := strings.SplitN(p, "/", n+1)
+	if len(parts) > n {
+		return strings.Join(parts[:n], "/")
+	}
+	return p
+}
+
+// setDerived sets the fields derived from the others: the path, root and
+// short uri, the short user agent and the date and hour of the request
+func (e *accessLogEntry) setDerived() {
+	e.path = strings.SplitN(e.uri, "?", 2)[0]
+	e.rootURI = uriPrefix(e.uri, 2)
+	e.shortURI = uriPrefix(e.uri, 3)
+	e.shortUserAgent = strings.SplitN(strings.SplitN(e.userAgent, " ", 2)[0], "(", 2)[0]
+	e.requestDate = fmt.Sprintf("%04d-%02d-%02d", e.year, e.month, e.day)
+	e.requestHour = fmt.Sprintf("%s %02d:00", e.requestDate, e.hour)
+}
+
+// setDate sets the date fields of the entry from a timestamp in the given
+// layout
+func (e *accessLogEntry) setDate(layout, value string) {
+	mDate, err := time.Parse(layout, value)
+	if err != nil {
+		log.Println(err)
+	}
+	e.timestamp = mDate
+	e.year = mDate.Year()
+	e.month = int(mDate.Month())
+	e.day = mDate.Day()
+	e.hour = mDate.Hour()
+}
+
+// setRequest sets the method, domain, scheme and uri of the entry from the
+// request line
+func (e *accessLogEntry) setRequest(method, rawURL string) {
+	e.method = method
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		log.Println(err)
+	} else {
+		e.domain = u.Hostname()
+		e.scheme = u.Scheme
+		e.uri = u.RequestURI()
+	}
+}
+
+// parseInt returns the integer value of a field, 0 if it is empty or "-"
+func parseInt(s string) int64 {
+	v, _ := strconv.ParseInt(s, 10, 64)
+	return v
+}
+
+// parseDuration returns the value of a field holding a duration, -1 if it is
+// "-" like the durations the load balancers could not measure
+func parseDuration(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return -1
+	}
+	return v
+}
+
+// parseClassic builds the entry of a Classic ELB line
+func parseClassic(result []string) *accessLogEntry {
+	entry := accessLogEntry{}
+	entry.setDate("2006-01-02T15:04:05.000000Z", result[1])
+	entry.elb = result[2]
+	entry.sourceIP = result[3]
+	entry.sourcePort = int(parseInt(result[4]))
+	entry.backendIP = result[5]
+	entry.backendPort = int(parseInt(result[6]))
+	entry.requestProcessingTime = parseDuration(result[7])
+	entry.backendProcessingTime = parseDuration(result[8])
+	entry.responseProcessingTime = parseDuration(result[9])
+	entry.elbResponseCode = result[10]
+	entry.backendResponseCode = result[11]
+	entry.receivedBytes = parseInt(result[12])
+	entry.sentBytes = parseInt(result[13])
+	entry.setRequest(result[14], result[15])
+	entry.userAgent = result[17]
+	entry.sslCipher = result[18]
+	entry.sslProtocol = result[19]
+	entry.connectionTime, entry.tlsHandshakeTime = -1, -1
+	return &entry
+}
+
+// parseALB builds the entry of an Application Load Balancer line. The fields
+// added at the end of the lines by AWS over time are ignored.
+func parseALB(result []string) *accessLogEntry {
+	entry := accessLogEntry{}
+	entry.requestType = result[1]
+	entry.setDate("2006-01-02T15:04:05.000000Z", result[2])
+	entry.elb = result[3]
+	entry.sourceIP = result[4]
+	entry.sourcePort = int(parseInt(result[5]))
+	entry.backendIP = result[6]
+	entry.backendPort = int(parseInt(result[7]))
+	entry.requestProcessingTime = parseDuration(result[8])
+	entry.backendProcessingTime = parseDuration(result[9])
+	entry.responseProcessingTime = parseDuration(result[10])
+	entry.elbResponseCode = result[11]
+	entry.backendResponseCode = result[12]
+	entry.receivedBytes = parseInt(result[13])
+	entry.sentBytes = parseInt(result[14])
+	entry.setRequest(result[15], result[16])
+	entry.userAgent = result[18]
+	entry.sslCipher = result[19]
+	entry.sslProtocol = result[20]
+	entry.targetGroupARN = result[21]
+	entry.traceID = result[22]
+	entry.sniDomain = result[23]
+	entry.chosenCertARN = result[24]
+	entry.actionsExecuted = result[27]
+	entry.redirectURL = result[28]
+	entry.errorReason = result[29]
+	entry.connectionTime, entry.tlsHandshakeTime = -1, -1
+	return &entry
+}
+
+// parseNLB builds the entry of a Network Load Balancer TLS line. As there is
+// no HTTP request, the domain is the one requested with SNI.
+func parseNLB(result []string) *accessLogEntry {
+	entry := accessLogEntry{}
+	entry.requestType = "tls"
+	entry.scheme = "tls"
+	entry.setDate("2006-01-02T15:04:05", result[2])
+	entry.requestProcessingTime, entry.backendProcessingTime, entry.responseProcessingTime = -1, -1, -1
+	entry.elb = result[3]
+	entry.sourceIP = result[5]
+	entry.sourcePort = int(parseInt(result[6]))
+	entry.backendIP = result[7]
+	entry.backendPort = int(parseInt(result[8]))
+	entry.connectionTime = parseDuration(result[9])
+	entry.tlsHandshakeTime = parseDuration(result[10])
+	entry.receivedBytes = parseInt(result[11])
+	entry.sentBytes = parseInt(result[12])
+	entry.incomingTLSAlert = result[13]
+	entry.chosenCertARN = result[14]
+	entry.sslCipher = result[16]
+	entry.sslProtocol = result[17]
+	entry.sniDomain = result[19]
+	entry.domain = result[19]
+	return &entry
+}
+
+// openLogReader returns a reader of the content of a log file, uncompressing
+// it if it is gzipped like the ALB and NLB log files
+func openLogReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// processLogs reads the lines of a log file and sends their entry to the
+// channel, nil for the lines that cannot be parsed or are filtered out, and
+// returns the number of lines read. If format is nil, the format of the file
+// is detected from its first valid line.
+func processLogs(name string, r io.Reader, format *logFormat, filter *entryFilter, dataPipe chan *accessLogEntry) (int64, error) {
+	rdr, err := openLogReader(r)
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(rdr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(bufio.ScanLines)
+
+	var lines int64
+	for scanner.Scan() {
+		lines++
+		// Avoid filling up memory too much
+		if len(dataPipe) > 50000 {
+			time.Sleep(500 * time.Millisecond)
+		}
+		if format == nil {
+			if format = detectFormat(scanner.Text()); format == nil {
+				dataPipe <- nil
+				continue
+			}
+			log.Printf("Format of file %s: %s\n", name, format.name)
+		}
+		entry := format.processLine(scanner.Text(), filter)
+		if entry != nil {
+			entry.sourceFile = name
+		}
+		dataPipe <- entry
+	}
+	return lines, scanner.Err()
+}
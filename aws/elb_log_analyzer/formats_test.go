@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	classicLine = `2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.000086 0.001048 0.001337 200 200 0 57 "GET https://www.example.com:443/path?q=1 HTTP/1.1" "curl/7.38.0" DHE-RSA-AES128-SHA TLSv1.2`
+	albLine     = `https 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.086 0.048 0.037 200 200 0 57 "GET https://www.example.com:443/path?q=1 HTTP/1.1" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337281-1d84f3d73c47ec4e58577259" "www.example.com" "arn:aws:acm:us-east-2:123456789012:certificate/12345678-1234-1234-1234-123456789012" 1 2018-07-02T22:22:48.364000Z "authenticate,forward" "-" "-" "10.0.0.1:80" "200" "-" "-"`
+	nlbLine     = `tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99 - ECDHE-RSA-AES128-SHA tlsv12 - my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com - - - 2018-12-20T02:59:30`
+)
+
+func TestProcessLine(t *testing.T) {
+	for _, d := range []struct {
+		line     string
+		format   string
+		expected accessLogEntry
+	}{
+		{classicLine, "classic", accessLogEntry{
+			timestamp: time.Date(2015, 5, 13, 23, 39, 43, 945958000, time.UTC),
+			year:      2015, month: 5, day: 13, hour: 23,
+			sourceIP: "192.168.131.39", method: "GET", domain: "www.example.com", scheme: "https", uri: "/path?q=1", userAgent: "curl/7.38.0", elbResponseCode: "200", backendResponseCode: "200",
+			format: "classic", elb: "my-loadbalancer", backendIP: "10.0.0.1", sslCipher: "DHE-RSA-AES128-SHA", sslProtocol: "TLSv1.2",
+			sourcePort: 2817, backendPort: 80,
+			requestProcessingTime: 0.000086, backendProcessingTime: 0.001048, responseProcessingTime: 0.001337,
+			sentBytes:      57,
+			connectionTime: -1, tlsHandshakeTime: -1,
+			path: "/path", rootURI: "/path", shortURI: "/path", shortUserAgent: "curl/7.38.0", requestDate: "2015-05-13", requestHour: "2015-05-13 23:00",
+		}},
+		{albLine, "alb", accessLogEntry{
+			timestamp: time.Date(2018, 7, 2, 22, 23, 0, 186641000, time.UTC),
+			year:      2018, month: 7, day: 2, hour: 22,
+			sourceIP: "192.168.131.39", method: "GET", domain: "www.example.com", scheme: "https", uri: "/path?q=1", userAgent: "curl/7.46.0", elbResponseCode: "200", backendResponseCode: "200",
+			format: "alb", requestType: "https", elb: "app/my-loadbalancer/50dc6c495c0c9188", backendIP: "10.0.0.1", sslCipher: "ECDHE-RSA-AES128-GCM-SHA256", sslProtocol: "TLSv1.2",
+			sourcePort: 2817, backendPort: 80,
+			requestProcessingTime: 0.086, backendProcessingTime: 0.048, responseProcessingTime: 0.037,
+			sentBytes:      57,
+			targetGroupARN: "arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067", traceID: "Root=1-58337281-1d84f3d73c47ec4e58577259", sniDomain: "www.example.com",
+			chosenCertARN: "arn:aws:acm:us-east-2:123456789012:certificate/12345678-1234-1234-1234-123456789012", actionsExecuted: "authenticate,forward", redirectURL: "-", errorReason: "-",
+			connectionTime: -1, tlsHandshakeTime: -1,
+			path: "/path", rootURI: "/path", shortURI: "/path", shortUserAgent: "curl/7.46.0", requestDate: "2018-07-02", requestHour: "2018-07-02 22:00",
+		}},
+		{nlbLine, "nlb", accessLogEntry{
+			timestamp: time.Date(2018, 12, 20, 2, 59, 40, 0, time.UTC),
+			year:      2018, month: 12, day: 20, hour: 2,
+			sourceIP: "72.21.218.154", domain: "my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com", scheme: "tls",
+			format: "nlb", requestType: "tls", elb: "net/my-network-loadbalancer/c6e77e28c25b2234", backendIP: "172.100.100.185", sslCipher: "ECDHE-RSA-AES128-SHA", sslProtocol: "tlsv12",
+			sourcePort: 51341, backendPort: 443,
+			requestProcessingTime: -1, backendProcessingTime: -1, responseProcessingTime: -1,
+			receivedBytes: 98, sentBytes: 246,
+			sniDomain: "my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com", chosenCertARN: "arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99",
+			connectionTime: 5, tlsHandshakeTime: 2, incomingTLSAlert: "-",
+			requestDate: "2018-12-20", requestHour: "2018-12-20 02:00",
+		}},
+	} {
+		f := detectFormat(d.line)
+		if f == nil || f.name != d.format {
+			t.Errorf("Expecting the format %s to be detected got %v", d.format, f)
+			continue
+		}
+		got := f.processLine(d.line, nil)
+		if got == nil || !reflect.DeepEqual(*got, d.expected) {
+			t.Errorf("%s: expecting %+v got %+v", d.format, d.expected, got)
+		}
+		// The lines of the other formats do not match
+		for _, other := range logFormats {
+			if other != f && other.processLine(d.line, nil) != nil {
+				t.Errorf("Expecting the %s line not to match the %s format", d.format, other.name)
+			}
+		}
+	}
+
+	// The fields added by AWS at the end of the ALB lines are ignored
+	if detectFormat(albLine+` "TID_123456"`) == nil {
+		t.Errorf("Expecting the ALB lines with additional fields to be parsed")
+	}
+	if detectFormat("not a log line") != nil {
+		t.Errorf("Expecting an invalid line not to be detected")
+	}
+}
+
+func TestSetDerived(t *testing.T) {
+	e := accessLogEntry{year: 2017, month: 3, day: 4, hour: 5, uri: "//api/v1/users/12?id=1", userAgent: "Mozilla/5.0 (X11; Linux x86_64)"}
+	e.setDerived()
+	expected := accessLogEntry{year: 2017, month: 3, day: 4, hour: 5, uri: "//api/v1/users/12?id=1", userAgent: "Mozilla/5.0 (X11; Linux x86_64)",
+		path: "//api/v1/users/12", rootURI: "/api", shortURI: "/api/v1", shortUserAgent: "Mozilla/5.0", requestDate: "2017-03-04", requestHour: "2017-03-04 05:00"}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Expecting %+v got %+v", expected, e)
+	}
+}
+
+func TestProcessLogs(t *testing.T) {
+	// The ALB files are gzipped
+	b := &bytes.Buffer{}
+	zw := gzip.NewWriter(b)
+	zw.Write([]byte("garbage\n" + albLine + "\n" + albLine + "\n"))
+	zw.Close()
+
+	dp := make(chan *accessLogEntry, 10)
+	processLogs("test.log.gz", b, nil, nil, dp)
+	processLogs("test.log", strings.NewReader(classicLine+"\n"), nil, nil, dp)
+	close(dp)
+	var formats []string
+	for e := range dp {
+		if e == nil {
+			formats = append(formats, "nil")
+			continue
+		}
+		formats = append(formats, e.format)
+	}
+	expected := []string{"nil", "alb", "alb", "classic"}
+	if !reflect.DeepEqual(formats, expected) {
+		t.Errorf("Expecting %v got %v", expected, formats)
+	}
+	if f, err := getLogFormat("elb"); err == nil || f != nil {
+		t.Errorf("Expecting an unknown format to be rejected")
+	}
+	if len(accessLogColumns) != len((&accessLogEntry{}).values()) {
+		t.Errorf("Expecting a value for each of the %d columns", len(accessLogColumns))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// latencyPercentiles are the percentiles of the latency reported for each
+// group of requests
+var latencyPercentiles = []float64{0.5, 0.9, 0.99}
+
+// latencyGroup is the latency statistics of a group of requests
+type latencyGroup struct {
+	key         string
+	calls       int
+	percentiles []float64
+	max         float64
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// newLatencyGroup computes the statistics of the sorted latencies of a group
+func newLatencyGroup(key string, sorted []float64) *latencyGroup {
+	g := &latencyGroup{key: key, calls: len(sorted), max: sorted[len(sorted)-1]}
+	for _, p := range latencyPercentiles {
+		g.percentiles = append(g.percentiles, percentile(sorted, p))
+	}
+	return g
+}
+
+// queryLatencyGroups runs a query returning a group key and a latency, ordered
+// by group and by latency, and returns the statistics of each group in the
+// order of the query. Only the latencies of one group are kept in memory.
+func queryLatencyGroups(db *sql.DB, query string) ([]*latencyGroup, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		groups    []*latencyGroup
+		key       sql.NullString
+		latency   float64
+		current   string
+		latencies []float64
+	)
+	for rows.Next() {
+		if err = rows.Scan(&key, &latency); err != nil {
+			return nil, err
+		}
+		if key.String != current && len(latencies) > 0 {
+			groups = append(groups, newLatencyGroup(current, latencies))
+			latencies = latencies[:0]
+		}
+		current = key.String
+		latencies = append(latencies, latency)
+	}
+	if len(latencies) > 0 {
+		groups = append(groups, newLatencyGroup(current, latencies))
+	}
+	return groups, rows.Err()
+}
+
+// dbLatencyToCSV writes the latency percentiles of the groups of the query.
+// If top is positive, only the top groups with the most calls are written,
+// the busiest first.
+func dbLatencyToCSV(db *sql.DB, query, keyColumn string, top int, csvWriter *csv.Writer) error {
+	groups, err := queryLatencyGroups(db, query)
+	if err != nil {
+		return err
+	}
+	if top > 0 {
+		sort.SliceStable(groups, func(i, j int) bool { return groups[i].calls > groups[j].calls })
+		if len(groups) > top {
+			groups = groups[:top]
+		}
+	}
+
+	header := []string{keyColumn, "nbrcalls"}
+	for _, p := range latencyPercentiles {
+		header = append(header, "p"+strconv.FormatFloat(p*100, 'f', -1, 64))
+	}
+	if err = csvWriter.Write(append(header, "max")); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		row := []string{g.key, strconv.Itoa(g.calls)}
+		for _, v := range g.percentiles {
+			row = append(row, strconv.FormatFloat(v, 'f', 6, 64))
+		}
+		if err = csvWriter.Write(append(row, strconv.FormatFloat(g.max, 'f', 6, 64))); err != nil {
+			return err
+		}
+	}
+	csvWriter.Flush()
+	return csvWriter.Error()
+}
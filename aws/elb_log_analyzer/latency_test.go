@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]float64, 100)
+	for i := range sorted {
+		sorted[i] = float64(i + 1)
+	}
+	for _, d := range []struct {
+		p, expected float64
+	}{
+		{0.5, 50}, {0.9, 90}, {0.99, 99}, {1, 100}, {0, 1},
+	} {
+		if v := percentile(sorted, d.p); v != d.expected {
+			t.Errorf("p%v: expecting %v got %v", d.p*100, d.expected, v)
+		}
+	}
+	if v := percentile([]float64{0.2}, 0.99); v != 0.2 {
+		t.Errorf("Expecting the single value got %v", v)
+	}
+}
+
+func TestDbLatencyToCSV(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("CREATE TABLE `logs` (`root` VARCHAR(32), `latency` DOUBLE)"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		db.Exec("INSERT INTO `logs` VALUES ('/api', ?)", float64(i)/10)
+	}
+	db.Exec("INSERT INTO `logs` VALUES ('/static', 0.01), (NULL, 2)")
+
+	query := "SELECT `root`, `latency` FROM `logs` ORDER BY `root`, `latency`"
+	b := &bytes.Buffer{}
+	if err = dbLatencyToCSV(db, query, "root_uri", 2, csv.NewWriter(b)); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "root_uri,nbrcalls,p50,p90,p99,max\n" +
+		"/api,10,0.500000,0.900000,1.000000,1.000000\n" +
+		",1,2.000000,2.000000,2.000000,2.000000\n"
+	if b.String() != expected {
+		t.Errorf("Expecting %q got %q", expected, b.String())
+	}
+}
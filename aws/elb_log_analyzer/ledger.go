@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+)
+
+// fileEvent is sent on the data channel around the entries of a file so that
+// the rows of the file and its ledger entry are written by the same
+// transactions as its entries
+type fileEvent struct {
+	// done is false for the event sent before the entries of the file and
+	// true for the one sent after them
+	done bool
+	// replace tells that the table may hold rows of a previous load of the
+	// file, to delete before loading it again
+	replace bool
+	version string
+	lines   int64
+}
+
+// ledgerTable returns the name of the table recording the files loaded in the
+// given table
+func ledgerTable(tableName string) string {
+	return tableName + "_files"
+}
+
+// fileLedger is the list of the files already loaded in the table with their
+// version: the ETag of the s3 files and the modification time of the local
+// ones, followed by a hash of the filter of the entries if any
+type fileLedger struct {
+	// force loads again the files already loaded
+	force bool
+	// filter is the canonical form of the filter of the entries loaded
+	filter   string
+	versions map[string]string
+	skipped  int
+}
+
+// newFileLedger creates the ledger table of the given table if it does not
+// exist and reads the files it records. The files loaded with another filter
+// of the entries are loaded again.
+func newFileLedger(store logStore, tableName string, force bool, filter *entryFilter) (*fileLedger, error) {
+	db, err := store.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (`fileKey` VARCHAR(2048), `version` VARCHAR(128), `nbrLines` BIGINT)", ledgerTable(tableName))); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT `fileKey`, `version` FROM `%s`", ledgerTable(tableName)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	l := &fileLedger{force: force, filter: filter.String(), versions: map[string]string{}}
+	for rows.Next() {
+		var key, version string
+		if err = rows.Scan(&key, &version); err != nil {
+			return nil, err
+		}
+		l.versions[key] = version
+	}
+	return l, rows.Err()
+}
+
+// fileVersion returns the version of a file recorded in the ledger. The hash of
+// the filter keeps the version short enough for the ledger table.
+func (l *fileLedger) fileVersion(version string) string {
+	if len(l.filter) == 0 {
+		return version
+	}
+	h := sha1.Sum([]byte(l.filter))
+	return version + " " + hex.EncodeToString(h[:8])
+}
+
+// isLoaded tells whether the given version of the file is already loaded with
+// the same filter and counts the files skipped this way
+func (l *fileLedger) isLoaded(key, version string) bool {
+	if l.force {
+		return false
+	}
+	if v, ok := l.versions[key]; ok && v == l.fileVersion(version) {
+		l.skipped++
+		return true
+	}
+	return false
+}
+
+// loadFile sends the entries of a file to the channel between the events
+// replacing the rows of its previous load and recording it in the ledger
+func (l *fileLedger) loadFile(key, version string, r io.Reader, format *logFormat, filter *entryFilter, dataPipe chan *accessLogEntry) {
+	_, known := l.versions[key]
+	dataPipe <- &accessLogEntry{sourceFile: key, event: &fileEvent{replace: known}}
+	n, err := processLogs(key, r, format, filter, dataPipe)
+	if err != nil {
+		log.Printf("Error while reading file %s: %s\n", key, err)
+		return
+	}
+	dataPipe <- &accessLogEntry{sourceFile: key, event: &fileEvent{done: true, version: l.fileVersion(version), lines: n}}
+}
+
+// dbFileEvent writes a file event in the transaction. The file is recorded in
+// the ledger with an empty version until all its entries are written so that
+// it is loaded again, replacing its rows, if the tool stops before.
+func dbFileEvent(tx *sql.Tx, tableName string, elem *accessLogEntry) {
+	ledger := ledgerTable(tableName)
+	type statement struct {
+		query string
+		args  []interface{}
+	}
+	var stmts []statement
+	if elem.event.done {
+		stmts = append(stmts, statement{fmt.Sprintf("UPDATE `%s` SET `version` = ?, `nbrLines` = ? WHERE `fileKey` = ?", ledger), []interface{}{elem.event.version, elem.event.lines, elem.sourceFile}})
+	} else {
+		if elem.event.replace {
+			log.Printf("Replacing the rows of file %s\n", elem.sourceFile)
+			stmts = append(stmts, statement{fmt.Sprintf("DELETE FROM `%s` WHERE `sourceFile` = ?", tableName), []interface{}{elem.sourceFile}})
+		}
+		stmts = append(stmts,
+			statement{fmt.Sprintf("DELETE FROM `%s` WHERE `fileKey` = ?", ledger), []interface{}{elem.sourceFile}},
+			statement{fmt.Sprintf("INSERT INTO `%s` (`fileKey`, `version`, `nbrLines`) VALUES (?, '', -1)", ledger), []interface{}{elem.sourceFile}})
+	}
+	for _, st := range stmts {
+		if _, err := tx.Exec(st.query, st.args...); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elb_log_analyzer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &sqliteStore{path: filepath.Join(dir, "accesslogs.db")}
+	logPath := filepath.Join(dir, "access.log")
+
+	loadFiltered := func(force bool, filter *entryFilter) *fileLedger {
+		ledger, err := newFileLedger(store, "accesslogs", force, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dp := make(chan *accessLogEntry)
+		wg.Add(1)
+		go channelToDB(store, "accesslogs", dp)
+		processLocalFile(logPath, ledger, nil, filter, dp)
+		close(dp)
+		wg.Wait()
+		return ledger
+	}
+	load := func(force bool) *fileLedger {
+		return loadFiltered(force, nil)
+	}
+	db, err := store.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check := func(step string, expectedRows, expectedLines int64, expectedSkipped int, ledger *fileLedger) {
+		var rows, lines int64
+		if err := db.QueryRow("SELECT count(*) FROM `accesslogs`").Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.QueryRow("SELECT `nbrLines` FROM `accesslogs_files`").Scan(&lines); err != nil {
+			t.Fatal(err)
+		}
+		if rows != expectedRows || lines != expectedLines || ledger.skipped != expectedSkipped {
+			t.Errorf("%s: expecting %d rows, %d lines and %d skipped files got %d, %d and %d", step, expectedRows, expectedLines, expectedSkipped, rows, lines, ledger.skipped)
+		}
+	}
+
+	if err = ioutil.WriteFile(logPath, []byte(classicLine+"\ngarbage\n"+classicLine+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	check("first load", 2, 3, 0, load(false))
+	check("unchanged file", 2, 3, 1, load(false))
+	check("forced load", 2, 3, 0, load(true))
+
+	// The rows of a file that changed are replaced
+	if err = ioutil.WriteFile(logPath, []byte(classicLine+"\n"+classicLine+"\n"+classicLine+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	if err = os.Chtimes(logPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	check("changed file", 3, 3, 0, load(false))
+
+	// A file whose load was interrupted is loaded again
+	if _, err = db.Exec("UPDATE `accesslogs_files` SET `version` = '', `nbrLines` = -1"); err != nil {
+		t.Fatal(err)
+	}
+	check("interrupted load", 3, 3, 0, load(false))
+
+	// A file loaded with a filter is loaded again with another filter or
+	// without any
+	filter, err := newEntryFilter("", "", "", "", "", "", "", "200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("filtered load", 0, 3, 0, loadFiltered(false, filter))
+	check("same filter", 0, 3, 1, loadFiltered(false, filter))
+	check("unfiltered load", 3, 3, 0, load(false))
+
+	var source sql.NullString
+	if err = db.QueryRow("SELECT DISTINCT `sourceFile` FROM `accesslogs`").Scan(&source); err != nil {
+		t.Fatal(err)
+	}
+	if abs, _ := filepath.Abs(logPath); source.String != abs {
+		t.Errorf("Expecting the rows to come from %s got %s", abs, source.String)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// logStore is a database the access logs are loaded in and the report is
+// queried from. The statements and the queries of the tool are understood by
+// all the stores.
+type logStore interface {
+	// open connects to the database
+	open() (*sql.DB, error)
+	// backfill returns the expression computing a derived column, added to
+	// the table by this version, for the rows loaded by previous versions.
+	// Returns an empty string if the store has no such rows.
+	backfill(column string) string
+}
+
+// sqliteStore stores the access logs in a local SQLite file
+type sqliteStore struct {
+	path string
+}
+
+func (s *sqliteStore) open() (*sql.DB, error) {
+	return sql.Open("sqlite3", s.path)
+}
+
+// backfill returns an empty string as the previous versions did not support
+// SQLite
+func (s *sqliteStore) backfill(column string) string {
+	return ""
+}
+
+// mysqlStore stores the access logs in a MySQL/MariaDB database
+type mysqlStore struct {
+	user, pwd, host, database string
+}
+
+func (s *mysqlStore) open() (*sql.DB, error) {
+	return sql.Open("mysql", fmt.Sprintf("%s:%s@%s/%s?charset=utf8", s.user, s.pwd, s.host, s.database))
+}
+
+// mysqlBackfills are the expressions the previous versions used in the report
+// queries to compute the derived columns
+var mysqlBackfills = map[string]string{
+	"path":           "SUBSTRING_INDEX(uri, '?', 1)",
+	"rootUri":        "SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 2)",
+	"shortUri":       "SUBSTRING_INDEX(SUBSTRING_INDEX(REPLACE(uri,'//','/'), '?', 1), '/', 3)",
+	"shortUserAgent": "SUBSTRING_INDEX(SUBSTRING_INDEX(userAgent, ' ', 1),'(',1)",
+	"requestDate":    "CONCAT(year, '-', LPAD(month, 2, '0'), '-', LPAD(day, 2, '0'))",
+	"requestHour":    "CONCAT(year, '-', LPAD(month, 2, '0'), '-', LPAD(day, 2, '0'), ' ', LPAD(hour, 2, '0'), ':00')",
+}
+
+func (s *mysqlStore) backfill(column string) string {
+	return mysqlBackfills[column]
+}
+
+// newLogStore returns the store of the given backend: sqlite or mysql. If the
+// backend is empty, MySQL is used when a host is given and SQLite otherwise.
+func newLogStore(backend, sqlitePath, user, pwd, host, database string) (logStore, error) {
+	if len(backend) == 0 {
+		backend = "sqlite"
+		if len(host) > 0 {
+			backend = "mysql"
+		}
+	}
+	switch backend {
+	case "sqlite":
+		if len(sqlitePath) == 0 {
+			return nil, fmt.Errorf("the sqlite storage requires -sqlite-path")
+		}
+		return &sqliteStore{path: sqlitePath}, nil
+	case "mysql":
+		if len(host) == 0 {
+			return nil, fmt.Errorf("the mysql storage requires -db-host")
+		}
+		return &mysqlStore{user: user, pwd: pwd, host: host, database: database}, nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", backend)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewLogStore(t *testing.T) {
+	for _, d := range []struct {
+		backend, sqlitePath, host, expected string
+	}{
+		{"", "a.db", "", "*main.sqliteStore"},
+		{"", "a.db", "tcp(localhost)", "*main.mysqlStore"},
+		{"sqlite", "a.db", "tcp(localhost)", "*main.sqliteStore"},
+		{"mysql", "a.db", "", ""},
+		{"sqlite", "", "", ""},
+		{"postgres", "a.db", "", ""},
+	} {
+		s, err := newLogStore(d.backend, d.sqlitePath, "user", "pwd", d.host, "accesslogs")
+		if len(d.expected) == 0 {
+			if err == nil {
+				t.Errorf("%+v: expecting an error", d)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %s", d, err)
+		} else if got := reflect.TypeOf(s).String(); got != d.expected {
+			t.Errorf("%+v: expecting %s got %s", d, d.expected, got)
+		}
+	}
+}
+
+func TestSqliteReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elb_log_analyzer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &sqliteStore{path: filepath.Join(dir, "accesslogs.db")}
+	reportPath := filepath.Join(dir, "report.csv")
+
+	// Loading twice appends the lines to the existing table
+	for i := 0; i < 2; i++ {
+		dp := make(chan *accessLogEntry)
+		wg.Add(1)
+		go channelToDB(store, "accesslogs", dp)
+		for _, line := range []string{classicLine, "garbage", albLine, nlbLine} {
+			processLogs("test.log", strings.NewReader(line+"\n"), nil, nil, dp)
+		}
+		close(dp)
+		wg.Wait()
+	}
+	generateReport(store, "accesslogs", reportPath)
+
+	b, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := string(b)
+	for _, expected := range []string{
+		"Requests per day\ndate,nbrcalls\n2015-05-13,2\n2018-07-02,2\n2018-12-20,2\n",
+		"Top 10 root uri path\nroot_uri,nbrcalls\n/path,4\n,2\n",
+		"Bytes served per domain\ndomain,nbrcalls,bytes_sent,bytes_received\nmy-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com,2,492,196\nwww.example.com,4,228,0\n",
+		"Backend latency percentiles per hour (seconds)\ndate_hour,nbrcalls,p50,p90,p99,max\n2015-05-13 23:00,2,0.001048,0.001048,0.001048,0.001048\n2018-07-02 22:00,2,0.048000,0.048000,0.048000,0.048000\n",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expecting the report to contain %q got:\n%s", expected, report)
+		}
+	}
+}
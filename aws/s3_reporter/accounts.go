@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// awsAccount is an AWS account which buckets are scanned by assuming a role
+type awsAccount struct {
+	id      string
+	name    string
+	roleARN string
+	// err is the error that prevented listing the buckets of the account
+	err error
+}
+
+// accountFromRole returns the account of the role with the given ARN
+func accountFromRole(roleARN string) (*awsAccount, error) {
+	// arn:partition:iam::account-id:role/role-name
+	parts := strings.SplitN(roleARN, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "iam" || len(parts[4]) == 0 || !strings.HasPrefix(parts[5], "role/") {
+		return nil, fmt.Errorf("invalid role ARN %q", roleARN)
+	}
+	return &awsAccount{id: parts[4], roleARN: roleARN}, nil
+}
+
+// listOrgAccounts returns the active accounts of the organization sorted by
+// id, each one with the ARN of the role of the given name in the account
+func listOrgAccounts(svc organizationsiface.OrganizationsAPI, roleName string) ([]*awsAccount, error) {
+	var res []*awsAccount
+	err := svc.ListAccountsPages(&organizations.ListAccountsInput{},
+		func(page *organizations.ListAccountsOutput, lastPage bool) bool {
+			for _, a := range page.Accounts {
+				if aws.StringValue(a.Status) != organizations.AccountStatusActive {
+					continue
+				}
+				// The partition is taken from the ARN of the account:
+				// arn:partition:organizations::management-account-id:account/org-id/account-id
+				partition := "aws"
+				if parts := strings.Split(aws.StringValue(a.Arn), ":"); len(parts) > 1 && len(parts[1]) > 0 {
+					partition = parts[1]
+				}
+				res = append(res, &awsAccount{
+					id:      aws.StringValue(a.Id),
+					name:    aws.StringValue(a.Name),
+					roleARN: fmt.Sprintf("arn:%s:iam::%s:role/%s", partition, aws.StringValue(a.Id), roleName),
+				})
+			}
+			return true
+		})
+	sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+	return res, err
+}
+
+// accountClient returns the session and the S3 client used to scan the
+// buckets of an account
+type accountClient func(a *awsAccount) (client.ConfigProvider, s3iface.S3API)
+
+// assumeRoleClient returns an accountClient assuming the role of each account
+// with the credentials of the given session
+func assumeRoleClient(sess *session.Session, sessionName string) accountClient {
+	return func(a *awsAccount) (client.ConfigProvider, s3iface.S3API) {
+		creds := stscreds.NewCredentials(sess, a.roleARN, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+		})
+		accountSess := sess.Copy(aws.NewConfig().WithCredentials(creds))
+		return accountSess, newS3Client(accountSess)
+	}
+}
+
+// scanAccounts scans the buckets of each account one after another. When the
+// -buckets flag is set, only the buckets it lists are scanned. The accounts
+// which buckets cannot be listed, for example because the role cannot be
+// assumed, are skipped and their error is recorded.
+func scanAccounts(newClient accountClient, sessionRegion string, accounts []*awsAccount, progress *scanProgress, opts *reportOptions, pools *scanOptions) {
+	for _, a := range accounts {
+		sess, svc := newClient(a)
+		buckets, err := getBucketsList(svc)
+		if err != nil {
+			log.Printf("Error while listing the buckets of account %s with role %s: %s\n", a.id, a.roleARN, err)
+			a.err = err
+			continue
+		}
+		if len(*bucketsList) > 0 {
+			var selected []*string
+			for _, b := range buckets {
+				if stringInSlice(*b, strings.Split(*bucketsList, ",")) {
+					selected = append(selected, b)
+				}
+			}
+			buckets = selected
+		}
+		log.Printf("Scanning %d buckets of account %s", len(buckets), a.id)
+		scanBuckets(sess, sessionRegion, svc, buckets, nil, progress, opts, pools)
+		reportMutex.Lock()
+		for _, b := range buckets {
+			if c, ok := report[*b]; ok {
+				c.setAccount(a.id)
+			}
+		}
+		reportMutex.Unlock()
+	}
+}
+
+// accountStats is the rollup of the buckets of an account
+type accountStats struct {
+	account *awsAccount
+	buckets int
+	files   uint64
+	size    uint64
+	cost    float64
+}
+
+// accountRollup sums the statistics of the buckets of each account. The last
+// entry is the rollup of all the accounts, its account being nil.
+func accountRollup(ctr map[string]*bucketCounter, accounts []*awsAccount, p *pricingTable) []*accountStats {
+	byID := make(map[string]*accountStats, len(accounts))
+	res := make([]*accountStats, 0, len(accounts)+1)
+	for _, a := range accounts {
+		byID[a.id] = &accountStats{account: a}
+		res = append(res, byID[a.id])
+	}
+	total := &accountStats{}
+	for _, k := range sortedKeys(ctr) {
+		c := ctr[k]
+		for _, s := range []*accountStats{byID[c.meta.account], total} {
+			if s == nil {
+				continue
+			}
+			s.buckets++
+			s.files += c.fileCount
+			s.size += c.sizeTotal
+			if p != nil {
+				s.cost += p.counterCost(c.meta.region, c)
+			}
+		}
+	}
+	return append(res, total)
+}
+
+// accountsTable builds the table of the rollup of the buckets by account,
+// ending with the rollup of all the accounts
+func accountsTable(ctr map[string]*bucketCounter, opts *reportOptions) *reportTable {
+	t := reportTable{
+		title:   "Repartition of files by accounts",
+		headers: []string{"Account", "Account name", "Number of buckets", "Total number of files", "Total size (GB)"},
+	}
+	if opts.pricing != nil {
+		t.headers = append(t.headers, "Estimated monthly cost (USD)")
+	}
+	t.headers = append(t.headers, "Error")
+	for _, s := range accountRollup(ctr, opts.accounts, opts.pricing) {
+		row := []string{"All accounts", ""}
+		if s.account != nil {
+			row = []string{s.account.id, s.account.name}
+		}
+		row = append(row,
+			strconv.Itoa(s.buckets),
+			strconv.FormatUint(s.files, 10),
+			strconv.FormatFloat(bytesToGB(s.size), 'f', 4, 64),
+		)
+		if opts.pricing != nil {
+			row = append(row, formatCost(s.cost))
+		}
+		if s.account != nil && s.account.err != nil {
+			row = append(row, s.account.err.Error())
+		} else {
+			row = append(row, "")
+		}
+		t.rows = append(t.rows, row)
+	}
+	return &t
+}
+
+// withAccountColumn adds a first column to the table containing the account
+// returned by the given function for each row. Nil tables are left as is.
+func withAccountColumn(t *reportTable, account func(row []string) string) *reportTable {
+	if t == nil {
+		return nil
+	}
+	t.headers = append([]string{"Account"}, t.headers...)
+	for i, row := range t.rows {
+		t.rows[i] = append([]string{account(row)}, row...)
+	}
+	return t
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type organizationsMock struct {
+	organizationsiface.OrganizationsAPI
+	pages []*organizations.ListAccountsOutput
+}
+
+func (m *organizationsMock) ListAccountsPages(input *organizations.ListAccountsInput, fn func(*organizations.ListAccountsOutput, bool) bool) error {
+	for i, p := range m.pages {
+		if !fn(p, i == len(m.pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestAccountFromRole(t *testing.T) {
+	a, err := accountFromRole("arn:aws:iam::123456789012:role/S3Reporter")
+	if err != nil || a.id != "123456789012" || a.roleARN != "arn:aws:iam::123456789012:role/S3Reporter" {
+		t.Errorf("Unexpected account %+v, %v", a, err)
+	}
+	for _, arn := range []string{"", "123456789012", "arn:aws:iam::123456789012:user/bob", "arn:aws:s3:::bucket", "arn:aws:iam:::role/S3Reporter"} {
+		if _, err := accountFromRole(arn); err == nil {
+			t.Errorf("Expecting an error for %q", arn)
+		}
+	}
+}
+
+func TestListOrgAccounts(t *testing.T) {
+	account := func(id, name, status string) *organizations.Account {
+		return &organizations.Account{
+			Arn:    aws.String("arn:aws-us-gov:organizations::111111111111:account/o-abc/" + id),
+			Id:     aws.String(id),
+			Name:   aws.String(name),
+			Status: aws.String(status),
+		}
+	}
+	svc := &organizationsMock{pages: []*organizations.ListAccountsOutput{
+		{Accounts: []*organizations.Account{account("333333333333", "data", organizations.AccountStatusActive), account("222222222222", "old", organizations.AccountStatusSuspended)}},
+		{Accounts: []*organizations.Account{account("111111111111", "management", organizations.AccountStatusActive)}},
+	}}
+	accounts, err := listOrgAccounts(svc, "S3Reporter")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []*awsAccount{
+		{id: "111111111111", name: "management", roleARN: "arn:aws-us-gov:iam::111111111111:role/S3Reporter"},
+		{id: "333333333333", name: "data", roleARN: "arn:aws-us-gov:iam::333333333333:role/S3Reporter"},
+	}
+	if !reflect.DeepEqual(accounts, expected) {
+		t.Errorf("Expecting %+v got %+v", expected, accounts)
+	}
+}
+
+func TestScanAccounts(t *testing.T) {
+	reportMutex = &sync.Mutex{}
+	report = make(map[string]*bucketCounter)
+	lastMod := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	obj := func(key string, size int64) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), StorageClass: aws.String("STANDARD"), LastModified: aws.Time(lastMod)}
+	}
+	clients := map[string]*s3BucketsMock{
+		"111111111111": {objects: map[string][]*s3.Object{"foo": {obj("a/b.txt", 1000), obj("c.txt", 10)}, "bar": {obj("d.txt", 100)}}},
+		"222222222222": {listErr: errors.New("AccessDenied: not authorized to perform sts:AssumeRole")},
+		"333333333333": {objects: map[string][]*s3.Object{"baz": {obj("e.txt", 1)}}},
+	}
+	newClient := func(a *awsAccount) (client.ConfigProvider, s3iface.S3API) {
+		return nil, clients[a.id]
+	}
+	accounts := []*awsAccount{{id: "111111111111", name: "prod"}, {id: "222222222222", name: "broken"}, {id: "333333333333", name: "dev"}}
+	opts := &reportOptions{prefixDepth: 1, accounts: accounts}
+	progress := newScanProgress()
+	scanAccounts(newClient, "us-east-1", accounts, progress, opts, &scanOptions{bucketWorkers: 2, pageWorkers: 2, pageQueue: 10})
+
+	if len(progress.failures()) != 0 || accounts[1].err == nil || accounts[0].err != nil {
+		t.Fatalf("Expecting only the listing of account 222222222222 to fail got %v and %+v", progress.failures(), accounts)
+	}
+	for bucket, account := range map[string]string{"foo": "111111111111", "bar": "111111111111", "baz": "333333333333"} {
+		if report[bucket] == nil || report[bucket].meta.account != account {
+			t.Errorf("Expecting bucket %s to belong to account %s got %+v", bucket, account, report[bucket])
+		}
+	}
+
+	tables := summaryTables(report, opts)
+	expectedRows := [][]string{
+		{"111111111111", "prod", "2", "3", "0.0000", ""},
+		{"222222222222", "broken", "0", "0", "0.0000", "AccessDenied: not authorized to perform sts:AssumeRole"},
+		{"333333333333", "dev", "1", "1", "0.0000", ""},
+		{"All accounts", "", "3", "4", "0.0000", ""},
+	}
+	if !reflect.DeepEqual(tables[0].rows, expectedRows) {
+		t.Errorf("Expecting %v got %v", expectedRows, tables[0].rows)
+	}
+	if tables[1].headers[0] != "Account" || !reflect.DeepEqual(tables[1].rows[0][:3], []string{"111111111111", "bar", "1"}) {
+		t.Errorf("Expecting an account column got %v %v", tables[1].headers, tables[1].rows)
+	}
+	for _, dt := range detailsTables("baz", report["baz"], opts) {
+		if dt != nil && dt.rows[0][0] != "333333333333" {
+			t.Errorf("Expecting an account column in %q got %v", dt.title, dt.rows)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Names of the settings of a bucket checked by the audit
+const (
+	auditEncryption        = "encryption"
+	auditVersioning        = "versioning"
+	auditPublicAccessBlock = "public_access_block"
+	auditPolicy            = "policy"
+	auditLogging           = "logging"
+	auditReplication       = "replication"
+	auditTags              = "tags"
+)
+
+// Severities of the audit findings, from the most to the least severe
+const (
+	severityHigh   = "high"
+	severityMedium = "medium"
+	severityLow    = "low"
+)
+
+var severityOrder = map[string]int{severityHigh: 0, severityMedium: 1, severityLow: 2}
+
+// bucketAudit holds the security related configuration of a bucket
+type bucketAudit struct {
+	// Encryption is the default encryption algorithm, empty if none
+	Encryption string `json:"encryption,omitempty"`
+	KMSKeyID   string `json:"kms_key_id,omitempty"`
+	// Versioning is Enabled, Suspended or empty if it was never enabled
+	Versioning string `json:"versioning,omitempty"`
+	MFADelete  bool   `json:"mfa_delete"`
+	// The settings of the public access block of the bucket, all false if the
+	// bucket has none
+	BlockPublicAcls       bool `json:"block_public_acls"`
+	IgnorePublicAcls      bool `json:"ignore_public_acls"`
+	BlockPublicPolicy     bool `json:"block_public_policy"`
+	RestrictPublicBuckets bool `json:"restrict_public_buckets"`
+	// PolicyPublic is true if the bucket policy grants public access
+	PolicyPublic  bool   `json:"policy_public"`
+	LoggingTarget string `json:"logging_target,omitempty"`
+	// Replication lists the destination buckets of the enabled replication
+	// rules
+	Replication []string          `json:"replication,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// Errors holds the errors that prevented retrieving some of the settings,
+	// by setting name
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// auditFinding is a risky configuration found on a bucket
+type auditFinding struct {
+	Bucket   string `json:"bucket"`
+	Severity string `json:"severity"`
+	Finding  string `json:"finding"`
+}
+
+// notConfigured returns true if the error means the setting is not configured
+// on the bucket, the given codes being the ones S3 returns in that case
+func notConfigured(err error, codes ...string) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return stringInSlice(aerr.Code(), codes)
+	}
+	return false
+}
+
+// getBucketAudit retrieves the security related configuration of a bucket.
+// The settings that cannot be retrieved, for example because of missing
+// permissions, are recorded as errors and the other ones are still retrieved.
+func getBucketAudit(svc s3iface.S3API, bucketName *string) *bucketAudit {
+	a := &bucketAudit{}
+	fail := func(setting string, err error) {
+		if a.Errors == nil {
+			a.Errors = make(map[string]string)
+		}
+		a.Errors[setting] = err.Error()
+	}
+
+	enc, err := svc.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: bucketName})
+	switch {
+	case err == nil:
+		if cfg := enc.ServerSideEncryptionConfiguration; cfg != nil {
+			for _, r := range cfg.Rules {
+				if d := r.ApplyServerSideEncryptionByDefault; d != nil {
+					a.Encryption = aws.StringValue(d.SSEAlgorithm)
+					a.KMSKeyID = aws.StringValue(d.KMSMasterKeyID)
+				}
+			}
+		}
+	case !notConfigured(err, "ServerSideEncryptionConfigurationNotFoundError"):
+		fail(auditEncryption, err)
+	}
+
+	if v, err := svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: bucketName}); err != nil {
+		fail(auditVersioning, err)
+	} else {
+		a.Versioning = aws.StringValue(v.Status)
+		a.MFADelete = aws.StringValue(v.MFADelete) == s3.MFADeleteStatusEnabled
+	}
+
+	pab, err := svc.GetPublicAccessBlock(&s3.GetPublicAccessBlockInput{Bucket: bucketName})
+	switch {
+	case err == nil:
+		if cfg := pab.PublicAccessBlockConfiguration; cfg != nil {
+			a.BlockPublicAcls = aws.BoolValue(cfg.BlockPublicAcls)
+			a.IgnorePublicAcls = aws.BoolValue(cfg.IgnorePublicAcls)
+			a.BlockPublicPolicy = aws.BoolValue(cfg.BlockPublicPolicy)
+			a.RestrictPublicBuckets = aws.BoolValue(cfg.RestrictPublicBuckets)
+		}
+	case !notConfigured(err, "NoSuchPublicAccessBlockConfiguration"):
+		fail(auditPublicAccessBlock, err)
+	}
+
+	status, err := svc.GetBucketPolicyStatus(&s3.GetBucketPolicyStatusInput{Bucket: bucketName})
+	switch {
+	case err == nil:
+		if status.PolicyStatus != nil {
+			a.PolicyPublic = aws.BoolValue(status.PolicyStatus.IsPublic)
+		}
+	case !notConfigured(err, "NoSuchBucketPolicy"):
+		fail(auditPolicy, err)
+	}
+
+	if l, err := svc.GetBucketLogging(&s3.GetBucketLoggingInput{Bucket: bucketName}); err != nil {
+		fail(auditLogging, err)
+	} else if l.LoggingEnabled != nil {
+		a.LoggingTarget = "s3://" + aws.StringValue(l.LoggingEnabled.TargetBucket) + "/" + aws.StringValue(l.LoggingEnabled.TargetPrefix)
+	}
+
+	repl, err := svc.GetBucketReplication(&s3.GetBucketReplicationInput{Bucket: bucketName})
+	switch {
+	case err == nil:
+		if cfg := repl.ReplicationConfiguration; cfg != nil {
+			for _, r := range cfg.Rules {
+				if aws.StringValue(r.Status) != s3.ReplicationRuleStatusEnabled || r.Destination == nil {
+					continue
+				}
+				if dest := aws.StringValue(r.Destination.Bucket); !stringInSlice(dest, a.Replication) {
+					a.Replication = append(a.Replication, dest)
+				}
+			}
+			sort.Strings(a.Replication)
+		}
+	case !notConfigured(err, "ReplicationConfigurationNotFoundError"):
+		fail(auditReplication, err)
+	}
+
+	tags, err := svc.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: bucketName})
+	switch {
+	case err == nil:
+		if len(tags.TagSet) > 0 {
+			a.Tags = make(map[string]string, len(tags.TagSet))
+			for _, t := range tags.TagSet {
+				a.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+			}
+		}
+	case !notConfigured(err, "NoSuchTagSet"):
+		fail(auditTags, err)
+	}
+	return a
+}
+
+// known returns true if the setting could be retrieved
+func (a *bucketAudit) known(setting string) bool {
+	_, ok := a.Errors[setting]
+	return !ok
+}
+
+// public returns true if the bucket policy grants public access and the public
+// access block of the bucket does not restrict it
+func (a *bucketAudit) public() bool {
+	return a.PolicyPublic && !a.RestrictPublicBuckets
+}
+
+// publicAccessBlock describes the settings of the public access block enabled
+// on the bucket
+func (a *bucketAudit) publicAccessBlock() string {
+	var enabled []string
+	for _, s := range []struct {
+		name string
+		on   bool
+	}{
+		{"BlockPublicAcls", a.BlockPublicAcls},
+		{"IgnorePublicAcls", a.IgnorePublicAcls},
+		{"BlockPublicPolicy", a.BlockPublicPolicy},
+		{"RestrictPublicBuckets", a.RestrictPublicBuckets},
+	} {
+		if s.on {
+			enabled = append(enabled, s.name)
+		}
+	}
+	switch len(enabled) {
+	case 0:
+		return "none"
+	case 4:
+		return "all"
+	}
+	return strings.Join(enabled, " ")
+}
+
+// findings returns the risky configurations of the bucket. The rules relying
+// on a setting that could not be retrieved are skipped, the error being
+// reported as a finding instead.
+func (a *bucketAudit) findings(bucket string) []*auditFinding {
+	var res []*auditFinding
+	add := func(severity, format string, args ...interface{}) {
+		res = append(res, &auditFinding{Bucket: bucket, Severity: severity, Finding: fmt.Sprintf(format, args...)})
+	}
+	public := a.known(auditPolicy) && a.known(auditPublicAccessBlock) && a.public()
+	if public {
+		switch {
+		case !a.known(auditEncryption):
+		case a.Encryption == "":
+			add(severityHigh, "public bucket without default encryption")
+		default:
+			add(severityHigh, "public bucket")
+		}
+		if a.known(auditLogging) && a.LoggingTarget == "" {
+			add(severityMedium, "public bucket without access logging")
+		}
+	}
+	if a.known(auditPublicAccessBlock) && a.publicAccessBlock() != "all" {
+		add(severityMedium, "public access block not fully enabled (%s)", a.publicAccessBlock())
+	}
+	if a.known(auditEncryption) && a.Encryption == "" && !public {
+		add(severityMedium, "no default encryption")
+	}
+	if a.known(auditVersioning) {
+		switch {
+		case len(a.Replication) > 0 && a.Versioning != s3.BucketVersioningStatusEnabled:
+			add(severityMedium, "replication configured while versioning is not enabled")
+		case a.Versioning != s3.BucketVersioningStatusEnabled:
+			add(severityLow, "versioning not enabled")
+		}
+	}
+	if a.known(auditLogging) && a.LoggingTarget == "" && !public {
+		add(severityLow, "access logging disabled")
+	}
+	if a.known(auditTags) && len(a.Tags) == 0 {
+		add(severityLow, "no tags")
+	}
+	for _, setting := range sortedStringKeys(a.Errors) {
+		add(severityLow, "%s setting could not be retrieved: %s", setting, a.Errors[setting])
+	}
+	return res
+}
+
+// auditFindings returns the findings of all the audited buckets, the most
+// severe first
+func auditFindings(ctr map[string]*bucketCounter) []*auditFinding {
+	var res []*auditFinding
+	for _, k := range sortedKeys(ctr) {
+		if a := ctr[k].meta.audit; a != nil {
+			res = append(res, a.findings(k)...)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return severityOrder[res[i].Severity] < severityOrder[res[j].Severity]
+	})
+	return res
+}
+
+// auditTable builds the table of the configuration of each audited bucket
+func auditTable(ctr map[string]*bucketCounter) *reportTable {
+	t := reportTable{
+		title:   "Configuration of the buckets",
+		headers: []string{"Bucket name", "Default encryption", "Versioning", "MFA delete", "Public access block", "Public policy", "Access logging", "Replication", "Tags", "Errors"},
+	}
+	for _, k := range sortedKeys(ctr) {
+		a := ctr[k].meta.audit
+		if a == nil {
+			continue
+		}
+		unknown := func(setting, value string) string {
+			if !a.known(setting) {
+				return "unknown"
+			}
+			return value
+		}
+		encryption := "none"
+		if a.Encryption != "" {
+			encryption = a.Encryption
+			if a.KMSKeyID != "" {
+				encryption += " " + a.KMSKeyID
+			}
+		}
+		versioning := a.Versioning
+		if versioning == "" {
+			versioning = "Disabled"
+		}
+		logging := a.LoggingTarget
+		if logging == "" {
+			logging = "disabled"
+		}
+		var tags, errors []string
+		for _, tag := range sortedStringKeys(a.Tags) {
+			tags = append(tags, tag+"="+a.Tags[tag])
+		}
+		for _, setting := range sortedStringKeys(a.Errors) {
+			errors = append(errors, setting+": "+a.Errors[setting])
+		}
+		t.rows = append(t.rows, []string{
+			k,
+			unknown(auditEncryption, encryption),
+			unknown(auditVersioning, versioning),
+			unknown(auditVersioning, fmt.Sprint(a.MFADelete)),
+			unknown(auditPublicAccessBlock, a.publicAccessBlock()),
+			unknown(auditPolicy, fmt.Sprint(a.PolicyPublic)),
+			unknown(auditLogging, logging),
+			unknown(auditReplication, strings.Join(a.Replication, " ")),
+			unknown(auditTags, strings.Join(tags, " ")),
+			strings.Join(errors, "; "),
+		})
+	}
+	return &t
+}
+
+// findingsTable builds the table of the risky configurations found by the
+// audit
+func findingsTable(findings []*auditFinding) *reportTable {
+	t := reportTable{
+		title:   "Findings of the audit of the buckets",
+		headers: []string{"Bucket name", "Severity", "Finding"},
+	}
+	for _, f := range findings {
+		t.rows = append(t.rows, []string{f.Bucket, f.Severity, f.Finding})
+	}
+	return &t
+}
+
+// sortedStringKeys returns the keys of the map sorted
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
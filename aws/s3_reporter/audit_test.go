@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3AuditMock returns a static configuration for each setting of a bucket.
+// A setting with an error in errs fails with it.
+type s3AuditMock struct {
+	s3iface.S3API
+	encryption  *s3.GetBucketEncryptionOutput
+	versioning  *s3.GetBucketVersioningOutput
+	pab         *s3.GetPublicAccessBlockOutput
+	policy      *s3.GetBucketPolicyStatusOutput
+	logging     *s3.GetBucketLoggingOutput
+	replication *s3.GetBucketReplicationOutput
+	tagging     *s3.GetBucketTaggingOutput
+	errs        map[string]error
+}
+
+func (m *s3AuditMock) GetBucketEncryption(*s3.GetBucketEncryptionInput) (*s3.GetBucketEncryptionOutput, error) {
+	return m.encryption, m.errs[auditEncryption]
+}
+
+func (m *s3AuditMock) GetBucketVersioning(*s3.GetBucketVersioningInput) (*s3.GetBucketVersioningOutput, error) {
+	return m.versioning, m.errs[auditVersioning]
+}
+
+func (m *s3AuditMock) GetPublicAccessBlock(*s3.GetPublicAccessBlockInput) (*s3.GetPublicAccessBlockOutput, error) {
+	return m.pab, m.errs[auditPublicAccessBlock]
+}
+
+func (m *s3AuditMock) GetBucketPolicyStatus(*s3.GetBucketPolicyStatusInput) (*s3.GetBucketPolicyStatusOutput, error) {
+	return m.policy, m.errs[auditPolicy]
+}
+
+func (m *s3AuditMock) GetBucketLogging(*s3.GetBucketLoggingInput) (*s3.GetBucketLoggingOutput, error) {
+	return m.logging, m.errs[auditLogging]
+}
+
+func (m *s3AuditMock) GetBucketReplication(*s3.GetBucketReplicationInput) (*s3.GetBucketReplicationOutput, error) {
+	return m.replication, m.errs[auditReplication]
+}
+
+func (m *s3AuditMock) GetBucketTagging(*s3.GetBucketTaggingInput) (*s3.GetBucketTaggingOutput, error) {
+	return m.tagging, m.errs[auditTags]
+}
+
+// unconfiguredBucket returns the mock of a bucket without any configuration
+func unconfiguredBucket() *s3AuditMock {
+	return &s3AuditMock{
+		encryption:  &s3.GetBucketEncryptionOutput{},
+		versioning:  &s3.GetBucketVersioningOutput{},
+		pab:         &s3.GetPublicAccessBlockOutput{},
+		policy:      &s3.GetBucketPolicyStatusOutput{},
+		logging:     &s3.GetBucketLoggingOutput{},
+		replication: &s3.GetBucketReplicationOutput{},
+		tagging:     &s3.GetBucketTaggingOutput{},
+		errs: map[string]error{
+			auditEncryption:        awserr.New("ServerSideEncryptionConfigurationNotFoundError", "The server side encryption configuration was not found", nil),
+			auditPublicAccessBlock: awserr.New("NoSuchPublicAccessBlockConfiguration", "The public access block configuration was not found", nil),
+			auditPolicy:            awserr.New("NoSuchBucketPolicy", "The bucket policy does not exist", nil),
+			auditReplication:       awserr.New("ReplicationConfigurationNotFoundError", "The replication configuration was not found", nil),
+			auditTags:              awserr.New("NoSuchTagSet", "The TagSet does not exist", nil),
+		},
+	}
+}
+
+func TestGetBucketAudit(t *testing.T) {
+	if a := getBucketAudit(unconfiguredBucket(), aws.String("foo")); !reflect.DeepEqual(a, &bucketAudit{}) {
+		t.Errorf("Expecting an empty audit for a bucket without configuration got %+v", a)
+	}
+
+	m := &s3AuditMock{
+		encryption: &s3.GetBucketEncryptionOutput{ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+				SSEAlgorithm: aws.String("aws:kms"), KMSMasterKeyID: aws.String("alias/s3"),
+			}}},
+		}},
+		versioning: &s3.GetBucketVersioningOutput{Status: aws.String("Enabled"), MFADelete: aws.String("Enabled")},
+		pab: &s3.GetPublicAccessBlockOutput{PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+			BlockPublicAcls: aws.Bool(true), IgnorePublicAcls: aws.Bool(true),
+		}},
+		policy:  &s3.GetBucketPolicyStatusOutput{PolicyStatus: &s3.PolicyStatus{IsPublic: aws.Bool(true)}},
+		logging: &s3.GetBucketLoggingOutput{LoggingEnabled: &s3.LoggingEnabled{TargetBucket: aws.String("logs"), TargetPrefix: aws.String("foo/")}},
+		replication: &s3.GetBucketReplicationOutput{ReplicationConfiguration: &s3.ReplicationConfiguration{Rules: []*s3.ReplicationRule{
+			{Status: aws.String("Enabled"), Destination: &s3.Destination{Bucket: aws.String("arn:aws:s3:::foo-replica")}},
+			{Status: aws.String("Enabled"), Destination: &s3.Destination{Bucket: aws.String("arn:aws:s3:::foo-replica")}},
+			{Status: aws.String("Disabled"), Destination: &s3.Destination{Bucket: aws.String("arn:aws:s3:::old-replica")}},
+		}}},
+		tagging: &s3.GetBucketTaggingOutput{TagSet: []*s3.Tag{{Key: aws.String("team"), Value: aws.String("data")}}},
+		errs:    map[string]error{auditLogging: awserr.New("AccessDenied", "Access Denied", nil)},
+	}
+	expected := &bucketAudit{
+		Encryption:       "aws:kms",
+		KMSKeyID:         "alias/s3",
+		Versioning:       "Enabled",
+		MFADelete:        true,
+		BlockPublicAcls:  true,
+		IgnorePublicAcls: true,
+		PolicyPublic:     true,
+		Replication:      []string{"arn:aws:s3:::foo-replica"},
+		Tags:             map[string]string{"team": "data"},
+		Errors:           map[string]string{auditLogging: "AccessDenied: Access Denied"},
+	}
+	if a := getBucketAudit(m, aws.String("foo")); !reflect.DeepEqual(a, expected) {
+		t.Errorf("Expecting %+v got %+v", expected, a)
+	}
+}
+
+func TestAuditFindings(t *testing.T) {
+	unconfigured := getBucketAudit(unconfiguredBucket(), aws.String("bar"))
+	public := *unconfigured
+	public.PolicyPublic = true
+	restricted := public
+	restricted.BlockPublicAcls, restricted.IgnorePublicAcls, restricted.BlockPublicPolicy, restricted.RestrictPublicBuckets = true, true, true, true
+	restricted.Encryption, restricted.Versioning, restricted.LoggingTarget = "AES256", "Enabled", "s3://logs/"
+	restricted.Tags = map[string]string{"team": "data"}
+
+	ctr := map[string]*bucketCounter{"bar": newBucketCounter(), "foo": newBucketCounter(), "baz": newBucketCounter(), "qux": newBucketCounter()}
+	ctr["bar"].setMetadata(bucketMetadata{audit: unconfigured})
+	ctr["foo"].setMetadata(bucketMetadata{audit: &public})
+	ctr["baz"].setMetadata(bucketMetadata{audit: &restricted})
+	expected := []*auditFinding{
+		{"foo", severityHigh, "public bucket without default encryption"},
+		{"bar", severityMedium, "public access block not fully enabled (none)"},
+		{"bar", severityMedium, "no default encryption"},
+		{"foo", severityMedium, "public bucket without access logging"},
+		{"foo", severityMedium, "public access block not fully enabled (none)"},
+		{"bar", severityLow, "versioning not enabled"},
+		{"bar", severityLow, "access logging disabled"},
+		{"bar", severityLow, "no tags"},
+		{"foo", severityLow, "versioning not enabled"},
+		{"foo", severityLow, "no tags"},
+	}
+	if f := auditFindings(ctr); !reflect.DeepEqual(f, expected) {
+		t.Errorf("Expecting %v got %v", expected, f)
+	}
+
+	// The rules relying on a setting that could not be retrieved are skipped
+	failed := public
+	failed.Errors = map[string]string{auditEncryption: "AccessDenied: Access Denied", auditPublicAccessBlock: "AccessDenied: Access Denied"}
+	expected = []*auditFinding{
+		{"foo", severityLow, "versioning not enabled"},
+		{"foo", severityLow, "access logging disabled"},
+		{"foo", severityLow, "no tags"},
+		{"foo", severityLow, "encryption setting could not be retrieved: AccessDenied: Access Denied"},
+		{"foo", severityLow, "public_access_block setting could not be retrieved: AccessDenied: Access Denied"},
+	}
+	if f := failed.findings("foo"); !reflect.DeepEqual(f, expected) {
+		t.Errorf("Expecting %v got %v", expected, f)
+	}
+
+	// Replication requires versioning
+	replicated := restricted
+	replicated.Versioning = "Suspended"
+	replicated.Replication = []string{"arn:aws:s3:::baz-replica"}
+	expected = []*auditFinding{{"baz", severityMedium, "replication configured while versioning is not enabled"}}
+	if f := replicated.findings("baz"); !reflect.DeepEqual(f, expected) {
+		t.Errorf("Expecting %v got %v", expected, f)
+	}
+
+	table := auditTable(ctr)
+	if len(table.rows) != 3 {
+		t.Fatalf("Expecting a row for each audited bucket got %v", table.rows)
+	}
+	expectedRow := []string{"baz", "AES256", "Enabled", "false", "all", "true", "s3://logs/", "", "team=data", ""}
+	if !reflect.DeepEqual(table.rows[1], expectedRow) {
+		t.Errorf("Expecting %v got %v", expectedRow, table.rows[1])
+	}
+}
@@ -1,21 +1,23 @@
 package main
 
 import (
-	"encoding/csv"
 	"flag"
-	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/organizations"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/gobike/envflag"
@@ -32,10 +34,64 @@ var (
 
 // flags
 var (
-	reportPath     = flag.String("report-path", "/tmp/s3.csv", "Path to the csv report to generate. Environment variable: REPORT_PATH")
+	reportPath     = flag.String("report-path", "/tmp/s3.csv", "Path to the report to generate. Environment variable: REPORT_PATH")
 	bucketsList    = flag.String("buckets", "", "Coma-separated list of bucket to scan. If none specified, all buckets will be scanned. Environment variable: BUCKETS")
 	bucketsExclude = flag.String("exclude-buckets", "", "Coma-separated list of bucket to exclude from the scan. Environment variable: EXCLUDE_BUCKETS")
 	reportType     = flag.String("report-type", "full", "Type of report to output. Allowed values 'summary' (only size and age global report), 'details' (only details tables for each bucket), 'full' (summary + details). Environment variable: REPORT_TYPE")
+	reportFormat   = flag.String("report-format", "csv", "Format of the report to generate. Allowed values 'csv', 'json', 'markdown'. Environment variable: REPORT_FORMAT")
+	checkpointPath = flag.String("checkpoint-path", "/tmp/s3_reporter_checkpoint.json", "Path of the file where the progress of the scan is saved. If empty, no checkpoint is saved. Environment variable: CHECKPOINT_PATH")
+	checkpointFreq = flag.Duration("checkpoint-interval", time.Minute, "Interval between 2 saves of the progress of the scan. Environment variable: CHECKPOINT_INTERVAL")
+	pricingPath    = flag.String("pricing-path", "", "Path to a yaml or json file containing the monthly price per GB of each storage class. If specified, the report includes the estimated monthly storage cost. Environment variable: PRICING_PATH")
+	lifecycle      = flag.Bool("lifecycle", false, "Add lifecycle transition recommendations to the details report, compared with the current lifecycle rules of each bucket. Environment variable: LIFECYCLE")
+	lifecycleRatio = flag.Float64("lifecycle-min-ratio", 0.5, "Minimum ratio of the bytes of a bucket or root folder that a transition must concern to be recommended. Environment variable: LIFECYCLE_MIN_RATIO")
+	lifecycleSize  = flag.Uint64("lifecycle-min-size", 1024*1024*1024, "Minimum number of bytes of a bucket or root folder that a transition must concern to be recommended. Environment variable: LIFECYCLE_MIN_SIZE")
+	lifecycleDir   = flag.String("lifecycle-policy-dir", "", "Directory where the suggested lifecycle configuration of each bucket is written as json. Requires -lifecycle. Environment variable: LIFECYCLE_POLICY_DIR")
+	audit          = flag.Bool("audit", false, "Audit the configuration of each bucket: default encryption, versioning, public access block, bucket policy, access logging, replication and tags. The summary report gets the configuration of the buckets and the risky ones found. Environment variable: AUDIT")
+	resume         = flag.Bool("resume", false, "Resume the scan from the file specified by -checkpoint-path. Environment variable: RESUME")
+	prefixDepth    = flag.Int("prefix-depth", 1, "Number of folder levels of the prefix tree built for each bucket. Environment variable: PREFIX_DEPTH")
+	prefixTop      = flag.Int("prefix-top", 10, "Number of heaviest prefixes reported for each level of the prefix tree when -prefix-depth is greater than 1. 0 reports all of them. Environment variable: PREFIX_TOP")
+	versions       = flag.Bool("versions", false, "List all the versions of the objects and the incomplete multipart uploads to report the storage used by noncurrent versions, delete markers and incomplete multipart uploads. Environment variable: VERSIONS")
+	duplicates     = flag.Bool("duplicates", false, "Find the objects with the same ETag and size, inside a bucket and across buckets. Environment variable: DUPLICATES")
+	duplicatesDir  = flag.String("duplicates-dir", os.TempDir(), "Directory in which the index used to find the duplicates is written, in a new directory for each scan. Environment variable: DUPLICATES_DIR")
+	duplicatesTop  = flag.Int("duplicates-top", 20, "Number of duplicate groups wasting the most bytes that are reported. 0 reports all of them. Environment variable: DUPLICATES_TOP")
+	topCount       = flag.Int("top-objects", 0, "Number of largest, oldest and oldest but largest objects reported for each bucket and for all the buckets. 0 disables them. Environment variable: TOP_OBJECTS")
+	snapshotPath   = flag.String("snapshot-path", "", "Path of the file where the counters are saved as json at the end of the scan, to be compared with the ones of another run with the diff subcommand. Environment variable: SNAPSHOT_PATH")
+	exporter       = flag.Bool("exporter", false, "Run as a Prometheus exporter: the buckets are scanned every -scan-interval and the statistics of the last scan are exposed on /metrics instead of being written to a report. Environment variable: EXPORTER")
+	listenAddress  = flag.String("listen-address", ":9340", "Address to listen on in exporter mode. Environment variable: LISTEN_ADDRESS")
+	scanInterval   = flag.Duration("scan-interval", 24*time.Hour, "Interval between the start of 2 scans in exporter mode. Environment variable: SCAN_INTERVAL")
+	exporterRoots  = flag.Int("exporter-max-roots", 100, "Maximum number of root folders of each bucket exposed as labels in exporter mode. The smallest ones are grouped under the _other root. 0 exposes all of them. Environment variable: EXPORTER_MAX_ROOTS")
+	bucketWorkers  = flag.Int("bucket-workers", 8, "Number of buckets or inventories read in parallel. Environment variable: BUCKET_WORKERS")
+	shardWorkers   = flag.Int("shard-workers", 8, "Number of shards of the buckets given with -shard-buckets listed in parallel. Environment variable: SHARD_WORKERS")
+	pageWorkers    = flag.Int("page-workers", 2, "Number of pages of objects counted in parallel. Environment variable: PAGE_WORKERS")
+	pageQueue      = flag.Int("page-queue", 100, "Number of pages listed but not counted yet above which the listings wait for the page workers. Environment variable: PAGE_QUEUE")
+	shardBuckets   = flag.String("shard-buckets", "", "Coma-separated list of buckets which key space is split in shards listed in parallel: the first level of the bucket is listed with -shard-delimiter and each prefix found is listed on its own. Environment variable: SHARD_BUCKETS")
+	shardDelimiter = flag.String("shard-delimiter", "/", "Delimiter used to find the prefixes of the shards of the buckets given with -shard-buckets. Environment variable: SHARD_DELIMITER")
+	roleARNs       = flag.String("role-arns", "", "Coma-separated list of ARNs of IAM roles to assume to scan the buckets of other accounts. The reports get an account dimension. Environment variable: ROLE_ARNS")
+	orgRoleName    = flag.String("org-role-name", "", "Name of the IAM role to assume in each active account of the AWS Organization, listed with the default credentials, to scan their buckets. The reports get an account dimension. Environment variable: ORG_ROLE_NAME")
+	roleSession    = flag.String("role-session-name", "s3_reporter", "Session name used when assuming the roles of -role-arns or -org-role-name. Environment variable: ROLE_SESSION_NAME")
+	filtersPath    = flag.String("filters-path", "", "Path to a yaml or json file containing the rule sets selecting the objects counted, for all the buckets and for specific buckets. Environment variable: FILTERS_PATH")
+	includeKeys    = flag.String("include-keys", "", "Coma-separated list of expressions of the keys of the objects to count: prefix:value, glob:value or regex:value. A value without kind is a prefix. Environment variable: INCLUDE_KEYS")
+	excludeKeys    = flag.String("exclude-keys", "", "Coma-separated list of expressions of the keys of the objects not to count, in the same form as -include-keys. Environment variable: EXCLUDE_KEYS")
+	minSize        = flag.Int64("min-size", 0, "Minimum size in bytes of the objects counted. Environment variable: MIN_SIZE")
+	maxSize        = flag.Int64("max-size", 0, "Maximum size in bytes of the objects counted. 0 means no limit. Environment variable: MAX_SIZE")
+	modifiedAfter  = flag.String("modified-after", "", "Only count the objects last modified at or after this date, of the form 2006-01-02 or a RFC3339 timestamp. Environment variable: MODIFIED_AFTER")
+	modifiedBefore = flag.String("modified-before", "", "Only count the objects last modified before this date, of the form 2006-01-02 or a RFC3339 timestamp. Environment variable: MODIFIED_BEFORE")
+	bandsPath      = flag.String("bands-path", "", "Path to a yaml or json file containing the size and age bands of the reports and the date the ages are computed as of. Environment variable: BANDS_PATH")
+	sizeBandsList  = flag.String("size-bands", "", "Coma-separated list of the sizes at which each size range of the reports starts, in increasing order, such as 512B,1KB,1MB. Defaults to 1KB,10KB,100KB,1MB,10MB,100MB,1GB,10GB,100GB. Environment variable: SIZE_BANDS")
+	ageBandsList   = flag.String("age-bands", "", "Coma-separated list of the ages at which each age range of the reports starts, in increasing order, as a number of days (d), weeks (w), months (m) or years (y) such as 1d,7d,1m,1y. Defaults to 1m,2m,3m,6m,9m,1y,2y,3y,4y,5y. Environment variable: AGE_BANDS")
+	asOfDate       = flag.String("as-of", "", "Date the age of the objects is computed as of, of the form 2006-01-02 or a RFC3339 timestamp, so that a report can be reproduced. Defaults to the start of the scan. Environment variable: AS_OF")
+	sqlitePath     = flag.String("sqlite-path", "", "Path of a SQLite database where the statistics of the buckets are written at the end of the scan, one row per bucket, root folder, storage class, extension and month, with views reproducing the tables of the report. Environment variable: SQLITE_PATH")
+	dbHost         = flag.String("db-host", "", "Name of the MySQL server where the statistics of the buckets are written at the end of the scan, like with -sqlite-path. Environment variable: DB_HOST")
+	dbName         = flag.String("db-name", "s3_reporter", "Name of the MySQL database to connect to. Environment variable: DB_NAME")
+	dbUser         = flag.String("db-user", "", "User name to use to connect to the MySQL database. Environment variable: DB_USER")
+	dbPassword     = flag.String("db-pwd", "", "Password to use to connect to the MySQL database. Environment variable: DB_PWD")
+	requesterPays  = flag.Bool("requester-pays", false, "Accept the charges of the requests to the buckets configured as requester pays, which deny the access otherwise. Environment variable: REQUESTER_PAYS")
+	maxRetries     = flag.Int("max-retries", 5, "Number of retries of a listing throttled by S3 before the bucket is skipped. The listing resumes from the last page received. Environment variable: MAX_RETRIES")
+	retryDelay     = flag.Duration("retry-delay", time.Second, "Delay before the first retry of a listing throttled by S3, doubled at each retry. Environment variable: RETRY_DELAY")
+	sampleRate     = flag.Float64("sample-rate", 0, "Fraction of the objects of each bucket, between 0 and 1, which metadata is fetched with HeadObject to estimate the repartition of the objects by content type, server-side encryption and KMS key. 0 disables the sampling. Environment variable: SAMPLE_RATE")
+	sampleRPS      = flag.Float64("sample-rps", 50, "Maximum number of HeadObject requests per second sent by -sample-rate for all the buckets. 0 means no limit. Environment variable: SAMPLE_RPS")
+	sampleWorkers  = flag.Int("sample-workers", 4, "Number of HeadObject requests of -sample-rate sent in parallel. Environment variable: SAMPLE_WORKERS")
+	inventories    = flag.String("inventory-manifests", "", "Coma-separated list of S3 Inventory manifest.json files, local paths or s3://bucket/key urls. If specified, the objects are read from the inventories instead of being listed. Environment variable: INVENTORY_MANIFESTS")
 )
 
 // getBucketsList returns the full list of buckets
@@ -58,119 +114,439 @@ func getBucketRegion(svc s3iface.S3API, bucketName *string) (string, error) {
 	return s3.NormalizeBucketLocation(loc), err
 }
 
+// regionalClient returns a client for the region the given bucket is located
+// in along with the region
+func regionalClient(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, bucketName *string) (s3iface.S3API, string, error) {
+	var loc string
+	err := throttleRetries.retry("retrieving the location of bucket "+*bucketName, func() (err error) {
+		loc, err = getBucketRegion(svc, bucketName)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	// Makes sure we are in the right region and avoid stuffs like:
+	// AuthorizationHeaderMalformed: The authorization header is malformed; the region 'us-east-1' is wrong
+	if loc != sessionRegion {
+		return newS3Client(sess, aws.NewConfig().WithRegion(loc)), loc, nil
+	}
+	return svc, loc, nil
+}
+
 // bucketWorker takes care of listing the objects pages and putting them in the
-// page channel
-func bucketWorker(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, buckets chan *string, wg *sync.WaitGroup, pageChan chan *s3.ListObjectsV2Output) {
+// page channel. The shards of the buckets split in shards are put in the shard
+// channel instead.
+func bucketWorker(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, buckets chan *string, wg *sync.WaitGroup, pageChan chan *s3.ListObjectsV2Output, shards chan *shardJob, progress *scanProgress, pools *scanOptions) {
 	for b := range buckets {
 		log.Printf("%d buckets left in the queue", len(buckets))
-		loc, err := getBucketRegion(svc, b)
+		localSvc, loc, err := regionalClient(sess, sessionRegion, svc, b)
 		if err != nil {
-			log.Printf("Error while retrieving the bucket %s location: %s\n", *b, err)
+			log.Printf("Error while retrieving the bucket %s location (%s): %s\n", *b, errorClass(err), err)
+			if !progress.isDone(*b) {
+				progress.markFailed(*b, err)
+			}
+			continue
+		}
+		if progress.isDone(*b) {
+			// The bucket has been scanned before the checkpoint, only the
+			// objects left to sample are
+			objSampler.setClient(*b, localSvc)
 			continue
 		}
 		log.Printf("Bucket: %s, Location: %s\n", *b, loc)
-		localSvc := svc
-		// Makes sure we are in the right region and avoid stuffs like:
-		// AuthorizationHeaderMalformed: The authorization header is malformed; the region 'us-east-1' is wrong
-		if loc != sessionRegion {
-			localSvc = s3.New(sess, aws.NewConfig().WithRegion(loc))
+		setBucketMetadata(localSvc, b, loc)
+		if pools.sharded(*b) {
+			listShards(localSvc, b, pools.shardDelimiter, pageChan, shards, progress)
+			continue
+		}
+		list := getBucketObjects
+		if *versions {
+			list = getBucketVersions
+		}
+		err = throttleRetries.retry("listing the objects of bucket "+*b, func() error {
+			return list(localSvc, b, pageChan, progress)
+		})
+		if err != nil {
+			log.Printf("Error while listing the objects of bucket %s (%s): %s\n", *b, errorClass(err), err)
+			progress.markFailed(*b, err)
+			continue
 		}
-		getBucketObjects(localSvc, b, pageChan)
+		progress.markDone(*b)
 	}
 	wg.Done()
 }
 
-// getBucketObjects gets the list of objects in a bucket
-func getBucketObjects(svc s3iface.S3API, bucketName *string, pageChan chan *s3.ListObjectsV2Output) {
-	encodingType := "url"
-	params := s3.ListObjectsV2Input{Bucket: bucketName, EncodingType: &encodingType}
-	chanWarn := int(float64(cap(pageChan)) * 0.95) // threshold after which we slow down the feed to the channel
-	err := svc.ListObjectsV2Pages(&params,
+// setBucketMetadata records the region of a bucket and, if required, its
+// lifecycle rules and the audit of its configuration in the report, before
+// its objects are listed
+func setBucketMetadata(svc s3iface.S3API, bucketName *string, loc string) {
+	reportMutex.Lock()
+	currentReport := report[*bucketName]
+	reportMutex.Unlock()
+	if objSampler != nil {
+		objSampler.setClient(*bucketName, svc)
+	}
+	meta := bucketMetadata{region: loc}
+	if *lifecycle {
+		transitions, err := getBucketLifecycle(svc, bucketName)
+		if err != nil {
+			log.Printf("Error while retrieving the bucket %s lifecycle configuration: %s\n", *bucketName, err)
+		}
+		meta.lifecycle = transitions
+	}
+	if *audit {
+		meta.audit = getBucketAudit(svc, bucketName)
+	}
+	currentReport.setMetadata(meta)
+}
+
+// inventoryMetadata fetches the metadata of a bucket read from an inventory.
+// Errors are only logged as the report can be generated without them.
+func inventoryMetadata(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, bucketName *string) {
+	localSvc, loc, err := regionalClient(sess, sessionRegion, svc, bucketName)
+	if err != nil {
+		log.Printf("Error while retrieving the bucket %s location, the default prices are used: %s\n", *bucketName, err)
+		return
+	}
+	setBucketMetadata(localSvc, bucketName, loc)
+}
+
+// loadManifest loads an inventory manifest from a local path or a s3 url
+func loadManifest(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, location string) (*inventoryManifest, error) {
+	bucket, key, ok := parseS3URL(location)
+	if !ok {
+		return loadLocalManifest(location)
+	}
+	localSvc, _, err := regionalClient(sess, sessionRegion, svc, &bucket)
+	if err != nil {
+		return nil, err
+	}
+	return loadS3Manifest(localSvc, bucket, key)
+}
+
+// getBucketObjects gets the list of objects in a bucket. If the progress
+// contains a continuation token for the bucket, the listing starts from there.
+func getBucketObjects(svc s3iface.S3API, bucketName *string, pageChan chan *s3.ListObjectsV2Output, progress *scanProgress) error {
+	return listObjects(svc, &s3.ListObjectsV2Input{Bucket: bucketName}, *bucketName, pageChan, progress)
+}
+
+// listObjects lists the objects matching the given parameters and puts the
+// pages in the page channel. The progress of the listing is recorded under
+// the given key and the listing starts from its continuation token if any.
+// The listing blocks while the page channel is full.
+func listObjects(svc s3iface.S3API, params *s3.ListObjectsV2Input, key string, pageChan chan *s3.ListObjectsV2Output, progress *scanProgress) error {
+	params.EncodingType = aws.String("url")
+	if token := progress.token(key); token != "" {
+		log.Printf("Resuming the listing of %s", key)
+		params.ContinuationToken = &token
+	}
+	return svc.ListObjectsV2Pages(params,
 		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-			if len(pageChan) > chanWarn {
-				log.Println("Page channel is soon at capacity, slowing down the worker")
-				time.Sleep(1 * time.Second)
-			}
-			pageChan <- page
+			progress.pushPageAs(key, page, pageChan, nil)
 			return !lastPage
 		})
-	if err != nil {
-		log.Fatalf("ListObjectsV2Pages returned: %s", err)
-	}
 }
 
 // processPage gets the statistics for each page of objects provided by the
-// channel
-func processPage(pageChan chan *s3.ListObjectsV2Output, wg *sync.WaitGroup) {
+// channel. The pages are counted in counters owned by the worker, merged in
+// the report once all the pages have been counted or when a checkpoint is
+// taken.
+func processPage(pageChan chan *s3.ListObjectsV2Output, wg *sync.WaitGroup, progress *scanProgress) {
+	counters := progress.newPageCounters()
 	for page := range pageChan {
 		log.Printf("1 page of %d objects fetched for bucket %s", len(page.Contents), *page.Name)
+		pageReport := counters.counter(*page.Name)
 		for _, obj := range page.Contents {
-			getObjectStats(page.Name, obj)
+			if !keyFilters.match(*page.Name, decodeKey(*obj.Key), *obj.Size, *obj.LastModified) {
+				continue
+			}
+			countObject(pageReport, page.Name, obj)
 		}
+		progress.pageDone()
 	}
+	progress.flushPageCounters(counters)
 	wg.Done()
 }
 
-// getObjectStats collects the statistics of an objects in the report structure
-func getObjectStats(bucketName *string, obj *s3.Object) {
+// countObject collects the statistics of an object of the bucket in the given
+// counter
+func countObject(currentReport *bucketCounter, bucketName *string, obj *s3.Object) {
 	lastChar := (*obj.Key)[len(*obj.Key)-1:]
 	// Skips folders
 	if lastChar != "/" {
 		ext := path.Ext(*obj.Key)
 		lastMod := (*obj.LastModified).UTC()
-		root := (strings.Split(*obj.Key, "/"))[0]
-		reportMutex.Lock()
-		currentReport := report[*bucketName]
-		reportMutex.Unlock()
-		currentReport.increment(*obj.Size, *obj.StorageClass, ext, root, lastMod, true)
+		prefixes := keyPrefixes(*obj.Key, *prefixDepth)
+		currentReport.incrementPrefixes(*obj.Size, *obj.StorageClass, ext, prefixes, lastMod)
+		if strings.Contains(*obj.Key, "/") {
+			currentReport.markFolder(prefixes[0])
+		}
+		if collectFacts {
+			currentReport.countFact(factKey{prefixes[0], *obj.StorageClass, ext, monthKey(lastMod)}, *obj.Size)
+		}
+		if *topCount > 0 {
+			currentReport.countTop(&topEntry{
+				Bucket:       *bucketName,
+				Key:          decodeKey(*obj.Key),
+				Size:         *obj.Size,
+				StorageClass: *obj.StorageClass,
+				LastModified: lastMod,
+			}, *topCount)
+		}
+		if dupIndex != nil {
+			dupIndex.add(*bucketName, obj)
+		}
+		if objSampler != nil {
+			objSampler.add(*bucketName, decodeKey(*obj.Key), *obj.Size)
+		}
 	}
 }
 
-// reportCsv export the current state of the report to a csv file
-func reportCsv(filePath, reportType string) {
-	f, errF := os.Create(filePath)
-	if errF != nil {
-		log.Fatalf("os.Create returned: %s", errF)
+// decodeKey returns the key of an object listed with the url encoding type, or
+// read from an inventory, as stored in the bucket. The key is returned as is
+// if it cannot be decoded.
+func decodeKey(key string) string {
+	if k, err := url.QueryUnescape(key); err == nil {
+		return k
 	}
-	defer f.Close()
+	return key
+}
 
-	csvWriter := csv.NewWriter(f)
-	if reportType == "summary" || reportType == "full" {
-		if err := reportSizing(csvWriter, report, "bucket name"); err != nil {
-			log.Fatalf("reportSizing returned: %s", err)
-		}
+// keyPrefixes returns the folders of a key down to the given depth. A file at
+// the root of the bucket is its own root folder.
+func keyPrefixes(key string, depth int) []string {
+	parts := strings.Split(key, "/")
+	if len(parts) > 1 {
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return parts
+}
 
-		if err := reportDateSummary(csvWriter, report); err != nil {
-			log.Fatalf("reportDateSummary returned: %s", err)
+// getBuckets returns the list of buckets to scan: the source buckets of the
+// inventories if any, the buckets given with -buckets or all the buckets
+func getBuckets(svc s3iface.S3API, manifests map[string]*inventoryManifest) ([]*string, error) {
+	var buckets []*string
+	switch {
+	case len(manifests) > 0:
+		for b := range manifests {
+			bucket := b
+			if len(*bucketsList) > 0 && !stringInSlice(bucket, strings.Split(*bucketsList, ",")) {
+				continue
+			}
+			buckets = append(buckets, &bucket)
+		}
+	case len(*bucketsList) <= 0:
+		return getBucketsList(svc)
+	default:
+		for _, b := range strings.Split(*bucketsList, ",") {
+			bucket := b
+			buckets = append(buckets, &bucket)
 		}
 	}
+	return buckets, nil
+}
 
-	if reportType == "details" || reportType == "full" {
-		for bucket, stats := range report {
-			if err := reportByRoot(csvWriter, bucket, stats); err != nil {
-				log.Fatalf("reportByRoot returned: %s", err)
-			}
+// scanBuckets gathers the statistics of the given buckets in the report,
+// either by listing their objects or by reading their inventory. The buckets
+// excluded or already done are skipped. The failures are recorded in the
+// progress.
+func scanBuckets(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, buckets []*string, manifests map[string]*inventoryManifest, progress *scanProgress, opts *reportOptions, pools *scanOptions) {
+	var wg, wgBucket, wgShard sync.WaitGroup
+	pageChan := make(chan *s3.ListObjectsV2Output, pools.pageQueue)
+	bucketsChan := make(chan *string, 1000)
+	manifestsChan := make(chan *inventoryManifest, 1000)
+	shardsChan := make(chan *shardJob, 1000)
+	// Setup a worker group
+	for i := 0; i < pools.pageWorkers; i++ {
+		wg.Add(1)
+		go processPage(pageChan, &wg, progress)
+	}
+	// The metadata of the buckets read from an inventory is only fetched when
+	// the report needs it or the objects are sampled
+	metadata := opts.pricing != nil || opts.lifecycle || opts.audit || objSampler != nil
+	for i := 0; i < pools.bucketWorkers; i++ {
+		wgBucket.Add(1)
+		if len(manifests) > 0 {
+			go inventoryWorker(sess, sessionRegion, svc, metadata, manifestsChan, &wgBucket, pageChan, progress)
+		} else {
+			go bucketWorker(sess, sessionRegion, svc, bucketsChan, &wgBucket, pageChan, shardsChan, progress, pools)
+		}
+	}
+	if len(pools.shardBuckets) > 0 {
+		for i := 0; i < pools.shardWorkers; i++ {
+			wgShard.Add(1)
+			go shardWorker(shardsChan, &wgShard, pageChan, progress)
+		}
+	}
 
-			if err := reportUint64(csvWriter, stats.storageCount, fmt.Sprintf("Repartition of files for bucket %s by storage class", bucket), []string{"Storage class", "Number of files"}); err != nil {
-				log.Fatalf("Storage class reportUint64 returned: %s", err)
-			}
-			if err := reportUint64(csvWriter, stats.extensionCount, fmt.Sprintf("Repartition of files for bucket %s by extension", bucket), []string{"Extension", "Number of files"}); err != nil {
-				log.Fatalf("Extension reportUint64 returned: %s", err)
+	skipBuckets := strings.Split(*bucketsExclude, ",")
+BUCKETS_LOOP:
+	for _, b := range buckets {
+		for _, skip := range skipBuckets {
+			if *b == skip {
+				continue BUCKETS_LOOP
 			}
-			if err := reportUint64(csvWriter, stats.dateCount, fmt.Sprintf("Repartition of files for bucket %s by month", bucket), []string{"Month", "Number of files"}); err != nil {
-				log.Fatalf("Monthly reportUint64 returned: %s", err)
+		}
+		if progress.isDone(*b) {
+			if objSampler == nil || !objSampler.waiting(*b) {
+				log.Printf("Bucket %s already scanned, skipping it", *b)
+				continue
 			}
+			log.Printf("Bucket %s already scanned, sampling the objects left", *b)
+		}
+		reportMutex.Lock()
+		if _, ok := report[*b]; !ok {
+			report[*b] = newBucketCounter()
 		}
+		reportMutex.Unlock()
+		if m, ok := manifests[*b]; ok {
+			manifestsChan <- m
+			continue
+		}
+		bucketsChan <- b
 	}
-	csvWriter.Flush()
+	close(bucketsChan)
+	close(manifestsChan)
+
+	wgBucket.Wait()
+	close(shardsChan)
+	wgShard.Wait()
+	close(pageChan)
+	wg.Wait()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		runDiff(os.Args[2:])
+		return
+	}
 	envflag.Parse()
 
 	if *reportType != "summary" && *reportType != "details" && *reportType != "full" {
 		log.Fatal("Incorrect report-type specified. Allowed values:\n - summary: only size and age global report\n - details: only details tables for each bucket\n - full: summary + details")
 	}
+	if *reportFormat != "csv" && *reportFormat != "json" && *reportFormat != "markdown" {
+		log.Fatal("Incorrect report-format specified. Allowed values: csv, json, markdown")
+	}
+	if len(*lifecycleDir) > 0 && !*lifecycle {
+		log.Fatal("-lifecycle-policy-dir requires -lifecycle")
+	}
+	if *prefixDepth < 1 || *prefixTop < 0 {
+		log.Fatal("-prefix-depth must be at least 1 and -prefix-top cannot be negative")
+	}
+	if *duplicatesTop < 0 {
+		log.Fatal("-duplicates-top cannot be negative")
+	}
+	if *topCount < 0 {
+		log.Fatal("-top-objects cannot be negative")
+	}
+	multiAccount := len(*roleARNs) > 0 || len(*orgRoleName) > 0
+	if len(*roleARNs) > 0 && len(*orgRoleName) > 0 {
+		log.Fatal("-role-arns and -org-role-name cannot be used together")
+	}
+	if multiAccount && (*exporter || len(*inventories) > 0) {
+		log.Fatal("-role-arns and -org-role-name cannot be used with -exporter or -inventory-manifests")
+	}
+	if *exporter && (*resume || *duplicates || *audit) {
+		log.Fatal("-exporter cannot be used with -resume, -duplicates or -audit")
+	}
+	if len(*sqlitePath) > 0 && len(*dbHost) > 0 {
+		log.Fatal("-sqlite-path and -db-host cannot be used together")
+	}
+	collectFacts = len(*sqlitePath) > 0 || len(*dbHost) > 0
+	if *exporter && collectFacts {
+		log.Fatal("-exporter cannot be used with -sqlite-path or -db-host")
+	}
+	if *exporter && (*scanInterval <= 0 || *exporterRoots < 0) {
+		log.Fatal("-scan-interval must be positive and -exporter-max-roots cannot be negative")
+	}
+	if *maxRetries < 0 || *retryDelay < 0 {
+		log.Fatal("-max-retries and -retry-delay cannot be negative")
+	}
+	throttleRetries = retryPolicy{maxRetries: *maxRetries, delay: *retryDelay}
+	if *sampleRate < 0 || *sampleRate > 1 || *sampleRPS < 0 || *sampleWorkers < 1 {
+		log.Fatal("-sample-rate must be between 0 and 1, -sample-rps cannot be negative and -sample-workers must be at least 1")
+	}
+	if *exporter && *sampleRate > 0 {
+		log.Fatal("-exporter cannot be used with -sample-rate")
+	}
+	if *bucketWorkers < 1 || *shardWorkers < 1 || *pageWorkers < 1 || *pageQueue < 1 {
+		log.Fatal("-bucket-workers, -shard-workers, -page-workers and -page-queue must be at least 1")
+	}
+	pools := scanOptions{
+		bucketWorkers:  *bucketWorkers,
+		shardWorkers:   *shardWorkers,
+		pageWorkers:    *pageWorkers,
+		pageQueue:      *pageQueue,
+		shardDelimiter: *shardDelimiter,
+	}
+	if len(*shardBuckets) > 0 {
+		if *versions || len(*inventories) > 0 {
+			log.Fatal("-shard-buckets cannot be used with -versions or -inventory-manifests")
+		}
+		if len(*shardDelimiter) == 0 {
+			log.Fatal("-shard-delimiter cannot be empty")
+		}
+		pools.shardBuckets = strings.Split(*shardBuckets, ",")
+	}
+	opts := reportOptions{lifecycle: *lifecycle, lifecycleMinRatio: *lifecycleRatio, lifecycleMinBytes: *lifecycleSize, prefixDepth: *prefixDepth, prefixTop: *prefixTop, versions: *versions, audit: *audit, top: *topCount, sampling: *sampleRate > 0}
+	var err error
+	rules := &filterFile{}
+	if len(*filtersPath) > 0 {
+		if rules, err = loadFilters(*filtersPath); err != nil {
+			log.Fatalf("Error while loading the filters %s: %s\n", *filtersPath, err)
+		}
+	}
+	// The filter flags are added to the default rule set of the file
+	if len(*includeKeys) > 0 {
+		rules.Include = append(rules.Include, strings.Split(*includeKeys, ",")...)
+	}
+	if len(*excludeKeys) > 0 {
+		rules.Exclude = append(rules.Exclude, strings.Split(*excludeKeys, ",")...)
+	}
+	if *minSize != 0 {
+		rules.MinSize = *minSize
+	}
+	if *maxSize != 0 {
+		rules.MaxSize = *maxSize
+	}
+	if len(*modifiedAfter) > 0 {
+		rules.ModifiedAfter = *modifiedAfter
+	}
+	if len(*modifiedBefore) > 0 {
+		rules.ModifiedBefore = *modifiedBefore
+	}
+	if keyFilters, err = newFilterSet(rules); err != nil {
+		log.Fatalf("Invalid filters: %s\n", err)
+	}
+	opts.filters = keyFilters
+	bands := &bandConfig{}
+	if len(*bandsPath) > 0 {
+		if bands, err = loadBands(*bandsPath); err != nil {
+			log.Fatalf("Error while loading the bands %s: %s\n", *bandsPath, err)
+		}
+	}
+	// The band flags replace the ones of the file
+	if len(*sizeBandsList) > 0 {
+		bands.SizeBands = strings.Split(*sizeBandsList, ",")
+	}
+	if len(*ageBandsList) > 0 {
+		bands.AgeBands = strings.Split(*ageBandsList, ",")
+	}
+	if len(*asOfDate) > 0 {
+		bands.AsOf = *asOfDate
+	}
+	if err = bands.apply(); err != nil {
+		log.Fatalf("Invalid bands: %s\n", err)
+	}
+	if len(*pricingPath) > 0 {
+		if opts.pricing, err = loadPricing(*pricingPath); err != nil {
+			log.Fatalf("Error while loading the pricing table %s: %s\n", *pricingPath, err)
+		}
+	}
 
 	// PROFILING CPU BLOCK INIT
 	if *cpuprofile != "" {
@@ -185,63 +561,195 @@ func main() {
 	}
 	// PROFILING CPU BLOCK END
 
+	scanStart := time.Now().UTC()
+	progress := newScanProgress()
+	dupResumeDir := ""
+	var sampleResume []*sampleJob
+	if *resume {
+		cp, err := loadCheckpoint(*checkpointPath)
+		if err != nil {
+			log.Fatalf("Error while loading the checkpoint %s: %s\n", *checkpointPath, err)
+		}
+		if err = resumeBands(cp.Bands); err != nil {
+			log.Fatalf("Cannot resume from %s: %s\n", *checkpointPath, err)
+		}
+		report = progress.restore(cp)
+		dupResumeDir = cp.DuplicatesDir
+		sampleResume = cp.SampleJobs
+		log.Printf("Resuming the scan from %s: %d buckets already done", *checkpointPath, len(cp.Done))
+	}
 	if report == nil {
 		report = make(map[string]*bucketCounter)
 	}
+	if !bands.isDefault() {
+		opts.bands = currentBands()
+	}
+	if *duplicates {
+		var err error
+		if len(dupResumeDir) > 0 {
+			if dupIndex, err = openDuplicateIndex(dupResumeDir); err != nil {
+				log.Fatalf("Error while opening the duplicate index in %s: %s\n", dupResumeDir, err)
+			}
+		} else {
+			if *resume {
+				log.Printf("The checkpoint %s has no duplicate index, the buckets already scanned are not part of the duplicates", *checkpointPath)
+			}
+			if dupIndex, err = newDuplicateIndex(*duplicatesDir); err != nil {
+				log.Fatalf("Error while creating the duplicate index in %s: %s\n", *duplicatesDir, err)
+			}
+		}
+	}
+	if *sampleRate > 0 {
+		objSampler = newObjectSampler(*sampleRate, *sampleRPS, *sampleWorkers)
+		objSampler.restore(sampleResume)
+	}
 	sess := session.Must(session.NewSessionWithOptions(session.Options{
 		SharedConfigState: session.SharedConfigEnable,
 	}))
 
-	svc := s3.New(sess)
-	var buckets []*string
-	if len(*bucketsList) <= 0 {
-		var err error
-		if buckets, err = getBucketsList(svc); err != nil {
-			log.Fatalf("Error while retrieving the buckets list: %s\n", err)
+	svc := newS3Client(sess)
+	manifests := make(map[string]*inventoryManifest)
+	for _, loc := range strings.Split(*inventories, ",") {
+		if len(loc) == 0 {
+			continue
 		}
-	} else {
-		for _, b := range strings.Split(*bucketsList, ",") {
-			bucket := b
-			buckets = append(buckets, &bucket)
+		m, err := loadManifest(sess, *sess.Config.Region, svc, loc)
+		if err != nil {
+			log.Fatalf("Error while loading the inventory manifest %s: %s\n", loc, err)
+		}
+		if _, ok := manifests[m.SourceBucket]; ok {
+			log.Fatalf("Several inventory manifests given for bucket %s\n", m.SourceBucket)
 		}
+		manifests[m.SourceBucket] = m
 	}
 
-	reportMutex = &sync.Mutex{}
-	var wg, wgBucket sync.WaitGroup
-	pageChan := make(chan *s3.ListObjectsV2Output, 100)
-	bucketsChan := make(chan *string, 1000)
-	// Setup a worker group
-	for i := 0; i < 2; i++ {
-		wg.Add(1)
-		go processPage(pageChan, &wg)
+	if len(*roleARNs) > 0 {
+		opts.accounts = []*awsAccount{}
+		for _, arn := range strings.Split(*roleARNs, ",") {
+			a, err := accountFromRole(arn)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.accounts = append(opts.accounts, a)
+		}
 	}
-	for i := 0; i < 8; i++ {
-		wgBucket.Add(1)
-		go bucketWorker(sess, *sess.Config.Region, svc, bucketsChan, &wgBucket, pageChan)
+	if len(*orgRoleName) > 0 {
+		var err error
+		if opts.accounts, err = listOrgAccounts(organizations.New(sess), *orgRoleName); err != nil {
+			log.Fatalf("Error while listing the accounts of the organization: %s\n", err)
+		}
+		log.Printf("%d active accounts found in the organization", len(opts.accounts))
 	}
 
-	skipBuckets := strings.Split(*bucketsExclude, ",")
-BUCKETS_LOOP:
-	for _, b := range buckets {
-		for _, skip := range skipBuckets {
-			if *b == skip {
-				continue BUCKETS_LOOP
-			}
+	reportMutex = &sync.Mutex{}
+	if *exporter {
+		e := newExporter(*exporterRoots)
+		runExporter(*listenAddress, *scanInterval, e, func() {
+			e.scan(sess, *sess.Config.Region, svc, manifests, &opts, &pools)
+		})
+		return
+	}
+
+	stopCheckpoints := make(chan struct{})
+	if len(*checkpointPath) > 0 {
+		if *checkpointFreq > 0 {
+			go checkpointLoop(progress, *checkpointPath, *checkpointFreq, stopCheckpoints)
 		}
-		if _, ok := report[*b]; !ok {
-			reportMutex.Lock()
-			report[*b] = newBucketCounter()
-			reportMutex.Unlock()
+		// Saves the progress before exiting when the process is interrupted
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-sigChan
+			log.Printf("Received %s, saving the checkpoint before exiting", sig)
+			if err := saveCheckpoint(*checkpointPath, progress.checkpoint(report)); err != nil {
+				log.Fatalf("Error while saving the checkpoint to %s: %s\n", *checkpointPath, err)
+			}
+			log.Fatalf("Scan interrupted. Use the -resume flag to continue it.")
+		}()
+	}
+
+	if opts.accounts != nil {
+		scanAccounts(assumeRoleClient(sess, *roleSession), *sess.Config.Region, opts.accounts, progress, &opts, &pools)
+	} else {
+		buckets, err := getBuckets(svc, manifests)
+		if err != nil {
+			log.Fatalf("Error while retrieving the buckets list: %s\n", err)
 		}
-		bucketsChan <- b
+		scanBuckets(sess, *sess.Config.Region, svc, buckets, manifests, progress, &opts, &pools)
 	}
-	close(bucketsChan)
+	if objSampler != nil {
+		// Waits for the samples still queued to be part of the last
+		// checkpoint and of the report
+		objSampler.close()
+	}
+	close(stopCheckpoints)
 
-	wgBucket.Wait()
-	close(pageChan)
-	wg.Wait()
+	// The buckets that could not be fully scanned are listed at the end of
+	// the report. The checkpoint is kept so that their scan can be continued
+	// with -resume once the cause of the errors is fixed.
+	failures := progress.failures()
+	for b, err := range failures {
+		log.Printf("Bucket %s skipped (%s): %s\n", b, errorClass(err), skipReason(err))
+	}
+	opts.skipped = failures
+	keepCheckpoint := len(failures) > 0 && len(*checkpointPath) > 0
+	if keepCheckpoint {
+		if err := saveCheckpoint(*checkpointPath, progress.checkpoint(report)); err != nil {
+			log.Fatalf("Error while saving the checkpoint to %s: %s\n", *checkpointPath, err)
+		}
+		log.Printf("%d buckets could not be fully scanned. Use the -resume flag to continue their scan from %s", len(failures), *checkpointPath)
+	}
+	partial := len(failures) > 0
 
-	reportCsv(*reportPath, *reportType)
+	if dupIndex != nil {
+		var err error
+		if opts.duplicates, err = dupIndex.analyze(*duplicatesTop); err != nil {
+			log.Fatalf("Error while looking for duplicates in %s: %s\n", dupIndex.dir, err)
+		}
+	}
+	if err := writeReport(*reportPath, *reportFormat, *reportType, report, &opts); err != nil {
+		log.Fatalf("Error while writing the report to %s: %s\n", *reportPath, err)
+	}
+	for _, a := range opts.accounts {
+		if a.err != nil {
+			log.Printf("The buckets of account %s could not be listed, it is missing from the report: %s\n", a.id, a.err)
+			partial = true
+		}
+	}
+	if len(*snapshotPath) > 0 {
+		if err := saveSnapshot(*snapshotPath, newRunSnapshot(report, scanStart)); err != nil {
+			log.Fatalf("Error while saving the snapshot to %s: %s\n", *snapshotPath, err)
+		}
+	}
+	if collectFacts {
+		db, err := openDatabase(*sqlitePath, *dbHost, *dbUser, *dbPassword, *dbName)
+		if err == nil {
+			err = exportDatabase(db, report)
+			db.Close()
+		}
+		if err != nil {
+			log.Fatalf("Error while exporting the statistics to the database: %s\n", err)
+		}
+	}
+	if len(*lifecycleDir) > 0 {
+		if err := writeLifecyclePolicies(*lifecycleDir, report, opts.lifecycleMinRatio, opts.lifecycleMinBytes, opts.pricing); err != nil {
+			log.Fatalf("Error while writing the lifecycle configurations to %s: %s\n", *lifecycleDir, err)
+		}
+	}
+	if len(*checkpointPath) > 0 && !keepCheckpoint {
+		if err := os.Remove(*checkpointPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error while removing the checkpoint %s: %s\n", *checkpointPath, err)
+		}
+	}
+	if dupIndex != nil {
+		dupIndex.close()
+		// The index is kept along with the checkpoint to resume the scan
+		if !keepCheckpoint {
+			if err := dupIndex.remove(); err != nil {
+				log.Printf("Error while removing the duplicate index from %s: %s\n", dupIndex.dir, err)
+			}
+		}
+	}
 
 	// MEMORY PROFILING BLOCK INIT
 	if *memprofile != "" {
@@ -256,4 +764,11 @@ BUCKETS_LOOP:
 		f.Close()
 	}
 	// MEMORY PROFILING BLOCK END
+
+	if partial {
+		log.Printf("The report is partial, exiting with code %d", exitPartial)
+		// os.Exit does not run the deferred functions
+		pprof.StopCPUProfile()
+		os.Exit(exitPartial)
+	}
 }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSizeBands and defaultAgeBands are the bands used when none is
+// configured
+var (
+	defaultSizeBands = []string{"1KB", "10KB", "100KB", "1MB", "10MB", "100MB", "1GB", "10GB", "100GB"}
+	defaultAgeBands  = []string{"1m", "2m", "3m", "6m", "9m", "1y", "2y", "3y", "4y", "5y"}
+)
+
+var (
+	// now is the date the age of the objects is computed from: the start of
+	// the scan or the date given with -as-of
+	now time.Time
+	// fixedAsOf is true when now has been given by the user and must not be
+	// moved to the start of each scan
+	fixedAsOf bool
+	// sizeBounds are the sizes in bytes at which each size range but the
+	// first one starts, in increasing order
+	sizeBounds []int64
+	// ageBounds are the ages at which each date range but the first one
+	// starts, in increasing order
+	ageBounds []ageBound
+	// dateLimits are the dates corresponding to ageBounds as of now
+	dateLimits []time.Time
+	// sizeRangeLabels lists the labels of the size ranges from the smallest
+	// to the biggest
+	sizeRangeLabels []string
+	// dateRangeLabels lists the labels of the date ranges from the most
+	// recent to the oldest
+	dateRangeLabels []string
+)
+
+func init() {
+	if err := (&bandConfig{}).apply(); err != nil {
+		panic(err)
+	}
+}
+
+// sizeUnits lists the units of the sizes of the bands, from the biggest one
+var sizeUnits = []struct {
+	name  string
+	bytes int64
+}{{"PB", 1 << 50}, {"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// parseSize parses a size of the form 512B, 10KB, 1GB... A size without unit
+// is a number of bytes.
+func parseSize(s string) (int64, error) {
+	v, mult := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.name) {
+			v, mult = strings.TrimSuffix(v, u.name), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("invalid size %q, expecting a positive number of B, KB, MB, GB, TB or PB", s)
+	}
+	return n * mult, nil
+}
+
+// formatSize writes a size with the biggest unit it is a whole number of
+func formatSize(n int64) string {
+	for _, u := range sizeUnits {
+		if n%u.bytes == 0 {
+			return strconv.FormatInt(n/u.bytes, 10) + u.name
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+// ageUnits gives the name and the approximate number of days of the units of
+// the ages of the bands
+var ageUnits = map[string]struct {
+	name string
+	days float64
+}{
+	"d": {"day", 1},
+	"w": {"week", 7},
+	"m": {"month", 365.25 / 12},
+	"y": {"year", 365.25},
+}
+
+// ageBound is an age of n days, weeks, months or years
+type ageBound struct {
+	n    int
+	unit string
+}
+
+// parseAge parses an age of the form 7d, 2w, 3m or 1y
+func parseAge(s string) (ageBound, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	if len(v) > 1 {
+		unit := v[len(v)-1:]
+		if _, ok := ageUnits[unit]; ok {
+			if n, err := strconv.Atoi(v[:len(v)-1]); err == nil && n > 0 {
+				return ageBound{n, unit}, nil
+			}
+		}
+	}
+	return ageBound{}, fmt.Errorf("invalid age %q, expecting a positive number of days (d), weeks (w), months (m) or years (y)", s)
+}
+
+func (a ageBound) String() string {
+	return strconv.Itoa(a.n) + a.unit
+}
+
+// label returns the age in words, such as 3 month
+func (a ageBound) label() string {
+	return fmt.Sprintf("%d %s", a.n, ageUnits[a.unit].name)
+}
+
+// days returns the approximate number of days of the age, used to order them
+func (a ageBound) days() float64 {
+	return float64(a.n) * ageUnits[a.unit].days
+}
+
+// in returns the age as a number of the given unit. The second value is false
+// if it is not a whole number of it.
+func (a ageBound) in(unit string) (int, bool) {
+	switch {
+	case a.unit == unit:
+		return a.n, true
+	case a.unit == "w" && unit == "d":
+		return 7 * a.n, true
+	case a.unit == "y" && unit == "m":
+		return 12 * a.n, true
+	}
+	return 0, false
+}
+
+// since returns the date at which an object is of that age as of the given
+// date
+func (a ageBound) since(asOf time.Time) time.Time {
+	switch a.unit {
+	case "d":
+		return asOf.AddDate(0, 0, -a.n)
+	case "w":
+		return asOf.AddDate(0, 0, -7*a.n)
+	case "m":
+		return asOf.AddDate(0, -a.n, 0)
+	}
+	return asOf.AddDate(-a.n, 0, 0)
+}
+
+// sizeLabels returns the labels of the size ranges delimited by the bounds,
+// such as <1KB, 1KB-10KB and 10KB+
+func sizeLabels(bounds []int64) []string {
+	res := []string{"<" + formatSize(bounds[0])}
+	for i := 1; i < len(bounds); i++ {
+		res = append(res, formatSize(bounds[i-1])+"-"+formatSize(bounds[i]))
+	}
+	return append(res, formatSize(bounds[len(bounds)-1])+"+")
+}
+
+// ageLabels returns the labels of the date ranges delimited by the bounds,
+// such as <1 month, 1-2 month, 7 day-1 month and >5 year
+func ageLabels(bounds []ageBound) []string {
+	res := []string{"<" + bounds[0].label()}
+	for i := 1; i < len(bounds); i++ {
+		lo, hi := bounds[i-1], bounds[i]
+		if n, ok := hi.in(lo.unit); ok {
+			res = append(res, fmt.Sprintf("%d-%d %s", lo.n, n, ageUnits[lo.unit].name))
+		} else {
+			res = append(res, lo.label()+"-"+hi.label())
+		}
+	}
+	return append(res, ">"+bounds[len(bounds)-1].label())
+}
+
+// setAsOf sets the date the age of the objects is computed from
+func setAsOf(asOf time.Time) {
+	now = asOf.UTC()
+	dateLimits = make([]time.Time, len(ageBounds))
+	for i, a := range ageBounds {
+		dateLimits[i] = a.since(now)
+	}
+}
+
+// bandConfig is the definition of the size and age ranges of the reports, as
+// written in the bands file. Empty values are replaced by the default ones.
+type bandConfig struct {
+	SizeBands []string `json:"size_bands,omitempty" yaml:"size_bands"`
+	AgeBands  []string `json:"age_bands,omitempty" yaml:"age_bands"`
+	// AsOf is a date or a RFC3339 timestamp
+	AsOf string `json:"as_of,omitempty" yaml:"as_of"`
+}
+
+// apply checks the configuration and sets the ranges the objects are counted
+// in. It must be called before any counter is created.
+func (c *bandConfig) apply() error {
+	sizeBands, ageBands := c.SizeBands, c.AgeBands
+	if len(sizeBands) == 0 {
+		sizeBands = defaultSizeBands
+	}
+	if len(ageBands) == 0 {
+		ageBands = defaultAgeBands
+	}
+	sizes := make([]int64, len(sizeBands))
+	for i, s := range sizeBands {
+		n, err := parseSize(s)
+		if err != nil {
+			return err
+		}
+		if i > 0 && n <= sizes[i-1] {
+			return fmt.Errorf("size bands must be in increasing order, got %s after %s", s, sizeBands[i-1])
+		}
+		sizes[i] = n
+	}
+	ages := make([]ageBound, len(ageBands))
+	for i, s := range ageBands {
+		a, err := parseAge(s)
+		if err != nil {
+			return err
+		}
+		if i > 0 && a.days() <= ages[i-1].days() {
+			return fmt.Errorf("age bands must be in increasing order, got %s after %s", s, ageBands[i-1])
+		}
+		ages[i] = a
+	}
+	asOf := time.Now().Truncate(time.Second)
+	if len(c.AsOf) > 0 {
+		var err error
+		if asOf, err = parseFilterDate(c.AsOf); err != nil {
+			return err
+		}
+	}
+	sizeBounds, sizeRangeLabels = sizes, sizeLabels(sizes)
+	ageBounds, dateRangeLabels = ages, ageLabels(ages)
+	fixedAsOf = len(c.AsOf) > 0
+	setAsOf(asOf)
+	return nil
+}
+
+// isDefault returns true if the configuration does not change anything
+func (c *bandConfig) isDefault() bool {
+	return len(c.SizeBands) == 0 && len(c.AgeBands) == 0 && len(c.AsOf) == 0
+}
+
+// currentBands returns the configuration of the ranges in use, with the date
+// the ages are computed from
+func currentBands() *bandConfig {
+	c := &bandConfig{AsOf: now.Format(time.RFC3339)}
+	for _, n := range sizeBounds {
+		c.SizeBands = append(c.SizeBands, formatSize(n))
+	}
+	for _, a := range ageBounds {
+		c.AgeBands = append(c.AgeBands, a.String())
+	}
+	return c
+}
+
+// sameRanges returns true if both configurations define the same ranges,
+// whatever the date the ages are computed from
+func (c *bandConfig) sameRanges(o *bandConfig) bool {
+	return strings.Join(c.SizeBands, ",") == strings.Join(o.SizeBands, ",") && strings.Join(c.AgeBands, ",") == strings.Join(o.AgeBands, ",")
+}
+
+// resumeBands checks that the ranges saved in a checkpoint are the ones in
+// use and moves the date the ages are computed from to the one of the
+// interrupted scan. The checkpoints saved before the ranges could be
+// configured have no ranges and are not checked.
+func resumeBands(saved *bandConfig) error {
+	if saved == nil {
+		return nil
+	}
+	if cur := currentBands(); !saved.sameRanges(cur) {
+		return fmt.Errorf("the scan was started with the size bands %s and the age bands %s, got %s and %s",
+			strings.Join(saved.SizeBands, ","), strings.Join(saved.AgeBands, ","), strings.Join(cur.SizeBands, ","), strings.Join(cur.AgeBands, ","))
+	}
+	asOf, err := time.Parse(time.RFC3339, saved.AsOf)
+	if err != nil {
+		return err
+	}
+	if fixedAsOf && !asOf.Equal(now) {
+		return fmt.Errorf("the scan was started as of %s, got %s", saved.AsOf, now.Format(time.RFC3339))
+	}
+	setAsOf(asOf)
+	return nil
+}
+
+// loadBands reads the configuration of the ranges from a yaml or json file
+func loadBands(filePath string) (*bandConfig, error) {
+	c := bandConfig{}
+	if err := loadConfigFile(filePath, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// bandsTable builds the table of the ranges used by the report. Returns nil if
+// the default ranges are used.
+func bandsTable(c *bandConfig) *reportTable {
+	if c == nil {
+		return nil
+	}
+	return &reportTable{
+		title:   "Size and age ranges",
+		headers: []string{"Setting", "Value"},
+		rows: [][]string{
+			{"as of", c.AsOf},
+			{"size bands", strings.Join(c.SizeBands, ",")},
+			{"age bands", strings.Join(c.AgeBands, ",")},
+		},
+	}
+}
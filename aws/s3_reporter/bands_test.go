@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBands(t *testing.T) {
+	for _, d := range []struct {
+		input    string
+		expected int64
+		label    string
+	}{
+		{"512", 512, "512B"},
+		{"512B", 512, "512B"},
+		{"1kb", 1024, "1KB"},
+		{"1536B", 1536, "1536B"},
+		{"100GB", 107374182400, "100GB"},
+		{"2048MB", 2147483648, "2GB"},
+	} {
+		n, err := parseSize(d.input)
+		if err != nil || n != d.expected {
+			t.Errorf("%s: expecting %d got %d, %v", d.input, d.expected, n, err)
+		}
+		if l := formatSize(n); l != d.label {
+			t.Errorf("%s: expecting %s got %s", d.input, d.label, l)
+		}
+	}
+	for _, s := range []string{"", "KB", "-1KB", "0", "1.5MB", "10000000PB"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("Expecting an error for size %q", s)
+		}
+	}
+
+	for _, s := range []string{"7d", "2w", "3M", "1y"} {
+		a, err := parseAge(s)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", s, err)
+		}
+		if a.String() != s && a.String() != "3m" {
+			t.Errorf("%s: got %s", s, a)
+		}
+	}
+	for _, s := range []string{"", "d", "0d", "1h", "-1y", "1.5y"} {
+		if _, err := parseAge(s); err == nil {
+			t.Errorf("Expecting an error for age %q", s)
+		}
+	}
+}
+
+func TestBandLabels(t *testing.T) {
+	// The default bands give the historical labels
+	expectedSizes := []string{"<1KB", "1KB-10KB", "10KB-100KB", "100KB-1MB", "1MB-10MB", "10MB-100MB", "100MB-1GB", "1GB-10GB", "10GB-100GB", "100GB+"}
+	if !reflect.DeepEqual(sizeRangeLabels, expectedSizes) {
+		t.Errorf("Expecting %v got %v", expectedSizes, sizeRangeLabels)
+	}
+	expectedAges := []string{"<1 month", "1-2 month", "2-3 month", "3-6 month", "6-9 month", "9-12 month", "1-2 year", "2-3 year", "3-4 year", "4-5 year", ">5 year"}
+	if !reflect.DeepEqual(dateRangeLabels, expectedAges) {
+		t.Errorf("Expecting %v got %v", expectedAges, dateRangeLabels)
+	}
+
+	expectedAges = []string{"<1 day", "1-7 day", "1 week-1 month", "1-12 month", ">1 year"}
+	if l := ageLabels([]ageBound{{1, "d"}, {1, "w"}, {1, "m"}, {1, "y"}}); !reflect.DeepEqual(l, expectedAges) {
+		t.Errorf("Expecting %v got %v", expectedAges, l)
+	}
+	expectedSizes = []string{"<128B", "128B-1KB", "1KB+"}
+	if l := sizeLabels([]int64{128, 1024}); !reflect.DeepEqual(l, expectedSizes) {
+		t.Errorf("Expecting %v got %v", expectedSizes, l)
+	}
+}
+
+func TestCustomBands(t *testing.T) {
+	defer (&bandConfig{}).apply()
+	for n, c := range []*bandConfig{
+		{SizeBands: []string{"1KB", "1KB"}},
+		{SizeBands: []string{"1MB", "1KB"}},
+		{AgeBands: []string{"1m", "4w"}},
+		{AgeBands: []string{"1y", "12m"}},
+		{AgeBands: []string{"1x"}},
+		{AsOf: "yesterday"},
+	} {
+		if err := c.apply(); err == nil {
+			t.Errorf("#%d: expecting an error for %+v", n, c)
+		}
+	}
+
+	c := &bandConfig{SizeBands: []string{"128B", "1KB"}, AgeBands: []string{"1d", "7d", "1y"}, AsOf: "2018-03-16"}
+	if err := c.apply(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !now.Equal(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC)) || !fixedAsOf {
+		t.Errorf("Expecting the ages computed as of 2018-03-16 got %s", now)
+	}
+	for _, d := range []struct {
+		date     time.Time
+		expected string
+	}{
+		{time.Date(2018, 3, 15, 12, 0, 0, 0, time.UTC), "<1 day"},
+		{time.Date(2018, 3, 14, 23, 0, 0, 0, time.UTC), "1-7 day"},
+		{time.Date(2018, 3, 8, 23, 0, 0, 0, time.UTC), "7 day-1 year"},
+		{time.Date(2017, 3, 15, 0, 0, 0, 0, time.UTC), ">1 year"},
+	} {
+		if r := getDateRange(d.date); r != d.expected {
+			t.Errorf("%s: expecting %s got %s", d.date, d.expected, r)
+		}
+	}
+
+	ctr := newBucketCounter()
+	ctr.increment(100, "STANDARD", ".gz", "logs", time.Date(2018, 3, 15, 12, 0, 0, 0, time.UTC), false)
+	ctr.increment(2000, "STANDARD", ".gz", "logs", time.Date(2016, 3, 15, 0, 0, 0, 0, time.UTC), false)
+	expected := map[string]uint64{"<128B": 1, "128B-1KB": 0, "1KB+": 1}
+	if !reflect.DeepEqual(ctr.sizeCount, expected) {
+		t.Errorf("Expecting %v got %v", expected, ctr.sizeCount)
+	}
+	if b := ctr.olderThan("STANDARD", ageBound{1, "y"}); b != 2000 {
+		t.Errorf("Expecting 2000 bytes older than 1 year got %d", b)
+	}
+	// The range 7 day-1 year is only partly older than 3 months
+	if b := ctr.olderThan("STANDARD", ageBound{3, "m"}); b != 2000 {
+		t.Errorf("Expecting 2000 bytes older than 3 months got %d", b)
+	}
+
+	rows := dateSummaryTable(map[string]*bucketCounter{"foo": ctr})
+	expectedHeaders := []string{"Bucket name", "Total number of files", "<1 day", "1-7 day", "7 day-1 year", ">1 year"}
+	if !reflect.DeepEqual(rows.headers, expectedHeaders) || !reflect.DeepEqual(rows.rows[0], []string{"foo", "2", "1", "0", "0", "1"}) {
+		t.Errorf("Unexpected date summary %v %v", rows.headers, rows.rows)
+	}
+	rows = sizingTable(map[string]*bucketCounter{"foo": ctr}, "bucket name")
+	if !reflect.DeepEqual(rows.rows[0], []string{"foo", "2", "0.0000", "1", "0", "1"}) {
+		t.Errorf("Unexpected sizing %v", rows.rows)
+	}
+
+	b := &bytes.Buffer{}
+	r, _ := newReporter("csv", b, &reportOptions{bands: currentBands()})
+	if err := r.header(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.close()
+	expectedHeader := "Size and age ranges\nSetting,Value\nas of,2018-03-16T00:00:00Z\nsize bands,\"128B,1KB\"\nage bands,\"1d,7d,1y\"\n\n"
+	if b.String() != expectedHeader {
+		t.Errorf("Expecting %q got %q", expectedHeader, b.String())
+	}
+}
+
+func TestResumeBands(t *testing.T) {
+	defer (&bandConfig{}).apply()
+	if err := (&bandConfig{AgeBands: []string{"1d", "1y"}}).apply(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	saved := currentBands()
+	saved.AsOf = "2018-03-16T10:00:00Z"
+	if err := resumeBands(saved); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !now.Equal(time.Date(2018, 3, 16, 10, 0, 0, 0, time.UTC)) || !dateLimits[0].Equal(time.Date(2018, 3, 15, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expecting the ages computed as of the interrupted scan got %s", now)
+	}
+	if err := resumeBands(nil); err != nil {
+		t.Errorf("Unexpected error for a checkpoint without bands: %s", err)
+	}
+
+	(&bandConfig{}).apply()
+	if err := resumeBands(saved); err == nil {
+		t.Error("Expecting an error for different bands")
+	}
+	(&bandConfig{AgeBands: []string{"1d", "1y"}, AsOf: "2018-03-17"}).apply()
+	if err := resumeBands(saved); err == nil {
+		t.Error("Expecting an error for a different as of date")
+	}
+}
+
+func TestLoadBands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := &bandConfig{SizeBands: []string{"128B", "1KB"}, AgeBands: []string{"1d", "1w"}, AsOf: "2018-03-16"}
+	testData := []struct {
+		fileName, content string
+		expectError       bool
+	}{
+		{"bands.yaml", "size_bands: [128B, 1KB]\nage_bands: [1d, 1w]\nas_of: 2018-03-16\n", false},
+		{"bands.json", `{"size_bands": ["128B", "1KB"], "age_bands": ["1d", "1w"], "as_of": "2018-03-16"}`, false},
+		{"bands.txt", "", true},
+	}
+	for n, d := range testData {
+		filePath := filepath.Join(dir, d.fileName)
+		if err = ioutil.WriteFile(filePath, []byte(d.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadBands(filePath)
+		if d.expectError {
+			if err == nil {
+				t.Errorf("#%d: expecting an error", n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %s", n, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, expected) {
+			t.Errorf("#%d: expecting %+v got %+v", n, expected, c)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// checkpoint is the content of the file saved on disk to be able to resume a
+// scan that has been interrupted
+type checkpoint struct {
+	// Done lists the buckets that have been fully scanned
+	Done []string `json:"done"`
+	// Tokens contains the continuation token of the next page to list for each
+	// bucket which scan is still in progress
+	Tokens map[string]string `json:"tokens"`
+	// Counters contains the statistics gathered so far for each bucket
+	Counters map[string]*counterSnapshot `json:"counters"`
+	// Shards contains the prefixes found so far for each bucket which key
+	// space is split in shards
+	Shards map[string][]string `json:"shards,omitempty"`
+	// Bands contains the size and age ranges the counters are computed with
+	// and the date the ages are computed from
+	Bands *bandConfig `json:"bands,omitempty"`
+	// DuplicatesDir is the directory of the duplicate index completed by a
+	// resumed scan
+	DuplicatesDir string `json:"duplicates_dir,omitempty"`
+	// SampleJobs lists the objects selected for sampling which metadata had
+	// not been counted yet
+	SampleJobs []*sampleJob `json:"sample_jobs,omitempty"`
+}
+
+// scanProgress keeps track of the listing progress of each bucket.
+// The pages sent to the page channel are tracked so that a checkpoint is only
+// taken once every page that has been listed has also been counted. This way
+// the counters and the continuation tokens saved are always consistent.
+type scanProgress struct {
+	pauseMutex *sync.RWMutex
+	inflight   sync.WaitGroup
+	stateMutex sync.Locker
+	done       map[string]bool
+	failed     map[string]error
+	tokens     map[string]string
+	shardList  map[string][]string
+	workers    []pageCounters
+}
+
+// pageCounters are the counters of the buckets which pages are counted by a
+// page worker. They are merged in the report when a checkpoint is taken and
+// when the worker stops, so that the workers never share a counter while
+// counting.
+type pageCounters map[string]*pageCounter
+
+// pageCounter is the counter of a bucket owned by a page worker and the
+// counter of the report it is merged in
+type pageCounter struct {
+	local  *bucketCounter
+	target *bucketCounter
+}
+
+// counter returns the counter of the given bucket, created with its first page
+func (c pageCounters) counter(bucket string) *bucketCounter {
+	ctr, ok := c[bucket]
+	if !ok {
+		reportMutex.Lock()
+		target := report[bucket]
+		reportMutex.Unlock()
+		ctr = &pageCounter{local: newBucketCounter(), target: target}
+		c[bucket] = ctr
+	}
+	return ctr.local
+}
+
+// mergeInto merges the counters in the counters of the report and empties them
+func (c pageCounters) mergeInto() {
+	for _, v := range c {
+		v.target.merge(v.local, *topCount)
+		v.local = newBucketCounter()
+	}
+}
+
+// newScanProgress initialize a new scanProgress with the required fields
+// initialized
+func newScanProgress() *scanProgress {
+	return &scanProgress{
+		pauseMutex: &sync.RWMutex{},
+		stateMutex: &sync.Mutex{},
+		done:       make(map[string]bool),
+		failed:     make(map[string]error),
+		tokens:     make(map[string]string),
+		shardList:  make(map[string][]string),
+	}
+}
+
+// pushPage sends a page to the page channel and records the continuation
+// token to use to get the following page of the bucket. A page without
+// continuation token is the last page of the bucket which is then flagged as
+// done.
+func (p *scanProgress) pushPage(page *s3.ListObjectsV2Output, pageChan chan *s3.ListObjectsV2Output) {
+	p.pushPageWith(page, pageChan, nil)
+}
+
+// pushPageWith works like pushPage and also calls the given function, if not
+// nil, before sending the page. It is used to update the counters that are
+// not computed from the objects of the page while making sure that a
+// checkpoint cannot be taken in between.
+func (p *scanProgress) pushPageWith(page *s3.ListObjectsV2Output, pageChan chan *s3.ListObjectsV2Output, count func()) {
+	p.pushPageAs(*page.Name, page, pageChan, count)
+}
+
+// pushPageAs works like pushPageWith but records the continuation token under
+// the given key instead of the name of the bucket. It is used for the shards
+// of a bucket which are each listed on their own.
+func (p *scanProgress) pushPageAs(key string, page *s3.ListObjectsV2Output, pageChan chan *s3.ListObjectsV2Output, count func()) {
+	p.pauseMutex.RLock()
+	defer p.pauseMutex.RUnlock()
+	if count != nil {
+		count()
+	}
+	p.inflight.Add(1)
+	pageChan <- page
+	p.stateMutex.Lock()
+	if page.NextContinuationToken != nil {
+		p.tokens[key] = *page.NextContinuationToken
+	} else {
+		p.done[key] = true
+		delete(p.tokens, key)
+	}
+	p.stateMutex.Unlock()
+}
+
+// pageDone flags a page previously sent by pushPage as counted
+func (p *scanProgress) pageDone() {
+	p.inflight.Done()
+}
+
+// newPageCounters returns the counters of a page worker. They are only used
+// by the worker between the reception of a page and its pageDone call.
+func (p *scanProgress) newPageCounters() pageCounters {
+	c := make(pageCounters)
+	p.stateMutex.Lock()
+	p.workers = append(p.workers, c)
+	p.stateMutex.Unlock()
+	return c
+}
+
+// flushPageCounters merges the counters of a page worker that stopped in the
+// report
+func (p *scanProgress) flushPageCounters(c pageCounters) {
+	p.pauseMutex.RLock()
+	defer p.pauseMutex.RUnlock()
+	c.mergeInto()
+}
+
+// markDone flags a bucket as fully listed
+func (p *scanProgress) markDone(bucket string) {
+	p.pauseMutex.RLock()
+	defer p.pauseMutex.RUnlock()
+	p.stateMutex.Lock()
+	p.done[bucket] = true
+	delete(p.tokens, bucket)
+	p.stateMutex.Unlock()
+}
+
+// markFailed records the error that interrupted the listing of a bucket
+func (p *scanProgress) markFailed(bucket string, err error) {
+	p.stateMutex.Lock()
+	p.failed[bucket] = err
+	p.stateMutex.Unlock()
+}
+
+// isDone returns true if the bucket has already been fully listed
+func (p *scanProgress) isDone(bucket string) bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.done[bucket]
+}
+
+// token returns the continuation token to start the listing of a bucket from.
+// An empty string means that the listing starts from the beginning.
+func (p *scanProgress) token(bucket string) string {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.tokens[bucket]
+}
+
+// addShards records prefixes found for a bucket which key space is split in
+// shards
+func (p *scanProgress) addShards(bucket string, prefixes []string) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.shardList[bucket] = append(p.shardList[bucket], prefixes...)
+}
+
+// shards returns the prefixes of the shards found so far for a bucket
+func (p *scanProgress) shards(bucket string) []string {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return append([]string(nil), p.shardList[bucket]...)
+}
+
+// failures returns the buckets which listing failed with the associated error
+func (p *scanProgress) failures() map[string]error {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	res := make(map[string]error, len(p.failed))
+	for k, v := range p.failed {
+		res[k] = v
+	}
+	return res
+}
+
+// checkpoint pauses the bucket workers, waits for all the pages already
+// listed to be counted, merges the counters of the page workers and returns a
+// copy of the current state of the scan. The sampled objects which metadata
+// has not been counted yet are saved with the counters instead of being waited
+// for.
+func (p *scanProgress) checkpoint(ctr map[string]*bucketCounter) *checkpoint {
+	p.pauseMutex.Lock()
+	defer p.pauseMutex.Unlock()
+	p.inflight.Wait()
+	p.stateMutex.Lock()
+	workers := p.workers
+	p.stateMutex.Unlock()
+	for _, c := range workers {
+		c.mergeInto()
+	}
+
+	cp := checkpoint{
+		Tokens:   make(map[string]string),
+		Counters: make(map[string]*counterSnapshot),
+		Bands:    currentBands(),
+	}
+	p.stateMutex.Lock()
+	for k := range p.done {
+		cp.Done = append(cp.Done, k)
+	}
+	for k, v := range p.tokens {
+		cp.Tokens[k] = v
+	}
+	for k, v := range p.shardList {
+		if cp.Shards == nil {
+			cp.Shards = make(map[string][]string)
+		}
+		cp.Shards[k] = append([]string(nil), v...)
+	}
+	p.stateMutex.Unlock()
+
+	snapshot := func() {
+		reportMutex.Lock()
+		for k, v := range ctr {
+			cp.Counters[k] = v.snapshot()
+		}
+		reportMutex.Unlock()
+	}
+	if objSampler != nil {
+		// A resumed scan does not sample the objects of the pages already
+		// counted again, it only samples the ones still pending
+		cp.SampleJobs = objSampler.pendingJobs(snapshot)
+	} else {
+		snapshot()
+	}
+	// The duplicate index must contain at least the objects of the counters
+	// saved. The objects indexed twice after a resume are ignored when
+	// analyzing it.
+	if dupIndex != nil {
+		if err := dupIndex.flush(); err != nil {
+			log.Printf("Error while saving the duplicate index: %s\n", err)
+		}
+		cp.DuplicatesDir = dupIndex.dir
+	}
+	return &cp
+}
+
+// restore loads the state of a checkpoint in the scanProgress and returns the
+// counters it contains
+func (p *scanProgress) restore(cp *checkpoint) map[string]*bucketCounter {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	for _, b := range cp.Done {
+		p.done[b] = true
+	}
+	for k, v := range cp.Tokens {
+		p.tokens[k] = v
+	}
+	for k, v := range cp.Shards {
+		p.shardList[k] = append([]string(nil), v...)
+	}
+	ctr := make(map[string]*bucketCounter, len(cp.Counters))
+	for k, v := range cp.Counters {
+		ctr[k] = v.restore()
+	}
+	return ctr
+}
+
+// saveCheckpoint writes the checkpoint to the given file
+func saveCheckpoint(filePath string, cp *checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data)
+}
+
+// writeFileAtomic writes data to the given file. The content is written to a
+// temporary file first so that an interruption during the write does not
+// corrupt the previous content of the file.
+func writeFileAtomic(filePath string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath))
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// loadCheckpoint reads a checkpoint previously written by saveCheckpoint
+func loadCheckpoint(filePath string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	cp := checkpoint{}
+	if err = json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// checkpointLoop saves the progress of the scan every interval until the stop
+// channel is closed
+func checkpointLoop(p *scanProgress, filePath string, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveCheckpoint(filePath, p.checkpoint(report)); err != nil {
+				log.Printf("Error while saving the checkpoint to %s: %s\n", filePath, err)
+				continue
+			}
+			log.Printf("Checkpoint saved to %s", filePath)
+		case <-stop:
+			return
+		}
+	}
+}
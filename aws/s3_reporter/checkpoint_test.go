@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3ListMock serves pages of objects from a static list and can be configured
+// to fail after a given number of pages
+type s3ListMock struct {
+	s3iface.S3API
+	objects   []*s3.Object
+	pageSize  int
+	failAfter int
+	calls     int
+}
+
+func (m *s3ListMock) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	start := 0
+	if input.ContinuationToken != nil {
+		start, _ = strconv.Atoi(*input.ContinuationToken)
+	}
+	for start < len(m.objects) {
+		if m.failAfter > 0 && m.calls >= m.failAfter {
+			return errors.New("ListObjectsV2 random failure")
+		}
+		m.calls++
+		end := start + m.pageSize
+		if end > len(m.objects) {
+			end = len(m.objects)
+		}
+		page := &s3.ListObjectsV2Output{Name: input.Bucket, Contents: m.objects[start:end]}
+		lastPage := end == len(m.objects)
+		if !lastPage {
+			page.NextContinuationToken = aws.String(strconv.Itoa(end))
+		}
+		if !fn(page, lastPage) {
+			break
+		}
+		start = end
+	}
+	return nil
+}
+
+func mockObjects(n int) []*s3.Object {
+	res := make([]*s3.Object, n)
+	for i := range res {
+		res[i] = &s3.Object{
+			Key:          aws.String("root" + strconv.Itoa(i%3) + "/file" + strconv.Itoa(i) + ".txt"),
+			Size:         aws.Int64(int64(i * 1000)),
+			StorageClass: aws.String("STANDARD"),
+			LastModified: aws.Time(time.Date(2017, time.Month(i%12+1), 1, 0, 0, 0, 0, time.UTC)),
+		}
+	}
+	return res
+}
+
+// scanMock runs the listing of a bucket through the same channels as main
+func scanMock(svc s3iface.S3API, bucket string, progress *scanProgress) error {
+	var wg sync.WaitGroup
+	pageChan := make(chan *s3.ListObjectsV2Output, 10)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go processPage(pageChan, &wg, progress)
+	}
+	err := getBucketObjects(svc, &bucket, pageChan, progress)
+	if err == nil {
+		progress.markDone(bucket)
+	}
+	close(pageChan)
+	wg.Wait()
+	return err
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	c := newBucketCounter()
+	c.increment(1500, "STANDARD", ".txt", "foo", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	c.increment(15, "GLACIER", ".gz", "bar", time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	s := c.snapshot()
+	r := s.restore()
+	if !reflect.DeepEqual(s, r.snapshot()) {
+		t.Errorf("Expecting %v got %v", s, r.snapshot())
+	}
+}
+
+func TestSaveLoadCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "checkpoint.json")
+
+	c := newBucketCounter()
+	c.increment(1500, "STANDARD", ".txt", "foo", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	expected := &checkpoint{
+		Done:     []string{"foo"},
+		Tokens:   map[string]string{"bar": "token"},
+		Counters: map[string]*counterSnapshot{"foo": c.snapshot(), "bar": newBucketCounter().snapshot()},
+	}
+	if err = saveCheckpoint(filePath, expected); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cp, err := loadCheckpoint(filePath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(cp, expected) {
+		t.Errorf("Expecting %v got %v", expected, cp)
+	}
+	if _, err = loadCheckpoint(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expecting an error when loading a missing checkpoint")
+	}
+}
+
+func TestResumeScan(t *testing.T) {
+	reportMutex = &sync.Mutex{}
+	objects := mockObjects(95)
+
+	// Uninterrupted scan
+	report = map[string]*bucketCounter{"foo": newBucketCounter()}
+	if err := scanMock(&s3ListMock{objects: objects, pageSize: 10}, "foo", newScanProgress()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := report["foo"].snapshot()
+
+	// Scan failing after 4 pages
+	report = map[string]*bucketCounter{"foo": newBucketCounter()}
+	progress := newScanProgress()
+	if err := scanMock(&s3ListMock{objects: objects, pageSize: 10, failAfter: 4}, "foo", progress); err == nil {
+		t.Fatal("Expecting the listing to fail")
+	}
+	cp := progress.checkpoint(report)
+	if cp.Tokens["foo"] != "40" {
+		t.Errorf("Expecting continuation token 40 got %q", cp.Tokens["foo"])
+	}
+	if len(cp.Done) != 0 {
+		t.Errorf("Expecting no bucket done got %v", cp.Done)
+	}
+
+	// Resumed scan
+	progress = newScanProgress()
+	report = progress.restore(cp)
+	svc := &s3ListMock{objects: objects, pageSize: 10}
+	if err := scanMock(svc, "foo", progress); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if svc.calls != 6 {
+		t.Errorf("Expecting 6 pages listed on resume got %d", svc.calls)
+	}
+	if !progress.isDone("foo") {
+		t.Error("Expecting bucket foo to be done")
+	}
+	if r := report["foo"].snapshot(); !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expecting %v got %v", expected, r)
+	}
+}
+
+func TestCheckpointMergesPageCounters(t *testing.T) {
+	reportMutex = &sync.Mutex{}
+	objects := mockObjects(30)
+	report = map[string]*bucketCounter{"foo": newBucketCounter()}
+	progress := newScanProgress()
+	var wg sync.WaitGroup
+	pageChan := make(chan *s3.ListObjectsV2Output, 10)
+	wg.Add(1)
+	go processPage(pageChan, &wg, progress)
+
+	// The pages counted by a running worker are in the checkpoint
+	progress.pushPage(&s3.ListObjectsV2Output{Name: aws.String("foo"), Contents: objects[:10], NextContinuationToken: aws.String("10")}, pageChan)
+	progress.pushPage(&s3.ListObjectsV2Output{Name: aws.String("foo"), Contents: objects[10:20], NextContinuationToken: aws.String("20")}, pageChan)
+	cp := progress.checkpoint(report)
+	if cp.Counters["foo"].FileCount != 20 || cp.Tokens["foo"] != "20" {
+		t.Errorf("Expecting 20 files up to token 20 got %d up to %q", cp.Counters["foo"].FileCount, cp.Tokens["foo"])
+	}
+
+	// The worker keeps counting after the checkpoint without counting the
+	// merged pages twice
+	progress.pushPage(&s3.ListObjectsV2Output{Name: aws.String("foo"), Contents: objects[20:]}, pageChan)
+	close(pageChan)
+	wg.Wait()
+	if n := report["foo"].snapshot().FileCount; n != 30 {
+		t.Errorf("Expecting 30 files got %d", n)
+	}
+}
@@ -9,34 +9,63 @@ import (
 	"time"
 )
 
-var (
-	now5yAgo = time.Now().UTC().AddDate(-5, 0, 0)
-	now4yAgo = time.Now().UTC().AddDate(-4, 0, 0)
-	now3yAgo = time.Now().UTC().AddDate(-3, 0, 0)
-	now2yAgo = time.Now().UTC().AddDate(-2, 0, 0)
-	now1yAgo = time.Now().UTC().AddDate(-1, 0, 0)
-	now9mAgo = time.Now().UTC().AddDate(0, -9, 0)
-	now6mAgo = time.Now().UTC().AddDate(0, -6, 0)
-	now3mAgo = time.Now().UTC().AddDate(0, -3, 0)
-	now2mAgo = time.Now().UTC().AddDate(0, -2, 0)
-	now1mAgo = time.Now().UTC().AddDate(0, -1, 0)
-)
-
+// bucketCounter contains the statistics of a bucket or of one of its folders.
+// The counters are not protected: the page workers count the objects in
+// counters they own, merged in the counters of the report. Only the counters
+// of the buckets of the report are shared, protected by their mutex.
 type bucketCounter struct {
-	fileMutex      sync.Locker
+	// mutex protects the counter of a bucket of the report and the counters
+	// of its folders while they are merged, sampled or snapshotted
+	mutex          sync.Locker
 	fileCount      uint64
-	sizeMutex      sync.Locker
 	sizeCount      map[string]uint64
 	sizeTotal      uint64
-	storageMutex   sync.Locker
 	storageCount   map[string]uint64
-	rootMutex      sync.Locker
+	storageSize    map[string]uint64
+	meta           bucketMetadata
 	rootCount      map[string]*bucketCounter
-	extensionMutex sync.Locker
 	extensionCount map[string]uint64
-	dateMutex      sync.Locker
 	dateCount      map[string]uint64
 	dateRange      map[string]uint64
+	ageSize        map[string]map[string]uint64
+	noncurrent     uint64
+	noncurrentSize uint64
+	noncurrentAge  map[string]uint64
+	deleteMarkers  uint64
+	multipart      uint64
+	multipartSize  uint64
+	multipartAge   map[string]uint64
+	top            *topObjects
+	facts          map[factKey]factCount
+	samples        *sampleStats
+	// folder is true for the counter of a root folder that counted at least
+	// one object under it, false for the counter of a file at the root of the
+	// bucket
+	folder bool
+}
+
+// bucketMetadata is the configuration of a bucket, retrieved before its
+// objects are listed, and the account owning it
+type bucketMetadata struct {
+	region    string
+	account   string
+	lifecycle []lifecycleTransition
+	audit     *bucketAudit
+}
+
+// factKey is a root folder, storage class, extension and month the objects of
+// a bucket are counted by for the database export
+type factKey struct {
+	root         string
+	storageClass string
+	extension    string
+	month        string
+}
+
+// factCount is the number of objects and bytes of a factKey
+type factCount struct {
+	files uint64
+	bytes uint64
 }
 
 // newBucketCounter initialize a new bucketCounter with the required fields
@@ -49,213 +78,375 @@ func newBucketCounter() *bucketCounter {
 
 // countFile increments the file counter
 func (c *bucketCounter) countFile() {
-	c.fileMutex.Lock()
 	c.fileCount++
-	c.fileMutex.Unlock()
 }
 
 // countSize increments the different size counters
 func (c *bucketCounter) countSize(keySize int64) {
 	k := getSizeRange(keySize)
-	c.sizeMutex.Lock()
 	c.sizeCount[k]++
 	c.sizeTotal += uint64(keySize)
-	c.sizeMutex.Unlock()
+}
+
+// countStorage increments the storage class counters
+func (c *bucketCounter) countStorage(storageClass string, keySize int64) {
+	c.storageCount[storageClass]++
+	c.storageSize[storageClass] += uint64(keySize)
+}
+
+// setMetadata records the configuration of the bucket, retrieved once before
+// its objects are listed. The account is kept.
+func (c *bucketCounter) setMetadata(m bucketMetadata) {
+	c.mutex.Lock()
+	m.account = c.meta.account
+	c.meta = m
+	c.mutex.Unlock()
+}
+
+// setAccount records the id of the AWS account owning the bucket
+func (c *bucketCounter) setAccount(account string) {
+	c.mutex.Lock()
+	c.meta.account = account
+	c.mutex.Unlock()
+}
+
+// countTop ranks the object in the top n lists of the bucket, created with
+// the first object
+func (c *bucketCounter) countTop(e *topEntry, n int) {
+	if c.top == nil {
+		c.top = newTopObjects()
+	}
+	c.top.add(e, n)
+}
+
+// countFact increments the counters of the root folder, storage class,
+// extension and month of an object, created with the first object
+func (c *bucketCounter) countFact(k factKey, size int64) {
+	if c.facts == nil {
+		c.facts = make(map[factKey]factCount)
+	}
+	f := c.facts[k]
+	f.files++
+	f.bytes += uint64(size)
+	c.facts[k] = f
+}
+
+// topSnapshot returns the sorted top lists of the bucket, nil if no object has
+// been ranked
+func (c *bucketCounter) topSnapshot() *topSnapshot {
+	if c.top == nil {
+		return nil
+	}
+	return c.top.snapshot()
+}
+
+// countAgeSize increments the size of the files by storage class and date range
+func (c *bucketCounter) countAgeSize(storageClass string, keyDate time.Time, keySize int64) {
+	k := getDateRange(keyDate)
+	ctr, ok := c.ageSize[storageClass]
+	if !ok {
+		ctr = make(map[string]uint64)
+		c.ageSize[storageClass] = ctr
+	}
+	ctr[k] += uint64(keySize)
+}
+
+// countNoncurrent increments the counters of the versions of the objects that
+// are not the current version. The size is reported by age of the version.
+func (c *bucketCounter) countNoncurrent(keyDate time.Time, keySize int64) {
+	k := getDateRange(keyDate)
+	c.noncurrent++
+	c.noncurrentSize += uint64(keySize)
+	c.noncurrentAge[k] += uint64(keySize)
+}
+
+// countDeleteMarkers increments the delete markers counter
+func (c *bucketCounter) countDeleteMarkers(n uint64) {
+	c.deleteMarkers += n
+}
+
+// countMultipart increments the counters of the multipart uploads that have
+// not been completed nor aborted. The size of their parts is reported by
+// the age of the upload.
+func (c *bucketCounter) countMultipart(initiated time.Time, partsSize int64) {
+	k := getDateRange(initiated)
+	c.multipart++
+	c.multipartSize += uint64(partsSize)
+	c.multipartAge[k] += uint64(partsSize)
 }
 
 // countDateSummary increments the date summary counters
 func (c *bucketCounter) countDateSummary(keyDate time.Time) {
 	k := getDateRange(keyDate)
-	incrementUint64(c.dateMutex, c.dateRange, k)
+	incrementUint64(c.dateRange, k)
 }
 
-// incrementUint64 increments a map[string]uint64 using a mutex
-func incrementUint64(m sync.Locker, ctr map[string]uint64, key string) {
-	m.Lock()
+// incrementUint64 increments a map[string]uint64
+func incrementUint64(ctr map[string]uint64, key string) {
 	// Relies on the fact that a null value for an uint64 is 0
 	ctr[key]++
-	m.Unlock()
 }
 
-// increment increments a *bucketCounter
+// increment increments a *bucketCounter. If recurse is true, the counter of
+// the given root folder is incremented as well.
 func (c *bucketCounter) increment(size int64, storageClass, extension, root string, lastModified time.Time, recurse bool) {
-	lastMod := fmt.Sprintf("%d-%02d-01", lastModified.Year(), lastModified.Month())
+	var prefixes []string
+	if recurse {
+		prefixes = []string{root}
+	}
+	c.incrementPrefixes(size, storageClass, extension, prefixes, lastModified)
+}
+
+// incrementPrefixes increments a *bucketCounter and the counters of the tree
+// of sub-folders it contains, one level per given prefix
+func (c *bucketCounter) incrementPrefixes(size int64, storageClass, extension string, prefixes []string, lastModified time.Time) {
+	lastMod := monthKey(lastModified)
 	c.countFile()
 	c.countSize(size)
 	c.countDateSummary(lastModified)
-	incrementUint64(c.storageMutex, c.storageCount, storageClass)
-	incrementUint64(c.extensionMutex, c.extensionCount, extension)
-	incrementUint64(c.dateMutex, c.dateCount, lastMod)
-	if recurse {
-		c.rootMutex.Lock()
-		ctr, ok := c.rootCount[root]
+	c.countAgeSize(storageClass, lastModified, size)
+	c.countStorage(storageClass, size)
+	incrementUint64(c.extensionCount, extension)
+	incrementUint64(c.dateCount, lastMod)
+	if len(prefixes) > 0 {
+		ctr, ok := c.rootCount[prefixes[0]]
 		if !ok {
 			ctr = newBucketCounter()
+			c.rootCount[prefixes[0]] = ctr
 		}
-		ctr.rootCount[root] = ctr
-		c.rootMutex.Unlock()
-		ctr.increment(size, storageClass, extension, root, lastModified, false)
+		ctr.incrementPrefixes(size, storageClass, extension, prefixes[1:], lastModified)
+	}
+}
+
+// markFolder records that the given root of the bucket is a folder, not only a
+// file at the root of the bucket
+func (c *bucketCounter) markFolder(root string) {
+	if ctr, ok := c.rootCount[root]; ok {
+		ctr.folder = true
+	}
+}
+
+// monthKey returns the first day of the month of the date, the key of the
+// counters by month
+func monthKey(t time.Time) string {
+	return fmt.Sprintf("%d-%02d-01", t.Year(), t.Month())
+}
+
+// merge adds the counters of src, and of its sub-folders, to c while holding
+// the mutex of c. src must not be in use anymore. The top lists are merged
+// keeping the top n, the bucket settings such as the region are not merged.
+func (c *bucketCounter) merge(src *bucketCounter, topN int) {
+	c.mutex.Lock()
+	c.mergeLocked(src, topN)
+	c.mutex.Unlock()
+}
+
+// mergeLocked adds the counters of src to c, which mutex is held by the caller
+func (c *bucketCounter) mergeLocked(src *bucketCounter, topN int) {
+	c.fileCount += src.fileCount
+	addUint64(c.sizeCount, src.sizeCount)
+	c.sizeTotal += src.sizeTotal
+	addUint64(c.storageCount, src.storageCount)
+	addUint64(c.storageSize, src.storageSize)
+	if src.top != nil {
+		if c.top == nil {
+			c.top = newTopObjects()
+		}
+		c.top.merge(src.top, topN)
+	}
+	if src.facts != nil && c.facts == nil {
+		c.facts = make(map[factKey]factCount, len(src.facts))
+	}
+	for k, v := range src.facts {
+		f := c.facts[k]
+		f.files += v.files
+		f.bytes += v.bytes
+		c.facts[k] = f
+	}
+	addUint64(c.extensionCount, src.extensionCount)
+	addUint64(c.dateCount, src.dateCount)
+	addUint64(c.dateRange, src.dateRange)
+	for class, ages := range src.ageSize {
+		ctr, ok := c.ageSize[class]
+		if !ok {
+			ctr = make(map[string]uint64, len(ages))
+			c.ageSize[class] = ctr
+		}
+		addUint64(ctr, ages)
+	}
+	c.noncurrent += src.noncurrent
+	c.noncurrentSize += src.noncurrentSize
+	addUint64(c.noncurrentAge, src.noncurrentAge)
+	c.deleteMarkers += src.deleteMarkers
+	c.multipart += src.multipart
+	c.multipartSize += src.multipartSize
+	addUint64(c.multipartAge, src.multipartAge)
+
+	for k, v := range src.rootCount {
+		ctr, ok := c.rootCount[k]
+		if !ok {
+			ctr = newBucketCounter()
+			c.rootCount[k] = ctr
+		}
+		ctr.folder = ctr.folder || v.folder
+		ctr.mergeLocked(v, topN)
 	}
 }
 
 // initStats initialize the statistics of a bucketCounter
 func (c *bucketCounter) initStats() {
-	c.fileMutex = &sync.Mutex{}
+	c.mutex = &sync.Mutex{}
 	c.fileCount = 0
-	c.sizeMutex = &sync.Mutex{}
-	c.sizeCount = map[string]uint64{
-		"100GB+":     0,
-		"10GB-100GB": 0,
-		"1GB-10GB":   0,
-		"100MB-1GB":  0,
-		"10MB-100MB": 0,
-		"1MB-10MB":   0,
-		"100KB-1MB":  0,
-		"10KB-100KB": 0,
-		"1KB-10KB":   0,
-		"<1KB":       0,
+	c.sizeCount = make(map[string]uint64, len(sizeRangeLabels))
+	for _, r := range sizeRangeLabels {
+		c.sizeCount[r] = 0
 	}
 	c.sizeTotal = 0
-	c.storageMutex = &sync.Mutex{}
 	c.storageCount = make(map[string]uint64)
-	c.rootMutex = &sync.Mutex{}
+	c.storageSize = make(map[string]uint64)
 	c.rootCount = make(map[string]*bucketCounter)
-	c.extensionMutex = &sync.Mutex{}
 	c.extensionCount = make(map[string]uint64)
-	c.dateMutex = &sync.Mutex{}
 	c.dateCount = make(map[string]uint64)
-	c.dateRange = map[string]uint64{
-		"<1 month":   0,
-		"1-2 month":  0,
-		"2-3 month":  0,
-		"3-6 month":  0,
-		"6-9 month":  0,
-		"9-12 month": 0,
-		"1-2 year":   0,
-		"2-3 year":   0,
-		"3-4 year":   0,
-		"4-5 year":   0,
-		">5 year":    0,
+	c.dateRange = make(map[string]uint64, len(dateRangeLabels))
+	for _, r := range dateRangeLabels {
+		c.dateRange[r] = 0
 	}
-
+	c.ageSize = make(map[string]map[string]uint64)
+	c.noncurrentAge = make(map[string]uint64)
+	c.multipartAge = make(map[string]uint64)
 }
 
 // getDateRange returns the key label corresponding to the range the given date is in
 func getDateRange(keyDate time.Time) string {
-	switch {
-	case keyDate.Before(now5yAgo):
-		return ">5 year"
-	case keyDate.Before(now4yAgo):
-		return "4-5 year"
-	case keyDate.Before(now3yAgo):
-		return "3-4 year"
-	case keyDate.Before(now2yAgo):
-		return "2-3 year"
-	case keyDate.Before(now1yAgo):
-		return "1-2 year"
-	case keyDate.Before(now9mAgo):
-		return "9-12 month"
-	case keyDate.Before(now6mAgo):
-		return "6-9 month"
-	case keyDate.Before(now3mAgo):
-		return "3-6 month"
-	case keyDate.Before(now2mAgo):
-		return "2-3 month"
-	case keyDate.Before(now1mAgo):
-		return "1-2 month"
-	}
-	return "<1 month"
+	for i := len(dateLimits) - 1; i >= 0; i-- {
+		if keyDate.Before(dateLimits[i]) {
+			return dateRangeLabels[i+1]
+		}
+	}
+	return dateRangeLabels[0]
 }
 
 // getSizeRange returns the key label corresponding to the range the given size is in
 func getSizeRange(keySize int64) string {
-	switch {
-	case keySize >= 107374182400:
-		return "100GB+"
-	case keySize >= 10737418240:
-		return "10GB-100GB"
-	case keySize >= 1073741824:
-		return "1GB-10GB"
-	case keySize >= 104857600:
-		return "100MB-1GB"
-	case keySize >= 10485760:
-		return "10MB-100MB"
-	case keySize >= 1048576:
-		return "1MB-10MB"
-	case keySize >= 102400:
-		return "100KB-1MB"
-	case keySize >= 10240:
-		return "10KB-100KB"
-	case keySize >= 1024:
-		return "1KB-10KB"
-	}
-	return "<1KB"
-}
-
-// reportDateSummary provides the reports on date-related statistics for a map[string]*bucketCounter
-func reportDateSummary(csvWriter *csv.Writer, ctr map[string]*bucketCounter) error {
-	if err := csvWriter.Write([]string{"Repartition of file ages by buckets"}); err != nil {
-		return err
+	for i := len(sizeBounds) - 1; i >= 0; i-- {
+		if keySize >= sizeBounds[i] {
+			return sizeRangeLabels[i+1]
+		}
 	}
-	header := []string{"Bucket name", "Total number of files", "<1 month", "1-2 month", "2-3 month", "3-6 month", "6-9 month", "9-12 month", "1-2 year", "2-3 year", "3-4 year", "4-5 year", ">5 year"}
-	if err := csvWriter.Write(header); err != nil {
-		return err
+	return sizeRangeLabels[0]
+}
+
+// reportTable is a titled table of statistics that can be rendered in any of
+// the report formats
+type reportTable struct {
+	title   string
+	headers []string
+	rows    [][]string
+}
+
+// sortedKeys returns the keys of a map[string]*bucketCounter in sorted order
+func sortedKeys(ctr map[string]*bucketCounter) []string {
+	keys := make([]string, 0, len(ctr))
+	for k := range ctr {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	for k, v := range ctr {
-		arr := []string{
+// dateSummaryTable builds the table of date-related statistics for a map[string]*bucketCounter
+func dateSummaryTable(ctr map[string]*bucketCounter) *reportTable {
+	t := reportTable{
+		title:   "Repartition of file ages by buckets",
+		headers: append([]string{"Bucket name", "Total number of files"}, dateRangeLabels...),
+	}
+	for _, k := range sortedKeys(ctr) {
+		v := ctr[k]
+		row := []string{k, strconv.FormatUint(v.fileCount, 10)}
+		for _, r := range dateRangeLabels {
+			row = append(row, strconv.FormatUint(v.dateRange[r], 10))
+		}
+		t.rows = append(t.rows, row)
+	}
+	return &t
+}
+
+// sizingTable builds the table of size-related statistics for a map[string]*bucketCounter
+func sizingTable(ctr map[string]*bucketCounter, byColumn string) *reportTable {
+	t := reportTable{
+		title:   fmt.Sprintf("Repartition of file sizes by %s", byColumn),
+		headers: append([]string{byColumn, "Total number of files", "Total size (GB)"}, sizeRangeLabels...),
+	}
+	for _, k := range sortedKeys(ctr) {
+		v := ctr[k]
+		row := []string{
 			k,
 			strconv.FormatUint(v.fileCount, 10),
-			strconv.FormatUint(v.dateRange["<1 month"], 10),
-			strconv.FormatUint(v.dateRange["1-2 month"], 10),
-			strconv.FormatUint(v.dateRange["2-3 month"], 10),
-			strconv.FormatUint(v.dateRange["3-6 month"], 10),
-			strconv.FormatUint(v.dateRange["6-9 month"], 10),
-			strconv.FormatUint(v.dateRange["9-12 month"], 10),
-			strconv.FormatUint(v.dateRange["1-2 year"], 10),
-			strconv.FormatUint(v.dateRange["2-3 year"], 10),
-			strconv.FormatUint(v.dateRange["3-4 year"], 10),
-			strconv.FormatUint(v.dateRange["4-5 year"], 10),
-			strconv.FormatUint(v.dateRange[">5 year"], 10),
+			strconv.FormatFloat((float64(v.sizeTotal) / 1024.0 / 1024.0 / 1024.0), 'f', 4, 64),
 		}
-		if err := csvWriter.Write(arr); err != nil {
-			return err
+		for _, r := range sizeRangeLabels {
+			row = append(row, strconv.FormatUint(v.sizeCount[r], 10))
 		}
+		t.rows = append(t.rows, row)
 	}
-	if err := csvWriter.Write(nil); err != nil {
-		return err
+	return &t
+}
+
+// byRootTable builds the table of the repartition of files by root folder for
+// a given bucket. Returns nil if there is no root folder.
+func byRootTable(bucket string, ctr *bucketCounter) *reportTable {
+	if ctr == nil || len(ctr.rootCount) == 0 {
+		return nil
 	}
-	csvWriter.Flush()
-	return nil
+	return sizingTable(ctr.rootCount, fmt.Sprintf("root folder for bucket %s", bucket))
 }
 
-// reportSizing provides the reports on size-related statistics for a map[string]*bucketCounter
-func reportSizing(csvWriter *csv.Writer, ctr map[string]*bucketCounter, byColumn string) error {
-	if err := csvWriter.Write([]string{fmt.Sprintf("Repartition of file sizes by %s", byColumn)}); err != nil {
-		return err
+// uint64Table builds a table out of a map[string]uint64 under a given title
+// and set of headers. Returns nil if the map is empty.
+func uint64Table(ctr map[string]uint64, title string, headers []string) *reportTable {
+	if len(ctr) == 0 {
+		return nil
 	}
-	header := []string{byColumn, "Total number of files", "Total size (GB)", "<1KB", "1KB-10KB", "10KB-100KB", "100KB-1MB", "1MB-10MB", "10MB-100MB", "100MB-1GB", "1GB-10GB", "10GB-100GB", "100GB+"}
-	if err := csvWriter.Write(header); err != nil {
-		return err
+	t := reportTable{title: title, headers: headers}
+	// To store the keys in slice in sorted order
+	var keys []string
+	for k := range ctr {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t.rows = append(t.rows, []string{k, strconv.FormatUint(ctr[k], 10)})
+	}
+	return &t
+}
 
-	for k, v := range ctr {
-		arr := []string{
-			k,
-			strconv.FormatUint(v.fileCount, 10),
-			strconv.FormatFloat((float64(v.sizeTotal) / 1024.0 / 1024.0 / 1024.0), 'f', 4, 64),
-			strconv.FormatUint(v.sizeCount["<1KB"], 10),
-			strconv.FormatUint(v.sizeCount["1KB-10KB"], 10),
-			strconv.FormatUint(v.sizeCount["10KB-100KB"], 10),
-			strconv.FormatUint(v.sizeCount["100KB-1MB"], 10),
-			strconv.FormatUint(v.sizeCount["1MB-10MB"], 10),
-			strconv.FormatUint(v.sizeCount["10MB-100MB"], 10),
-			strconv.FormatUint(v.sizeCount["100MB-1GB"], 10),
-			strconv.FormatUint(v.sizeCount["1GB-10GB"], 10),
-			strconv.FormatUint(v.sizeCount["10GB-100GB"], 10),
-			strconv.FormatUint(v.sizeCount["100GB+"], 10),
+// sizeTable builds a table out of a map[string]uint64 of sizes in bytes
+// under a given title and set of headers. The sizes are reported in GB.
+// Returns nil if the map is empty.
+func sizeTable(ctr map[string]uint64, title string, headers []string) *reportTable {
+	t := uint64Table(ctr, title, headers)
+	if t != nil {
+		for _, row := range t.rows {
+			row[1] = strconv.FormatFloat(bytesToGB(ctr[row[0]]), 'f', 4, 64)
 		}
-		if err := csvWriter.Write(arr); err != nil {
+	}
+	return t
+}
+
+// writeCsvTable exports a reportTable in a csv format: a title line, the
+// headers, the rows and an empty line. Nil tables are skipped.
+func writeCsvTable(csvWriter *csv.Writer, t *reportTable) error {
+	if t == nil {
+		return nil
+	}
+	if err := csvWriter.Write([]string{t.title}); err != nil {
+		return err
+	}
+	if err := csvWriter.Write(t.headers); err != nil {
+		return err
+	}
+	for _, row := range t.rows {
+		if err := csvWriter.Write(row); err != nil {
 			return err
 		}
 	}
@@ -263,45 +454,186 @@ func reportSizing(csvWriter *csv.Writer, ctr map[string]*bucketCounter, byColumn
 		return err
 	}
 	csvWriter.Flush()
-	return nil
+	return csvWriter.Error()
 }
 
-// reportByRoot Reports the repartition of files by root folder for a given bucket
-func reportByRoot(csvWriter *csv.Writer, bucket string, ctr *bucketCounter) error {
-	var err error
-	if ctr != nil && len(ctr.rootCount) > 0 {
-		err = reportSizing(csvWriter, ctr.rootCount, fmt.Sprintf("root folder for bucket %s", bucket))
-	}
-	return err
+// counterSnapshot is the serializable version of a bucketCounter. It is used
+// to save the state of the counters on disk and restore it later.
+type counterSnapshot struct {
+	FileCount      uint64                       `json:"file_count"`
+	SizeCount      map[string]uint64            `json:"size_count"`
+	SizeTotal      uint64                       `json:"size_total"`
+	StorageCount   map[string]uint64            `json:"storage_count"`
+	StorageSize    map[string]uint64            `json:"storage_size"`
+	Region         string                       `json:"region,omitempty"`
+	Account        string                       `json:"account,omitempty"`
+	RootCount      map[string]*counterSnapshot  `json:"root_count,omitempty"`
+	ExtensionCount map[string]uint64            `json:"extension_count"`
+	DateCount      map[string]uint64            `json:"date_count"`
+	DateRange      map[string]uint64            `json:"date_range"`
+	AgeSize        map[string]map[string]uint64 `json:"age_size"`
+	Lifecycle      []lifecycleTransition        `json:"lifecycle,omitempty"`
+	Audit          *bucketAudit                 `json:"audit,omitempty"`
+	Noncurrent     uint64                       `json:"noncurrent,omitempty"`
+	NoncurrentSize uint64                       `json:"noncurrent_size,omitempty"`
+	NoncurrentAge  map[string]uint64            `json:"noncurrent_age"`
+	DeleteMarkers  uint64                       `json:"delete_markers,omitempty"`
+	Multipart      uint64                       `json:"multipart,omitempty"`
+	MultipartSize  uint64                       `json:"multipart_size,omitempty"`
+	MultipartAge   map[string]uint64            `json:"multipart_age"`
+	Top            *topSnapshot                 `json:"top,omitempty"`
+	Facts          []*factRow                   `json:"facts,omitempty"`
+	Samples        *sampleStats                 `json:"samples,omitempty"`
+	Folder         bool                         `json:"folder,omitempty"`
 }
 
-// reportUint64 exports in a csv format a map[string]uint64 under a give title
-// and set of headers
-func reportUint64(csvWriter *csv.Writer, ctr map[string]uint64, title string, headers []string) error {
-	var err error
-	if len(ctr) > 0 {
-		if err = csvWriter.Write([]string{title}); err != nil {
-			return err
+// factRow is the serializable version of a factKey and its factCount
+type factRow struct {
+	Root         string `json:"root"`
+	StorageClass string `json:"storage_class"`
+	Extension    string `json:"extension"`
+	Month        string `json:"month"`
+	Files        uint64 `json:"files"`
+	Bytes        uint64 `json:"bytes"`
+}
+
+// factRows returns the counters of the facts sorted by their key
+func (c *bucketCounter) factRows() []*factRow {
+	if len(c.facts) == 0 {
+		return nil
+	}
+	res := make([]*factRow, 0, len(c.facts))
+	for k, v := range c.facts {
+		res = append(res, &factRow{k.root, k.storageClass, k.extension, k.month, v.files, v.bytes})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Root != b.Root {
+			return a.Root < b.Root
 		}
-		if err = csvWriter.Write(headers); err != nil {
-			return err
+		if a.StorageClass != b.StorageClass {
+			return a.StorageClass < b.StorageClass
 		}
-		// To store the keys in slice in sorted order
-		var keys []string
-		for k := range ctr {
-			keys = append(keys, k)
+		if a.Extension != b.Extension {
+			return a.Extension < b.Extension
 		}
-		sort.Strings(keys)
-		for _, k := range keys {
-			if err = csvWriter.Write([]string{k, strconv.FormatUint(ctr[k], 10)}); err != nil {
-				return err
-			}
+		return a.Month < b.Month
+	})
+	return res
+}
+
+// copyUint64 returns a copy of a map[string]uint64
+func copyUint64(ctr map[string]uint64) map[string]uint64 {
+	res := make(map[string]uint64, len(ctr))
+	for k, v := range ctr {
+		res[k] = v
+	}
+	return res
+}
+
+// snapshot returns a serializable copy of the bucketCounter and its
+// sub-counters made while holding its mutex
+func (c *bucketCounter) snapshot() *counterSnapshot {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.snapshotLocked()
+}
+
+// snapshotLocked returns a serializable copy of the bucketCounter, which mutex
+// is held by the caller, and its sub-counters
+func (c *bucketCounter) snapshotLocked() *counterSnapshot {
+	s := counterSnapshot{
+		FileCount:      c.fileCount,
+		SizeCount:      copyUint64(c.sizeCount),
+		SizeTotal:      c.sizeTotal,
+		StorageCount:   copyUint64(c.storageCount),
+		StorageSize:    copyUint64(c.storageSize),
+		Region:         c.meta.region,
+		Account:        c.meta.account,
+		ExtensionCount: copyUint64(c.extensionCount),
+		DateCount:      copyUint64(c.dateCount),
+		DateRange:      copyUint64(c.dateRange),
+		AgeSize:        make(map[string]map[string]uint64, len(c.ageSize)),
+		Lifecycle:      c.meta.lifecycle,
+		Audit:          c.meta.audit,
+		Noncurrent:     c.noncurrent,
+		NoncurrentSize: c.noncurrentSize,
+		NoncurrentAge:  copyUint64(c.noncurrentAge),
+		DeleteMarkers:  c.deleteMarkers,
+		Multipart:      c.multipart,
+		MultipartSize:  c.multipartSize,
+		MultipartAge:   copyUint64(c.multipartAge),
+		Top:            c.topSnapshot(),
+		Facts:          c.factRows(),
+		Samples:        c.sampleSnapshot(),
+		Folder:         c.folder,
+	}
+	for k, v := range c.ageSize {
+		s.AgeSize[k] = copyUint64(v)
+	}
+	if len(c.rootCount) > 0 {
+		s.RootCount = make(map[string]*counterSnapshot, len(c.rootCount))
+		for k, v := range c.rootCount {
+			s.RootCount[k] = v.snapshotLocked()
 		}
-		if err = csvWriter.Write(nil); err != nil {
-			return err
+	}
+	return &s
+}
+
+// restore rebuilds a bucketCounter from its snapshot
+func (s *counterSnapshot) restore() *bucketCounter {
+	c := newBucketCounter()
+	c.fileCount = s.FileCount
+	c.sizeTotal = s.SizeTotal
+	for k, v := range s.SizeCount {
+		c.sizeCount[k] = v
+	}
+	for k, v := range s.StorageCount {
+		c.storageCount[k] = v
+	}
+	for k, v := range s.StorageSize {
+		c.storageSize[k] = v
+	}
+	c.meta = bucketMetadata{region: s.Region, account: s.Account, lifecycle: s.Lifecycle, audit: s.Audit}
+	if s.Top != nil {
+		c.top = s.Top.restore()
+	}
+	if len(s.Facts) > 0 {
+		c.facts = make(map[factKey]factCount, len(s.Facts))
+		for _, f := range s.Facts {
+			c.facts[factKey{f.Root, f.StorageClass, f.Extension, f.Month}] = factCount{f.Files, f.Bytes}
 		}
-		csvWriter.Flush()
-		err = csvWriter.Error()
 	}
-	return err
+	c.samples = s.Samples
+	c.folder = s.Folder
+	for k, v := range s.AgeSize {
+		c.ageSize[k] = make(map[string]uint64, len(v))
+		for r, size := range v {
+			c.ageSize[k][r] = size
+		}
+	}
+	for k, v := range s.ExtensionCount {
+		c.extensionCount[k] = v
+	}
+	for k, v := range s.DateCount {
+		c.dateCount[k] = v
+	}
+	for k, v := range s.DateRange {
+		c.dateRange[k] = v
+	}
+	c.noncurrent = s.Noncurrent
+	c.noncurrentSize = s.NoncurrentSize
+	for k, v := range s.NoncurrentAge {
+		c.noncurrentAge[k] = v
+	}
+	c.deleteMarkers = s.DeleteMarkers
+	c.multipart = s.Multipart
+	c.multipartSize = s.MultipartSize
+	for k, v := range s.MultipartAge {
+		c.multipartAge[k] = v
+	}
+	for k, v := range s.RootCount {
+		c.rootCount[k] = v.restore()
+	}
+	return c
 }
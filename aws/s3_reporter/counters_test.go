@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io"
 	"reflect"
 	"sync"
@@ -31,9 +32,8 @@ func (m *mutexMock) Unlock() {
 
 func TestNewBucketCounter(t *testing.T) {
 	expected := bucketCounter{
-		fileMutex: &sync.Mutex{},
+		mutex:     &sync.Mutex{},
 		fileCount: 0,
-		sizeMutex: &sync.Mutex{},
 		sizeCount: map[string]uint64{
 			"100GB+":     0,
 			"10GB-100GB": 0,
@@ -47,13 +47,10 @@ func TestNewBucketCounter(t *testing.T) {
 			"<1KB":       0,
 		},
 		sizeTotal:      0,
-		storageMutex:   &sync.Mutex{},
 		storageCount:   map[string]uint64{},
-		rootMutex:      &sync.Mutex{},
+		storageSize:    map[string]uint64{},
 		rootCount:      map[string]*bucketCounter{},
-		extensionMutex: &sync.Mutex{},
 		extensionCount: map[string]uint64{},
-		dateMutex:      &sync.Mutex{},
 		dateCount:      map[string]uint64{},
 		dateRange: map[string]uint64{
 			"<1 month":   0,
@@ -68,6 +65,9 @@ func TestNewBucketCounter(t *testing.T) {
 			"4-5 year":   0,
 			">5 year":    0,
 		},
+		ageSize:       map[string]map[string]uint64{},
+		noncurrentAge: map[string]uint64{},
+		multipartAge:  map[string]uint64{},
 	}
 
 	r := newBucketCounter()
@@ -85,18 +85,15 @@ func BenchmarkCountFile(b *testing.B) {
 
 func TestCountFile(t *testing.T) {
 	c := newBucketCounter()
-	c.fileMutex = &mutexMock{}
+	c.mutex = &mutexMock{}
 	lockCalls = 0
 	unlockCalls = 0
 	c.countFile()
 	if c.fileCount != 1 {
 		t.Errorf("Expecting fileCount to be 1, got %d", c.fileCount)
 	}
-	if lockCalls != 1 {
-		t.Errorf("Expecting 1 mutex lock to be triggered. Got %d", lockCalls)
-	}
-	if unlockCalls != 1 {
-		t.Errorf("Expecting 1 mutex unlock to be triggered. Got %d", unlockCalls)
+	if lockCalls != 0 || unlockCalls != 0 {
+		t.Errorf("Expecting no mutex lock to be triggered. Got %d locks and %d unlocks", lockCalls, unlockCalls)
 	}
 }
 
@@ -121,7 +118,7 @@ func TestCountSize(t *testing.T) {
 		c := newBucketCounter()
 		c.sizeCount[d.label] = d.initialLabelCount
 		c.sizeTotal = d.initialTotalSize
-		c.sizeMutex = &mutexMock{}
+		c.mutex = &mutexMock{}
 		lockCalls = 0
 		unlockCalls = 0
 		c.countSize(d.inputSize)
@@ -131,27 +128,16 @@ func TestCountSize(t *testing.T) {
 		if c.sizeTotal != d.expectedTotalSize {
 			t.Errorf("Expecting sizeTotal to be %d, got %d", d.expectedTotalSize, c.sizeTotal)
 		}
-		if lockCalls != 1 {
-			t.Errorf("Expecting 1 mutex lock to be triggered. Got %d", lockCalls)
-		}
-		if unlockCalls != 1 {
-			t.Errorf("Expecting 1 mutex unlock to be triggered. Got %d", unlockCalls)
+		if lockCalls != 0 || unlockCalls != 0 {
+			t.Errorf("Expecting no mutex lock to be triggered. Got %d locks and %d unlocks", lockCalls, unlockCalls)
 		}
 	}
 }
 func TestGetDateRange(t *testing.T) {
 	tzLA, _ := time.LoadLocation("America/Los_Angeles")
 	nowDate := time.Date(2018, 3, 13, 9, 30, 0, 0, tzLA)
-	now5yAgo = nowDate.UTC().AddDate(-5, 0, 0)
-	now4yAgo = nowDate.UTC().AddDate(-4, 0, 0)
-	now3yAgo = nowDate.UTC().AddDate(-3, 0, 0)
-	now2yAgo = nowDate.UTC().AddDate(-2, 0, 0)
-	now1yAgo = nowDate.UTC().AddDate(-1, 0, 0)
-	now9mAgo = nowDate.UTC().AddDate(0, -9, 0)
-	now6mAgo = nowDate.UTC().AddDate(0, -6, 0)
-	now3mAgo = nowDate.UTC().AddDate(0, -3, 0)
-	now2mAgo = nowDate.UTC().AddDate(0, -2, 0)
-	now1mAgo = nowDate.UTC().AddDate(0, -1, 0)
+	setDateRanges(nowDate)
+	defer setDateRanges(time.Now())
 
 	testData := []struct {
 		dateCheck time.Time
@@ -241,7 +227,8 @@ func BenchmarkCountDateSummary(b *testing.B) {
 }
 
 func TestCountDateSummary(t *testing.T) {
-	now5yAgo = time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC)
+	setDateRanges(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	defer setDateRanges(time.Now())
 	testData := []struct {
 		inputDate     time.Time
 		initialMap    map[string]uint64
@@ -254,18 +241,15 @@ func TestCountDateSummary(t *testing.T) {
 	for _, d := range testData {
 		c := newBucketCounter()
 		c.dateRange = d.initialMap
-		c.dateMutex = &mutexMock{}
+		c.mutex = &mutexMock{}
 		lockCalls = 0
 		unlockCalls = 0
 		c.countDateSummary(d.inputDate)
 		if c.dateRange[d.expectedLabel] != d.expectedCount {
 			t.Errorf("Expecting dateRange of %s to be %d, got %d", d.expectedLabel, d.expectedCount, c.dateRange[d.expectedLabel])
 		}
-		if lockCalls != 1 {
-			t.Errorf("Expecting 1 mutex lock to be triggered. Got %d", lockCalls)
-		}
-		if unlockCalls != 1 {
-			t.Errorf("Expecting 1 mutex unlock to be triggered. Got %d", unlockCalls)
+		if lockCalls != 0 || unlockCalls != 0 {
+			t.Errorf("Expecting no mutex lock to be triggered. Got %d locks and %d unlocks", lockCalls, unlockCalls)
 		}
 	}
 }
@@ -273,9 +257,8 @@ func TestCountDateSummary(t *testing.T) {
 func BenchmarkIncrementUint64(b *testing.B) {
 	input := map[string]uint64{"bar": 100, "foo": 42}
 	key := "foo"
-	m := &sync.Mutex{}
 	for n := 0; n < b.N; n++ {
-		incrementUint64(m, input, key)
+		incrementUint64(input, key)
 	}
 }
 
@@ -291,14 +274,66 @@ func TestIncrementUint64(t *testing.T) {
 		{map[string]uint64{"foo": 42}, "foo", map[string]uint64{"foo": 43}},
 	}
 	for _, d := range testData {
-		m := &mutexMock{}
-		incrementUint64(m, d.inputM, d.inputK)
+		incrementUint64(d.inputM, d.inputK)
 		if !reflect.DeepEqual(d.inputM, d.expected) {
 			t.Errorf("Expecting %v, got %v", d.expected, d.inputM)
 		}
 	}
 }
 
+func TestMerge(t *testing.T) {
+	setDateRanges(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	defer setDateRanges(time.Now())
+	entries := randomEntries(1000, "foo")
+	classes := []string{"STANDARD", "GLACIER", "STANDARD_IA"}
+
+	// Counting the objects in local counters merged every 64 objects gives the
+	// same statistics as counting them directly
+	direct, merged := newBucketCounter(), newBucketCounter()
+	merged.setMetadata(bucketMetadata{region: "eu-west-1"})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			local := newBucketCounter()
+			for i := w; i < len(entries); i += 4 {
+				e := entries[i]
+				e.StorageClass = classes[i%len(classes)]
+				prefixes := []string{fmt.Sprintf("dir%d", i%3), fmt.Sprintf("sub%d", i%5)}
+				local.incrementPrefixes(e.Size, e.StorageClass, ".gz", prefixes, e.LastModified)
+				local.countTop(e, 10)
+				local.countFact(factKey{prefixes[0], e.StorageClass, ".gz", monthKey(e.LastModified)}, e.Size)
+				if i%64 < 4 {
+					merged.merge(local, 10)
+					local = newBucketCounter()
+				}
+			}
+			merged.merge(local, 10)
+			wg.Done()
+		}(w)
+	}
+	wg.Wait()
+	for i, e := range entries {
+		prefixes := []string{fmt.Sprintf("dir%d", i%3), fmt.Sprintf("sub%d", i%5)}
+		direct.incrementPrefixes(e.Size, e.StorageClass, ".gz", prefixes, e.LastModified)
+		direct.countTop(e, 10)
+		direct.countFact(factKey{prefixes[0], e.StorageClass, ".gz", monthKey(e.LastModified)}, e.Size)
+	}
+	direct.setMetadata(bucketMetadata{region: "eu-west-1"})
+	if expected, got := direct.snapshot(), merged.snapshot(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expecting %+v got %+v", expected, got)
+	}
+	// Only the mutex of the counter merged in is taken, once whatever the
+	// number of sub-folders
+	merged.mutex = &mutexMock{}
+	lockCalls = 0
+	unlockCalls = 0
+	merged.merge(direct, 10)
+	if lockCalls != 1 || unlockCalls != 1 {
+		t.Errorf("Expecting 1 mutex lock to be triggered. Got %d locks and %d unlocks", lockCalls, unlockCalls)
+	}
+}
+
 type failWriter struct {
 	w io.Writer
 	e error
@@ -317,7 +352,7 @@ func (t *failWriter) Write(p []byte) (n int, err error) {
 	return t.w.Write(p)
 }
 
-func TestReportUint64(t *testing.T) {
+func TestWriteUint64Table(t *testing.T) {
 	testData := []struct {
 		inputMap       map[string]uint64
 		inputTitle     string
@@ -335,7 +370,7 @@ func TestReportUint64(t *testing.T) {
 		b := &bytes.Buffer{}
 		w := FailWriter(b, d.inputError)
 		f := csv.NewWriter(w)
-		if err := reportUint64(f, d.inputMap, d.inputTitle, d.inputHeaders); !reflect.DeepEqual(err, d.Error) {
+		if err := writeCsvTable(f, uint64Table(d.inputMap, d.inputTitle, d.inputHeaders)); !reflect.DeepEqual(err, d.Error) {
 			t.Errorf("#%d: unexpected error:\ngot  %v\nwant %v", n, err, d.Error)
 		}
 		out := b.String()
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// collectFacts enables the counters by root folder, storage class, extension
+// and month of each bucket, which are only needed by the database export
+var collectFacts bool
+
+// databaseTables lists the statements creating the tables of the export. The
+// statements are understood by both SQLite and MySQL.
+var databaseTables = []string{
+	"CREATE TABLE IF NOT EXISTS `s3_buckets` (`bucket` VARCHAR(255) NOT NULL, `account` VARCHAR(32) NOT NULL, `region` VARCHAR(32) NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS `s3_objects` (`bucket` VARCHAR(255) NOT NULL, `root` VARCHAR(1024) NOT NULL, `storage_class` VARCHAR(32) NOT NULL, `extension` VARCHAR(255) NOT NULL, `month` CHAR(10) NOT NULL, `files` BIGINT NOT NULL, `bytes` BIGINT NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS `s3_size_ranges` (`bucket` VARCHAR(255) NOT NULL, `root` VARCHAR(1024) NOT NULL, `size_range` VARCHAR(32) NOT NULL, `position` INT NOT NULL, `files` BIGINT NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS `s3_age_ranges` (`bucket` VARCHAR(255) NOT NULL, `root` VARCHAR(1024) NOT NULL, `age_range` VARCHAR(32) NOT NULL, `position` INT NOT NULL, `files` BIGINT NOT NULL)",
+}
+
+// cannedQuery is a view of the database reproducing a table of the csv report
+type cannedQuery struct {
+	name  string
+	title string
+	query string
+}
+
+// rangeColumns returns the columns summing the files of each range, named
+// after the label of the range
+func rangeColumns(column string, labels []string) string {
+	cols := make([]string, len(labels))
+	for i, l := range labels {
+		cols[i] = fmt.Sprintf("SUM(CASE WHEN `%s` = '%s' THEN `files` ELSE 0 END) AS `%s`", column, strings.Replace(l, "'", "''", -1), l)
+	}
+	return strings.Join(cols, ", ")
+}
+
+// rangeValues returns the range columns of the given table alias, 0 when the
+// alias has no row
+func rangeValues(alias string, labels []string) string {
+	cols := make([]string, len(labels))
+	for i, l := range labels {
+		cols[i] = fmt.Sprintf("COALESCE(%s.`%s`, 0) AS `%s`", alias, l, l)
+	}
+	return strings.Join(cols, ", ")
+}
+
+// cannedQueries returns the views reproducing the tables of the csv report.
+// The columns of the ranges follow the ones in use.
+func cannedQueries() []*cannedQuery {
+	return []*cannedQuery{
+		{
+			"sizing_by_bucket", "Repartition of file sizes by bucket name",
+			"SELECT b.`bucket` AS `bucket name`, COALESCE(o.`files`, 0) AS `Total number of files`, ROUND(COALESCE(o.`bytes`, 0) / 1073741824.0, 4) AS `Total size (GB)`, " + rangeValues("r", sizeRangeLabels) +
+				" FROM `s3_buckets` b" +
+				" LEFT JOIN (SELECT `bucket`, SUM(`files`) AS `files`, SUM(`bytes`) AS `bytes` FROM `s3_objects` GROUP BY `bucket`) o ON o.`bucket` = b.`bucket`" +
+				" LEFT JOIN (SELECT `bucket`, " + rangeColumns("size_range", sizeRangeLabels) + " FROM `s3_size_ranges` GROUP BY `bucket`) r ON r.`bucket` = b.`bucket`" +
+				" ORDER BY b.`bucket`",
+		},
+		{
+			"ages_by_bucket", "Repartition of file ages by buckets",
+			"SELECT b.`bucket` AS `Bucket name`, COALESCE(o.`files`, 0) AS `Total number of files`, " + rangeValues("r", dateRangeLabels) +
+				" FROM `s3_buckets` b" +
+				" LEFT JOIN (SELECT `bucket`, SUM(`files`) AS `files` FROM `s3_objects` GROUP BY `bucket`) o ON o.`bucket` = b.`bucket`" +
+				" LEFT JOIN (SELECT `bucket`, " + rangeColumns("age_range", dateRangeLabels) + " FROM `s3_age_ranges` GROUP BY `bucket`) r ON r.`bucket` = b.`bucket`" +
+				" ORDER BY b.`bucket`",
+		},
+		{
+			"sizing_by_root", "Repartition of file sizes by root folder for each bucket",
+			"SELECT o.`bucket` AS `Bucket name`, o.`root` AS `Root folder`, o.`files` AS `Total number of files`, ROUND(o.`bytes` / 1073741824.0, 4) AS `Total size (GB)`, " + rangeValues("r", sizeRangeLabels) +
+				" FROM (SELECT `bucket`, `root`, SUM(`files`) AS `files`, SUM(`bytes`) AS `bytes` FROM `s3_objects` GROUP BY `bucket`, `root`) o" +
+				" LEFT JOIN (SELECT `bucket`, `root`, " + rangeColumns("size_range", sizeRangeLabels) + " FROM `s3_size_ranges` GROUP BY `bucket`, `root`) r ON r.`bucket` = o.`bucket` AND r.`root` = o.`root`" +
+				" ORDER BY o.`bucket`, o.`root`",
+		},
+		{
+			"files_by_storage_class", "Repartition of files and file sizes for each bucket by storage class",
+			"SELECT `bucket` AS `Bucket name`, `storage_class` AS `Storage class`, SUM(`files`) AS `Number of files`, ROUND(SUM(`bytes`) / 1073741824.0, 4) AS `Total size (GB)`" +
+				" FROM `s3_objects` GROUP BY `bucket`, `storage_class` ORDER BY `bucket`, `storage_class`",
+		},
+		{
+			"files_by_extension", "Repartition of files for each bucket by extension",
+			"SELECT `bucket` AS `Bucket name`, `extension` AS `Extension`, SUM(`files`) AS `Number of files`" +
+				" FROM `s3_objects` GROUP BY `bucket`, `extension` ORDER BY `bucket`, `extension`",
+		},
+		{
+			"files_by_month", "Repartition of files for each bucket by month",
+			"SELECT `bucket` AS `Bucket name`, `month` AS `Month`, SUM(`files`) AS `Number of files`" +
+				" FROM `s3_objects` GROUP BY `bucket`, `month` ORDER BY `bucket`, `month`",
+		},
+	}
+}
+
+// exportDatabase replaces the content of the tables of the database with the
+// statistics of the buckets and creates the views of the canned queries
+func exportDatabase(db *sql.DB, ctr map[string]*bucketCounter) error {
+	for _, s := range databaseTables {
+		if _, err := db.Exec(s); err != nil {
+			return err
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = insertStats(tx, ctr); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	// The views are created once the data is committed as MySQL commits the
+	// transaction on the creation of a view
+	for _, q := range cannedQueries() {
+		if _, err = db.Exec(fmt.Sprintf("DROP VIEW IF EXISTS `%s`", q.name)); err != nil {
+			return err
+		}
+		if _, err = db.Exec(fmt.Sprintf("CREATE VIEW `%s` AS %s", q.name, q.query)); err != nil {
+			return fmt.Errorf("view %s: %s", q.name, err)
+		}
+	}
+	return nil
+}
+
+// insertStats deletes the previous content of the tables and inserts the
+// statistics of the buckets in the transaction
+func insertStats(tx *sql.Tx, ctr map[string]*bucketCounter) error {
+	for _, t := range []string{"s3_buckets", "s3_objects", "s3_size_ranges", "s3_age_ranges"} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM `%s`", t)); err != nil {
+			return err
+		}
+	}
+	stmts := make(map[string]*sql.Stmt)
+	for t, s := range map[string]string{
+		"s3_buckets":     "INSERT INTO `s3_buckets` (`bucket`, `account`, `region`) VALUES (?, ?, ?)",
+		"s3_objects":     "INSERT INTO `s3_objects` (`bucket`, `root`, `storage_class`, `extension`, `month`, `files`, `bytes`) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		"s3_size_ranges": "INSERT INTO `s3_size_ranges` (`bucket`, `root`, `size_range`, `position`, `files`) VALUES (?, ?, ?, ?, ?)",
+		"s3_age_ranges":  "INSERT INTO `s3_age_ranges` (`bucket`, `root`, `age_range`, `position`, `files`) VALUES (?, ?, ?, ?, ?)",
+	} {
+		stmt, err := tx.Prepare(s)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		stmts[t] = stmt
+	}
+	for _, bucket := range sortedKeys(ctr) {
+		c := ctr[bucket]
+		if _, err := stmts["s3_buckets"].Exec(bucket, c.meta.account, c.meta.region); err != nil {
+			return err
+		}
+		for _, f := range c.factRows() {
+			if _, err := stmts["s3_objects"].Exec(bucket, f.Root, f.StorageClass, f.Extension, f.Month, f.Files, f.Bytes); err != nil {
+				return err
+			}
+		}
+		// The ranges are exported by root folder, the ones of the bucket
+		// being their sum
+		for _, root := range sortedKeys(c.rootCount) {
+			r := c.rootCount[root]
+			for i, l := range sizeRangeLabels {
+				if n := r.sizeCount[l]; n > 0 {
+					if _, err := stmts["s3_size_ranges"].Exec(bucket, root, l, i, n); err != nil {
+						return err
+					}
+				}
+			}
+			for i, l := range dateRangeLabels {
+				if n := r.dateRange[l]; n > 0 {
+					if _, err := stmts["s3_age_ranges"].Exec(bucket, root, l, i, n); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// openDatabase opens the SQLite database at the given path or, if a host is
+// given, the MySQL database of the host
+func openDatabase(sqlitePath, host, user, pwd, database string) (*sql.DB, error) {
+	if len(host) > 0 {
+		return sql.Open("mysql", fmt.Sprintf("%s:%s@%s/%s?charset=utf8", user, pwd, host, database))
+	}
+	return sql.Open("sqlite3", sqlitePath)
+}
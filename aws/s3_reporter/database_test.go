@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// queryTable returns the rows of a view as a reportTable, the numbers being
+// formatted like in the report
+func queryTable(db *sql.DB, view string) (*reportTable, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT * FROM `%s`", view))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	t := &reportTable{}
+	if t.headers, err = rows.Columns(); err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(t.headers))
+		ptrs := make([]interface{}, len(values))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			switch v := v.(type) {
+			case int64:
+				row[i] = strconv.FormatInt(v, 10)
+			case float64:
+				row[i] = strconv.FormatFloat(v, 'f', 4, 64)
+			case []byte:
+				row[i] = string(v)
+			default:
+				row[i] = fmt.Sprint(v)
+			}
+		}
+		t.rows = append(t.rows, row)
+	}
+	return t, rows.Err()
+}
+
+func TestExportDatabase(t *testing.T) {
+	setDateRanges(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	defer setDateRanges(time.Now())
+	collectFacts = true
+	defer func() { collectFacts = false }()
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctr := map[string]*bucketCounter{"foo": newBucketCounter(), "bar": newBucketCounter(), "empty": newBucketCounter()}
+	ctr["foo"].setMetadata(bucketMetadata{region: "eu-west-1"})
+	for i, o := range []struct {
+		bucket, key, storageClass string
+		size                      int64
+		lastModified              time.Time
+	}{
+		{"foo", "logs/a.gz", "STANDARD", 100, time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"foo", "logs/b.gz", "STANDARD", 2000, time.Date(2018, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"foo", "logs/c.gz", "GLACIER", 3 << 30, time.Date(2016, 1, 10, 0, 0, 0, 0, time.UTC)},
+		{"foo", "img/d.png", "STANDARD", 50 << 20, time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"foo", "e.txt", "STANDARD_IA", 10, time.Date(2018, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{"foo", "img/", "STANDARD", 0, time.Date(2018, 1, 20, 0, 0, 0, 0, time.UTC)},
+		{"bar", "x/y/z.csv", "STANDARD", 12345, time.Date(2012, 12, 31, 0, 0, 0, 0, time.UTC)},
+	} {
+		countObject(ctr[o.bucket], aws.String(o.bucket), &s3.Object{
+			Key:          aws.String(o.key),
+			Size:         aws.Int64(o.size),
+			StorageClass: aws.String(o.storageClass),
+			LastModified: aws.Time(o.lastModified),
+			ETag:         aws.String(fmt.Sprintf("\"%d\"", i)),
+		})
+	}
+
+	// The facts survive a checkpoint
+	if s := ctr["foo"].snapshot().restore(); !reflect.DeepEqual(s.facts, ctr["foo"].facts) {
+		t.Errorf("Expecting %v got %v", ctr["foo"].facts, s.facts)
+	}
+
+	db, err := openDatabase(filepath.Join(dir, "s3.db"), "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Exporting twice replaces the previous statistics
+	for i := 0; i < 2; i++ {
+		if err = exportDatabase(db, ctr); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+
+	// The canned queries reproduce the tables of the report
+	for _, d := range []struct {
+		view     string
+		expected *reportTable
+	}{
+		{"sizing_by_bucket", sizingTable(ctr, "bucket name")},
+		{"ages_by_bucket", dateSummaryTable(ctr)},
+		{"sizing_by_root", &reportTable{
+			headers: append([]string{"Bucket name", "Root folder", "Total number of files", "Total size (GB)"}, sizeRangeLabels...),
+			rows: [][]string{
+				append([]string{"bar"}, sizingTable(ctr["bar"].rootCount, "").rows[0]...),
+				append([]string{"foo"}, sizingTable(ctr["foo"].rootCount, "").rows[0]...),
+				append([]string{"foo"}, sizingTable(ctr["foo"].rootCount, "").rows[1]...),
+				append([]string{"foo"}, sizingTable(ctr["foo"].rootCount, "").rows[2]...),
+			},
+		}},
+		{"files_by_storage_class", &reportTable{
+			headers: []string{"Bucket name", "Storage class", "Number of files", "Total size (GB)"},
+			rows: [][]string{
+				{"bar", "STANDARD", "1", "0.0000"},
+				{"foo", "GLACIER", "1", "3.0000"},
+				{"foo", "STANDARD", "3", "0.0488"},
+				{"foo", "STANDARD_IA", "1", "0.0000"},
+			},
+		}},
+		{"files_by_extension", &reportTable{
+			headers: []string{"Bucket name", "Extension", "Number of files"},
+			rows:    [][]string{{"bar", ".csv", "1"}, {"foo", ".gz", "3"}, {"foo", ".png", "1"}, {"foo", ".txt", "1"}},
+		}},
+		{"files_by_month", &reportTable{
+			headers: []string{"Bucket name", "Month", "Number of files"},
+			rows: [][]string{
+				{"bar", "2012-12-01", "1"},
+				{"foo", "2016-01-01", "1"},
+				{"foo", "2017-06-01", "1"},
+				{"foo", "2018-01-01", "1"},
+				{"foo", "2018-03-01", "2"},
+			},
+		}},
+	} {
+		got, err := queryTable(db, d.view)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.view, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.headers, d.expected.headers) {
+			t.Errorf("%s: expecting the columns %v got %v", d.view, d.expected.headers, got.headers)
+		}
+		if !reflect.DeepEqual(got.rows, d.expected.rows) {
+			t.Errorf("%s: expecting %v got %v", d.view, d.expected.rows, got.rows)
+		}
+	}
+	var region string
+	if err = db.QueryRow("SELECT `region` FROM `s3_buckets` WHERE `bucket` = ?", "foo").Scan(&region); err != nil || region != "eu-west-1" {
+		t.Errorf("Expecting the region of the bucket got %q, %v", region, err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// growth is the evolution of a value between 2 snapshots
+type growth struct {
+	Old   uint64 `json:"old"`
+	New   uint64 `json:"new"`
+	Delta int64  `json:"delta"`
+	// Percent is nil when the old value is 0
+	Percent *float64 `json:"delta_percent"`
+}
+
+// newGrowth computes the evolution between 2 values
+func newGrowth(oldValue, newValue uint64) *growth {
+	g := growth{Old: oldValue, New: newValue, Delta: int64(newValue) - int64(oldValue)}
+	if oldValue > 0 {
+		p := float64(g.Delta) / float64(oldValue) * 100
+		g.Percent = &p
+	}
+	return &g
+}
+
+// formatPercent returns the growth in percent with 2 decimals, or "new" if
+// there was nothing before
+func (g *growth) formatPercent() string {
+	if g.Percent == nil {
+		if g.New == 0 {
+			return "0.00"
+		}
+		return "new"
+	}
+	return strconv.FormatFloat(*g.Percent, 'f', 2, 64)
+}
+
+// diffEntry is the evolution of the statistics of a bucket or of one of its
+// root folders, storage classes or extensions
+type diffEntry struct {
+	Bucket string  `json:"bucket"`
+	Key    string  `json:"key,omitempty"`
+	Files  *growth `json:"files"`
+	// Size is nil for the extensions as their size is not tracked
+	Size *growth `json:"size_bytes,omitempty"`
+}
+
+// growthAlert is a bucket or root folder which size grew more than the
+// configured threshold
+type growthAlert struct {
+	Bucket string  `json:"bucket"`
+	Prefix string  `json:"prefix,omitempty"`
+	Size   *growth `json:"size_bytes"`
+}
+
+// String describes the alert in a sentence
+func (a *growthAlert) String() string {
+	where := "bucket " + a.Bucket
+	if a.Prefix != "" {
+		where = fmt.Sprintf("prefix %s/ of bucket %s", a.Prefix, a.Bucket)
+	}
+	if a.Size.Percent == nil {
+		return fmt.Sprintf("%s is new and contains %sGB", where, strconv.FormatFloat(bytesToGB(a.Size.New), 'f', 4, 64))
+	}
+	return fmt.Sprintf("%s grew by %.2f%% from %sGB to %sGB", where, *a.Size.Percent,
+		strconv.FormatFloat(bytesToGB(a.Size.Old), 'f', 4, 64), strconv.FormatFloat(bytesToGB(a.Size.New), 'f', 4, 64))
+}
+
+// diffReport is the comparison of 2 snapshots
+type diffReport struct {
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	Buckets        []*diffEntry   `json:"buckets"`
+	Roots          []*diffEntry   `json:"roots"`
+	StorageClasses []*diffEntry   `json:"storage_classes"`
+	Extensions     []*diffEntry   `json:"extensions"`
+	Alerts         []*growthAlert `json:"alerts"`
+}
+
+// alertOptions are the thresholds above which a growth raises an alert
+type alertOptions struct {
+	// percent is the minimum growth in percent. Alerts are disabled if 0.
+	percent float64
+	// minBytes is the minimum size of the bucket or prefix after the growth
+	minBytes uint64
+}
+
+// alert returns true if the growth of the size must raise an alert
+func (o *alertOptions) alert(g *growth) bool {
+	if o.percent <= 0 || g.New < o.minBytes || g.Delta <= 0 {
+		return false
+	}
+	return g.Percent == nil || *g.Percent >= o.percent
+}
+
+// unionKeys returns the sorted keys present in any of 2 maps
+func unionKeys(a, b map[string]uint64) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range []map[string]uint64{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unionSnapshotKeys returns the sorted keys present in any of 2 maps of
+// snapshots
+func unionSnapshotKeys(a, b map[string]*counterSnapshot) []string {
+	m := make(map[string]uint64)
+	for k := range a {
+		m[k] = 0
+	}
+	for k := range b {
+		m[k] = 0
+	}
+	return unionKeys(m, nil)
+}
+
+// emptySnapshot is used in place of a bucket or a root folder that does not
+// exist in one of the snapshots
+var emptySnapshot = &counterSnapshot{}
+
+// snapshotOrEmpty returns the snapshot of the given key or an empty one
+func snapshotOrEmpty(m map[string]*counterSnapshot, key string) *counterSnapshot {
+	if s, ok := m[key]; ok {
+		return s
+	}
+	return emptySnapshot
+}
+
+// diffSnapshots compares 2 snapshots
+func diffSnapshots(from, to *runSnapshot, opts *alertOptions) *diffReport {
+	r := diffReport{From: from.CreatedAt, To: to.CreatedAt}
+	for _, b := range unionSnapshotKeys(from.Buckets, to.Buckets) {
+		o, n := snapshotOrEmpty(from.Buckets, b), snapshotOrEmpty(to.Buckets, b)
+		e := &diffEntry{Bucket: b, Files: newGrowth(o.FileCount, n.FileCount), Size: newGrowth(o.SizeTotal, n.SizeTotal)}
+		r.Buckets = append(r.Buckets, e)
+		if opts.alert(e.Size) {
+			r.Alerts = append(r.Alerts, &growthAlert{Bucket: b, Size: e.Size})
+		}
+		for _, root := range unionSnapshotKeys(o.RootCount, n.RootCount) {
+			ro, rn := snapshotOrEmpty(o.RootCount, root), snapshotOrEmpty(n.RootCount, root)
+			e := &diffEntry{Bucket: b, Key: root, Files: newGrowth(ro.FileCount, rn.FileCount), Size: newGrowth(ro.SizeTotal, rn.SizeTotal)}
+			r.Roots = append(r.Roots, e)
+			if opts.alert(e.Size) {
+				r.Alerts = append(r.Alerts, &growthAlert{Bucket: b, Prefix: root, Size: e.Size})
+			}
+		}
+		for _, class := range unionKeys(o.StorageCount, n.StorageCount) {
+			r.StorageClasses = append(r.StorageClasses, &diffEntry{
+				Bucket: b,
+				Key:    class,
+				Files:  newGrowth(o.StorageCount[class], n.StorageCount[class]),
+				Size:   newGrowth(o.StorageSize[class], n.StorageSize[class]),
+			})
+		}
+		for _, ext := range unionKeys(o.ExtensionCount, n.ExtensionCount) {
+			r.Extensions = append(r.Extensions, &diffEntry{Bucket: b, Key: ext, Files: newGrowth(o.ExtensionCount[ext], n.ExtensionCount[ext])})
+		}
+	}
+	return &r
+}
+
+// diffTable builds the table of a list of diff entries
+func diffTable(title, keyHeader string, entries []*diffEntry) *reportTable {
+	if len(entries) == 0 {
+		return nil
+	}
+	t := reportTable{title: title, headers: []string{"Bucket name"}}
+	if keyHeader != "" {
+		t.headers = append(t.headers, keyHeader)
+	}
+	t.headers = append(t.headers, "Old number of files", "New number of files", "Files delta", "Files delta (%)")
+	if entries[0].Size != nil {
+		t.headers = append(t.headers, "Old size (GB)", "New size (GB)", "Size delta (GB)", "Size delta (%)")
+	}
+	for _, e := range entries {
+		row := []string{e.Bucket}
+		if keyHeader != "" {
+			row = append(row, e.Key)
+		}
+		row = append(row,
+			strconv.FormatUint(e.Files.Old, 10),
+			strconv.FormatUint(e.Files.New, 10),
+			strconv.FormatInt(e.Files.Delta, 10),
+			e.Files.formatPercent(),
+		)
+		if e.Size != nil {
+			row = append(row,
+				strconv.FormatFloat(bytesToGB(e.Size.Old), 'f', 4, 64),
+				strconv.FormatFloat(bytesToGB(e.Size.New), 'f', 4, 64),
+				strconv.FormatFloat(float64(e.Size.Delta)/1024/1024/1024, 'f', 4, 64),
+				e.Size.formatPercent(),
+			)
+		}
+		t.rows = append(t.rows, row)
+	}
+	return &t
+}
+
+// alertsTable builds the table of the growth alerts
+func alertsTable(alerts []*growthAlert) *reportTable {
+	if len(alerts) == 0 {
+		return nil
+	}
+	t := reportTable{
+		title:   "Growth alerts",
+		headers: []string{"Bucket name", "Prefix", "Old size (GB)", "New size (GB)", "Size delta (%)", "Alert"},
+	}
+	for _, a := range alerts {
+		t.rows = append(t.rows, []string{
+			a.Bucket,
+			a.Prefix,
+			strconv.FormatFloat(bytesToGB(a.Size.Old), 'f', 4, 64),
+			strconv.FormatFloat(bytesToGB(a.Size.New), 'f', 4, 64),
+			a.Size.formatPercent(),
+			a.String(),
+		})
+	}
+	return &t
+}
+
+// diffTables returns the tables of a diff report
+func diffTables(r *diffReport) []*reportTable {
+	return []*reportTable{
+		alertsTable(r.Alerts),
+		diffTable("Growth by bucket", "", r.Buckets),
+		diffTable("Growth by root folder", "Root folder", r.Roots),
+		diffTable("Growth by storage class", "Storage class", r.StorageClasses),
+		diffTable("Growth by extension", "Extension", r.Extensions),
+	}
+}
+
+// writeDiff renders a diff report in the given format
+func writeDiff(w io.Writer, format string, r *diffReport) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		csvWriter := csv.NewWriter(w)
+		for _, t := range diffTables(r) {
+			if err := writeCsvTable(csvWriter, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "markdown":
+		for _, t := range diffTables(r) {
+			if err := writeMarkdownTable(w, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// diffEnv lists the environment variables of the flags of the diff
+// subcommand. They are prefixed by DIFF_ so as not to be mistaken for the ones
+// of the scan.
+var diffEnv = []struct{ flag, env string }{
+	{"report-path", "DIFF_REPORT_PATH"},
+	{"report-format", "DIFF_REPORT_FORMAT"},
+	{"alert-threshold", "DIFF_ALERT_THRESHOLD"},
+	{"alert-min-size", "DIFF_ALERT_MIN_SIZE"},
+}
+
+// parseDiffFlags parses the arguments of the diff subcommand. The flags that
+// are not given on the command line are read from their environment variable
+// if set.
+func parseDiffFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, e := range diffEnv {
+		v, ok := os.LookupEnv(e.env)
+		if !ok || set[e.flag] {
+			continue
+		}
+		if err := fs.Set(e.flag, v); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", v, e.env, err)
+		}
+	}
+	return nil
+}
+
+// runDiff implements the diff subcommand comparing 2 snapshots
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s diff: %s diff [flags] old_snapshot.json new_snapshot.json\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	diffPath := fs.String("report-path", "/tmp/s3_diff.csv", "Path to the diff report to generate. Environment variable: DIFF_REPORT_PATH")
+	diffFormat := fs.String("report-format", "csv", "Format of the diff report to generate. Allowed values 'csv', 'json', 'markdown'. Environment variable: DIFF_REPORT_FORMAT")
+	alertPercent := fs.Float64("alert-threshold", 0, "Growth of the size of a bucket or root folder, in percent, above which an alert is raised. 0 disables the alerts. Environment variable: DIFF_ALERT_THRESHOLD")
+	alertMinSize := fs.Float64("alert-min-size", 1, "Minimum size in GB of a bucket or root folder for its growth to raise an alert. Environment variable: DIFF_ALERT_MIN_SIZE")
+	if err := parseDiffFlags(fs, args); err != nil {
+		log.Fatalf("Error while parsing the flags of the diff subcommand: %s\n", err)
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	from, err := loadSnapshot(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Error while loading the snapshot %s: %s\n", fs.Arg(0), err)
+	}
+	to, err := loadSnapshot(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Error while loading the snapshot %s: %s\n", fs.Arg(1), err)
+	}
+	r := diffSnapshots(from, to, &alertOptions{percent: *alertPercent, minBytes: uint64(*alertMinSize * 1024 * 1024 * 1024)})
+	for _, a := range r.Alerts {
+		log.Printf("Growth alert: %s", a)
+	}
+
+	f, err := os.Create(*diffPath)
+	if err != nil {
+		log.Fatalf("Error while creating the diff report %s: %s\n", *diffPath, err)
+	}
+	defer f.Close()
+	if err = writeDiff(f, *diffFormat, r); err != nil {
+		log.Fatalf("Error while writing the diff report to %s: %s\n", *diffPath, err)
+	}
+	if err = f.Close(); err != nil {
+		log.Fatalf("Error while writing the diff report to %s: %s\n", *diffPath, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "snapshot.json")
+
+	c := newBucketCounter()
+	c.increment(1500, "STANDARD", ".txt", "foo", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	expected := newRunSnapshot(map[string]*bucketCounter{"foo": c}, time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	if err = saveSnapshot(filePath, expected); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	s, err := loadSnapshot(filePath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("Expecting %v got %v", expected, s)
+	}
+	if err = ioutil.WriteFile(filePath, []byte(`{"version": 42}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadSnapshot(filePath); err == nil {
+		t.Error("Expecting an error for an unknown snapshot version")
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	lastMod := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	gb := int64(1073741824)
+	oldFoo := newBucketCounter()
+	oldFoo.increment(10*gb, "STANDARD", ".gz", "logs", lastMod, true)
+	oldFoo.increment(gb, "STANDARD", ".bin", "data", lastMod, true)
+	newFoo := newBucketCounter()
+	newFoo.increment(10*gb, "STANDARD", ".gz", "logs", lastMod, true)
+	newFoo.increment(5*gb, "GLACIER", ".gz", "logs", lastMod, true)
+	newFoo.increment(gb, "STANDARD", ".bin", "data", lastMod, true)
+	newBar := newBucketCounter()
+	newBar.increment(2*gb, "STANDARD", ".csv", "tmp", lastMod, true)
+
+	from := newRunSnapshot(map[string]*bucketCounter{"foo": oldFoo}, time.Date(2018, 3, 9, 0, 0, 0, 0, time.UTC))
+	to := newRunSnapshot(map[string]*bucketCounter{"foo": newFoo, "bar": newBar}, time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	r := diffSnapshots(from, to, &alertOptions{percent: 40, minBytes: uint64(gb)})
+
+	if len(r.Buckets) != 2 || r.Buckets[0].Bucket != "bar" || r.Buckets[1].Bucket != "foo" {
+		t.Fatalf("Unexpected buckets %v", r.Buckets)
+	}
+	if g := r.Buckets[1].Size; g.Delta != 5*gb || *g.Percent < 45.45 || *g.Percent > 45.46 {
+		t.Errorf("Unexpected growth of bucket foo %+v", g)
+	}
+	if r.Buckets[0].Size.Percent != nil || r.Buckets[0].Size.formatPercent() != "new" {
+		t.Errorf("Expecting bucket bar to be new got %+v", r.Buckets[0].Size)
+	}
+	var alerts []string
+	for _, a := range r.Alerts {
+		alerts = append(alerts, a.String())
+	}
+	expectedAlerts := []string{
+		"bucket bar is new and contains 2.0000GB",
+		"prefix tmp/ of bucket bar is new and contains 2.0000GB",
+		"bucket foo grew by 45.45% from 11.0000GB to 16.0000GB",
+		"prefix logs/ of bucket foo grew by 50.00% from 10.0000GB to 15.0000GB",
+	}
+	if !reflect.DeepEqual(alerts, expectedAlerts) {
+		t.Errorf("Expecting %v got %v", expectedAlerts, alerts)
+	}
+
+	tables := diffTables(r)
+	expectedRows := [][]string{
+		{"bar", "STANDARD", "0", "1", "1", "new", "0.0000", "2.0000", "2.0000", "new"},
+		{"foo", "GLACIER", "0", "1", "1", "new", "0.0000", "5.0000", "5.0000", "new"},
+		{"foo", "STANDARD", "2", "2", "0", "0.00", "11.0000", "11.0000", "0.0000", "0.00"},
+	}
+	if !reflect.DeepEqual(tables[3].rows, expectedRows) {
+		t.Errorf("Expecting %v got %v", expectedRows, tables[3].rows)
+	}
+	if len(tables[4].headers) != 6 {
+		t.Errorf("Expecting no size columns for the extensions got %v", tables[4].headers)
+	}
+
+	var b bytes.Buffer
+	if err := writeDiff(&b, "markdown", r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(b.String(), "### Growth alerts\n") {
+		t.Errorf("Expecting the alerts first got %q", b.String())
+	}
+	if err := writeDiff(&b, "xml", r); err == nil {
+		t.Error("Expecting an error for an unknown format")
+	}
+
+	// No alert without threshold
+	if r = diffSnapshots(from, to, &alertOptions{}); len(r.Alerts) != 0 {
+		t.Errorf("Expecting no alert got %v", r.Alerts)
+	}
+}
+
+func TestParseDiffFlags(t *testing.T) {
+	os.Setenv("DIFF_REPORT_FORMAT", "json")
+	os.Setenv("DIFF_ALERT_THRESHOLD", "10")
+	os.Setenv("REPORT_PATH", "/tmp/scan.csv")
+	defer os.Unsetenv("DIFF_REPORT_FORMAT")
+	defer os.Unsetenv("DIFF_ALERT_THRESHOLD")
+	defer os.Unsetenv("REPORT_PATH")
+
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	path := fs.String("report-path", "/tmp/s3_diff.csv", "")
+	format := fs.String("report-format", "csv", "")
+	threshold := fs.Float64("alert-threshold", 0, "")
+	fs.Float64("alert-min-size", 1, "")
+	if err := parseDiffFlags(fs, []string{"-alert-threshold", "20", "old.json", "new.json"}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The command line has precedence over the environment, the variables of
+	// the scan are ignored
+	if *path != "/tmp/s3_diff.csv" || *format != "json" || *threshold != 20 {
+		t.Errorf("Unexpected flags: report-path=%s report-format=%s alert-threshold=%v", *path, *format, *threshold)
+	}
+	if fs.NArg() != 2 || fs.Arg(0) != "old.json" {
+		t.Errorf("Unexpected arguments %v", fs.Args())
+	}
+
+	os.Unsetenv("DIFF_REPORT_FORMAT")
+	os.Setenv("DIFF_ALERT_THRESHOLD", "ten")
+	fs = flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.Float64("alert-threshold", 0, "")
+	if err := parseDiffFlags(fs, nil); err == nil || !strings.Contains(err.Error(), "DIFF_ALERT_THRESHOLD") {
+		t.Errorf("Expecting an error on DIFF_ALERT_THRESHOLD got %v", err)
+	}
+}
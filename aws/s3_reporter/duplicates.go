@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// duplicatePartitions is the number of files the duplicate index is split
+// into. The objects with the same ETag and size are always in the same file, so
+// the files can be analyzed one at a time.
+const duplicatePartitions = 256
+
+// duplicateExamples is the number of copies listed for each duplicate group
+const duplicateExamples = 3
+
+// duplicateChunkSize is the number of bytes of records of a file of the index
+// sorted in memory at once. Bigger files are sorted in chunks written to disk
+// then merged.
+var duplicateChunkSize = 64 * 1024 * 1024
+
+// dupIndex is the index of the objects used to find duplicates. It is nil
+// when the duplicate detection is disabled.
+var dupIndex *duplicateIndex
+
+// duplicatePartition is one of the files of the duplicate index
+type duplicatePartition struct {
+	mutex sync.Locker
+	file  *os.File
+	w     *bufio.Writer
+}
+
+// duplicateIndex records the ETag, size, bucket and key of each object in a
+// set of files on disk, partitioned by ETag and size, to keep the memory used
+// bounded whatever the number of objects
+type duplicateIndex struct {
+	dir        string
+	partitions []*duplicatePartition
+}
+
+// duplicateFileName returns the name of the file of a partition of the index
+func duplicateFileName(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%03d.tsv", n))
+}
+
+// newDuplicateIndex creates the files of the duplicate index in a new
+// directory of the given one, so that several scans can run side by side
+func newDuplicateIndex(parent string) (*duplicateIndex, error) {
+	dir, err := ioutil.TempDir(parent, "s3_reporter_duplicates_")
+	if err != nil {
+		return nil, err
+	}
+	return openDuplicateIndex(dir)
+}
+
+// openDuplicateIndex opens the files of the duplicate index in the given
+// directory. The content of existing files is kept so that a resumed scan
+// completes the index of the interrupted one.
+func openDuplicateIndex(dir string) (*duplicateIndex, error) {
+	idx := &duplicateIndex{dir: dir}
+	for i := 0; i < duplicatePartitions; i++ {
+		f, err := os.OpenFile(duplicateFileName(dir, i), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			idx.close()
+			return nil, err
+		}
+		idx.partitions = append(idx.partitions, &duplicatePartition{mutex: &sync.Mutex{}, file: f, w: bufio.NewWriter(f)})
+	}
+	return idx, nil
+}
+
+// isMultipartETag returns true if the ETag is the one of an object uploaded in
+// several parts. Such an ETag is not the MD5 of the content and depends on the
+// size of the parts.
+func isMultipartETag(eTag string) bool {
+	return strings.Contains(eTag, "-")
+}
+
+// add records an object in the index. Empty objects and objects without ETag
+// are ignored.
+func (d *duplicateIndex) add(bucket string, obj *s3.Object) {
+	if obj.ETag == nil || obj.Size == nil || *obj.Size == 0 {
+		return
+	}
+	eTag := strings.Trim(*obj.ETag, `"`)
+	size := strconv.FormatInt(*obj.Size, 10)
+	h := fnv.New32a()
+	h.Write([]byte(eTag + "\t" + size))
+	p := d.partitions[h.Sum32()%duplicatePartitions]
+	p.mutex.Lock()
+	// The keys are url encoded so they cannot contain tabs or new lines
+	fmt.Fprintf(p.w, "%s\t%s\t%s\t%s\n", eTag, size, bucket, *obj.Key)
+	p.mutex.Unlock()
+}
+
+// flush writes the buffered records of all the partitions to disk
+func (d *duplicateIndex) flush() error {
+	for _, p := range d.partitions {
+		p.mutex.Lock()
+		err := p.w.Flush()
+		p.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close flushes and closes the files of the index
+func (d *duplicateIndex) close() error {
+	var res error
+	for _, p := range d.partitions {
+		p.mutex.Lock()
+		if err := p.w.Flush(); err != nil && res == nil {
+			res = err
+		}
+		if err := p.file.Close(); err != nil && res == nil {
+			res = err
+		}
+		p.mutex.Unlock()
+	}
+	return res
+}
+
+// remove deletes the directory of the index
+func (d *duplicateIndex) remove() error {
+	return os.RemoveAll(d.dir)
+}
+
+// duplicateGroup is a set of objects with the same ETag and size
+type duplicateGroup struct {
+	ETag      string   `json:"etag"`
+	Size      uint64   `json:"size_bytes"`
+	Copies    uint64   `json:"copies"`
+	Buckets   []string `json:"buckets"`
+	Wasted    uint64   `json:"wasted_bytes"`
+	Multipart bool     `json:"multipart_etag"`
+	Examples  []string `json:"examples"`
+}
+
+// duplicateReport contains the duplicate groups wasting the most bytes
+type duplicateReport struct {
+	// InBucket are the copies of the same object inside a single bucket
+	InBucket []*duplicateGroup `json:"in_bucket"`
+	// CrossBucket are the copies of the same object found in several buckets
+	CrossBucket []*duplicateGroup `json:"cross_bucket"`
+}
+
+// keepTop sorts the groups by wasted bytes and keeps the given number of them
+func keepTop(groups []*duplicateGroup, top int) []*duplicateGroup {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted != groups[j].Wasted {
+			return groups[i].Wasted > groups[j].Wasted
+		}
+		if groups[i].ETag != groups[j].ETag {
+			return groups[i].ETag < groups[j].ETag
+		}
+		return strings.Join(groups[i].Buckets, ",") < strings.Join(groups[j].Buckets, ",")
+	})
+	if top > 0 && len(groups) > top {
+		groups = groups[:top]
+	}
+	return groups
+}
+
+// newDuplicateGroup returns an empty group for the ETag and size of a record.
+// Each record is made of the ETag, the size, the bucket and the key.
+func newDuplicateGroup(record []string) *duplicateGroup {
+	size, _ := strconv.ParseUint(record[1], 10, 64)
+	return &duplicateGroup{
+		ETag:      record[0],
+		Size:      size,
+		Multipart: isMultipartETag(record[0]),
+	}
+}
+
+// addCopy adds a record to the group. The records of a bucket must be added
+// next to each other.
+func (g *duplicateGroup) addCopy(record []string) {
+	g.Copies++
+	g.Wasted = g.Size * (g.Copies - 1)
+	if len(g.Buckets) == 0 || g.Buckets[len(g.Buckets)-1] != record[2] {
+		g.Buckets = append(g.Buckets, record[2])
+	}
+	if len(g.Examples) < duplicateExamples {
+		g.Examples = append(g.Examples, record[2]+"/"+record[3])
+	}
+}
+
+// duplicateFinder builds the duplicate groups out of the sorted records of the
+// index, one record at a time, so that only the groups being built and the
+// top groups found so far are in memory
+type duplicateFinder struct {
+	top int
+	// key is the ETag and size of the current group
+	key string
+	// group holds all the copies of the current group, bucket its copies in
+	// the current bucket
+	group, bucket         *duplicateGroup
+	inBucket, crossBucket []*duplicateGroup
+}
+
+// add adds the next record of the index
+func (d *duplicateFinder) add(record []string) {
+	if key := record[0] + "\t" + record[1]; d.group == nil || key != d.key {
+		d.flush()
+		d.key = key
+		d.group = newDuplicateGroup(record)
+	}
+	if d.bucket != nil && d.bucket.Buckets[0] != record[2] {
+		d.flushBucket()
+	}
+	if d.bucket == nil {
+		d.bucket = newDuplicateGroup(record)
+	}
+	d.group.addCopy(record)
+	d.bucket.addCopy(record)
+}
+
+// keep adds a group to a list of groups, trimmed to the top groups once it
+// gets twice as long
+func (d *duplicateFinder) keep(groups []*duplicateGroup, g *duplicateGroup) []*duplicateGroup {
+	groups = append(groups, g)
+	if d.top > 0 && len(groups) >= 2*d.top {
+		groups = keepTop(groups, d.top)
+	}
+	return groups
+}
+
+// flushBucket ends the copies of the current group in the current bucket
+func (d *duplicateFinder) flushBucket() {
+	if d.bucket != nil && d.bucket.Copies > 1 {
+		d.inBucket = d.keep(d.inBucket, d.bucket)
+	}
+	d.bucket = nil
+}
+
+// flush ends the current group
+func (d *duplicateFinder) flush() {
+	d.flushBucket()
+	if d.group != nil && len(d.group.Buckets) > 1 {
+		d.crossBucket = d.keep(d.crossBucket, d.group)
+	}
+	d.group = nil
+}
+
+// sortRuns splits a file of the index in chunks of duplicateChunkSize bytes,
+// sorts each of them in memory and writes them next to the file. Returns the
+// paths of the sorted runs.
+func sortRuns(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var runs []string
+	var chunk []string
+	size := 0
+	writeRun := func() error {
+		sort.Strings(chunk)
+		run, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".run")
+		if err != nil {
+			return err
+		}
+		runs = append(runs, run.Name())
+		w := bufio.NewWriter(run)
+		for _, l := range chunk {
+			w.WriteString(l)
+			w.WriteByte('\n')
+		}
+		err = w.Flush()
+		if closeErr := run.Close(); err == nil {
+			err = closeErr
+		}
+		chunk = chunk[:0]
+		size = 0
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		chunk = append(chunk, scanner.Text())
+		size += len(scanner.Bytes())
+		if size >= duplicateChunkSize {
+			if err = writeRun(); err != nil {
+				return runs, err
+			}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return runs, err
+	}
+	if len(chunk) > 0 {
+		err = writeRun()
+	}
+	return runs, err
+}
+
+// runReader is a sorted run being merged, positioned on its next line
+type runReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+	line    string
+}
+
+// runHeap orders the runs being merged by their next line
+type runHeap []*runReader
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return h[i].line < h[j].line }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// mergeRuns reads the sorted runs in parallel and calls fn with their lines
+// in sorted order
+func mergeRuns(runs []string, fn func(string) error) error {
+	h := &runHeap{}
+	defer func() {
+		for _, r := range *h {
+			r.file.Close()
+		}
+	}()
+	for _, path := range runs {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		r := &runReader{file: f, scanner: bufio.NewScanner(f)}
+		if !r.scanner.Scan() {
+			f.Close()
+			if err = r.scanner.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+		r.line = r.scanner.Text()
+		*h = append(*h, r)
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		r := (*h)[0]
+		if err := fn(r.line); err != nil {
+			return err
+		}
+		if r.scanner.Scan() {
+			r.line = r.scanner.Text()
+			heap.Fix(h, 0)
+			continue
+		}
+		heap.Pop(h)
+		r.file.Close()
+		if err := r.scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyzePartition adds the records of a file of the index to the finder. The
+// file is sorted so that the records of a group are next to each other and
+// the records written twice, by a resumed scan, are counted once.
+func analyzePartition(filePath string, d *duplicateFinder) error {
+	runs, err := sortRuns(filePath)
+	defer func() {
+		for _, r := range runs {
+			os.Remove(r)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	previous := ""
+	err = mergeRuns(runs, func(l string) error {
+		if l == previous {
+			return nil
+		}
+		previous = l
+		r := strings.SplitN(l, "\t", 4)
+		if len(r) != 4 {
+			return fmt.Errorf("invalid record %q in %s", l, filePath)
+		}
+		d.add(r)
+		return nil
+	})
+	d.flush()
+	return err
+}
+
+// analyze reads the files of the index one by one and returns the given
+// number of duplicate groups wasting the most bytes. 0 returns all of them.
+func (d *duplicateIndex) analyze(top int) (*duplicateReport, error) {
+	if err := d.flush(); err != nil {
+		return nil, err
+	}
+	finder := &duplicateFinder{top: top}
+	for i := 0; i < duplicatePartitions; i++ {
+		if err := analyzePartition(duplicateFileName(d.dir, i), finder); err != nil {
+			return nil, err
+		}
+	}
+	return &duplicateReport{
+		InBucket:    keepTop(finder.inBucket, top),
+		CrossBucket: keepTop(finder.crossBucket, top),
+	}, nil
+}
+
+// duplicateTable builds the table of a list of duplicate groups. Returns nil
+// if the list is empty.
+func duplicateTable(title string, groups []*duplicateGroup) *reportTable {
+	if len(groups) == 0 {
+		return nil
+	}
+	t := reportTable{
+		title:   title,
+		headers: []string{"ETag", "Size (GB)", "Copies", "Wasted size (GB)", "Multipart ETag", "Buckets", "Examples"},
+	}
+	for _, g := range groups {
+		t.rows = append(t.rows, []string{
+			g.ETag,
+			strconv.FormatFloat(bytesToGB(g.Size), 'f', 4, 64),
+			strconv.FormatUint(g.Copies, 10),
+			strconv.FormatFloat(bytesToGB(g.Wasted), 'f', 4, 64),
+			strconv.FormatBool(g.Multipart),
+			strings.Join(g.Buckets, " "),
+			strings.Join(g.Examples, " "),
+		})
+	}
+	return &t
+}
+
+// duplicateTables builds the tables of the duplicates inside a bucket and
+// across buckets
+func duplicateTables(r *duplicateReport) []*reportTable {
+	return []*reportTable{
+		duplicateTable("Duplicate objects wasting the most bytes inside a bucket", r.InBucket),
+		duplicateTable("Duplicate objects wasting the most bytes across buckets", r.CrossBucket),
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestDuplicateIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	obj := func(key, eTag string, size int64) *s3.Object {
+		return &s3.Object{Key: aws.String(key), ETag: aws.String(`"` + eTag + `"`), Size: aws.Int64(size)}
+	}
+	idx, err := newDuplicateIndex(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Each scan gets its own directory
+	other, err := newDuplicateIndex(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	other.close()
+	if other.dir == idx.dir || filepath.Dir(idx.dir) != dir {
+		t.Errorf("Expecting 2 directories in %s got %s and %s", dir, idx.dir, other.dir)
+	}
+	if err = other.remove(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Same dataset copied in 2 buckets and twice in the first one
+	idx.add("foo", obj("data/a.csv", "aaa", 1000))
+	idx.add("foo", obj("backup/a.csv", "aaa", 1000))
+	idx.add("bar", obj("a.csv", "aaa", 1000))
+	// Multipart upload copied inside a bucket
+	idx.add("bar", obj("big1.bin", "bbb-2", 5000))
+	idx.add("bar", obj("big2.bin", "bbb-2", 5000))
+	// Same ETag but different sizes, empty objects and unique objects
+	idx.add("foo", obj("c.txt", "ccc", 10))
+	idx.add("foo", obj("d.txt", "ccc", 20))
+	idx.add("foo", obj("empty1", "d41d8cd98f00b204e9800998ecf8427e", 0))
+	idx.add("bar", obj("empty2", "d41d8cd98f00b204e9800998ecf8427e", 0))
+	if err = idx.close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// A resumed scan indexes some objects a second time
+	idx, err = openDuplicateIndex(idx.dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	idx.add("bar", obj("a.csv", "aaa", 1000))
+	idx.add("bar", obj("big2.bin", "bbb-2", 5000))
+
+	r, err := idx.analyze(0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := &duplicateReport{
+		InBucket: []*duplicateGroup{
+			{ETag: "bbb-2", Size: 5000, Copies: 2, Buckets: []string{"bar"}, Wasted: 5000, Multipart: true, Examples: []string{"bar/big1.bin", "bar/big2.bin"}},
+			{ETag: "aaa", Size: 1000, Copies: 2, Buckets: []string{"foo"}, Wasted: 1000, Examples: []string{"foo/backup/a.csv", "foo/data/a.csv"}},
+		},
+		CrossBucket: []*duplicateGroup{
+			{ETag: "aaa", Size: 1000, Copies: 3, Buckets: []string{"bar", "foo"}, Wasted: 2000, Examples: []string{"bar/a.csv", "foo/backup/a.csv", "foo/data/a.csv"}},
+		},
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expecting %+v got %+v", expected, r)
+	}
+	// The files sorted in several chunks give the same groups
+	defer func(size int) { duplicateChunkSize = size }(duplicateChunkSize)
+	duplicateChunkSize = 64
+	if r, err := idx.analyze(0); err != nil || !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expecting %+v got %+v, %v", expected, r, err)
+	}
+	if files, _ := ioutil.ReadDir(idx.dir); len(files) != duplicatePartitions {
+		t.Errorf("Expecting the sorted chunks to be removed, %d files in the index", len(files))
+	}
+	if r, err = idx.analyze(1); err != nil || len(r.InBucket) != 1 || r.InBucket[0].ETag != "bbb-2" {
+		t.Errorf("Expecting only the top group inside a bucket got %+v, %v", r, err)
+	}
+
+	tables := duplicateTables(r)
+	expectedRow := []string{"aaa", "0.0000", "3", "0.0000", "false", "bar foo", "bar/a.csv foo/backup/a.csv foo/data/a.csv"}
+	if !reflect.DeepEqual(tables[1].rows[0], expectedRow) {
+		t.Errorf("Expecting %v got %v", expectedRow, tables[1].rows[0])
+	}
+
+	idx.close()
+	if err = idx.remove(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expecting the index to be removed, %d files left", len(files))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Classes of the errors that make a bucket be skipped
+const (
+	errorAccessDenied = "access denied"
+	errorNoSuchBucket = "no such bucket"
+	errorWrongRegion  = "wrong region"
+	errorThrottling   = "throttling"
+	errorOther        = "other"
+)
+
+// exitPartial is the exit code of a scan which report has been written but
+// misses some buckets or accounts. Fatal errors exit with 1.
+const exitPartial = 2
+
+// throttlingCodes lists the error codes returned when the requests are
+// throttled
+var throttlingCodes = map[string]bool{
+	"SlowDown":                 true,
+	"Throttling":               true,
+	"ThrottlingException":      true,
+	"RequestLimitExceeded":     true,
+	"RequestThrottled":         true,
+	"TooManyRequestsException": true,
+}
+
+// errorClass returns the class of an error returned by S3, errorOther if it
+// is not a known one
+func errorClass(err error) string {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return errorOther
+	}
+	switch aerr.Code() {
+	case "AccessDenied", "AllAccessDisabled", "AccountProblem", "InvalidAccessKeyId", "ExpiredToken":
+		return errorAccessDenied
+	case s3.ErrCodeNoSuchBucket:
+		return errorNoSuchBucket
+	case "PermanentRedirect", "AuthorizationHeaderMalformed":
+		return errorWrongRegion
+	}
+	if throttlingCodes[aerr.Code()] || request.IsErrorThrottle(err) {
+		return errorThrottling
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		switch reqErr.StatusCode() {
+		case http.StatusForbidden:
+			return errorAccessDenied
+		case http.StatusNotFound:
+			return errorNoSuchBucket
+		case http.StatusMovedPermanently:
+			return errorWrongRegion
+		case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+			return errorThrottling
+		}
+	}
+	return errorOther
+}
+
+// retryPolicy configures the retries of the requests throttled by S3
+type retryPolicy struct {
+	// maxRetries is the number of retries after which the error is returned
+	maxRetries int
+	// delay is the delay before the first retry, doubled at each retry
+	delay time.Duration
+}
+
+// throttleRetries is the retry policy of the listings, set by the flags
+var throttleRetries = retryPolicy{maxRetries: 5, delay: time.Second}
+
+// retry calls fn until it succeeds, fails with an error other than a
+// throttling or has been retried maxRetries times. A random jitter is added to
+// the delay so that the workers throttled at the same time do not retry all
+// together. The listings resume from the last page counted, so fn can be
+// called again after a page has been sent.
+func (p retryPolicy) retry(what string, fn func() error) error {
+	delay := p.delay
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= p.maxRetries || errorClass(err) != errorThrottling {
+			return err
+		}
+		wait := delay
+		if delay > 0 {
+			wait = delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		}
+		log.Printf("Throttled while %s, retry %d/%d in %s: %s\n", what, i+1, p.maxRetries, wait, err)
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+// requesterPaysHandler adds the header accepting the charges of the requests
+// to the buckets configured as requester pays
+var requesterPaysHandler = request.NamedHandler{
+	Name: "s3_reporter.RequesterPays",
+	Fn: func(r *request.Request) {
+		r.HTTPRequest.Header.Set("x-amz-request-payer", s3.RequestPayerRequester)
+	},
+}
+
+// newS3Client returns a S3 client sending the requester pays header with each
+// request when the -requester-pays flag is set
+func newS3Client(p client.ConfigProvider, cfgs ...*aws.Config) *s3.S3 {
+	svc := s3.New(p, cfgs...)
+	if *requesterPays {
+		svc.Handlers.Build.PushBackNamed(requesterPaysHandler)
+	}
+	return svc
+}
+
+// skippedTable builds the table of the buckets that could not be fully
+// scanned with the class of the error and the error itself. Returns nil if no
+// bucket has been skipped.
+func skippedTable(skipped map[string]error) *reportTable {
+	if len(skipped) == 0 {
+		return nil
+	}
+	t := reportTable{
+		title:   "Skipped buckets",
+		headers: []string{"Bucket name", "Error type", "Reason"},
+	}
+	var buckets []string
+	for b := range skipped {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+	for _, b := range buckets {
+		t.rows = append(t.rows, []string{b, errorClass(skipped[b]), skipReason(skipped[b])})
+	}
+	return &t
+}
+
+// skipReason returns the error that made a bucket be skipped on a single line,
+// the code, message and status code of the S3 errors. As S3 denies the access
+// to the requester pays buckets when the requester does not accept the
+// charges, the access denied errors suggest the -requester-pays flag.
+func skipReason(err error) string {
+	reason := err.Error()
+	if aerr, ok := err.(awserr.Error); ok {
+		reason = aerr.Code()
+		if len(aerr.Message()) > 0 {
+			reason += ": " + aerr.Message()
+		}
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			reason += fmt.Sprintf(", status code: %d", reqErr.StatusCode())
+		}
+	}
+	if errorClass(err) == errorAccessDenied && !*requesterPays {
+		reason += " (if the bucket is requester pays, use -requester-pays)"
+	}
+	return reason
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3ErrorsMock serves the objects of s3ListMock for every bucket, fails the
+// location of the buckets in locationErr and throttles the given number of
+// listings after their first page
+type s3ErrorsMock struct {
+	*s3ListMock
+	mutex       sync.Mutex
+	locationErr map[string]error
+	throttles   int
+}
+
+func (m *s3ErrorsMock) GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	return &s3.GetBucketLocationOutput{}, m.locationErr[*input.Bucket]
+}
+
+func (m *s3ErrorsMock) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.throttles == 0 {
+		return m.s3ListMock.ListObjectsV2Pages(input, fn)
+	}
+	m.throttles--
+	throttled := false
+	m.s3ListMock.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		fn(page, lastPage)
+		throttled = !lastPage
+		return false
+	})
+	if throttled {
+		return awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "id")
+	}
+	return nil
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, d := range []struct {
+		err      error
+		expected string
+	}{
+		{awserr.New("AccessDenied", "Access Denied", nil), errorAccessDenied},
+		{awserr.NewRequestFailure(awserr.New("AllAccessDisabled", "All access to this object has been disabled", nil), 403, "id"), errorAccessDenied},
+		{awserr.NewRequestFailure(awserr.New("Forbidden", "", nil), 403, "id"), errorAccessDenied},
+		{awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil), errorNoSuchBucket},
+		{awserr.NewRequestFailure(awserr.New("NotFound", "", nil), 404, "id"), errorNoSuchBucket},
+		{awserr.New("PermanentRedirect", "The bucket must be addressed using the specified endpoint", nil), errorWrongRegion},
+		{awserr.New("SlowDown", "Please reduce your request rate.", nil), errorThrottling},
+		{awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, "id"), errorThrottling},
+		{awserr.New("InternalError", "We encountered an internal error", nil), errorOther},
+		{errors.New("unexpected EOF"), errorOther},
+	} {
+		if c := errorClass(d.err); c != d.expected {
+			t.Errorf("%s: expecting %q got %q", d.err, d.expected, c)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	throttled := awserr.New("SlowDown", "Please reduce your request rate.", nil)
+	for _, d := range []struct {
+		errs          []error
+		expectedCalls int
+		expectedErr   error
+	}{
+		{[]error{nil}, 1, nil},
+		{[]error{throttled, throttled, nil}, 3, nil},
+		{[]error{throttled, throttled, throttled, throttled}, 3, throttled},
+		{[]error{throttled, errors.New("failure"), nil}, 2, errors.New("failure")},
+	} {
+		calls := 0
+		err := retryPolicy{maxRetries: 2}.retry("testing", func() error {
+			calls++
+			return d.errs[calls-1]
+		})
+		if calls != d.expectedCalls || (err == nil) != (d.expectedErr == nil) || (err != nil && err.Error() != d.expectedErr.Error()) {
+			t.Errorf("%v: expecting %d calls and %v got %d and %v", d.errs, d.expectedCalls, d.expectedErr, calls, err)
+		}
+	}
+}
+
+func TestSkippedBuckets(t *testing.T) {
+	defer func(p retryPolicy) { throttleRetries = p }(throttleRetries)
+	throttleRetries = retryPolicy{maxRetries: 3}
+	reportMutex = &sync.Mutex{}
+	report = make(map[string]*bucketCounter)
+	svc := &s3ErrorsMock{
+		s3ListMock:  &s3ListMock{objects: mockObjects(100), pageSize: 10},
+		locationErr: map[string]error{"denied": awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id")},
+		throttles:   3,
+	}
+	progress := newScanProgress()
+	pools := &scanOptions{bucketWorkers: 1, pageWorkers: 2, pageQueue: 5}
+	scanBuckets(nil, "us-east-1", svc, []*string{aws.String("denied"), aws.String("foo")}, nil, progress, &reportOptions{prefixDepth: 1}, pools)
+
+	// The throttled listing resumes from the last page received
+	if !progress.isDone("foo") || report["foo"].fileCount != 100 {
+		t.Errorf("Expecting the 100 objects of bucket foo to be counted once got %d", report["foo"].fileCount)
+	}
+	failures := progress.failures()
+	if len(failures) != 1 || failures["denied"] == nil {
+		t.Fatalf("Expecting only bucket denied to be skipped got %v", failures)
+	}
+
+	b := &bytes.Buffer{}
+	r, _ := newReporter("csv", b, &reportOptions{skipped: failures})
+	if err := r.footer(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.close()
+	expected := "Skipped buckets\nBucket name,Error type,Reason\ndenied,access denied,\"AccessDenied: Access Denied, status code: 403 (if the bucket is requester pays, use -requester-pays)\"\n\n"
+	if b.String() != expected {
+		t.Errorf("Expecting %q got %q", expected, b.String())
+	}
+	*requesterPays = true
+	defer func() { *requesterPays = false }()
+	if row := skippedTable(failures).rows[0]; strings.Contains(row[2], "-requester-pays") {
+		t.Errorf("Expecting no hint when the requester pays got %v", row)
+	}
+}
+
+func TestRequesterPays(t *testing.T) {
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion("us-east-1")))
+	n := newS3Client(sess).Handlers.Build.Len()
+	*requesterPays = true
+	defer func() { *requesterPays = false }()
+	svc := newS3Client(sess)
+	if svc.Handlers.Build.Len() != n+1 {
+		t.Fatalf("Expecting the requester pays handler to be added to the %d handlers got %d", n, svc.Handlers.Build.Len())
+	}
+	svc.Handlers.Build.RemoveByName(requesterPaysHandler.Name)
+	if svc.Handlers.Build.Len() != n {
+		t.Errorf("Expecting the added handler to be the requester pays one")
+	}
+
+	r := &request.Request{HTTPRequest: httptest.NewRequest("GET", "https://foo.s3.amazonaws.com/", nil)}
+	requesterPaysHandler.Fn(r)
+	if h := r.HTTPRequest.Header.Get("x-amz-request-payer"); h != "requester" {
+		t.Errorf("Expecting the header x-amz-request-payer: requester got %q", h)
+	}
+}
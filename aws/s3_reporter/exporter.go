@@ -0,0 +1,257 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// otherRoot is the root label of the root folders merged together when a
+// bucket has more than -exporter-max-roots of them
+const otherRoot = "_other"
+
+var (
+	objectsDesc = prometheus.NewDesc("s3_reporter_objects",
+		"Number of objects found during the last scan.", []string{"bucket", "root"}, nil)
+	sizeDesc = prometheus.NewDesc("s3_reporter_size_bytes",
+		"Total size of the objects found during the last scan.", []string{"bucket", "root"}, nil)
+	objectsBySizeDesc = prometheus.NewDesc("s3_reporter_objects_by_size_range",
+		"Number of objects in each size range.", []string{"bucket", "root", "size_range"}, nil)
+	objectsByAgeDesc = prometheus.NewDesc("s3_reporter_objects_by_age_range",
+		"Number of objects in each range of age of their last modification.", []string{"bucket", "root", "age_range"}, nil)
+	sizeByAgeDesc = prometheus.NewDesc("s3_reporter_size_by_age_range_bytes",
+		"Total size of the objects in each range of age of their last modification.", []string{"bucket", "root", "age_range"}, nil)
+	objectsByClassDesc = prometheus.NewDesc("s3_reporter_objects_by_storage_class",
+		"Number of objects in each storage class.", []string{"bucket", "root", "storage_class"}, nil)
+	sizeByClassDesc = prometheus.NewDesc("s3_reporter_size_by_storage_class_bytes",
+		"Total size of the objects in each storage class.", []string{"bucket", "root", "storage_class"}, nil)
+	bucketSuccessDesc = prometheus.NewDesc("s3_reporter_bucket_scan_success",
+		"Whether the last scan of the bucket succeeded. The statistics of a failed bucket are the ones of its last successful scan.", []string{"bucket"}, nil)
+	scanSuccessDesc = prometheus.NewDesc("s3_reporter_last_scan_success",
+		"Whether the list of buckets could be retrieved during the last scan.", nil, nil)
+	scanTimestampDesc = prometheus.NewDesc("s3_reporter_last_scan_timestamp_seconds",
+		"Time the last scan started at, in seconds since the epoch.", nil, nil)
+	scanDurationDesc = prometheus.NewDesc("s3_reporter_last_scan_duration_seconds",
+		"Duration of the last scan.", nil, nil)
+)
+
+// metricsExporter exposes the statistics of the last scan of the buckets as
+// Prometheus metrics
+type metricsExporter struct {
+	mutex sync.Locker
+	// buckets holds the statistics of the last successful scan of each bucket
+	buckets    map[string]*counterSnapshot
+	succeeded  map[string]bool
+	listOK     bool
+	lastScan   time.Time
+	scanTime   time.Duration
+	maxRoots   int
+	hasScanned bool
+}
+
+// newExporter returns an exporter exposing at most maxRoots root folders per
+// bucket, 0 meaning no limit
+func newExporter(maxRoots int) *metricsExporter {
+	return &metricsExporter{
+		mutex:     &sync.Mutex{},
+		buckets:   make(map[string]*counterSnapshot),
+		succeeded: make(map[string]bool),
+		maxRoots:  maxRoots,
+	}
+}
+
+// scan runs a full scan of the buckets and updates the exposed statistics
+func (e *metricsExporter) scan(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, manifests map[string]*inventoryManifest, opts *reportOptions, pools *scanOptions) {
+	start := time.Now().UTC()
+	// The ages are computed as of the start of each scan
+	if !fixedAsOf {
+		setAsOf(start)
+	}
+	reportMutex.Lock()
+	report = make(map[string]*bucketCounter)
+	reportMutex.Unlock()
+	progress := newScanProgress()
+	buckets, err := getBuckets(svc, manifests)
+	if err != nil {
+		log.Printf("Error while retrieving the buckets list: %s\n", err)
+	} else {
+		scanBuckets(sess, sessionRegion, svc, buckets, manifests, progress, opts, pools)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.listOK = err == nil
+	e.lastScan = start
+	e.scanTime = time.Since(start)
+	e.hasScanned = true
+	if err != nil {
+		return
+	}
+	// Buckets that do not exist anymore are not exposed
+	succeeded := make(map[string]bool, len(report))
+	for b, c := range report {
+		succeeded[b] = progress.isDone(b)
+		if succeeded[b] {
+			e.buckets[b] = c.snapshot()
+		}
+	}
+	for b := range e.buckets {
+		if _, ok := succeeded[b]; !ok {
+			delete(e.buckets, b)
+		}
+	}
+	e.succeeded = succeeded
+	log.Printf("Scan of %d buckets done in %s", len(report), e.scanTime)
+}
+
+// Describe implements prometheus.Collector
+func (e *metricsExporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{objectsDesc, sizeDesc, objectsBySizeDesc, objectsByAgeDesc, sizeByAgeDesc,
+		objectsByClassDesc, sizeByClassDesc, bucketSuccessDesc, scanSuccessDesc, scanTimestampDesc, scanDurationDesc} {
+		ch <- d
+	}
+}
+
+// Collect implements prometheus.Collector
+func (e *metricsExporter) Collect(ch chan<- prometheus.Metric) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if !e.hasScanned {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(scanSuccessDesc, prometheus.GaugeValue, boolToFloat(e.listOK))
+	ch <- prometheus.MustNewConstMetric(scanTimestampDesc, prometheus.GaugeValue, float64(e.lastScan.Unix()))
+	ch <- prometheus.MustNewConstMetric(scanDurationDesc, prometheus.GaugeValue, e.scanTime.Seconds())
+	for b, ok := range e.succeeded {
+		ch <- prometheus.MustNewConstMetric(bucketSuccessDesc, prometheus.GaugeValue, boolToFloat(ok), b)
+	}
+	for b, s := range e.buckets {
+		for root, r := range limitRoots(s.RootCount, e.maxRoots) {
+			collectCounter(ch, b, root, r)
+		}
+	}
+}
+
+// collectCounter sends the metrics of a root folder of a bucket
+func collectCounter(ch chan<- prometheus.Metric, bucket, root string, s *counterSnapshot) {
+	ch <- prometheus.MustNewConstMetric(objectsDesc, prometheus.GaugeValue, float64(s.FileCount), bucket, root)
+	ch <- prometheus.MustNewConstMetric(sizeDesc, prometheus.GaugeValue, float64(s.SizeTotal), bucket, root)
+	for _, r := range sizeRangeLabels {
+		ch <- prometheus.MustNewConstMetric(objectsBySizeDesc, prometheus.GaugeValue, float64(s.SizeCount[r]), bucket, root, r)
+	}
+	for _, r := range dateRangeLabels {
+		var size uint64
+		for _, ctr := range s.AgeSize {
+			size += ctr[r]
+		}
+		ch <- prometheus.MustNewConstMetric(objectsByAgeDesc, prometheus.GaugeValue, float64(s.DateRange[r]), bucket, root, r)
+		ch <- prometheus.MustNewConstMetric(sizeByAgeDesc, prometheus.GaugeValue, float64(size), bucket, root, r)
+	}
+	for class, n := range s.StorageCount {
+		ch <- prometheus.MustNewConstMetric(objectsByClassDesc, prometheus.GaugeValue, float64(n), bucket, root, class)
+		ch <- prometheus.MustNewConstMetric(sizeByClassDesc, prometheus.GaugeValue, float64(s.StorageSize[class]), bucket, root, class)
+	}
+}
+
+// limitRoots returns the maxRoots biggest root folders, the other ones being
+// merged under the _other root. 0 means no limit.
+func limitRoots(roots map[string]*counterSnapshot, maxRoots int) map[string]*counterSnapshot {
+	if maxRoots == 0 || len(roots) <= maxRoots {
+		return roots
+	}
+	names := make([]string, 0, len(roots))
+	for k := range roots {
+		names = append(names, k)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if roots[names[i]].SizeTotal != roots[names[j]].SizeTotal {
+			return roots[names[i]].SizeTotal > roots[names[j]].SizeTotal
+		}
+		return names[i] < names[j]
+	})
+	res := make(map[string]*counterSnapshot, maxRoots+1)
+	other := &counterSnapshot{
+		SizeCount:    make(map[string]uint64),
+		StorageCount: make(map[string]uint64),
+		StorageSize:  make(map[string]uint64),
+		DateRange:    make(map[string]uint64),
+		AgeSize:      make(map[string]map[string]uint64),
+	}
+	for i, k := range names {
+		if i < maxRoots {
+			res[k] = roots[k]
+			continue
+		}
+		mergeSnapshot(other, roots[k])
+	}
+	// A real root folder named _other is merged as well
+	if r, ok := res[otherRoot]; ok {
+		mergeSnapshot(other, r)
+	}
+	res[otherRoot] = other
+	return res
+}
+
+// mergeSnapshot adds the counters exposed as metrics of src to dst
+func mergeSnapshot(dst, src *counterSnapshot) {
+	dst.FileCount += src.FileCount
+	dst.SizeTotal += src.SizeTotal
+	addUint64(dst.SizeCount, src.SizeCount)
+	addUint64(dst.StorageCount, src.StorageCount)
+	addUint64(dst.StorageSize, src.StorageSize)
+	addUint64(dst.DateRange, src.DateRange)
+	for class, ctr := range src.AgeSize {
+		if _, ok := dst.AgeSize[class]; !ok {
+			dst.AgeSize[class] = make(map[string]uint64)
+		}
+		addUint64(dst.AgeSize[class], ctr)
+	}
+}
+
+// addUint64 adds the values of src to dst
+func addUint64(dst, src map[string]uint64) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// boolToFloat returns 1 for true and 0 for false
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// handler returns the HTTP handler serving the metrics on /metrics
+func (e *metricsExporter) handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(e)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	return mux
+}
+
+// runExporter serves the metrics on the given address and runs the scan every
+// interval. It never returns.
+func runExporter(addr string, interval time.Duration, e *metricsExporter, scan func()) {
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, e.handler()))
+	}()
+	log.Printf("Serving the metrics on %s/metrics", addr)
+	for {
+		start := time.Now()
+		scan()
+		if wait := interval - time.Since(start); wait > 0 {
+			log.Printf("Next scan in %s", wait)
+			time.Sleep(wait)
+		}
+	}
+}
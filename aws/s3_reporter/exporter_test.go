@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3BucketsMock serves a static list of objects for each bucket and fails the
+// listing of the buckets in failing. The listing of the buckets fails with
+// listErr if set.
+type s3BucketsMock struct {
+	s3iface.S3API
+	objects map[string][]*s3.Object
+	failing map[string]bool
+	listErr error
+}
+
+func (m *s3BucketsMock) ListBuckets(*s3.ListBucketsInput) (*s3.ListBucketsOutput, error) {
+	res := &s3.ListBucketsOutput{}
+	if m.listErr != nil {
+		return res, m.listErr
+	}
+	var names []string
+	for b := range m.objects {
+		names = append(names, b)
+	}
+	sort.Strings(names)
+	for _, b := range names {
+		res.Buckets = append(res.Buckets, &s3.Bucket{Name: aws.String(b)})
+	}
+	return res, nil
+}
+
+func (m *s3BucketsMock) GetBucketLocation(*s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	return &s3.GetBucketLocationOutput{}, nil
+}
+
+func (m *s3BucketsMock) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	if m.failing[*input.Bucket] {
+		return errors.New("AccessDenied")
+	}
+	fn(&s3.ListObjectsV2Output{Name: input.Bucket, Contents: m.objects[*input.Bucket]}, true)
+	return nil
+}
+
+// scrape returns the body served on /metrics
+func scrape(t *testing.T, url string) string {
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+func TestExporter(t *testing.T) {
+	reportMutex = &sync.Mutex{}
+	lastMod := time.Now().UTC().AddDate(0, 0, -1)
+	obj := func(key string, size int64, class string) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), StorageClass: aws.String(class), LastModified: aws.Time(lastMod)}
+	}
+	svc := &s3BucketsMock{
+		objects: map[string][]*s3.Object{
+			"foo": {obj("logs/a.gz", 2048, "STANDARD"), obj("logs/b.gz", 4096, "GLACIER"), obj("data/c.bin", 100, "STANDARD"), obj("tmp/d", 10, "STANDARD")},
+			"bar": {obj("x/y.csv", 500, "STANDARD")},
+		},
+		failing: map[string]bool{},
+	}
+	e := newExporter(2)
+	server := httptest.NewServer(e.handler())
+	defer server.Close()
+
+	if body := scrape(t, server.URL); strings.Contains(body, "s3_reporter_") {
+		t.Errorf("Expecting no metric before the first scan got %s", body)
+	}
+
+	opts := &reportOptions{prefixDepth: 1}
+	pools := &scanOptions{bucketWorkers: 8, pageWorkers: 2, pageQueue: 100}
+	e.scan(nil, "us-east-1", svc, nil, opts, pools)
+	body := scrape(t, server.URL)
+	for _, l := range []string{
+		`s3_reporter_last_scan_success 1`,
+		`s3_reporter_bucket_scan_success{bucket="foo"} 1`,
+		`s3_reporter_objects{bucket="foo",root="logs"} 2`,
+		`s3_reporter_size_bytes{bucket="foo",root="logs"} 6144`,
+		`s3_reporter_objects_by_size_range{bucket="foo",root="logs",size_range="1KB-10KB"} 2`,
+		`s3_reporter_objects_by_age_range{age_range="<1 month",bucket="foo",root="logs"} 2`,
+		`s3_reporter_size_by_age_range_bytes{age_range="<1 month",bucket="foo",root="logs"} 6144`,
+		`s3_reporter_objects_by_storage_class{bucket="foo",root="logs",storage_class="GLACIER"} 1`,
+		`s3_reporter_size_by_storage_class_bytes{bucket="foo",root="logs",storage_class="GLACIER"} 4096`,
+		// data and tmp are merged as only 2 roots are exposed
+		`s3_reporter_objects{bucket="foo",root="_other"} 1`,
+		`s3_reporter_size_bytes{bucket="foo",root="_other"} 10`,
+		`s3_reporter_objects{bucket="foo",root="data"} 1`,
+		`s3_reporter_objects{bucket="bar",root="x"} 1`,
+	} {
+		if !strings.Contains(body, l+"\n") {
+			t.Errorf("Expecting the line %q in %s", l, body)
+		}
+	}
+	if strings.Contains(body, `root="tmp"`) {
+		t.Errorf("Expecting the root tmp to be merged in _other got %s", body)
+	}
+
+	// The statistics of a failed bucket are the ones of the previous scan
+	svc.failing["bar"] = true
+	svc.objects["bar"] = append(svc.objects["bar"], obj("x/z.csv", 500, "STANDARD"))
+	e.scan(nil, "us-east-1", svc, nil, opts, pools)
+	body = scrape(t, server.URL)
+	for _, l := range []string{
+		`s3_reporter_bucket_scan_success{bucket="bar"} 0`,
+		`s3_reporter_objects{bucket="bar",root="x"} 1`,
+		`s3_reporter_objects{bucket="foo",root="logs"} 2`,
+	} {
+		if !strings.Contains(body, l+"\n") {
+			t.Errorf("Expecting the line %q in %s", l, body)
+		}
+	}
+
+	// Deleted buckets disappear
+	delete(svc.objects, "bar")
+	e.scan(nil, "us-east-1", svc, nil, opts, pools)
+	if body = scrape(t, server.URL); strings.Contains(body, `bucket="bar"`) {
+		t.Errorf("Expecting no metric of the deleted bucket got %s", body)
+	}
+
+	// OpenMetrics is served when asked for
+	req, _ := http.NewRequest("GET", server.URL+"/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+	if data, _ := ioutil.ReadAll(resp.Body); !strings.HasSuffix(string(data), "# EOF\n") {
+		t.Errorf("Expecting an OpenMetrics exposition got %s", data)
+	}
+}
+
+func TestLimitRoots(t *testing.T) {
+	c := newBucketCounter()
+	lastMod := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	c.increment(300, "STANDARD", ".txt", "a", lastMod, true)
+	c.increment(200, "STANDARD", ".txt", "b", lastMod, true)
+	c.increment(100, "GLACIER", ".txt", "_other", lastMod, true)
+	c.increment(50, "STANDARD", ".txt", "c", lastMod, true)
+	roots := c.snapshot().RootCount
+
+	if r := limitRoots(roots, 0); len(r) != 4 {
+		t.Errorf("Expecting all the roots without limit got %v", r)
+	}
+	r := limitRoots(roots, 2)
+	if len(r) != 3 || r["a"] == nil || r["b"] == nil {
+		t.Fatalf("Expecting a, b and _other got %v", r)
+	}
+	other := r[otherRoot]
+	if other.FileCount != 2 || other.SizeTotal != 150 || other.StorageSize["GLACIER"] != 100 || other.StorageSize["STANDARD"] != 50 {
+		t.Errorf("Unexpected merged root %+v", other)
+	}
+	if roots[otherRoot].FileCount != 1 {
+		t.Errorf("Expecting the original roots to be left untouched got %+v", roots[otherRoot])
+	}
+}
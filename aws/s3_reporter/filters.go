@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyFilters decides which objects are counted. It is nil when no filter is
+// active, in which case all the objects are counted.
+var keyFilters *filterSet
+
+// filterRules is a rule set selecting the objects counted, as written in the
+// filters file. An object is counted if its key matches one of the include
+// expressions, if any, and none of the exclude expressions, and if its size
+// and last modification date are in the given ranges.
+type filterRules struct {
+	Include []string `json:"include,omitempty" yaml:"include"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude"`
+	// MinSize and MaxSize are in bytes, 0 meaning no limit
+	MinSize int64 `json:"min_size,omitempty" yaml:"min_size"`
+	MaxSize int64 `json:"max_size,omitempty" yaml:"max_size"`
+	// ModifiedAfter and ModifiedBefore are dates or RFC3339 timestamps
+	ModifiedAfter  string `json:"modified_after,omitempty" yaml:"modified_after"`
+	ModifiedBefore string `json:"modified_before,omitempty" yaml:"modified_before"`
+}
+
+// filterFile is the content of the filters file: the default rule set and
+// the rule sets of specific buckets, which replace the default one
+type filterFile struct {
+	filterRules `yaml:",inline"`
+	Buckets     map[string]*filterRules `json:"buckets,omitempty" yaml:"buckets"`
+}
+
+// keyExpr is an include or exclude expression of a key: a prefix, a glob or a
+// regular expression
+type keyExpr struct {
+	kind  string
+	value string
+	re    *regexp.Regexp
+}
+
+// parseKeyExpr parses an expression of the form prefix:value, glob:value or
+// regex:value. An expression without kind is a prefix.
+func parseKeyExpr(s string) (*keyExpr, error) {
+	e := &keyExpr{kind: "prefix", value: s}
+	if i := strings.Index(s, ":"); i >= 0 {
+		switch s[:i] {
+		case "prefix", "glob", "regex":
+			e.kind, e.value = s[:i], s[i+1:]
+		}
+	}
+	switch e.kind {
+	case "glob":
+		if _, err := path.Match(e.value, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %s", e.value, err)
+		}
+	case "regex":
+		re, err := regexp.Compile(e.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %s", e.value, err)
+		}
+		e.re = re
+	}
+	return e, nil
+}
+
+// match returns true if the key matches the expression. A glob without any
+// slash is matched against the last element of the key only, so that *.gz
+// matches the gzipped files of any folder.
+func (e *keyExpr) match(key string) bool {
+	switch e.kind {
+	case "glob":
+		name := key
+		if !strings.Contains(e.value, "/") {
+			name = key[strings.LastIndex(key, "/")+1:]
+		}
+		ok, _ := path.Match(e.value, name)
+		return ok
+	case "regex":
+		return e.re.MatchString(key)
+	}
+	return strings.HasPrefix(key, e.value)
+}
+
+func (e *keyExpr) String() string {
+	return e.kind + ":" + e.value
+}
+
+// keyFilter is a compiled filterRules
+type keyFilter struct {
+	include []*keyExpr
+	exclude []*keyExpr
+	minSize int64
+	maxSize int64
+	after   time.Time
+	before  time.Time
+}
+
+// parseFilterDate parses a date of the form 2006-01-02 or a RFC3339 timestamp
+func parseFilterDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q, expecting 2006-01-02 or a RFC3339 timestamp", s)
+	}
+	return t.UTC(), nil
+}
+
+// compile checks the rule set and returns the corresponding filter
+func (r *filterRules) compile() (*keyFilter, error) {
+	f := &keyFilter{minSize: r.MinSize, maxSize: r.MaxSize}
+	for _, list := range []struct {
+		exprs []string
+		dst   *[]*keyExpr
+	}{{r.Include, &f.include}, {r.Exclude, &f.exclude}} {
+		for _, s := range list.exprs {
+			e, err := parseKeyExpr(s)
+			if err != nil {
+				return nil, err
+			}
+			*list.dst = append(*list.dst, e)
+		}
+	}
+	if r.MinSize < 0 || r.MaxSize < 0 || (r.MaxSize > 0 && r.MinSize > r.MaxSize) {
+		return nil, fmt.Errorf("invalid size range [%d, %d]", r.MinSize, r.MaxSize)
+	}
+	var err error
+	if len(r.ModifiedAfter) > 0 {
+		if f.after, err = parseFilterDate(r.ModifiedAfter); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.ModifiedBefore) > 0 {
+		if f.before, err = parseFilterDate(r.ModifiedBefore); err != nil {
+			return nil, err
+		}
+	}
+	if !f.after.IsZero() && !f.before.IsZero() && !f.after.Before(f.before) {
+		return nil, fmt.Errorf("modified after %s is not before modified before %s", r.ModifiedAfter, r.ModifiedBefore)
+	}
+	return f, nil
+}
+
+// match returns true if the object must be counted
+func (f *keyFilter) match(key string, size int64, lastMod time.Time) bool {
+	if size < f.minSize || (f.maxSize > 0 && size > f.maxSize) {
+		return false
+	}
+	if (!f.after.IsZero() && lastMod.Before(f.after)) || (!f.before.IsZero() && !lastMod.Before(f.before)) {
+		return false
+	}
+	for _, e := range f.exclude {
+		if e.match(key) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, e := range f.include {
+		if e.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns the description of each rule of the rule set. The key
+// expressions are given with their kind.
+func (r *filterRules) describe() []string {
+	var res []string
+	expr := func(s string) string {
+		if e, err := parseKeyExpr(s); err == nil {
+			return e.String()
+		}
+		return s
+	}
+	for _, e := range r.Include {
+		res = append(res, "include "+expr(e))
+	}
+	for _, e := range r.Exclude {
+		res = append(res, "exclude "+expr(e))
+	}
+	if r.MinSize > 0 {
+		res = append(res, "min size "+strconv.FormatInt(r.MinSize, 10)+" bytes")
+	}
+	if r.MaxSize > 0 {
+		res = append(res, "max size "+strconv.FormatInt(r.MaxSize, 10)+" bytes")
+	}
+	if len(r.ModifiedAfter) > 0 {
+		res = append(res, "modified after "+r.ModifiedAfter)
+	}
+	if len(r.ModifiedBefore) > 0 {
+		res = append(res, "modified before "+r.ModifiedBefore)
+	}
+	return res
+}
+
+// filterSet holds the default filter and the filters of specific buckets
+type filterSet struct {
+	rules   *filterFile
+	def     *keyFilter
+	buckets map[string]*keyFilter
+}
+
+// newFilterSet compiles the rule sets. It returns nil if no rule is set.
+func newFilterSet(rules *filterFile) (*filterSet, error) {
+	if len(rules.describe()) == 0 && len(rules.Buckets) == 0 {
+		return nil, nil
+	}
+	s := &filterSet{rules: rules, buckets: make(map[string]*keyFilter, len(rules.Buckets))}
+	var err error
+	if s.def, err = rules.compile(); err != nil {
+		return nil, err
+	}
+	for b, r := range rules.Buckets {
+		if r == nil {
+			r = &filterRules{}
+			rules.Buckets[b] = r
+		}
+		if s.buckets[b], err = r.compile(); err != nil {
+			return nil, fmt.Errorf("bucket %s: %s", b, err)
+		}
+	}
+	return s, nil
+}
+
+// match returns true if the object of the bucket must be counted. All the
+// objects are counted when the set is nil.
+func (s *filterSet) match(bucket, key string, size int64, lastMod time.Time) bool {
+	if s == nil {
+		return true
+	}
+	if f, ok := s.buckets[bucket]; ok {
+		return f.match(key, size, lastMod)
+	}
+	return s.def.match(key, size, lastMod)
+}
+
+// loadFilters reads the rule sets from a yaml or json file
+func loadFilters(filePath string) (*filterFile, error) {
+	f := filterFile{}
+	if err := loadConfigFile(filePath, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// filtersTable builds the table of the filters active during the scan
+func filtersTable(s *filterSet) *reportTable {
+	if s == nil {
+		return nil
+	}
+	t := reportTable{
+		title:   "Active filters",
+		headers: []string{"Scope", "Filter"},
+	}
+	for _, d := range s.rules.describe() {
+		t.rows = append(t.rows, []string{"all buckets", d})
+	}
+	for _, b := range sortedRuleKeys(s.rules.Buckets) {
+		desc := s.rules.Buckets[b].describe()
+		if len(desc) == 0 {
+			desc = []string{"no filter"}
+		}
+		for _, d := range desc {
+			t.rows = append(t.rows, []string{"bucket " + b, d})
+		}
+	}
+	return &t
+}
+
+// sortedRuleKeys returns the buckets of the rule sets sorted
+func sortedRuleKeys(m map[string]*filterRules) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestKeyFilter(t *testing.T) {
+	lastMod := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	testData := []struct {
+		rules    filterRules
+		key      string
+		size     int64
+		lastMod  time.Time
+		expected bool
+	}{
+		{filterRules{}, "foo/bar.gz", 10, lastMod, true},
+		{filterRules{Include: []string{"foo/"}}, "foo/bar.gz", 10, lastMod, true},
+		{filterRules{Include: []string{"prefix:baz/"}}, "foo/bar.gz", 10, lastMod, false},
+		{filterRules{Include: []string{"baz/", "glob:*.gz"}}, "foo/bar.gz", 10, lastMod, true},
+		{filterRules{Include: []string{"glob:foo/*.gz"}}, "foo/baz/bar.gz", 10, lastMod, false},
+		{filterRules{Include: []string{"glob:foo/*/*.gz"}}, "foo/baz/bar.gz", 10, lastMod, true},
+		{filterRules{Include: []string{"regex:^foo/[0-9]{4}/"}}, "foo/2018/bar.gz", 10, lastMod, true},
+		{filterRules{Include: []string{"regex:^foo/[0-9]{4}/"}}, "foo/bar/bar.gz", 10, lastMod, false},
+		{filterRules{Include: []string{"foo/"}, Exclude: []string{"glob:*.gz"}}, "foo/bar.gz", 10, lastMod, false},
+		// An unknown kind is part of the prefix
+		{filterRules{Include: []string{"foo:bar"}}, "foo:bar/baz", 10, lastMod, true},
+		{filterRules{MinSize: 10}, "foo", 10, lastMod, true},
+		{filterRules{MinSize: 11}, "foo", 10, lastMod, false},
+		{filterRules{MaxSize: 9}, "foo", 10, lastMod, false},
+		{filterRules{ModifiedAfter: "2018-03-01"}, "foo", 10, lastMod, true},
+		{filterRules{ModifiedAfter: "2018-03-01T00:00:01Z"}, "foo", 10, lastMod, false},
+		{filterRules{ModifiedBefore: "2018-03-01"}, "foo", 10, lastMod, false},
+		{filterRules{ModifiedAfter: "2018-01-01", ModifiedBefore: "2018-04-01"}, "foo", 10, lastMod, true},
+	}
+	for n, d := range testData {
+		f, err := d.rules.compile()
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %s", n, err)
+			continue
+		}
+		if r := f.match(d.key, d.size, d.lastMod); r != d.expected {
+			t.Errorf("#%d: expecting %t got %t", n, d.expected, r)
+		}
+	}
+
+	for n, rules := range []filterRules{
+		{Include: []string{"glob:[a-"}},
+		{Exclude: []string{"regex:("}},
+		{MinSize: 10, MaxSize: 5},
+		{ModifiedAfter: "yesterday"},
+		{ModifiedAfter: "2018-04-01", ModifiedBefore: "2018-01-01"},
+	} {
+		if _, err := rules.compile(); err == nil {
+			t.Errorf("#%d: expecting an error for %+v", n, rules)
+		}
+	}
+}
+
+func TestFilterSet(t *testing.T) {
+	if s, err := newFilterSet(&filterFile{}); s != nil || err != nil {
+		t.Errorf("Expecting no filter got %v, %v", s, err)
+	}
+	s, err := newFilterSet(&filterFile{
+		filterRules: filterRules{Include: []string{"logs/"}},
+		Buckets:     map[string]*filterRules{"foo": {Exclude: []string{"logs/"}}, "bar": nil},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lastMod := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, d := range []struct {
+		bucket, key string
+		expected    bool
+	}{
+		{"baz", "logs/a", true},
+		{"baz", "data/a", false},
+		{"foo", "logs/a", false},
+		{"foo", "data/a", true},
+		{"bar", "data/a", true},
+	} {
+		if r := s.match(d.bucket, d.key, 1, lastMod); r != d.expected {
+			t.Errorf("%s/%s: expecting %t got %t", d.bucket, d.key, d.expected, r)
+		}
+	}
+
+	expected := [][]string{
+		{"all buckets", "include prefix:logs/"},
+		{"bucket bar", "no filter"},
+		{"bucket foo", "exclude prefix:logs/"},
+	}
+	if rows := filtersTable(s).rows; !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Expecting %v got %v", expected, rows)
+	}
+}
+
+func TestLoadFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := &filterFile{
+		filterRules: filterRules{Include: []string{"glob:*.parquet"}, MinSize: 1024, ModifiedAfter: "2018-01-01"},
+		Buckets:     map[string]*filterRules{"foo": {Exclude: []string{"regex:^tmp/"}}},
+	}
+	testData := []struct {
+		fileName, content string
+		expectError       bool
+	}{
+		{"filters.yaml", "include: ['glob:*.parquet']\nmin_size: 1024\nmodified_after: 2018-01-01\nbuckets:\n  foo:\n    exclude: ['regex:^tmp/']\n", false},
+		{"filters.json", `{"include": ["glob:*.parquet"], "min_size": 1024, "modified_after": "2018-01-01", "buckets": {"foo": {"exclude": ["regex:^tmp/"]}}}`, false},
+		{"filters.txt", "", true},
+	}
+	for n, d := range testData {
+		filePath := filepath.Join(dir, d.fileName)
+		if err = ioutil.WriteFile(filePath, []byte(d.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := loadFilters(filePath)
+		if d.expectError {
+			if err == nil {
+				t.Errorf("#%d: expecting an error", n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %s", n, err)
+			continue
+		}
+		if !reflect.DeepEqual(f, expected) {
+			t.Errorf("#%d: expecting %+v got %+v", n, expected, f)
+		}
+	}
+}
+
+func TestFilteredScan(t *testing.T) {
+	reportMutex = &sync.Mutex{}
+	svc := &s3KeySpaceMock{objects: map[string][]*s3.Object{"foo": keySpaceObjects(3, 10)}, pageSize: 7}
+	pools := &scanOptions{bucketWorkers: 1, pageWorkers: 2, pageQueue: 5}
+	var err error
+	keyFilters, err = newFilterSet(&filterFile{filterRules: filterRules{Include: []string{"dir001/", "glob:*.txt"}, MinSize: 5000}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer func() { keyFilters = nil }()
+
+	report = make(map[string]*bucketCounter)
+	res := scanKeySpace(svc, newScanProgress(), pools)
+	// The objects of size 5000 to 9000 of dir001 and of the root
+	if res["foo"].FileCount != 10 || res["foo"].RootCount["dir000"] != nil {
+		t.Errorf("Unexpected statistics %+v", res["foo"])
+	}
+
+	// The keys are matched once decoded
+	if !keyFilters.match("foo", decodeKey("dir001/my+file%C3%A9.txt"), 5000, time.Now()) || decodeKey("dir001/my+file%C3%A9.txt") != "dir001/my fileé.txt" {
+		t.Error("Expecting the decoded key to match")
+	}
+
+	b := &bytes.Buffer{}
+	r, _ := newReporter("csv", b, &reportOptions{filters: keyFilters})
+	if err := r.header(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.close()
+	expected := "Active filters\nScope,Filter\nall buckets,include prefix:dir001/\nall buckets,include glob:*.txt\nall buckets,min size 5000 bytes\n\n"
+	if b.String() != expected {
+		t.Errorf("Expecting %q got %q", expected, b.String())
+	}
+
+	b.Reset()
+	r, _ = newReporter("markdown", b, &reportOptions{})
+	if err := r.header(); err != nil || b.Len() != 0 {
+		t.Errorf("Expecting no header without filter got %q, %v", b.String(), err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/scritchley/orc"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// inventoryRows reads the rows of an inventory data file as strings, at the
+// positions of the fields of the inventory schema. read returns io.EOF after
+// the last row.
+type inventoryRows interface {
+	read() ([]string, error)
+	Close() error
+}
+
+// openInventoryRows returns the reader of the rows of a data file in the
+// format of the inventory schema
+func openInventoryRows(f io.Reader, schema *inventorySchema) (inventoryRows, error) {
+	switch schema.format {
+	case "ORC":
+		return newORCRows(f, schema)
+	case "PARQUET":
+		return newParquetRows(f, schema)
+	}
+	return newCSVRows(f)
+}
+
+// csvRows reads a gzipped csv data file
+type csvRows struct {
+	gz *gzip.Reader
+	r  *csv.Reader
+}
+
+func newCSVRows(f io.Reader) (*csvRows, error) {
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(gz)
+	r.FieldsPerRecord = -1
+	return &csvRows{gz: gz, r: r}, nil
+}
+
+func (r *csvRows) read() ([]string, error) {
+	return r.r.Read()
+}
+
+func (r *csvRows) Close() error {
+	return r.gz.Close()
+}
+
+// spoolInventoryFile returns the path of a local copy of a data file, as the
+// columnar formats are read starting from their footer. The local files are
+// read in place, the others are copied to a temporary file deleted by the
+// returned function.
+func spoolInventoryFile(f io.Reader) (string, func(), error) {
+	if file, ok := f.(*os.File); ok {
+		return file.Name(), func() {}, nil
+	}
+	tmp, err := ioutil.TempFile("", "s3_reporter_inventory_")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, f)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
+
+// inventoryValue formats a value read from a columnar data file like in a csv
+// data file
+func inventoryValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// orcRows reads an ORC data file stripe by stripe
+type orcRows struct {
+	reader    *orc.Reader
+	cursor    *orc.Cursor
+	positions []int
+	columns   int
+	inStripe  bool
+	cleanup   func()
+}
+
+func newORCRows(f io.Reader, schema *inventorySchema) (*orcRows, error) {
+	path, cleanup, err := spoolInventoryFile(f)
+	if err != nil {
+		return nil, err
+	}
+	r, err := orc.Open(path)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	res := orcRows{reader: r, positions: schema.used(), columns: schema.columns, cleanup: cleanup}
+	var names []string
+	for _, i := range res.positions {
+		names = append(names, schema.fields[i])
+	}
+	res.cursor = r.Select(names...)
+	return &res, nil
+}
+
+func (r *orcRows) read() ([]string, error) {
+	for {
+		if r.inStripe && r.cursor.Next() {
+			row := make([]string, r.columns)
+			for i, v := range r.cursor.Row() {
+				row[r.positions[i]] = inventoryValue(v)
+			}
+			return row, nil
+		}
+		if r.inStripe = r.cursor.Stripes(); !r.inStripe {
+			if err := r.cursor.Err(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+	}
+}
+
+func (r *orcRows) Close() error {
+	err := r.reader.Close()
+	r.cleanup()
+	return err
+}
+
+// parquetRows reads a Parquet data file column by column, inventoryPageSize
+// rows at a time
+type parquetRows struct {
+	file      source.ParquetFile
+	reader    *reader.ParquetReader
+	paths     map[int]string
+	columns   int
+	remaining int64
+	buffer    [][]string
+	// lastModified is the position of the last modified date, stored as a
+	// number of milliseconds or microseconds
+	lastModified int
+	micros       bool
+	cleanup      func()
+}
+
+func newParquetRows(f io.Reader, schema *inventorySchema) (*parquetRows, error) {
+	path, cleanup, err := spoolInventoryFile(f)
+	if err != nil {
+		return nil, err
+	}
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		file.Close()
+		cleanup()
+		return nil, err
+	}
+	res := parquetRows{
+		file:         file,
+		reader:       pr,
+		paths:        make(map[int]string),
+		columns:      schema.columns,
+		remaining:    pr.GetNumRows(),
+		lastModified: schema.lastModified,
+		cleanup:      cleanup,
+	}
+	root := pr.SchemaHandler.GetRootExName()
+	for _, i := range schema.used() {
+		res.paths[i] = common.PathToStr([]string{root, schema.fields[i]})
+	}
+	if inPath, err := pr.SchemaHandler.ConvertToInPathStr(res.paths[schema.lastModified]); err == nil {
+		if idx, ok := pr.SchemaHandler.MapIndex[inPath]; ok {
+			res.micros = pr.SchemaHandler.SchemaElements[idx].GetConvertedType() == parquet.ConvertedType_TIMESTAMP_MICROS
+		}
+	}
+	return &res, nil
+}
+
+func (r *parquetRows) read() ([]string, error) {
+	if len(r.buffer) == 0 {
+		if r.remaining <= 0 {
+			return nil, io.EOF
+		}
+		n := r.remaining
+		if n > inventoryPageSize {
+			n = inventoryPageSize
+		}
+		rows := make([][]string, n)
+		for j := range rows {
+			rows[j] = make([]string, r.columns)
+		}
+		for i, path := range r.paths {
+			values, _, _, err := r.reader.ReadColumnByPath(path, n)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(values)) != n {
+				return nil, fmt.Errorf("expecting %d values in column %s, got %d", n, path, len(values))
+			}
+			for j, v := range values {
+				if ms, ok := v.(int64); ok && i == r.lastModified {
+					v = time.Unix(0, ms*int64(time.Millisecond))
+					if r.micros {
+						v = time.Unix(0, ms*int64(time.Microsecond))
+					}
+				}
+				rows[j][i] = inventoryValue(v)
+			}
+		}
+		r.remaining -= n
+		r.buffer = rows
+	}
+	row := r.buffer[0]
+	r.buffer = r.buffer[1:]
+	return row, nil
+}
+
+func (r *parquetRows) Close() error {
+	r.reader.ReadStop()
+	err := r.file.Close()
+	r.cleanup()
+	return err
+}
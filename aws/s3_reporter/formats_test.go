@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/scritchley/orc"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// testInventoryRow is a row of the csv test inventory, with its key decoded as
+// stored in the ORC and Parquet inventories. A negative size is a null.
+type testInventoryRow struct {
+	key          string
+	size         int64
+	lastModified time.Time
+	eTag, class  string
+	isLatest     bool
+	deleteMarker bool
+}
+
+var testInventoryRows = []testInventoryRow{
+	{"logs/", 0, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), "d41d8cd98f00b204e9800998ecf8427e", "STANDARD", true, false},
+	{"logs/2016/12/01.gz", 1048576, time.Date(2016, 12, 1, 10, 0, 0, 0, time.UTC), "5f363e0e58a95f06cbe9bbc662c5dfb6", "STANDARD", true, false},
+	{"logs/2018/03/01.gz", 2048, time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC), "9e107d9d372bb6826bd81d3542a419d6", "STANDARD", true, false},
+	{"logs/2018/03/01.gz", 4096, time.Date(2018, 2, 28, 10, 0, 0, 0, time.UTC), "e4d909c290d0fb1ca068ffaddf22cbd0", "STANDARD", false, false},
+	{"data/file a.bin", 10485760, time.Date(2017, 9, 15, 8, 30, 0, 0, time.UTC), "a3cca2b2aa1e3b5b3b5aad99a8529074", "GLACIER", true, false},
+	{"data/deleted.bin", -1, time.Date(2018, 3, 10, 8, 30, 0, 0, time.UTC), "", "", true, true},
+	{"README", 512, time.Date(2018, 3, 15, 8, 30, 0, 0, time.UTC), "c4ca4238a0b923820dcc509a6f75849b", "STANDARD_IA", true, false},
+}
+
+// parquetInventoryRow is a row of a Parquet inventory, as written by S3
+type parquetInventoryRow struct {
+	Bucket           string  `parquet:"name=bucket, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Key              string  `parquet:"name=key, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Size             *int64  `parquet:"name=size, type=INT64, repetitiontype=OPTIONAL"`
+	LastModifiedDate *int64  `parquet:"name=last_modified_date, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	ETag             *string `parquet:"name=e_tag, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	StorageClass     *string `parquet:"name=storage_class, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	IsLatest         *bool   `parquet:"name=is_latest, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	IsDeleteMarker   *bool   `parquet:"name=is_delete_marker, type=BOOLEAN, repetitiontype=OPTIONAL"`
+}
+
+const testParquetSchema = `message s3.inventory {
+  required binary bucket (UTF8);
+  required binary key (UTF8);
+  optional int64 size;
+  optional int64 last_modified_date (TIMESTAMP_MILLIS);
+  optional binary e_tag (UTF8);
+  optional binary storage_class (UTF8);
+  optional boolean is_latest;
+  optional boolean is_delete_marker;
+}`
+
+func writeParquetInventory(path string) error {
+	fw, err := local.NewLocalFileWriter(path)
+	if err != nil {
+		return err
+	}
+	defer fw.Close()
+	pw, err := writer.NewParquetWriter(fw, new(parquetInventoryRow), 1)
+	if err != nil {
+		return err
+	}
+	optString := func(s string) *string {
+		if s == "" {
+			return nil
+		}
+		return aws.String(s)
+	}
+	for _, r := range testInventoryRows {
+		row := parquetInventoryRow{
+			Bucket:           "foo",
+			Key:              r.key,
+			LastModifiedDate: aws.Int64(r.lastModified.UnixNano() / int64(time.Millisecond)),
+			ETag:             optString(r.eTag),
+			StorageClass:     optString(r.class),
+			IsLatest:         aws.Bool(r.isLatest),
+			IsDeleteMarker:   aws.Bool(r.deleteMarker),
+		}
+		if r.size >= 0 {
+			row.Size = aws.Int64(r.size)
+		}
+		if err = pw.Write(row); err != nil {
+			return err
+		}
+	}
+	return pw.WriteStop()
+}
+
+const testORCSchema = "struct<bucket:string,key:string,size:bigint,last_modified_date:timestamp,e_tag:string,storage_class:string,is_latest:boolean,is_delete_marker:boolean>"
+
+func writeORCInventory(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	schema, err := orc.ParseSchema(testORCSchema)
+	if err != nil {
+		return err
+	}
+	w, err := orc.NewWriter(f, orc.SetSchema(schema))
+	if err != nil {
+		return err
+	}
+	for _, r := range testInventoryRows {
+		var size interface{}
+		if r.size >= 0 {
+			size = r.size
+		}
+		if err = w.Write("foo", r.key, size, r.lastModified, r.eTag, r.class, r.isLatest, r.deleteMarker); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func TestColumnarInventories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_reporter_inventory_test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testData := []struct {
+		format, schema string
+		write          func(string) error
+	}{
+		{"Parquet", testParquetSchema, writeParquetInventory},
+		{"ORC", testORCSchema, writeORCInventory},
+	}
+	expected := inventoryObjects()
+	for _, d := range testData {
+		dataFile := filepath.Join(dir, "data."+strings.ToLower(d.format))
+		if err = d.write(dataFile); err != nil {
+			t.Fatalf("%s: unexpected error: %s", d.format, err)
+		}
+		manifest := fmt.Sprintf(`{"sourceBucket": "foo", "fileFormat": %q, "fileSchema": %q, "files": [{"key": "data.%s"}]}`, d.format, d.schema, strings.ToLower(d.format))
+		m, err := parseManifest(strings.NewReader(manifest), "manifest.json")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", d.format, err)
+		}
+		// The local files are read in place, the files read from s3 are
+		// copied first
+		openers := map[string]func(string) (io.ReadCloser, error){
+			"local": func(key string) (io.ReadCloser, error) { return os.Open(filepath.Join(dir, key)) },
+			"s3": func(key string) (io.ReadCloser, error) {
+				data, err := ioutil.ReadFile(filepath.Join(dir, key))
+				return ioutil.NopCloser(bytes.NewReader(data)), err
+			},
+		}
+		for name, open := range openers {
+			m.open = open
+			var pages []*s3.ListObjectsV2Output
+			var hidden []*hiddenStats
+			err = readInventory(m, "", func(page *s3.ListObjectsV2Output, h *hiddenStats) {
+				pages = append(pages, page)
+				hidden = append(hidden, h)
+			})
+			if err != nil {
+				t.Fatalf("%s %s: unexpected error: %s", d.format, name, err)
+			}
+			if len(pages) != 1 {
+				t.Fatalf("%s %s: expecting 1 page got %d", d.format, name, len(pages))
+			}
+			for _, o := range pages[0].Contents {
+				o.ETag = nil
+			}
+			if !reflect.DeepEqual(pages[0].Contents, expected) {
+				t.Errorf("%s %s: expecting %v got %v", d.format, name, expected, pages[0].Contents)
+			}
+			if len(hidden[0].noncurrent) != 1 || aws.Int64Value(hidden[0].noncurrent[0].Size) != 4096 || hidden[0].deleteMarkers != 1 {
+				t.Errorf("%s %s: expecting 1 noncurrent version and 1 delete marker got %+v", d.format, name, hidden[0])
+			}
+		}
+	}
+}
+
+func TestEncodeInventoryKey(t *testing.T) {
+	for _, key := range []string{"logs/2018/03/01.gz", "data/file a.bin", "a+b/100%/é"} {
+		encoded := encodeInventoryKey(key)
+		if strings.Count(encoded, "/") != strings.Count(key, "/") {
+			t.Errorf("Expecting the folders of %q to be kept got %q", key, encoded)
+		}
+		if decoded := decodeKey(encoded); decoded != key {
+			t.Errorf("Expecting %q to be decoded as %q got %q", encoded, key, decoded)
+		}
+	}
+}
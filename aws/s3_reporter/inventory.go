@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// inventoryPageSize is the number of objects sent in each page built from
+// the inventory files. It matches the default page size of ListObjectsV2.
+const inventoryPageSize = 1000
+
+// inventoryManifest is the content of the manifest.json file delivered with
+// each S3 Inventory report
+type inventoryManifest struct {
+	SourceBucket      string          `json:"sourceBucket"`
+	DestinationBucket string          `json:"destinationBucket"`
+	FileFormat        string          `json:"fileFormat"`
+	FileSchema        string          `json:"fileSchema"`
+	Files             []inventoryFile `json:"files"`
+	// location is where the manifest has been read from
+	location string
+	// open returns the content of a data file of the inventory given its key
+	open func(key string) (io.ReadCloser, error)
+}
+
+// inventoryFile is a data file listed in an inventory manifest
+type inventoryFile struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// parseS3URL splits a s3://bucket/key url. The last value is false if the
+// given string is not a s3 url.
+func parseS3URL(u string) (string, string, bool) {
+	if !strings.HasPrefix(u, "s3://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// parseManifest decodes a manifest and checks that it can be processed
+func parseManifest(r io.Reader, location string) (*inventoryManifest, error) {
+	m := inventoryManifest{location: location}
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, err
+	}
+	if m.SourceBucket == "" {
+		return nil, fmt.Errorf("manifest %s has no source bucket", location)
+	}
+	if _, err := newInventorySchema(m.FileFormat, m.FileSchema); err != nil {
+		return nil, fmt.Errorf("manifest %s: %s", location, err)
+	}
+	return &m, nil
+}
+
+// loadLocalManifest reads a manifest from the local filesystem. The data files
+// are searched relatively to each parent directory of the manifest, which is
+// the layout obtained by syncing the inventory destination bucket locally,
+// and then next to the manifest itself.
+func loadLocalManifest(filePath string) (*inventoryManifest, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := parseManifest(f, filePath)
+	if err != nil {
+		return nil, err
+	}
+	manifestDir, err := filepath.Abs(filepath.Dir(filePath))
+	if err != nil {
+		return nil, err
+	}
+	m.open = func(key string) (io.ReadCloser, error) {
+		for dir := manifestDir; ; dir = filepath.Dir(dir) {
+			if f, err := os.Open(filepath.Join(dir, filepath.FromSlash(key))); err == nil {
+				return f, nil
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+		return os.Open(filepath.Join(manifestDir, filepath.Base(key)))
+	}
+	return m, nil
+}
+
+// loadS3Manifest reads a manifest from s3. The data files are read from the
+// same bucket as the manifest, which is the destination bucket of the
+// inventory.
+func loadS3Manifest(svc s3iface.S3API, bucket, key string) (*inventoryManifest, error) {
+	out, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	m, err := parseManifest(out.Body, fmt.Sprintf("s3://%s/%s", bucket, key))
+	if err != nil {
+		return nil, err
+	}
+	m.open = func(key string) (io.ReadCloser, error) {
+		out, err := svc.GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+		if err != nil {
+			return nil, err
+		}
+		return out.Body, nil
+	}
+	return m, nil
+}
+
+// inventorySchema contains the position of the fields used by the reporter in
+// the rows of the inventory data files. A negative position means that the
+// field is not part of the inventory.
+type inventorySchema struct {
+	key, size, lastModified, storageClass, eTag, isLatest, isDeleteMarker, columns int
+	// format is the upper case format of the data files
+	format string
+	// fields are the names of the fields of the rows as given by the manifest
+	fields []string
+}
+
+// parquetFieldRegexp matches the name of a field of a Parquet message
+var parquetFieldRegexp = regexp.MustCompile(`(?:required|optional|repeated)\s+\w+\s+([^\s;(]+)`)
+
+// inventoryFields returns the names of the fields of the fileSchema of a
+// manifest: a list of names for CSV, a struct<name:type,...> for ORC and a
+// message with a field per line for Parquet
+func inventoryFields(format, fileSchema string) ([]string, error) {
+	var fields []string
+	switch format {
+	case "CSV":
+		for _, f := range strings.Split(fileSchema, ",") {
+			fields = append(fields, strings.TrimSpace(f))
+		}
+	case "ORC":
+		s := strings.TrimSpace(fileSchema)
+		if !strings.HasPrefix(s, "struct<") || !strings.HasSuffix(s, ">") {
+			return nil, fmt.Errorf("invalid ORC schema %q", fileSchema)
+		}
+		for _, f := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(s, "struct<"), ">"), ",") {
+			fields = append(fields, strings.TrimSpace(strings.SplitN(f, ":", 2)[0]))
+		}
+	case "PARQUET":
+		for _, m := range parquetFieldRegexp.FindAllStringSubmatch(fileSchema, -1) {
+			fields = append(fields, m[1])
+		}
+	default:
+		return nil, fmt.Errorf("inventory format %q is not supported, only CSV, ORC and Parquet inventories can be read", format)
+	}
+	return fields, nil
+}
+
+// newInventorySchema parses the fileSchema field of a manifest given the
+// format of its data files. The fields are named like LastModifiedDate in the
+// CSV inventories and like last_modified_date in the other formats.
+func newInventorySchema(fileFormat, fileSchema string) (*inventorySchema, error) {
+	s := inventorySchema{-1, -1, -1, -1, -1, -1, -1, 0, strings.ToUpper(fileFormat), nil}
+	fields, err := inventoryFields(s.format, fileSchema)
+	if err != nil {
+		return nil, err
+	}
+	s.fields = fields
+	s.columns = len(fields)
+	for i, f := range fields {
+		switch strings.ToLower(strings.Replace(f, "_", "", -1)) {
+		case "key":
+			s.key = i
+		case "size":
+			s.size = i
+		case "lastmodifieddate":
+			s.lastModified = i
+		case "storageclass":
+			s.storageClass = i
+		case "etag":
+			s.eTag = i
+		case "islatest":
+			s.isLatest = i
+		case "isdeletemarker":
+			s.isDeleteMarker = i
+		}
+	}
+	if s.key < 0 || s.size < 0 || s.lastModified < 0 || s.storageClass < 0 {
+		return nil, fmt.Errorf("the inventory must include the Key, Size, LastModifiedDate and StorageClass fields, got %q", fileSchema)
+	}
+	return &s, nil
+}
+
+// used returns the positions of the fields read by the reporter, the other
+// fields are left empty by the readers of the columnar formats
+func (s *inventorySchema) used() []int {
+	var res []int
+	for _, i := range []int{s.key, s.size, s.lastModified, s.storageClass, s.eTag, s.isLatest, s.isDeleteMarker} {
+		if i >= 0 {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// encodeInventoryKey url encodes a key read from an ORC or Parquet inventory,
+// which keys are stored as is, like the keys of a listing or of a CSV
+// inventory. The slashes are kept to find the folders of the key.
+func encodeInventoryKey(key string) string {
+	parts := strings.Split(key, "/")
+	for i, p := range parts {
+		parts[i] = strings.Replace(url.PathEscape(p), "+", "%2B", -1)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Kinds of rows of an inventory
+const (
+	rowCurrent = iota
+	rowNoncurrent
+	rowDeleteMarker
+)
+
+// object converts a row of an inventory data file to a s3.Object and returns
+// its kind: current object, noncurrent version or delete marker. No object is
+// returned for a delete marker.
+func (s *inventorySchema) object(row []string) (*s3.Object, int, error) {
+	if len(row) != s.columns {
+		return nil, 0, fmt.Errorf("expecting %d fields, got %d", s.columns, len(row))
+	}
+	if s.isDeleteMarker >= 0 && row[s.isDeleteMarker] == "true" {
+		return nil, rowDeleteMarker, nil
+	}
+	size, err := strconv.ParseInt(row[s.size], 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	lastMod, err := time.Parse(time.RFC3339, row[s.lastModified])
+	if err != nil {
+		return nil, 0, err
+	}
+	key := row[s.key]
+	if s.format != "CSV" {
+		key = encodeInventoryKey(key)
+	}
+	obj := s3.Object{
+		Key:          aws.String(key),
+		Size:         aws.Int64(size),
+		LastModified: aws.Time(lastMod),
+		StorageClass: aws.String(row[s.storageClass]),
+	}
+	if s.eTag >= 0 {
+		obj.ETag = aws.String(row[s.eTag])
+	}
+	if s.isLatest >= 0 && row[s.isLatest] == "false" {
+		return &obj, rowNoncurrent, nil
+	}
+	return &obj, rowCurrent, nil
+}
+
+// inventoryPosition is the position of the reading of an inventory: the
+// index of the data file and the number of rows already read in this file.
+// It is used as continuation token to resume the reading.
+type inventoryPosition struct {
+	file, row int
+}
+
+func (p inventoryPosition) String() string {
+	return fmt.Sprintf("%d:%d", p.file, p.row)
+}
+
+// parseInventoryPosition parses a position produced by inventoryPosition.String.
+// An empty string is the beginning of the inventory.
+func parseInventoryPosition(token string) (inventoryPosition, error) {
+	pos := inventoryPosition{}
+	if token == "" {
+		return pos, nil
+	}
+	if _, err := fmt.Sscanf(token, "%d:%d", &pos.file, &pos.row); err != nil {
+		return pos, fmt.Errorf("invalid inventory position %q: %s", token, err)
+	}
+	return pos, nil
+}
+
+// readInventory reads the data files of an inventory starting from the given
+// position and sends their objects as pages to the given function, along with
+// the noncurrent versions and delete markers of the same rows. Each page
+// carries the position of the next one as continuation token, except the last
+// page of the inventory.
+func readInventory(m *inventoryManifest, token string, fn func(*s3.ListObjectsV2Output, *hiddenStats)) error {
+	schema, err := newInventorySchema(m.FileFormat, m.FileSchema)
+	if err != nil {
+		return err
+	}
+	start, err := parseInventoryPosition(token)
+	if err != nil {
+		return err
+	}
+	if len(m.Files) == 0 {
+		fn(&s3.ListObjectsV2Output{Name: aws.String(m.SourceBucket)}, &hiddenStats{})
+		return nil
+	}
+	for i := start.file; i < len(m.Files); i++ {
+		skip := 0
+		if i == start.file {
+			skip = start.row
+		}
+		log.Printf("Reading inventory file %s of bucket %s", m.Files[i].Key, m.SourceBucket)
+		if err = readInventoryFile(m, schema, i, skip, fn); err != nil {
+			return fmt.Errorf("inventory file %s: %s", m.Files[i].Key, err)
+		}
+	}
+	return nil
+}
+
+// readInventoryFile reads a data file of an inventory, skipping the given
+// number of rows
+func readInventoryFile(m *inventoryManifest, schema *inventorySchema, idx, skip int, fn func(*s3.ListObjectsV2Output, *hiddenStats)) error {
+	f, err := m.open(m.Files[idx].Key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := openInventoryRows(f, schema)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	page := &s3.ListObjectsV2Output{Name: aws.String(m.SourceBucket)}
+	hidden := &hiddenStats{}
+	row := 0
+	for {
+		record, err := r.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		row++
+		if row <= skip {
+			continue
+		}
+		obj, kind, err := schema.object(record)
+		if err != nil {
+			return fmt.Errorf("row %d: %s", row, err)
+		}
+		switch kind {
+		case rowCurrent:
+			page.Contents = append(page.Contents, obj)
+		case rowNoncurrent:
+			hidden.noncurrent = append(hidden.noncurrent, &s3.ObjectVersion{
+				ETag:         obj.ETag,
+				IsLatest:     aws.Bool(false),
+				Key:          obj.Key,
+				LastModified: obj.LastModified,
+				Size:         obj.Size,
+				StorageClass: obj.StorageClass,
+			})
+		case rowDeleteMarker:
+			hidden.deleteMarkers++
+		}
+		if len(page.Contents)+len(hidden.noncurrent)+int(hidden.deleteMarkers) == inventoryPageSize {
+			page.NextContinuationToken = aws.String(inventoryPosition{idx, row}.String())
+			fn(page, hidden)
+			page = &s3.ListObjectsV2Output{Name: aws.String(m.SourceBucket)}
+			hidden = &hiddenStats{}
+		}
+	}
+	// The remaining objects of the file are always sent, even if there are none,
+	// so that the last page of the inventory has no continuation token.
+	if idx < len(m.Files)-1 {
+		page.NextContinuationToken = aws.String(inventoryPosition{idx + 1, 0}.String())
+	}
+	fn(page, hidden)
+	return nil
+}
+
+// inventoryWorker reads the inventories and puts their objects in the page
+// channel. The noncurrent versions and delete markers are only counted with
+// the -versions flag, as for a listing. The region, the lifecycle rules and the
+// configuration of the bucket are not part of the inventory, they are only
+// fetched when metadata is true.
+func inventoryWorker(sess client.ConfigProvider, sessionRegion string, svc s3iface.S3API, metadata bool, manifests chan *inventoryManifest, wg *sync.WaitGroup, pageChan chan *s3.ListObjectsV2Output, progress *scanProgress) {
+	for m := range manifests {
+		if metadata {
+			inventoryMetadata(sess, sessionRegion, svc, aws.String(m.SourceBucket))
+		}
+		if progress.isDone(m.SourceBucket) {
+			// The inventory has been read before the checkpoint, the client
+			// set with the metadata samples the objects left
+			continue
+		}
+		log.Printf("Reading inventory %s of bucket %s", m.location, m.SourceBucket)
+		err := throttleRetries.retry("reading the inventory of bucket "+m.SourceBucket, func() error {
+			return readInventory(m, progress.token(m.SourceBucket), func(page *s3.ListObjectsV2Output, hidden *hiddenStats) {
+				if !*versions {
+					progress.pushPage(page, pageChan)
+					return
+				}
+				progress.pushPageWith(page, pageChan, func() { hidden.count(m.SourceBucket) })
+			})
+		})
+		if err != nil {
+			log.Printf("Error while reading the inventory of bucket %s: %s\n", m.SourceBucket, err)
+			progress.markFailed(m.SourceBucket, err)
+			continue
+		}
+		progress.markDone(m.SourceBucket)
+	}
+	wg.Done()
+}
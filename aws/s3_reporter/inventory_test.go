@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const testManifest = "testdata/inventory/foo/daily/2018-03-16T00-00Z/manifest.json"
+
+// s3FileMock serves the objects of a bucket from a local directory
+type s3FileMock struct {
+	s3iface.S3API
+	bucket, dir string
+}
+
+func (m *s3FileMock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if *input.Bucket != m.bucket {
+		return nil, errors.New("NoSuchBucket")
+	}
+	f, err := os.Open(filepath.Join(m.dir, filepath.FromSlash(*input.Key)))
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{Body: f}, nil
+}
+
+// inventoryObjects are the objects of the test inventory as ListObjectsV2
+// would return them
+func inventoryObjects() []*s3.Object {
+	obj := func(key string, size int64, lastMod time.Time, class string) *s3.Object {
+		return &s3.Object{Key: aws.String(key), Size: aws.Int64(size), LastModified: aws.Time(lastMod), StorageClass: aws.String(class)}
+	}
+	return []*s3.Object{
+		obj("logs/", 0, time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), "STANDARD"),
+		obj("logs/2016/12/01.gz", 1048576, time.Date(2016, 12, 1, 10, 0, 0, 0, time.UTC), "STANDARD"),
+		obj("logs/2018/03/01.gz", 2048, time.Date(2018, 3, 1, 10, 0, 0, 0, time.UTC), "STANDARD"),
+		obj("data/file%20a.bin", 10485760, time.Date(2017, 9, 15, 8, 30, 0, 0, time.UTC), "GLACIER"),
+		obj("README", 512, time.Date(2018, 3, 15, 8, 30, 0, 0, time.UTC), "STANDARD_IA"),
+	}
+}
+
+// scanInventory reads an inventory through the same channels as main
+func scanInventory(m *inventoryManifest, progress *scanProgress) error {
+	var wg, wgInventory sync.WaitGroup
+	pageChan := make(chan *s3.ListObjectsV2Output, 10)
+	manifests := make(chan *inventoryManifest, 1)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go processPage(pageChan, &wg, progress)
+	}
+	wgInventory.Add(1)
+	go inventoryWorker(nil, "", nil, false, manifests, &wgInventory, pageChan, progress)
+	manifests <- m
+	close(manifests)
+	wgInventory.Wait()
+	close(pageChan)
+	wg.Wait()
+	return progress.failures()[m.SourceBucket]
+}
+
+func TestParseManifest(t *testing.T) {
+	testData := []struct {
+		content     string
+		expectError bool
+	}{
+		{`{"sourceBucket": "foo", "fileFormat": "CSV", "fileSchema": "Bucket, Key, Size, LastModifiedDate, StorageClass"}`, false},
+		{`{"sourceBucket": "foo", "fileFormat": "Parquet", "fileSchema": "message s3.inventory {}"}`, true},
+		{`{"sourceBucket": "foo", "fileFormat": "ORC", "fileSchema": "struct<bucket:string,key:string>"}`, true},
+		{`{"sourceBucket": "foo", "fileFormat": "ORC", "fileSchema": "struct<bucket:string,key:string,size:bigint,last_modified_date:timestamp,storage_class:string>"}`, false},
+		{`{"sourceBucket": "foo", "fileFormat": "Parquet", "fileSchema": "message s3.inventory { required binary bucket (UTF8); required binary key (UTF8); optional int64 size; optional int64 last_modified_date (TIMESTAMP_MILLIS); optional binary storage_class (UTF8);}"}`, false},
+		{`{"sourceBucket": "foo", "fileFormat": "Avro", "fileSchema": "Bucket, Key, Size, LastModifiedDate, StorageClass"}`, true},
+		{`{"sourceBucket": "foo", "fileFormat": "CSV", "fileSchema": "Bucket, Key, Size"}`, true},
+		{`{"fileFormat": "CSV", "fileSchema": "Bucket, Key, Size, LastModifiedDate, StorageClass"}`, true},
+		{`{"sourceBucket": `, true},
+	}
+	for n, d := range testData {
+		_, err := parseManifest(strings.NewReader(d.content), "manifest.json")
+		if (err != nil) != d.expectError {
+			t.Errorf("#%d: unexpected error: %v", n, err)
+		}
+	}
+}
+
+func TestParseS3URL(t *testing.T) {
+	testData := []struct {
+		url, bucket, key string
+		ok               bool
+	}{
+		{"s3://inventories/foo/daily/manifest.json", "inventories", "foo/daily/manifest.json", true},
+		{"s3://inventories/", "", "", false},
+		{"/tmp/manifest.json", "", "", false},
+	}
+	for _, d := range testData {
+		b, k, ok := parseS3URL(d.url)
+		if b != d.bucket || k != d.key || ok != d.ok {
+			t.Errorf("Expecting %q, %q, %v for %s got %q, %q, %v", d.bucket, d.key, d.ok, d.url, b, k, ok)
+		}
+	}
+}
+
+func TestReadInventory(t *testing.T) {
+	m, err := loadLocalManifest(testManifest)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var pages []*s3.ListObjectsV2Output
+	var hidden []*hiddenStats
+	collect := func(page *s3.ListObjectsV2Output, h *hiddenStats) {
+		pages = append(pages, page)
+		hidden = append(hidden, h)
+	}
+	if err = readInventory(m, "", collect); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("Expecting 1 page per data file got %d", len(pages))
+	}
+	if aws.StringValue(pages[0].NextContinuationToken) != "1:0" || pages[1].NextContinuationToken != nil {
+		t.Errorf("Unexpected continuation tokens %v and %v", pages[0].NextContinuationToken, pages[1].NextContinuationToken)
+	}
+	var objects []*s3.Object
+	for _, p := range pages {
+		if aws.StringValue(p.Name) != "foo" {
+			t.Errorf("Expecting pages of bucket foo got %s", aws.StringValue(p.Name))
+		}
+		objects = append(objects, p.Contents...)
+	}
+	expected := inventoryObjects()
+	for _, o := range objects {
+		o.ETag = nil
+	}
+	if !reflect.DeepEqual(objects, expected) {
+		t.Errorf("Expecting %v got %v", expected, objects)
+	}
+	if len(hidden[0].noncurrent) != 1 || aws.Int64Value(hidden[0].noncurrent[0].Size) != 4096 || hidden[1].deleteMarkers != 1 {
+		t.Errorf("Expecting 1 noncurrent version in the 1st file and 1 delete marker in the 2nd got %+v and %+v", hidden[0], hidden[1])
+	}
+
+	// Resuming from the second file
+	pages = nil
+	if err = readInventory(m, "1:0", collect); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(pages) != 1 || len(pages[0].Contents) != 2 {
+		t.Errorf("Expecting 1 page of 2 objects got %v", pages)
+	}
+	if err = readInventory(m, "foo", collect); err == nil {
+		t.Error("Expecting an error for an invalid position")
+	}
+}
+
+func TestInventoryScan(t *testing.T) {
+	reportMutex = &sync.Mutex{}
+
+	// Counters built from the listing of the bucket
+	report = map[string]*bucketCounter{"foo": newBucketCounter()}
+	if err := scanMock(&s3ListMock{objects: inventoryObjects(), pageSize: 2}, "foo", newScanProgress()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := report["foo"].snapshot()
+
+	local, err := loadLocalManifest(testManifest)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	svc := &s3FileMock{bucket: "inventories", dir: "testdata/inventory"}
+	remote, err := loadS3Manifest(svc, "inventories", "foo/daily/2018-03-16T00-00Z/manifest.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, m := range []*inventoryManifest{local, remote} {
+		report = map[string]*bucketCounter{"foo": newBucketCounter()}
+		progress := newScanProgress()
+		if err = scanInventory(m, progress); err != nil {
+			t.Fatalf("%s: unexpected error: %s", m.location, err)
+		}
+		if !progress.isDone("foo") {
+			t.Errorf("%s: expecting bucket foo to be done", m.location)
+		}
+		if r := report["foo"].snapshot(); !reflect.DeepEqual(r, expected) {
+			t.Errorf("%s: expecting %v got %v", m.location, expected, r)
+		}
+	}
+
+	// A missing data file fails the bucket
+	remote.open = func(string) (io.ReadCloser, error) { return nil, errors.New("NoSuchKey") }
+	progress := newScanProgress()
+	if err = scanInventory(remote, progress); err == nil {
+		t.Error("Expecting an error when a data file is missing")
+	}
+	if progress.isDone("foo") {
+		t.Error("Expecting bucket foo not to be done")
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// lifecycleTransition is a transition configured in a lifecycle rule of a
+// bucket
+type lifecycleTransition struct {
+	RuleID       string `json:"rule_id"`
+	Prefix       string `json:"prefix"`
+	StorageClass string `json:"storage_class"`
+	Days         int64  `json:"days"`
+}
+
+// lifecycleCandidate is a transition that the reporter can recommend when
+// enough bytes of the source storage classes are older than a given age
+type lifecycleCandidate struct {
+	from      []string
+	to        string
+	days      int64
+	olderThan ageBound
+	ageLabel  string
+}
+
+// lifecycleCandidates lists the transitions that can be recommended, from the
+// most to the least aggressive
+var lifecycleCandidates = []lifecycleCandidate{
+	{[]string{"STANDARD", "STANDARD_IA", "ONEZONE_IA", "REDUCED_REDUNDANCY"}, "GLACIER", 365, ageBound{1, "y"}, ">1 year"},
+	{[]string{"STANDARD", "REDUCED_REDUNDANCY"}, "STANDARD_IA", 90, ageBound{3, "m"}, ">3 months"},
+}
+
+// storageClassRanks orders the storage classes from the hottest to the
+// coldest. A transition to a colder class than the one recommended moves the
+// bytes at least as far.
+var storageClassRanks = map[string]int{
+	"STANDARD":            0,
+	"REDUCED_REDUNDANCY":  0,
+	"INTELLIGENT_TIERING": 1,
+	"STANDARD_IA":         2,
+	"ONEZONE_IA":          3,
+	"GLACIER_IR":          4,
+	"GLACIER":             5,
+	"DEEP_ARCHIVE":        6,
+}
+
+// atLeastAsCold returns true if the storage class is the target one or a
+// colder one. Unknown classes only match themselves.
+func atLeastAsCold(storageClass, target string) bool {
+	if storageClass == target {
+		return true
+	}
+	rank, ok := storageClassRanks[storageClass]
+	targetRank, targetOk := storageClassRanks[target]
+	return ok && targetOk && rank >= targetRank
+}
+
+// lifecycleRecommendation is a transition recommended for a prefix of a bucket
+type lifecycleRecommendation struct {
+	Prefix       string  `json:"prefix"`
+	StorageClass string  `json:"storage_class"`
+	Target       string  `json:"transition_to"`
+	Days         int64   `json:"after_days"`
+	Bytes        uint64  `json:"bytes"`
+	Ratio        float64 `json:"ratio"`
+	Savings      float64 `json:"estimated_monthly_savings_usd"`
+	SavingsKnown bool    `json:"-"`
+	Current      string  `json:"current_rules"`
+	Covered      bool    `json:"already_covered"`
+	ageLabel     string
+}
+
+// String describes the recommendation in a sentence
+func (r *lifecycleRecommendation) String() string {
+	where := "in the bucket"
+	if r.Prefix != "" {
+		where = "under " + r.Prefix
+	}
+	savings := "saves an unknown amount"
+	if r.SavingsKnown {
+		savings = fmt.Sprintf("saves ~$%s/month", formatCost(r.Savings))
+	}
+	return fmt.Sprintf("%.0f%% of bytes %s are %s old in %s; transition to %s after %d days %s",
+		r.Ratio*100, where, r.ageLabel, r.StorageClass, r.Target, r.Days, savings)
+}
+
+// getBucketLifecycle returns the transitions of the enabled lifecycle rules of
+// a bucket. Rules filtering on tags are ignored as they cannot be compared with
+// the statistics gathered by prefix.
+func getBucketLifecycle(svc s3iface.S3API, bucketName *string) ([]lifecycleTransition, error) {
+	out, err := svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: bucketName})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchLifecycleConfiguration" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []lifecycleTransition
+	for _, rule := range out.Rules {
+		if aws.StringValue(rule.Status) != s3.ExpirationStatusEnabled {
+			continue
+		}
+		prefix := aws.StringValue(rule.Prefix)
+		if f := rule.Filter; f != nil {
+			switch {
+			case f.Tag != nil:
+				continue
+			case f.And != nil:
+				if len(f.And.Tags) > 0 {
+					continue
+				}
+				prefix = aws.StringValue(f.And.Prefix)
+			default:
+				prefix = aws.StringValue(f.Prefix)
+			}
+		}
+		for _, t := range rule.Transitions {
+			if t.Days == nil {
+				continue
+			}
+			res = append(res, lifecycleTransition{
+				RuleID:       aws.StringValue(rule.ID),
+				Prefix:       prefix,
+				StorageClass: aws.StringValue(t.StorageClass),
+				Days:         *t.Days,
+			})
+		}
+	}
+	return res, nil
+}
+
+// olderThan returns the number of bytes of a storage class that are in the
+// date ranges starting at the given age or at an older one. The bytes of the
+// range the age falls in are not counted as some of them are younger.
+func (c *bucketCounter) olderThan(storageClass string, age ageBound) uint64 {
+	var total uint64
+	limit := age.since(now)
+	for i, d := range dateLimits {
+		if !d.After(limit) {
+			total += c.ageSize[storageClass][dateRangeLabels[i+1]]
+		}
+	}
+	return total
+}
+
+// compareLifecycle checks the recommendation against the current lifecycle
+// transitions of the bucket. A transition to the recommended storage class or
+// to a colder one, not later than recommended, covers the recommendation.
+func compareLifecycle(rec *lifecycleRecommendation, current []lifecycleTransition) {
+	var notes []string
+	for _, t := range current {
+		if !strings.HasPrefix(rec.Prefix, t.Prefix) || !atLeastAsCold(t.StorageClass, rec.Target) {
+			continue
+		}
+		if t.Days <= rec.Days {
+			rec.Covered = true
+			notes = append(notes, fmt.Sprintf("covered by rule %q after %d days", t.RuleID, t.Days))
+		} else {
+			notes = append(notes, fmt.Sprintf("rule %q transitions after %d days", t.RuleID, t.Days))
+		}
+	}
+	rec.Current = "none"
+	if len(notes) > 0 {
+		rec.Current = strings.Join(notes, "; ")
+	}
+}
+
+// recommendPrefix returns the recommendations for the statistics of a prefix.
+// A transition is only recommended when it concerns at least minBytes, below
+// that the cost of the transition requests is not worth the savings.
+func recommendPrefix(prefix, region string, ctr *bucketCounter, current []lifecycleTransition, minRatio float64, minBytes uint64, p *pricingTable) []*lifecycleRecommendation {
+	var res []*lifecycleRecommendation
+	if ctr.sizeTotal == 0 {
+		return res
+	}
+	var classes []string
+	for k := range ctr.ageSize {
+		classes = append(classes, k)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		for _, cand := range lifecycleCandidates {
+			if !stringInSlice(class, cand.from) {
+				continue
+			}
+			bytes := ctr.olderThan(class, cand.olderThan)
+			ratio := float64(bytes) / float64(ctr.sizeTotal)
+			if bytes < minBytes || ratio < minRatio {
+				continue
+			}
+			rec := &lifecycleRecommendation{
+				Prefix:       prefix,
+				StorageClass: class,
+				Target:       cand.to,
+				Days:         cand.days,
+				Bytes:        bytes,
+				Ratio:        ratio,
+				ageLabel:     cand.ageLabel,
+			}
+			if p != nil {
+				from, okFrom := p.price(region, class)
+				to, okTo := p.price(region, cand.to)
+				if okFrom && okTo {
+					rec.Savings = bytesToGB(bytes) * (from - to)
+					rec.SavingsKnown = true
+				}
+			}
+			compareLifecycle(rec, current)
+			res = append(res, rec)
+			break
+		}
+	}
+	return res
+}
+
+// recommendLifecycle returns the lifecycle recommendations for a bucket as a
+// whole and for each of its root folders. The files at the root of the bucket
+// are not folders and get no recommendation of their own. The root folders are
+// counted with their key as listed, decoded to build the prefixes.
+func recommendLifecycle(ctr *bucketCounter, minRatio float64, minBytes uint64, p *pricingTable) []*lifecycleRecommendation {
+	res := recommendPrefix("", ctr.meta.region, ctr, ctr.meta.lifecycle, minRatio, minBytes, p)
+	for _, root := range sortedKeys(ctr.rootCount) {
+		if !ctr.rootCount[root].folder {
+			continue
+		}
+		res = append(res, recommendPrefix(decodeKey(root)+"/", ctr.meta.region, ctr.rootCount[root], ctr.meta.lifecycle, minRatio, minBytes, p)...)
+	}
+	return res
+}
+
+// lifecycleTable builds the table of the lifecycle recommendations of a bucket
+func lifecycleTable(bucket string, recs []*lifecycleRecommendation) *reportTable {
+	if len(recs) == 0 {
+		return nil
+	}
+	t := reportTable{
+		title:   fmt.Sprintf("Lifecycle recommendations for bucket %s", bucket),
+		headers: []string{"Prefix", "Storage class", "Transition to", "After (days)", "Size concerned (GB)", "Ratio of bytes", "Estimated monthly savings (USD)", "Current lifecycle rules", "Recommendation"},
+	}
+	for _, r := range recs {
+		savings := "unknown"
+		if r.SavingsKnown {
+			savings = formatCost(r.Savings)
+		}
+		t.rows = append(t.rows, []string{
+			r.Prefix,
+			r.StorageClass,
+			r.Target,
+			strconv.FormatInt(r.Days, 10),
+			strconv.FormatFloat(bytesToGB(r.Bytes), 'f', 4, 64),
+			strconv.FormatFloat(r.Ratio, 'f', 2, 64),
+			savings,
+			r.Current,
+			r.String(),
+		})
+	}
+	return &t
+}
+
+// The following types follow the format expected by
+// `aws s3api put-bucket-lifecycle-configuration --lifecycle-configuration`
+type lifecyclePolicy struct {
+	Rules []*lifecyclePolicyRule `json:"Rules"`
+}
+
+type lifecyclePolicyRule struct {
+	ID          string                       `json:"ID"`
+	Filter      lifecyclePolicyFilter        `json:"Filter"`
+	Status      string                       `json:"Status"`
+	Transitions []*lifecyclePolicyTransition `json:"Transitions"`
+}
+
+type lifecyclePolicyFilter struct {
+	Prefix string `json:"Prefix"`
+}
+
+type lifecyclePolicyTransition struct {
+	Days         int64  `json:"Days"`
+	StorageClass string `json:"StorageClass"`
+}
+
+var ruleIDCleaner = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// suggestedLifecycle builds the lifecycle configuration that applies the
+// recommendations not already covered by the current rules. When a transition
+// is recommended for the whole bucket, the same transition is not repeated for
+// its root folders. Returns nil if there is nothing to suggest.
+func suggestedLifecycle(recs []*lifecycleRecommendation) *lifecyclePolicy {
+	policy := lifecyclePolicy{}
+	rules := make(map[string]*lifecyclePolicyRule)
+	bucketWide := make(map[string]bool)
+	for _, r := range recs {
+		if r.Covered || (r.Prefix != "" && bucketWide[r.Target]) {
+			continue
+		}
+		if r.Prefix == "" {
+			bucketWide[r.Target] = true
+		}
+		rule, ok := rules[r.Prefix]
+		if !ok {
+			id := "s3-reporter-all"
+			if r.Prefix != "" {
+				id = "s3-reporter-" + strings.Trim(ruleIDCleaner.ReplaceAllString(r.Prefix, "-"), "-")
+			}
+			rule = &lifecyclePolicyRule{ID: id, Filter: lifecyclePolicyFilter{Prefix: r.Prefix}, Status: s3.ExpirationStatusEnabled}
+			rules[r.Prefix] = rule
+			policy.Rules = append(policy.Rules, rule)
+		}
+		exists := false
+		for _, t := range rule.Transitions {
+			exists = exists || t.StorageClass == r.Target
+		}
+		if !exists {
+			rule.Transitions = append(rule.Transitions, &lifecyclePolicyTransition{Days: r.Days, StorageClass: r.Target})
+		}
+	}
+	if len(policy.Rules) == 0 {
+		return nil
+	}
+	for _, rule := range policy.Rules {
+		sort.Slice(rule.Transitions, func(i, j int) bool { return rule.Transitions[i].Days < rule.Transitions[j].Days })
+	}
+	return &policy
+}
+
+// writeLifecyclePolicies writes the suggested lifecycle configuration of each
+// bucket in the given directory, in a file named <bucket>.lifecycle.json
+func writeLifecyclePolicies(dir string, ctr map[string]*bucketCounter, minRatio float64, minBytes uint64, p *pricingTable) error {
+	for _, bucket := range sortedKeys(ctr) {
+		policy := suggestedLifecycle(recommendLifecycle(ctr[bucket], minRatio, minBytes, p))
+		if policy == nil {
+			continue
+		}
+		data, err := json.MarshalIndent(policy, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, bucket+".lifecycle.json"), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stringInSlice returns true if the string is in the slice
+func stringInSlice(s string, list []string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
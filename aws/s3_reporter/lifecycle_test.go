@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3LifecycleMock returns a static lifecycle configuration
+type s3LifecycleMock struct {
+	s3iface.S3API
+	rules []*s3.LifecycleRule
+	err   error
+}
+
+func (m *s3LifecycleMock) GetBucketLifecycleConfiguration(*s3.GetBucketLifecycleConfigurationInput) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: m.rules}, m.err
+}
+
+func TestGetBucketLifecycle(t *testing.T) {
+	glacier := []*s3.Transition{{Days: aws.Int64(365), StorageClass: aws.String("GLACIER")}}
+	testData := []struct {
+		mock     *s3LifecycleMock
+		expected []lifecycleTransition
+		hasError bool
+	}{
+		{&s3LifecycleMock{err: awserr.New("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist", nil)}, nil, false},
+		{&s3LifecycleMock{err: awserr.New("AccessDenied", "Access Denied", nil)}, nil, true},
+		{&s3LifecycleMock{rules: []*s3.LifecycleRule{
+			{ID: aws.String("logs"), Status: aws.String("Enabled"), Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("logs/")}, Transitions: glacier},
+			{ID: aws.String("old"), Status: aws.String("Enabled"), Prefix: aws.String("old/"), Transitions: glacier},
+			{ID: aws.String("disabled"), Status: aws.String("Disabled"), Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")}, Transitions: glacier},
+			{ID: aws.String("tagged"), Status: aws.String("Enabled"), Filter: &s3.LifecycleRuleFilter{Tag: &s3.Tag{Key: aws.String("a"), Value: aws.String("b")}}, Transitions: glacier},
+		}}, []lifecycleTransition{
+			{RuleID: "logs", Prefix: "logs/", StorageClass: "GLACIER", Days: 365},
+			{RuleID: "old", Prefix: "old/", StorageClass: "GLACIER", Days: 365},
+		}, false},
+	}
+	for n, d := range testData {
+		r, err := getBucketLifecycle(d.mock, aws.String("foo"))
+		if (err != nil) != d.hasError {
+			t.Errorf("#%d: unexpected error: %v", n, err)
+		}
+		if !reflect.DeepEqual(r, d.expected) {
+			t.Errorf("#%d: expecting %v got %v", n, d.expected, r)
+		}
+	}
+}
+
+// setDateRanges sets the limits of the date ranges relatively to the given date
+func setDateRanges(nowDate time.Time) {
+	setAsOf(nowDate)
+}
+
+func TestRecommendLifecycle(t *testing.T) {
+	setDateRanges(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	c := newBucketCounter()
+	// logs/ is mostly made of data older than 1 year in STANDARD
+	c.increment(9*1073741824, "STANDARD", ".gz", "logs", time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), true)
+	c.increment(1073741824, "STANDARD", ".gz", "logs", time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	// data/ is only made of recent data
+	c.increment(10*1073741824, "STANDARD", ".bin", "data", time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	c.markFolder("logs")
+	c.markFolder("data")
+	// dump.tar is an old file at the root of the bucket, not a folder
+	c.increment(1073741824, "STANDARD", ".tar", "dump.tar", time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC), true)
+	c.setMetadata(bucketMetadata{region: "us-east-1", lifecycle: []lifecycleTransition{{RuleID: "logs", Prefix: "logs/", StorageClass: "GLACIER", Days: 730}}})
+
+	recs := recommendLifecycle(c, 0.5, 1073741824, testPricing)
+	if len(recs) != 1 {
+		t.Fatalf("Expecting 1 recommendation got %d: %v", len(recs), recs)
+	}
+	r := recs[0]
+	if r.Prefix != "logs/" || r.StorageClass != "STANDARD" || r.Target != "GLACIER" || r.Days != 365 || r.Covered {
+		t.Errorf("Unexpected recommendation %+v", r)
+	}
+	expected := `90% of bytes under logs/ are >1 year old in STANDARD; transition to GLACIER after 365 days saves ~$0.17/month`
+	if r.String() != expected {
+		t.Errorf("Expecting %q got %q", expected, r.String())
+	}
+	if r.Current != `rule "logs" transitions after 730 days` {
+		t.Errorf("Unexpected comparison with the current rules: %q", r.Current)
+	}
+
+	policy := suggestedLifecycle(recs)
+	expectedPolicy := &lifecyclePolicy{Rules: []*lifecyclePolicyRule{{
+		ID:          "s3-reporter-logs",
+		Filter:      lifecyclePolicyFilter{Prefix: "logs/"},
+		Status:      "Enabled",
+		Transitions: []*lifecyclePolicyTransition{{Days: 365, StorageClass: "GLACIER"}},
+	}}}
+	if !reflect.DeepEqual(policy, expectedPolicy) {
+		t.Errorf("Expecting %v got %v", expectedPolicy, policy)
+	}
+
+	// Once covered, nothing is left to suggest
+	c.setMetadata(bucketMetadata{region: "us-east-1", lifecycle: []lifecycleTransition{{RuleID: "all", Prefix: "", StorageClass: "GLACIER", Days: 180}}})
+	recs = recommendLifecycle(c, 0.5, 1073741824, testPricing)
+	if len(recs) != 1 || !recs[0].Covered {
+		t.Errorf("Expecting 1 covered recommendation got %v", recs)
+	}
+	if policy = suggestedLifecycle(recs); policy != nil {
+		t.Errorf("Expecting no policy got %v", policy)
+	}
+
+	// A transition to a colder storage class covers the recommendation too
+	c.setMetadata(bucketMetadata{region: "us-east-1", lifecycle: []lifecycleTransition{{RuleID: "archive", Prefix: "logs/", StorageClass: "DEEP_ARCHIVE", Days: 365}}})
+	recs = recommendLifecycle(c, 0.5, 1073741824, testPricing)
+	if len(recs) != 1 || !recs[0].Covered || recs[0].Current != `covered by rule "archive" after 365 days` {
+		t.Errorf("Expecting 1 covered recommendation got %+v", recs)
+	}
+	// A transition to a warmer storage class does not
+	c.setMetadata(bucketMetadata{region: "us-east-1", lifecycle: []lifecycleTransition{{RuleID: "ia", Prefix: "logs/", StorageClass: "STANDARD_IA", Days: 30}}})
+	recs = recommendLifecycle(c, 0.5, 1073741824, testPricing)
+	if len(recs) != 1 || recs[0].Covered || recs[0].Current != "none" {
+		t.Errorf("Expecting 1 uncovered recommendation got %+v", recs)
+	}
+}
+
+func TestRecommendLifecycleEncodedKeys(t *testing.T) {
+	setDateRanges(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	c := newBucketCounter()
+	lastMod := time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)
+	// The keys are listed URL-encoded
+	countObject(c, aws.String("foo"), &s3.Object{Key: aws.String("my+logs/a.gz"), Size: aws.Int64(2 * 1073741824), StorageClass: aws.String("STANDARD"), LastModified: &lastMod})
+	c.setMetadata(bucketMetadata{region: "us-east-1"})
+
+	recs := recommendLifecycle(c, 0.5, 1073741824, testPricing)
+	if len(recs) != 2 || recs[1].Prefix != "my logs/" {
+		t.Fatalf("Expecting a recommendation for my logs/ got %+v", recs)
+	}
+	recs[0].Covered = true
+	policy := suggestedLifecycle(recs)
+	if policy == nil || len(policy.Rules) != 1 || policy.Rules[0].ID != "s3-reporter-my-logs" || policy.Rules[0].Filter.Prefix != "my logs/" {
+		t.Errorf("Unexpected policy %+v", policy)
+	}
+}
+
+func TestCountObjectMarksFolders(t *testing.T) {
+	c := newBucketCounter()
+	lastMod := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, key := range []string{"logs/a.gz", "file.txt"} {
+		countObject(c, aws.String("foo"), &s3.Object{Key: aws.String(key), Size: aws.Int64(10), StorageClass: aws.String("STANDARD"), LastModified: &lastMod})
+	}
+	if !c.rootCount["logs"].folder {
+		t.Error("Expecting logs to be a folder")
+	}
+	if c.rootCount["file.txt"].folder {
+		t.Error("Expecting file.txt not to be a folder")
+	}
+	restored := c.snapshot().restore()
+	if !restored.rootCount["logs"].folder || restored.rootCount["file.txt"].folder {
+		t.Error("Expecting the folders to be kept by the snapshots")
+	}
+}
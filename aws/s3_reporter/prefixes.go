@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// prefixStat is the statistics of a prefix of the tree of a bucket
+type prefixStat struct {
+	level  int
+	prefix string
+	ctr    *bucketCounter
+}
+
+// prefixLevels walks the prefix tree of a bucket and returns the prefixes of
+// each level, the first level being the root folders
+func prefixLevels(ctr *bucketCounter) [][]*prefixStat {
+	var levels [][]*prefixStat
+	var walk func(parent string, c *bucketCounter, level int)
+	walk = func(parent string, c *bucketCounter, level int) {
+		for _, k := range sortedKeys(c.rootCount) {
+			if len(levels) < level {
+				levels = append(levels, nil)
+			}
+			p := &prefixStat{level: level, prefix: parent + k, ctr: c.rootCount[k]}
+			levels[level-1] = append(levels[level-1], p)
+			walk(p.prefix+"/", p.ctr, level+1)
+		}
+	}
+	walk("", ctr, 1)
+	return levels
+}
+
+// heaviestPrefixes returns the top prefixes of each level of the tree of a
+// bucket sorted by total size. If top is 0, all the prefixes are returned.
+func heaviestPrefixes(ctr *bucketCounter, top int) []*prefixStat {
+	var res []*prefixStat
+	for _, l := range prefixLevels(ctr) {
+		sort.SliceStable(l, func(i, j int) bool {
+			if l[i].ctr.sizeTotal != l[j].ctr.sizeTotal {
+				return l[i].ctr.sizeTotal > l[j].ctr.sizeTotal
+			}
+			return l[i].ctr.fileCount > l[j].ctr.fileCount
+		})
+		if top > 0 && len(l) > top {
+			l = l[:top]
+		}
+		res = append(res, l...)
+	}
+	return res
+}
+
+// heaviestPrefixesTable builds the table of the heaviest prefixes of each
+// level of a bucket. Returns nil if the bucket has no prefix.
+func heaviestPrefixesTable(bucket string, ctr *bucketCounter, top int) *reportTable {
+	prefixes := heaviestPrefixes(ctr, top)
+	if len(prefixes) == 0 {
+		return nil
+	}
+	t := reportTable{
+		title:   fmt.Sprintf("Heaviest prefixes by level for bucket %s", bucket),
+		headers: []string{"Level", "Prefix", "Total number of files", "Total size (GB)", "Ratio of bucket size"},
+	}
+	for _, p := range prefixes {
+		ratio := 0.0
+		if ctr.sizeTotal > 0 {
+			ratio = float64(p.ctr.sizeTotal) / float64(ctr.sizeTotal)
+		}
+		t.rows = append(t.rows, []string{
+			strconv.Itoa(p.level),
+			p.prefix,
+			strconv.FormatUint(p.ctr.fileCount, 10),
+			strconv.FormatFloat(bytesToGB(p.ctr.sizeTotal), 'f', 4, 64),
+			strconv.FormatFloat(ratio, 'f', 2, 64),
+		})
+	}
+	return &t
+}
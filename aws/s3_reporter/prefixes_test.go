@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyPrefixes(t *testing.T) {
+	testData := []struct {
+		key      string
+		depth    int
+		expected []string
+	}{
+		{"README", 1, []string{"README"}},
+		{"README", 3, []string{"README"}},
+		{"prod/api/2018-03-01/out.log", 1, []string{"prod"}},
+		{"prod/api/2018-03-01/out.log", 2, []string{"prod", "api"}},
+		{"prod/api/2018-03-01/out.log", 5, []string{"prod", "api", "2018-03-01"}},
+	}
+	for _, d := range testData {
+		if r := keyPrefixes(d.key, d.depth); !reflect.DeepEqual(r, d.expected) {
+			t.Errorf("Expecting %v for %s at depth %d got %v", d.expected, d.key, d.depth, r)
+		}
+	}
+}
+
+func TestHeaviestPrefixes(t *testing.T) {
+	lastMod := time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	c := newBucketCounter()
+	for _, f := range []struct {
+		key  string
+		size int64
+	}{
+		{"prod/api/2018-03-01/out.log", 4000},
+		{"prod/api/2018-03-02/out.log", 3000},
+		{"prod/web/2018-03-01/out.log", 2000},
+		{"dev/api/2018-03-01/out.log", 500},
+		{"dev/api/2018-03-01/err.log", 500},
+		{"README", 100},
+	} {
+		c.incrementPrefixes(f.size, "STANDARD", ".log", keyPrefixes(f.key, 2), lastMod)
+	}
+	if c.fileCount != 6 || c.rootCount["prod"].fileCount != 3 || c.rootCount["prod"].rootCount["api"].sizeTotal != 7000 {
+		t.Fatalf("Unexpected prefix tree %+v", c.rootCount)
+	}
+
+	expected := []string{"1 prod 9000", "1 dev 1000", "2 prod/api 7000", "2 prod/web 2000"}
+	var r []string
+	for _, p := range heaviestPrefixes(c, 2) {
+		r = append(r, fmt.Sprintf("%d %s %d", p.level, p.prefix, p.ctr.sizeTotal))
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expecting %v got %v", expected, r)
+	}
+	if l := len(heaviestPrefixes(c, 0)); l != 6 {
+		t.Errorf("Expecting 6 prefixes without limit got %d", l)
+	}
+
+	table := heaviestPrefixesTable("foo", c, 1)
+	expectedRows := [][]string{
+		{"1", "prod", "3", "0.0000", "0.89"},
+		{"2", "prod/api", "2", "0.0000", "0.69"},
+	}
+	if !reflect.DeepEqual(table.rows, expectedRows) {
+		t.Errorf("Expecting %v got %v", expectedRows, table.rows)
+	}
+	if table = heaviestPrefixesTable("foo", newBucketCounter(), 1); table != nil {
+		t.Errorf("Expecting no table for an empty bucket got %v", table)
+	}
+}
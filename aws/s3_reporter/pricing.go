@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// pricingTable contains the monthly price in USD of 1GB stored in each storage
+// class. Regions can override the default price of some storage classes.
+type pricingTable struct {
+	Default map[string]float64            `json:"default" yaml:"default"`
+	Regions map[string]map[string]float64 `json:"regions" yaml:"regions"`
+}
+
+// loadConfigFile decodes a yaml or json file into v. The format is determined
+// by the extension of the file.
+func loadConfigFile(filePath string, v interface{}) error {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".json":
+		return json.Unmarshal(data, v)
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, v)
+	}
+	return fmt.Errorf("unsupported file extension %q for %s, expecting .json, .yaml or .yml", filepath.Ext(filePath), filePath)
+}
+
+// loadPricing reads a pricing table from a yaml or json file
+func loadPricing(filePath string) (*pricingTable, error) {
+	p := pricingTable{}
+	if err := loadConfigFile(filePath, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// price returns the monthly price of 1GB of the given storage class in the
+// given region. The second value is false if the storage class has no price.
+func (p *pricingTable) price(region, storageClass string) (float64, bool) {
+	if r, ok := p.Regions[region]; ok {
+		if v, ok := r[storageClass]; ok {
+			return v, true
+		}
+	}
+	v, ok := p.Default[storageClass]
+	return v, ok
+}
+
+// bytesToGB converts a number of bytes to GB
+func bytesToGB(b uint64) float64 {
+	return float64(b) / 1024.0 / 1024.0 / 1024.0
+}
+
+// cost returns the estimated monthly cost of the given sizes by storage class
+// in a region. The storage classes that have no price are not part of the
+// total.
+func (p *pricingTable) cost(region string, storageSize map[string]uint64) float64 {
+	total := 0.0
+	for class, size := range storageSize {
+		if v, ok := p.price(region, class); ok {
+			total += bytesToGB(size) * v
+		}
+	}
+	return total
+}
+
+// counterCost returns the estimated monthly cost of a bucketCounter located
+// in the given region
+func (p *pricingTable) counterCost(region string, c *bucketCounter) float64 {
+	return p.cost(region, copyUint64(c.storageSize))
+}
+
+// formatCost formats a cost in USD for the reports
+func formatCost(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// costSummaryTable builds the table of the estimated monthly cost of each bucket
+func costSummaryTable(p *pricingTable, ctr map[string]*bucketCounter) *reportTable {
+	t := reportTable{
+		title:   "Estimated monthly storage cost by buckets",
+		headers: []string{"Bucket name", "Region", "Total size (GB)", "Estimated monthly cost (USD)"},
+	}
+	for _, k := range sortedKeys(ctr) {
+		v := ctr[k]
+		t.rows = append(t.rows, []string{
+			k,
+			v.meta.region,
+			strconv.FormatFloat(bytesToGB(v.sizeTotal), 'f', 4, 64),
+			formatCost(p.counterCost(v.meta.region, v)),
+		})
+	}
+	return &t
+}
+
+// costByStorageTable builds the table of the estimated monthly cost of a
+// bucket by storage class. Storage classes without price are reported as
+// unknown.
+func costByStorageTable(p *pricingTable, bucket string, ctr *bucketCounter) *reportTable {
+	if len(ctr.storageSize) == 0 {
+		return nil
+	}
+	t := reportTable{
+		title:   fmt.Sprintf("Estimated monthly storage cost for bucket %s by storage class", bucket),
+		headers: []string{"Storage class", "Total size (GB)", "Price per GB (USD)", "Estimated monthly cost (USD)"},
+	}
+	var classes []string
+	for k := range ctr.storageSize {
+		classes = append(classes, k)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		size := bytesToGB(ctr.storageSize[class])
+		row := []string{class, strconv.FormatFloat(size, 'f', 4, 64), "unknown", "unknown"}
+		if v, ok := p.price(ctr.meta.region, class); ok {
+			row[2] = strconv.FormatFloat(v, 'f', -1, 64)
+			row[3] = formatCost(size * v)
+		}
+		t.rows = append(t.rows, row)
+	}
+	return &t
+}
+
+// costByRootTable builds the table of the estimated monthly cost of a bucket
+// by root folder
+func costByRootTable(p *pricingTable, bucket string, ctr *bucketCounter) *reportTable {
+	if len(ctr.rootCount) == 0 {
+		return nil
+	}
+	t := reportTable{
+		title:   fmt.Sprintf("Estimated monthly storage cost for bucket %s by root folder", bucket),
+		headers: []string{"Root folder", "Total size (GB)", "Estimated monthly cost (USD)"},
+	}
+	for _, k := range sortedKeys(ctr.rootCount) {
+		v := ctr.rootCount[k]
+		t.rows = append(t.rows, []string{
+			k,
+			strconv.FormatFloat(bytesToGB(v.sizeTotal), 'f', 4, 64),
+			formatCost(p.counterCost(ctr.meta.region, v)),
+		})
+	}
+	return &t
+}
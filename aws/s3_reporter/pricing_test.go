@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testPricing = &pricingTable{
+	Default: map[string]float64{"STANDARD": 0.023, "GLACIER": 0.004},
+	Regions: map[string]map[string]float64{"us-west-1": {"STANDARD": 0.026}},
+}
+
+func TestLoadPricing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testData := []struct {
+		fileName, content string
+		expectError       bool
+	}{
+		{"pricing.yaml", "default:\n  STANDARD: 0.023\n  GLACIER: 0.004\nregions:\n  us-west-1:\n    STANDARD: 0.026\n", false},
+		{"pricing.json", `{"default": {"STANDARD": 0.023, "GLACIER": 0.004}, "regions": {"us-west-1": {"STANDARD": 0.026}}}`, false},
+		{"pricing.txt", "", true},
+		{"broken.json", `{"default": `, true},
+	}
+	for n, d := range testData {
+		filePath := filepath.Join(dir, d.fileName)
+		if err = ioutil.WriteFile(filePath, []byte(d.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		p, err := loadPricing(filePath)
+		if d.expectError {
+			if err == nil {
+				t.Errorf("#%d: expecting an error", n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %s", n, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, testPricing) {
+			t.Errorf("#%d: expecting %v got %v", n, testPricing, p)
+		}
+	}
+}
+
+func TestPrice(t *testing.T) {
+	testData := []struct {
+		region, storageClass string
+		expected             float64
+		expectedOk           bool
+	}{
+		{"us-east-1", "STANDARD", 0.023, true},
+		{"us-west-1", "STANDARD", 0.026, true},
+		{"us-west-1", "GLACIER", 0.004, true},
+		{"us-west-1", "DEEP_ARCHIVE", 0, false},
+	}
+	for _, d := range testData {
+		v, ok := testPricing.price(d.region, d.storageClass)
+		if v != d.expected || ok != d.expectedOk {
+			t.Errorf("Expecting %v, %v for %s in %s got %v, %v", d.expected, d.expectedOk, d.storageClass, d.region, v, ok)
+		}
+	}
+}
+
+func TestCostByStorageTable(t *testing.T) {
+	c := newBucketCounter()
+	c.setMetadata(bucketMetadata{region: "us-west-1"})
+	c.increment(10737418240, "STANDARD", ".gz", "logs", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	c.increment(1073741824, "DEEP_ARCHIVE", ".gz", "logs", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true)
+
+	expected := [][]string{
+		{"DEEP_ARCHIVE", "1.0000", "unknown", "unknown"},
+		{"STANDARD", "10.0000", "0.026", "0.26"},
+	}
+	if r := costByStorageTable(testPricing, "foo", c); !reflect.DeepEqual(r.rows, expected) {
+		t.Errorf("Expecting %v got %v", expected, r.rows)
+	}
+	expected = [][]string{{"logs", "11.0000", "0.26"}}
+	if r := costByRootTable(testPricing, "foo", c); !reflect.DeepEqual(r.rows, expected) {
+		t.Errorf("Expecting %v got %v", expected, r.rows)
+	}
+}
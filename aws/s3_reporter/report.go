@@ -0,0 +1,571 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// reportOptions contains the settings of the optional sections of the report
+type reportOptions struct {
+	// pricing is used to estimate the storage cost. The cost is not reported
+	// if nil.
+	pricing *pricingTable
+	// lifecycle enables the lifecycle recommendations
+	lifecycle bool
+	// lifecycleMinRatio is the minimum ratio of the bytes of a prefix that a
+	// transition must concern to be recommended
+	lifecycleMinRatio float64
+	// lifecycleMinBytes is the minimum number of bytes that a transition must
+	// concern to be recommended
+	lifecycleMinBytes uint64
+	// prefixDepth is the number of levels of the prefix tree of each bucket
+	prefixDepth int
+	// prefixTop is the number of heaviest prefixes reported for each level
+	prefixTop int
+	// versions enables the statistics of the noncurrent versions, delete
+	// markers and incomplete multipart uploads
+	versions bool
+	// audit enables the tables of the configuration of the buckets and of the
+	// risky configurations found
+	audit bool
+	// top is the number of largest, oldest and oldest but largest objects
+	// reported, 0 meaning none
+	top int
+	// sampling enables the tables of the metadata of the sampled objects
+	sampling bool
+	// filters holds the filters active during the scan, recorded in the
+	// header of the report. Nil if no filter is active.
+	filters *filterSet
+	// bands holds the size and age ranges of the report and the date the ages
+	// are computed from, recorded in the header of the report. Nil if the
+	// defaults are used.
+	bands *bandConfig
+	// duplicates contains the duplicate objects found. They are not reported
+	// if nil.
+	duplicates *duplicateReport
+	// accounts lists the accounts scanned by assuming a role in each of them.
+	// The tables get an account column if not nil.
+	accounts []*awsAccount
+	// skipped contains the error of each bucket that could not be fully
+	// scanned, listed at the end of the report
+	skipped map[string]error
+}
+
+// summaryTables returns the global tables of all the buckets
+func summaryTables(ctr map[string]*bucketCounter, opts *reportOptions) []*reportTable {
+	// byBucket adds the account column to the tables which rows are buckets
+	byBucket := func(t *reportTable) *reportTable {
+		if opts.accounts == nil {
+			return t
+		}
+		return withAccountColumn(t, func(row []string) string { return ctr[row[0]].meta.account })
+	}
+	var tables []*reportTable
+	if opts.accounts != nil {
+		tables = append(tables, accountsTable(ctr, opts))
+	}
+	tables = append(tables, byBucket(sizingTable(ctr, "bucket name")), byBucket(dateSummaryTable(ctr)))
+	if opts.versions {
+		tables = append(tables, byBucket(hiddenSummaryTable(ctr)))
+	}
+	if opts.top > 0 {
+		for _, t := range topTables(mergeTop(ctr, opts.top), "of all the buckets", true) {
+			tables = append(tables, byBucket(t))
+		}
+	}
+	if opts.audit {
+		tables = append(tables, byBucket(auditTable(ctr)), byBucket(findingsTable(auditFindings(ctr))))
+	}
+	if opts.sampling {
+		tables = append(tables, byBucket(encryptionSampleTable(ctr)))
+	}
+	if opts.duplicates != nil {
+		tables = append(tables, duplicateTables(opts.duplicates)...)
+	}
+	if opts.pricing != nil {
+		tables = append(tables, byBucket(costSummaryTable(opts.pricing, ctr)))
+	}
+	return tables
+}
+
+// detailsTables returns the detail tables of a bucket: by root folder, by
+// storage class, by extension and by month
+func detailsTables(bucket string, ctr *bucketCounter, opts *reportOptions) []*reportTable {
+	tables := []*reportTable{
+		byRootTable(bucket, ctr),
+		uint64Table(ctr.storageCount, fmt.Sprintf("Repartition of files for bucket %s by storage class", bucket), []string{"Storage class", "Number of files"}),
+		sizeTable(ctr.storageSize, fmt.Sprintf("Repartition of file sizes for bucket %s by storage class", bucket), []string{"Storage class", "Total size (GB)"}),
+		uint64Table(ctr.extensionCount, fmt.Sprintf("Repartition of files for bucket %s by extension", bucket), []string{"Extension", "Number of files"}),
+		uint64Table(ctr.dateCount, fmt.Sprintf("Repartition of files for bucket %s by month", bucket), []string{"Month", "Number of files"}),
+	}
+	if opts.versions {
+		tables = append(tables, hiddenDetailsTables(bucket, ctr)...)
+	}
+	if opts.prefixDepth > 1 {
+		tables = append(tables, heaviestPrefixesTable(bucket, ctr, opts.prefixTop))
+	}
+	if opts.pricing != nil {
+		tables = append(tables, costByStorageTable(opts.pricing, bucket, ctr), costByRootTable(opts.pricing, bucket, ctr))
+	}
+	if opts.top > 0 {
+		tables = append(tables, topTables(ctr.topSnapshot(), "of bucket "+bucket, false)...)
+	}
+	if opts.sampling {
+		tables = append(tables, sampleTables(bucket, ctr)...)
+	}
+	if opts.lifecycle {
+		tables = append(tables, lifecycleTable(bucket, recommendLifecycle(ctr, opts.lifecycleMinRatio, opts.lifecycleMinBytes, opts.pricing)))
+	}
+	if opts.accounts != nil {
+		for _, t := range tables {
+			withAccountColumn(t, func([]string) string { return ctr.meta.account })
+		}
+	}
+	return tables
+}
+
+// reporter is implemented by each output format of the report
+type reporter interface {
+	// header renders the description of the scan: the active filters
+	header() error
+	// summary renders the global size and age tables of all the buckets
+	summary(ctr map[string]*bucketCounter) error
+	// details renders the detail tables of a single bucket
+	details(bucket string, ctr *bucketCounter) error
+	// footer renders the buckets skipped by the scan
+	footer() error
+	// close finishes the report
+	close() error
+}
+
+// newReporter returns the reporter corresponding to the given format
+func newReporter(format string, w io.Writer, opts *reportOptions) (reporter, error) {
+	switch format {
+	case "csv":
+		return &csvReporter{w: csv.NewWriter(w), opts: opts}, nil
+	case "json":
+		return &jsonReporter{w: w, opts: opts, doc: jsonReport{Buckets: make(map[string]*jsonBucket)}}, nil
+	case "markdown":
+		return &markdownReporter{w: w, opts: opts}, nil
+	}
+	return nil, fmt.Errorf("unknown report format %q", format)
+}
+
+// writeReport generates the report of the given type and format in a file
+func writeReport(filePath, format, reportType string, ctr map[string]*bucketCounter, opts *reportOptions) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := newReporter(format, f, opts)
+	if err != nil {
+		return err
+	}
+	if err = r.header(); err != nil {
+		return err
+	}
+	if reportType == "summary" || reportType == "full" {
+		if err = r.summary(ctr); err != nil {
+			return err
+		}
+	}
+	if reportType == "details" || reportType == "full" {
+		for _, bucket := range sortedKeys(ctr) {
+			if err = r.details(bucket, ctr[bucket]); err != nil {
+				return err
+			}
+		}
+	}
+	if err = r.footer(); err != nil {
+		return err
+	}
+	if err = r.close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// csvReporter renders the report as stacked csv tables, each one preceded by
+// a title line
+type csvReporter struct {
+	w    *csv.Writer
+	opts *reportOptions
+}
+
+func (r *csvReporter) header() error {
+	if err := writeCsvTable(r.w, filtersTable(r.opts.filters)); err != nil {
+		return err
+	}
+	return writeCsvTable(r.w, bandsTable(r.opts.bands))
+}
+
+func (r *csvReporter) summary(ctr map[string]*bucketCounter) error {
+	for _, t := range summaryTables(ctr, r.opts) {
+		if err := writeCsvTable(r.w, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *csvReporter) details(bucket string, ctr *bucketCounter) error {
+	for _, t := range detailsTables(bucket, ctr, r.opts) {
+		if err := writeCsvTable(r.w, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *csvReporter) footer() error {
+	return writeCsvTable(r.w, skippedTable(r.opts.skipped))
+}
+
+func (r *csvReporter) close() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// markdownReporter renders the report as markdown tables, each one preceded by
+// a title
+type markdownReporter struct {
+	w    io.Writer
+	opts *reportOptions
+}
+
+// markdownEscaper escapes the pipes and replaces the line breaks, which would
+// break a markdown table cell
+var markdownEscaper = strings.NewReplacer("|", "\\|", "\r\n", " ", "\n", " ", "\r", " ")
+
+// escapeMarkdown escapes the characters that would break a markdown table cell
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// writeMarkdownTable renders a reportTable in markdown. The first column is
+// left-aligned and the other ones are right-aligned. Nil tables are skipped.
+func writeMarkdownTable(w io.Writer, t *reportTable) error {
+	if t == nil {
+		return nil
+	}
+	lines := []string{"### " + escapeMarkdown(t.title), ""}
+	cells := make([]string, len(t.headers))
+	align := make([]string, len(t.headers))
+	for i, h := range t.headers {
+		cells[i] = escapeMarkdown(h)
+		align[i] = "---:"
+	}
+	if len(align) > 0 {
+		align[0] = ":---"
+	}
+	lines = append(lines, "| "+strings.Join(cells, " | ")+" |", "| "+strings.Join(align, " | ")+" |")
+	for _, row := range t.rows {
+		cells = make([]string, len(row))
+		for i, c := range row {
+			cells[i] = escapeMarkdown(c)
+		}
+		lines = append(lines, "| "+strings.Join(cells, " | ")+" |")
+	}
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n\n")
+	return err
+}
+
+func (r *markdownReporter) header() error {
+	if err := writeMarkdownTable(r.w, filtersTable(r.opts.filters)); err != nil {
+		return err
+	}
+	return writeMarkdownTable(r.w, bandsTable(r.opts.bands))
+}
+
+func (r *markdownReporter) summary(ctr map[string]*bucketCounter) error {
+	for _, t := range summaryTables(ctr, r.opts) {
+		if err := writeMarkdownTable(r.w, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *markdownReporter) details(bucket string, ctr *bucketCounter) error {
+	for _, t := range detailsTables(bucket, ctr, r.opts) {
+		if err := writeMarkdownTable(r.w, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *markdownReporter) footer() error {
+	return writeMarkdownTable(r.w, skippedTable(r.opts.skipped))
+}
+
+func (r *markdownReporter) close() error {
+	return nil
+}
+
+// jsonCounter is the json representation of the size and age statistics of a
+// bucketCounter
+type jsonCounter struct {
+	FileCount  uint64            `json:"file_count"`
+	SizeTotal  uint64            `json:"size_total_bytes"`
+	SizeRanges map[string]uint64 `json:"size_ranges"`
+	AgeRanges  map[string]uint64 `json:"age_ranges"`
+}
+
+// jsonCost is the json representation of the estimated monthly cost of a
+// bucket in USD
+type jsonCost struct {
+	Total          float64            `json:"total"`
+	ByStorageClass map[string]float64 `json:"by_storage_class,omitempty"`
+	ByRoot         map[string]float64 `json:"by_root,omitempty"`
+}
+
+// jsonVersions is the json representation of the noncurrent versions, delete
+// markers and incomplete multipart uploads of a bucket
+type jsonVersions struct {
+	Noncurrent     uint64            `json:"noncurrent_versions"`
+	NoncurrentSize uint64            `json:"noncurrent_versions_bytes"`
+	NoncurrentAge  map[string]uint64 `json:"noncurrent_versions_age_bytes,omitempty"`
+	DeleteMarkers  uint64            `json:"delete_markers"`
+	Multipart      uint64            `json:"incomplete_multipart_uploads"`
+	MultipartSize  uint64            `json:"incomplete_multipart_uploads_bytes"`
+	MultipartAge   map[string]uint64 `json:"incomplete_multipart_uploads_age_bytes,omitempty"`
+}
+
+// newJSONVersions returns the json representation of the version statistics
+// of a bucketCounter. The ages are only part of the details.
+func newJSONVersions(c *bucketCounter, details bool) *jsonVersions {
+	v := &jsonVersions{
+		Noncurrent:     c.noncurrent,
+		NoncurrentSize: c.noncurrentSize,
+		DeleteMarkers:  c.deleteMarkers,
+		Multipart:      c.multipart,
+		MultipartSize:  c.multipartSize,
+	}
+	if details {
+		v.NoncurrentAge = c.noncurrentAge
+		v.MultipartAge = c.multipartAge
+	}
+	return v
+}
+
+// jsonPrefix is the json representation of a prefix of the tree of a bucket
+type jsonPrefix struct {
+	Level     int    `json:"level"`
+	Prefix    string `json:"prefix"`
+	FileCount uint64 `json:"file_count"`
+	SizeTotal uint64 `json:"size_total_bytes"`
+}
+
+// jsonBucket is the json document generated for each bucket
+type jsonBucket struct {
+	jsonCounter
+	Region             string                     `json:"region,omitempty"`
+	Account            string                     `json:"account,omitempty"`
+	Roots              map[string]*jsonCounter    `json:"roots,omitempty"`
+	Prefixes           []*jsonPrefix              `json:"heaviest_prefixes,omitempty"`
+	Versions           *jsonVersions              `json:"versions,omitempty"`
+	StorageClasses     map[string]uint64          `json:"storage_classes,omitempty"`
+	StorageClassesSize map[string]uint64          `json:"storage_classes_bytes,omitempty"`
+	Extensions         map[string]uint64          `json:"extensions,omitempty"`
+	Months             map[string]uint64          `json:"months,omitempty"`
+	Cost               *jsonCost                  `json:"estimated_monthly_cost_usd,omitempty"`
+	Lifecycle          []*lifecycleRecommendation `json:"lifecycle_recommendations,omitempty"`
+	SuggestedLifecycle *lifecyclePolicy           `json:"suggested_lifecycle_configuration,omitempty"`
+	Audit              *bucketAudit               `json:"audit,omitempty"`
+	Top                *topSnapshot               `json:"top_objects,omitempty"`
+	Samples            *jsonSamples               `json:"samples,omitempty"`
+}
+
+// jsonAccount is the json representation of the rollup of the buckets of an
+// account
+type jsonAccount struct {
+	ID        string   `json:"id,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Buckets   int      `json:"buckets"`
+	FileCount uint64   `json:"file_count"`
+	SizeTotal uint64   `json:"size_total_bytes"`
+	Cost      *float64 `json:"estimated_monthly_cost_usd,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// jsonSkipped is the json representation of a bucket skipped by the scan
+type jsonSkipped struct {
+	Bucket    string `json:"bucket"`
+	ErrorType string `json:"error_type"`
+	Reason    string `json:"reason"`
+}
+
+// jsonReport is the top-level json document of the report
+type jsonReport struct {
+	Filters     *filterFile            `json:"filters,omitempty"`
+	Bands       *bandConfig            `json:"bands,omitempty"`
+	Accounts    []*jsonAccount         `json:"accounts,omitempty"`
+	AllAccounts *jsonAccount           `json:"all_accounts,omitempty"`
+	Buckets     map[string]*jsonBucket `json:"buckets"`
+	Duplicates  *duplicateReport       `json:"duplicates,omitempty"`
+	Findings    []*auditFinding        `json:"audit_findings,omitempty"`
+	Top         *topSnapshot           `json:"top_objects,omitempty"`
+	Skipped     []*jsonSkipped         `json:"skipped_buckets,omitempty"`
+}
+
+// jsonReporter renders the report as a single json document containing a
+// nested document per bucket
+type jsonReporter struct {
+	w    io.Writer
+	opts *reportOptions
+	doc  jsonReport
+}
+
+// newJSONCounter returns the json representation of a bucketCounter
+func newJSONCounter(c *bucketCounter) *jsonCounter {
+	return &jsonCounter{
+		FileCount:  c.fileCount,
+		SizeTotal:  c.sizeTotal,
+		SizeRanges: c.sizeCount,
+		AgeRanges:  c.dateRange,
+	}
+}
+
+// bucket returns the json document of the given bucket, creating it if needed
+func (r *jsonReporter) bucket(name string) *jsonBucket {
+	b, ok := r.doc.Buckets[name]
+	if !ok {
+		b = &jsonBucket{}
+		r.doc.Buckets[name] = b
+	}
+	return b
+}
+
+func (r *jsonReporter) header() error {
+	if r.opts.filters != nil {
+		r.doc.Filters = r.opts.filters.rules
+	}
+	r.doc.Bands = r.opts.bands
+	return nil
+}
+
+func (r *jsonReporter) summary(ctr map[string]*bucketCounter) error {
+	r.doc.Duplicates = r.opts.duplicates
+	if r.opts.audit {
+		r.doc.Findings = auditFindings(ctr)
+	}
+	if r.opts.top > 0 {
+		r.doc.Top = mergeTop(ctr, r.opts.top)
+	}
+	if r.opts.accounts != nil {
+		for _, s := range accountRollup(ctr, r.opts.accounts, r.opts.pricing) {
+			a := &jsonAccount{Buckets: s.buckets, FileCount: s.files, SizeTotal: s.size}
+			if r.opts.pricing != nil {
+				cost := s.cost
+				a.Cost = &cost
+			}
+			if s.account == nil {
+				r.doc.AllAccounts = a
+				continue
+			}
+			a.ID, a.Name = s.account.id, s.account.name
+			if s.account.err != nil {
+				a.Error = s.account.err.Error()
+			}
+			r.doc.Accounts = append(r.doc.Accounts, a)
+		}
+	}
+	for name, c := range ctr {
+		b := r.bucket(name)
+		b.jsonCounter = *newJSONCounter(c)
+		b.Region = c.meta.region
+		b.Account = c.meta.account
+		if r.opts.audit {
+			b.Audit = c.meta.audit
+		}
+		if r.opts.sampling {
+			b.Samples = newJSONSamples(c)
+		}
+		if r.opts.versions && b.Versions == nil {
+			b.Versions = newJSONVersions(c, false)
+		}
+		if r.opts.pricing != nil {
+			if b.Cost == nil {
+				b.Cost = &jsonCost{}
+			}
+			b.Cost.Total = r.opts.pricing.counterCost(c.meta.region, c)
+		}
+	}
+	return nil
+}
+
+func (r *jsonReporter) details(bucket string, ctr *bucketCounter) error {
+	b := r.bucket(bucket)
+	b.jsonCounter = *newJSONCounter(ctr)
+	if len(ctr.rootCount) > 0 {
+		b.Roots = make(map[string]*jsonCounter, len(ctr.rootCount))
+		for k, v := range ctr.rootCount {
+			b.Roots[k] = newJSONCounter(v)
+		}
+	}
+	if r.opts.versions {
+		b.Versions = newJSONVersions(ctr, true)
+	}
+	if r.opts.prefixDepth > 1 {
+		for _, p := range heaviestPrefixes(ctr, r.opts.prefixTop) {
+			b.Prefixes = append(b.Prefixes, &jsonPrefix{Level: p.level, Prefix: p.prefix, FileCount: p.ctr.fileCount, SizeTotal: p.ctr.sizeTotal})
+		}
+	}
+	b.Region = ctr.meta.region
+	b.Account = ctr.meta.account
+	if r.opts.audit {
+		b.Audit = ctr.meta.audit
+	}
+	b.StorageClasses = ctr.storageCount
+	b.StorageClassesSize = ctr.storageSize
+	b.Extensions = ctr.extensionCount
+	b.Months = ctr.dateCount
+	if p := r.opts.pricing; p != nil {
+		b.Cost = &jsonCost{
+			Total:          p.counterCost(ctr.meta.region, ctr),
+			ByStorageClass: make(map[string]float64),
+			ByRoot:         make(map[string]float64),
+		}
+		for class, size := range ctr.storageSize {
+			if v, ok := p.price(ctr.meta.region, class); ok {
+				b.Cost.ByStorageClass[class] = bytesToGB(size) * v
+			}
+		}
+		for k, v := range ctr.rootCount {
+			b.Cost.ByRoot[k] = p.counterCost(ctr.meta.region, v)
+		}
+	}
+	if r.opts.top > 0 {
+		b.Top = ctr.topSnapshot()
+	}
+	if r.opts.sampling {
+		b.Samples = newJSONSamples(ctr)
+	}
+	if r.opts.lifecycle {
+		b.Lifecycle = recommendLifecycle(ctr, r.opts.lifecycleMinRatio, r.opts.lifecycleMinBytes, r.opts.pricing)
+		b.SuggestedLifecycle = suggestedLifecycle(b.Lifecycle)
+	}
+	return nil
+}
+
+func (r *jsonReporter) footer() error {
+	if t := skippedTable(r.opts.skipped); t != nil {
+		for _, row := range t.rows {
+			r.doc.Skipped = append(r.doc.Skipped, &jsonSkipped{Bucket: row[0], ErrorType: row[1], Reason: row[2]})
+		}
+	}
+	return nil
+}
+
+func (r *jsonReporter) close() error {
+	enc := json.NewEncoder(r.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.doc)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWriteMarkdownTable(t *testing.T) {
+	testData := []struct {
+		input    *reportTable
+		expected string
+	}{
+		{nil, ""},
+		{&reportTable{"my title", []string{"Key", "Value"}, nil}, "### my title\n\n| Key | Value |\n| :--- | ---: |\n\n"},
+		{&reportTable{"my title", []string{"Key", "Value"}, [][]string{{"a|b", "2"}, {"foo", "1"}}}, "### my title\n\n| Key | Value |\n| :--- | ---: |\n| a\\|b | 2 |\n| foo | 1 |\n\n"},
+		{&reportTable{"my title", []string{"Key", "Value"}, [][]string{{"a\nb\r\nc", "2"}}}, "### my title\n\n| Key | Value |\n| :--- | ---: |\n| a b c | 2 |\n\n"},
+	}
+	for n, d := range testData {
+		b := &bytes.Buffer{}
+		if err := writeMarkdownTable(b, d.input); err != nil {
+			t.Errorf("#%d: unexpected error: %s", n, err)
+		}
+		if out := b.String(); out != d.expected {
+			t.Errorf("#%d: out=%q want %q", n, out, d.expected)
+		}
+	}
+}
+
+func TestNewReporter(t *testing.T) {
+	for _, format := range []string{"csv", "json", "markdown"} {
+		if _, err := newReporter(format, &bytes.Buffer{}, &reportOptions{}); err != nil {
+			t.Errorf("Unexpected error for format %s: %s", format, err)
+		}
+	}
+	if _, err := newReporter("xml", &bytes.Buffer{}, &reportOptions{}); err == nil {
+		t.Error("Expecting an error for format xml")
+	}
+}
+
+func TestJSONReporter(t *testing.T) {
+	c := newBucketCounter()
+	c.increment(1500, "STANDARD", ".txt", "foo", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	c.increment(15, "GLACIER", ".gz", "bar", time.Date(2016, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	ctr := map[string]*bucketCounter{"myBucket": c}
+
+	b := &bytes.Buffer{}
+	r, _ := newReporter("json", b, &reportOptions{})
+	if err := r.summary(ctr); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := r.details("myBucket", c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := r.close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	doc := jsonReport{}
+	if err := json.Unmarshal(b.Bytes(), &doc); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	bucket, ok := doc.Buckets["myBucket"]
+	if !ok {
+		t.Fatalf("Expecting bucket myBucket in %s", b.String())
+	}
+	if bucket.FileCount != 2 || bucket.SizeTotal != 1515 {
+		t.Errorf("Expecting 2 files and 1515 bytes, got %d files and %d bytes", bucket.FileCount, bucket.SizeTotal)
+	}
+	expected := map[string]uint64{"STANDARD": 1, "GLACIER": 1}
+	if !reflect.DeepEqual(bucket.StorageClasses, expected) {
+		t.Errorf("Expecting %v got %v", expected, bucket.StorageClasses)
+	}
+}
+
+func TestCsvReporterDetails(t *testing.T) {
+	c := newBucketCounter()
+	c.increment(1500, "STANDARD", ".txt", "foo", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), false)
+	b := &bytes.Buffer{}
+	r, _ := newReporter("csv", b, &reportOptions{})
+	if err := r.details("myBucket", c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := r.close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "Repartition of files for bucket myBucket by storage class\nStorage class,Number of files\nSTANDARD,1\n\n" +
+		"Repartition of file sizes for bucket myBucket by storage class\nStorage class,Total size (GB)\nSTANDARD,0.0000\n\n" +
+		"Repartition of files for bucket myBucket by extension\nExtension,Number of files\n.txt,1\n\n" +
+		"Repartition of files for bucket myBucket by month\nMonth,Number of files\n2017-03-01,1\n\n"
+	if out := b.String(); out != expected {
+		t.Errorf("out=%q want %q", out, expected)
+	}
+}
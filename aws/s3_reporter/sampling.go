@@ -0,0 +1,494 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// sampleZ is the quantile of the normal distribution of the 95% confidence
+// intervals of the estimates
+const sampleZ = 1.96
+
+// objSampler fetches the metadata of a fraction of the objects. It is nil when
+// the sampling is disabled.
+var objSampler *objectSampler
+
+// sampleJob is an object which metadata is to be fetched. The objects queued
+// are saved in the checkpoints.
+type sampleJob struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+}
+
+// objectSampler selects a fraction of the objects counted and fetches their
+// metadata with HeadObject in a pool of workers, without exceeding a number of
+// requests per second for all the buckets. The metadata is counted in the
+// counter of the bucket of each object.
+type objectSampler struct {
+	rate    float64
+	jobs    chan *sampleJob
+	wg      sync.WaitGroup
+	limiter *time.Ticker
+	mutex   sync.Locker
+	clients map[string]s3iface.S3API
+	// pending are the objects queued which metadata has not been counted yet
+	pending map[*sampleJob]bool
+	// restored are the objects queued when the checkpoint of a resumed scan
+	// was taken, waiting for the client of their bucket to be queued again
+	restored map[string][]*sampleJob
+}
+
+// newObjectSampler starts the workers sampling the given fraction of the
+// objects. rps is the maximum number of requests per second, 0 meaning no
+// limit.
+func newObjectSampler(rate, rps float64, workers int) *objectSampler {
+	s := &objectSampler{
+		rate:     rate,
+		jobs:     make(chan *sampleJob, 1000),
+		mutex:    &sync.Mutex{},
+		clients:  make(map[string]s3iface.S3API),
+		pending:  make(map[*sampleJob]bool),
+		restored: make(map[string][]*sampleJob),
+	}
+	if rps > 0 {
+		s.limiter = time.NewTicker(time.Duration(float64(time.Second) / rps))
+	}
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.worker()
+	}
+	return s
+}
+
+// setClient records the client used to fetch the metadata of the objects of
+// a bucket, which must be called before any of its objects is added. The
+// objects of the bucket restored from a checkpoint are queued again.
+func (s *objectSampler) setClient(bucket string, svc s3iface.S3API) {
+	s.mutex.Lock()
+	s.clients[bucket] = svc
+	jobs := s.restored[bucket]
+	delete(s.restored, bucket)
+	s.mutex.Unlock()
+	s.queue(jobs...)
+}
+
+// selected returns true if the object is part of the sample. The selection
+// depends on the bucket and the key only so that a resumed scan samples the
+// same objects.
+func (s *objectSampler) selected(bucket, key string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(bucket))
+	h.Write([]byte{'/'})
+	h.Write([]byte(key))
+	return float64(h.Sum64())/math.MaxUint64 < s.rate
+}
+
+// add queues the object if it is part of the sample. The key is the one stored
+// in the bucket. It blocks while the queue is full.
+func (s *objectSampler) add(bucket, key string, size int64) {
+	if s.selected(bucket, key) {
+		s.queue(&sampleJob{Bucket: bucket, Key: key, Size: size})
+	}
+}
+
+// queue records the objects as pending and sends them to the workers. It
+// blocks while the queue is full.
+func (s *objectSampler) queue(jobs ...*sampleJob) {
+	if len(jobs) == 0 {
+		return
+	}
+	s.mutex.Lock()
+	for _, j := range jobs {
+		s.pending[j] = true
+	}
+	s.mutex.Unlock()
+	for _, j := range jobs {
+		s.jobs <- j
+	}
+}
+
+// waiting returns true if objects of the bucket restored from a checkpoint are
+// waiting for the client of the bucket
+func (s *objectSampler) waiting(bucket string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.restored[bucket]) > 0
+}
+
+// pendingJobs calls fn, which snapshots the counters of the buckets, while no
+// sample is counted and returns the objects which metadata has not been
+// counted yet. Together they make a consistent state to resume the sampling
+// from without waiting for the queue to be processed.
+func (s *objectSampler) pendingJobs(fn func()) []*sampleJob {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fn()
+	var res []*sampleJob
+	for j := range s.pending {
+		res = append(res, j)
+	}
+	for _, jobs := range s.restored {
+		res = append(res, jobs...)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Bucket != res[j].Bucket {
+			return res[i].Bucket < res[j].Bucket
+		}
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// restore records the objects which metadata had not been counted when the
+// checkpoint of a resumed scan was taken. They are queued again once the
+// client of their bucket is set.
+func (s *objectSampler) restore(jobs []*sampleJob) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, j := range jobs {
+		s.restored[j.Bucket] = append(s.restored[j.Bucket], j)
+	}
+}
+
+// close waits for the metadata of all the objects queued to be counted and
+// stops the workers. The objects restored from a checkpoint which bucket has
+// not been scanned again are counted as failed.
+func (s *objectSampler) close() {
+	s.mutex.Lock()
+	var jobs []*sampleJob
+	for _, v := range s.restored {
+		jobs = append(jobs, v...)
+	}
+	s.restored = make(map[string][]*sampleJob)
+	s.mutex.Unlock()
+	s.queue(jobs...)
+	close(s.jobs)
+	s.wg.Wait()
+	if s.limiter != nil {
+		s.limiter.Stop()
+	}
+}
+
+// worker fetches the metadata of the objects queued. The objects which
+// metadata cannot be fetched, like the ones of the buckets which region is
+// unknown, are counted as failed and left out of the estimates. Counting a
+// sample and removing it from the pending ones is done at once so that a
+// checkpoint saves each object either as counted or as pending.
+func (s *objectSampler) worker() {
+	for j := range s.jobs {
+		s.mutex.Lock()
+		svc, ok := s.clients[j.Bucket]
+		s.mutex.Unlock()
+		reportMutex.Lock()
+		currentReport := report[j.Bucket]
+		reportMutex.Unlock()
+		var out *s3.HeadObjectOutput
+		if ok {
+			err := throttleRetries.retry("sampling the objects of bucket "+j.Bucket, func() (err error) {
+				if s.limiter != nil {
+					<-s.limiter.C
+				}
+				out, err = svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(j.Bucket), Key: aws.String(j.Key)})
+				return err
+			})
+			if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusBadRequest {
+				// S3 refuses to return the metadata of the objects encrypted
+				// with a customer key when the key is not given
+				out, err = &s3.HeadObjectOutput{SSECustomerAlgorithm: aws.String(s3.ServerSideEncryptionAes256)}, nil
+			}
+			if err != nil {
+				log.Printf("Error while sampling the object %s of bucket %s (%s): %s\n", j.Key, j.Bucket, errorClass(err), err)
+				out = nil
+			}
+		}
+		s.mutex.Lock()
+		currentReport.countSample(out, j.Size)
+		delete(s.pending, j)
+		s.mutex.Unlock()
+	}
+	s.wg.Done()
+}
+
+// sampleCount is the number and the size of the sampled objects of a category
+type sampleCount struct {
+	Files uint64 `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// sampleStats is the metadata of the objects sampled in a bucket
+type sampleStats struct {
+	// Sampled is the number of objects which metadata has been fetched
+	Sampled uint64 `json:"sampled"`
+	// Failed is the number of objects which metadata could not be fetched
+	Failed uint64 `json:"failed,omitempty"`
+	// Bytes is the size of the objects which metadata has been fetched
+	Bytes        uint64                  `json:"bytes"`
+	ContentTypes map[string]*sampleCount `json:"content_types"`
+	Encryption   map[string]*sampleCount `json:"encryption"`
+	KMSKeys      map[string]*sampleCount `json:"kms_keys,omitempty"`
+}
+
+// newSampleStats returns empty sample statistics
+func newSampleStats() *sampleStats {
+	return &sampleStats{
+		ContentTypes: make(map[string]*sampleCount),
+		Encryption:   make(map[string]*sampleCount),
+		KMSKeys:      make(map[string]*sampleCount),
+	}
+}
+
+// addSample increments the counter of a category
+func addSample(m map[string]*sampleCount, k string, size int64) {
+	c, ok := m[k]
+	if !ok {
+		c = &sampleCount{}
+		m[k] = c
+	}
+	c.Files++
+	c.Bytes += uint64(size)
+}
+
+// encryptionType returns the server-side encryption of an object: AES256,
+// aws:kms, SSE-C or none
+func encryptionType(out *s3.HeadObjectOutput) string {
+	switch {
+	case aws.StringValue(out.SSECustomerAlgorithm) != "":
+		return "SSE-C"
+	case aws.StringValue(out.ServerSideEncryption) != "":
+		return *out.ServerSideEncryption
+	}
+	return "none"
+}
+
+// add counts the metadata of an object, nil if it could not be fetched
+func (s *sampleStats) add(out *s3.HeadObjectOutput, size int64) {
+	if out == nil {
+		s.Failed++
+		return
+	}
+	s.Sampled++
+	s.Bytes += uint64(size)
+	contentType := aws.StringValue(out.ContentType)
+	if contentType == "" {
+		contentType = "unknown"
+	}
+	addSample(s.ContentTypes, contentType, size)
+	enc := encryptionType(out)
+	addSample(s.Encryption, enc, size)
+	if enc == s3.ServerSideEncryptionAwsKms {
+		addSample(s.KMSKeys, aws.StringValue(out.SSEKMSKeyId), size)
+	}
+}
+
+// copy returns a deep copy of the statistics
+func (s *sampleStats) copy() *sampleStats {
+	res := newSampleStats()
+	res.Sampled, res.Failed, res.Bytes = s.Sampled, s.Failed, s.Bytes
+	for _, m := range []struct{ dst, src map[string]*sampleCount }{
+		{res.ContentTypes, s.ContentTypes},
+		{res.Encryption, s.Encryption},
+		{res.KMSKeys, s.KMSKeys},
+	} {
+		for k, v := range m.src {
+			c := *v
+			m.dst[k] = &c
+		}
+	}
+	return res
+}
+
+// countSample counts the metadata of a sampled object, nil if it could not be
+// fetched
+func (c *bucketCounter) countSample(out *s3.HeadObjectOutput, size int64) {
+	c.mutex.Lock()
+	if c.samples == nil {
+		c.samples = newSampleStats()
+	}
+	c.samples.add(out, size)
+	c.mutex.Unlock()
+}
+
+// sampleSnapshot returns a copy of the sample of the bucket, nil if no object
+// has been sampled
+func (c *bucketCounter) sampleSnapshot() *sampleStats {
+	if c.samples == nil {
+		return nil
+	}
+	return c.samples.copy()
+}
+
+// sampleEstimate is the extrapolation of a category of the sampled objects to
+// all the objects of the bucket, with its 95% confidence interval
+type sampleEstimate struct {
+	Value     string  `json:"value"`
+	Sampled   uint64  `json:"sampled"`
+	Share     float64 `json:"share"`
+	ShareLow  float64 `json:"share_low"`
+	ShareHigh float64 `json:"share_high"`
+	Files     uint64  `json:"estimated_files"`
+	FilesLow  uint64  `json:"estimated_files_low"`
+	FilesHigh uint64  `json:"estimated_files_high"`
+	Bytes     uint64  `json:"estimated_bytes"`
+}
+
+// wilsonInterval returns the Wilson score interval of the proportion of x
+// successes out of n draws from a population of total items. The finite
+// population correction shrinks the interval as the sample grows, down to the
+// observed proportion when the whole population is sampled.
+func wilsonInterval(x, n, total uint64) (float64, float64) {
+	if n == 0 {
+		return 0, 1
+	}
+	z := sampleZ
+	if total > 1 && n < total {
+		z *= math.Sqrt(float64(total-n) / float64(total-1))
+	} else if n >= total {
+		z = 0
+	}
+	p, fn, z2 := float64(x)/float64(n), float64(n), z*z
+	center := (p + z2/(2*fn)) / (1 + z2/fn)
+	margin := z / (1 + z2/fn) * math.Sqrt(p*(1-p)/fn+z2/(4*fn*fn))
+	return math.Max(0, center-margin), math.Min(1, center+margin)
+}
+
+// estimates extrapolates the categories of a breakdown of the sample to the
+// given number of files and bytes of the bucket. The number of files of a
+// category is its share of the sample times the number of files, its size is
+// its share of the bytes of the sample times the size of the bucket. The
+// estimates are sorted by decreasing number of sampled objects.
+func (s *sampleStats) estimates(breakdown map[string]*sampleCount, files, bytes uint64) []*sampleEstimate {
+	var res []*sampleEstimate
+	for k, v := range breakdown {
+		e := &sampleEstimate{Value: k, Sampled: v.Files, Share: float64(v.Files) / float64(s.Sampled)}
+		e.ShareLow, e.ShareHigh = wilsonInterval(v.Files, s.Sampled, files)
+		e.Files = uint64(math.Floor(e.Share*float64(files) + 0.5))
+		// The bounds are rounded outwards, ignoring the rounding errors of
+		// the shares so that an exact estimate keeps exact bounds
+		e.FilesLow = uint64(math.Floor(e.ShareLow*float64(files) + 1e-6))
+		e.FilesHigh = uint64(math.Ceil(e.ShareHigh*float64(files) - 1e-6))
+		if s.Bytes > 0 {
+			e.Bytes = uint64(math.Floor(float64(v.Bytes)/float64(s.Bytes)*float64(bytes) + 0.5))
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Sampled != res[j].Sampled {
+			return res[i].Sampled > res[j].Sampled
+		}
+		return res[i].Value < res[j].Value
+	})
+	return res
+}
+
+// sampleHeaders are the headers of the columns of the estimates
+var sampleHeaders = []string{"Sampled files", "Share (%)", "Share low (%)", "Share high (%)", "Estimated files", "Estimated files low", "Estimated files high", "Estimated size (GB)"}
+
+// estimateRow returns the columns of an estimate
+func estimateRow(e *sampleEstimate) []string {
+	pct := func(f float64) string { return strconv.FormatFloat(100*f, 'f', 2, 64) }
+	return []string{
+		strconv.FormatUint(e.Sampled, 10),
+		pct(e.Share),
+		pct(e.ShareLow),
+		pct(e.ShareHigh),
+		strconv.FormatUint(e.Files, 10),
+		strconv.FormatUint(e.FilesLow, 10),
+		strconv.FormatUint(e.FilesHigh, 10),
+		strconv.FormatFloat(bytesToGB(e.Bytes), 'f', 4, 64),
+	}
+}
+
+// encryptionSampleTable builds the table of the estimated server-side
+// encryption of the objects of each bucket, the buckets without sample being
+// left out. Returns nil if no object has been sampled.
+func encryptionSampleTable(ctr map[string]*bucketCounter) *reportTable {
+	t := reportTable{
+		title:   "Sampled server-side encryption by bucket",
+		headers: append([]string{"Bucket name", "Total number of files", "Sampled files", "Failed samples", "Encryption"}, sampleHeaders[1:]...),
+	}
+	for _, k := range sortedKeys(ctr) {
+		c := ctr[k]
+		s := c.sampleSnapshot()
+		if s == nil {
+			continue
+		}
+		for _, e := range s.estimates(s.Encryption, c.fileCount, c.sizeTotal) {
+			row := []string{k, strconv.FormatUint(c.fileCount, 10), strconv.FormatUint(s.Sampled, 10), strconv.FormatUint(s.Failed, 10), e.Value}
+			t.rows = append(t.rows, append(row, estimateRow(e)[1:]...))
+		}
+	}
+	if len(t.rows) == 0 {
+		return nil
+	}
+	return &t
+}
+
+// sampleTables builds the tables of the estimated repartition of the objects
+// of a bucket by content type, server-side encryption and KMS key. Returns nil
+// if no object has been sampled.
+func sampleTables(bucket string, c *bucketCounter) []*reportTable {
+	s := c.sampleSnapshot()
+	if s == nil || s.Sampled == 0 {
+		return nil
+	}
+	var tables []*reportTable
+	for _, b := range []struct {
+		title, header string
+		breakdown     map[string]*sampleCount
+	}{
+		{"content type", "Content type", s.ContentTypes},
+		{"server-side encryption", "Encryption", s.Encryption},
+		{"KMS key", "KMS key", s.KMSKeys},
+	} {
+		if len(b.breakdown) == 0 {
+			continue
+		}
+		t := &reportTable{
+			title:   fmt.Sprintf("Sampled repartition of files for bucket %s by %s (%d objects sampled)", bucket, b.title, s.Sampled),
+			headers: append([]string{b.header}, sampleHeaders...),
+		}
+		for _, e := range s.estimates(b.breakdown, c.fileCount, c.sizeTotal) {
+			t.rows = append(t.rows, append([]string{e.Value}, estimateRow(e)...))
+		}
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+// jsonSamples is the json representation of the estimates of a bucket
+type jsonSamples struct {
+	Sampled      uint64            `json:"sampled"`
+	Failed       uint64            `json:"failed"`
+	ContentTypes []*sampleEstimate `json:"content_types,omitempty"`
+	Encryption   []*sampleEstimate `json:"encryption,omitempty"`
+	KMSKeys      []*sampleEstimate `json:"kms_keys,omitempty"`
+}
+
+// newJSONSamples returns the json representation of the estimates of a
+// bucket, nil if no object has been sampled
+func newJSONSamples(c *bucketCounter) *jsonSamples {
+	s := c.sampleSnapshot()
+	if s == nil {
+		return nil
+	}
+	return &jsonSamples{
+		Sampled:      s.Sampled,
+		Failed:       s.Failed,
+		ContentTypes: s.estimates(s.ContentTypes, c.fileCount, c.sizeTotal),
+		Encryption:   s.estimates(s.Encryption, c.fileCount, c.sizeTotal),
+		KMSKeys:      s.estimates(s.KMSKeys, c.fileCount, c.sizeTotal),
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3HeadMock serves the objects of mockObjects. The objects of root0 are
+// encrypted with KMS, the ones of root1 with AES256 and the ones of root2 are
+// not encrypted. The metadata of file13.txt cannot be fetched and file14.txt
+// is encrypted with a customer key.
+type s3HeadMock struct {
+	*s3ErrorsMock
+	heads int
+}
+
+func (m *s3HeadMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	m.mutex.Lock()
+	m.heads++
+	m.mutex.Unlock()
+	key := *input.Key
+	if strings.HasSuffix(key, "/file13.txt") {
+		return nil, awserr.NewRequestFailure(awserr.New("Forbidden", "", nil), 403, "id")
+	}
+	if strings.HasSuffix(key, "/file14.txt") {
+		return nil, awserr.NewRequestFailure(awserr.New("BadRequest", "", nil), 400, "id")
+	}
+	out := &s3.HeadObjectOutput{ContentType: aws.String("text/plain")}
+	switch {
+	case strings.HasPrefix(key, "root0/"):
+		out.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		out.SSEKMSKeyId = aws.String("arn:aws:kms:us-east-1:123456789012:key/foo")
+	case strings.HasPrefix(key, "root1/"):
+		out.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+		out.ContentType = nil
+	}
+	return out, nil
+}
+
+func TestWilsonInterval(t *testing.T) {
+	for _, d := range []struct {
+		x, n, total uint64
+		low, high   float64
+	}{
+		// Large population: the usual Wilson interval
+		{50, 100, 1 << 40, 0.4038, 0.5962},
+		{0, 100, 1 << 40, 0, 0.0370},
+		{100, 100, 1 << 40, 0.9630, 1},
+		// The whole population is sampled: no uncertainty left
+		{30, 100, 100, 0.3, 0.3},
+		// Half of the population is sampled: the interval shrinks
+		{50, 100, 200, 0.4312, 0.5688},
+		{0, 0, 100, 0, 1},
+	} {
+		low, high := wilsonInterval(d.x, d.n, d.total)
+		if math.Abs(low-d.low) > 1e-4 || math.Abs(high-d.high) > 1e-4 {
+			t.Errorf("%d/%d of %d: expecting [%.4f, %.4f] got [%.4f, %.4f]", d.x, d.n, d.total, d.low, d.high, low, high)
+		}
+	}
+}
+
+func TestSampleSelection(t *testing.T) {
+	s := &objectSampler{rate: 0.3}
+	n := 0
+	for i := 0; i < 10000; i++ {
+		if s.selected("foo", "file"+strconv.Itoa(i)) {
+			n++
+		}
+	}
+	if n < 2800 || n > 3200 {
+		t.Errorf("Expecting about 3000 objects out of 10000 to be selected got %d", n)
+	}
+	// The selection does not change between 2 scans
+	for i := 0; i < 100; i++ {
+		k := "file" + strconv.Itoa(i)
+		if s.selected("foo", k) != s.selected("foo", k) {
+			t.Fatalf("Expecting the selection of %s to be stable", k)
+		}
+	}
+	if (&objectSampler{rate: 0}).selected("foo", "bar") || !(&objectSampler{rate: 1}).selected("foo", "bar") {
+		t.Errorf("Expecting a rate of 0 to select nothing and a rate of 1 everything")
+	}
+}
+
+func TestSampling(t *testing.T) {
+	defer func(p retryPolicy) { throttleRetries = p }(throttleRetries)
+	throttleRetries = retryPolicy{}
+	reportMutex = &sync.Mutex{}
+	report = make(map[string]*bucketCounter)
+	svc := &s3HeadMock{s3ErrorsMock: &s3ErrorsMock{s3ListMock: &s3ListMock{objects: mockObjects(99), pageSize: 10}}}
+	objSampler = newObjectSampler(1, 0, 3)
+	defer func() { objSampler = nil }()
+	pools := &scanOptions{bucketWorkers: 1, pageWorkers: 2, pageQueue: 5}
+	scanBuckets(nil, "us-east-1", svc, []*string{aws.String("foo")}, nil, newScanProgress(), &reportOptions{prefixDepth: 1}, pools)
+	objSampler.close()
+
+	c := report["foo"]
+	s := c.sampleSnapshot()
+	if svc.heads != 99 || s == nil || s.Sampled != 98 || s.Failed != 1 {
+		t.Fatalf("Expecting 99 objects sampled, 1 of them failed, got %d requests and %+v", svc.heads, s)
+	}
+	// Out of the objects which metadata has been fetched, the estimates are
+	// exact
+	got := s.estimates(s.Encryption, 98, 0)
+	if len(got) != 4 || got[0].Value != "aws:kms" || got[1].Value != "AES256" || got[2].Value != "none" || got[3].Value != "SSE-C" {
+		t.Fatalf("Expecting aws:kms, AES256, none and SSE-C by decreasing count got %+v", got)
+	}
+	for _, e := range got {
+		if e.ShareLow != e.Share || e.ShareHigh != e.Share || e.Files != e.Sampled || e.FilesLow != e.Files || e.FilesHigh != e.Files {
+			t.Errorf("Expecting an exact estimate for %s got %+v", e.Value, e)
+		}
+	}
+	if s.Encryption["AES256"].Files != 32 || s.ContentTypes["unknown"].Files != 33 || s.ContentTypes["text/plain"].Files != 65 {
+		t.Errorf("Unexpected breakdowns %+v %+v", s.Encryption, s.ContentTypes)
+	}
+	if len(s.KMSKeys) != 1 || s.KMSKeys["arn:aws:kms:us-east-1:123456789012:key/foo"].Files != 33 {
+		t.Errorf("Expecting the 33 objects of root0 to use the same KMS key got %+v", s.KMSKeys)
+	}
+
+	// The sample survives a checkpoint
+	if r := c.snapshot().restore(); !reflect.DeepEqual(r.samples, c.samples) {
+		t.Errorf("Expecting %+v got %+v", c.samples, r.samples)
+	}
+
+	tables := sampleTables("foo", c)
+	if len(tables) != 3 {
+		t.Fatalf("Expecting the content type, encryption and KMS key tables got %d", len(tables))
+	}
+	// The failed sample is left out and the 99 objects are extrapolated
+	if row := tables[0].rows[0]; row[0] != "text/plain" || row[1] != "65" || row[5] != "66" {
+		t.Errorf("Unexpected content type row %v", row)
+	}
+	summary := encryptionSampleTable(report)
+	if summary == nil || len(summary.rows) != 4 || summary.rows[0][1] != "99" || summary.rows[0][3] != "1" {
+		t.Errorf("Unexpected encryption summary %+v", summary)
+	}
+}
+
+func TestSampleEstimates(t *testing.T) {
+	s := newSampleStats()
+	for i := 0; i < 100; i++ {
+		out := &s3.HeadObjectOutput{}
+		if i < 25 {
+			out.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+		}
+		if i == 99 {
+			out.SSECustomerAlgorithm = aws.String("AES256")
+		}
+		s.add(out, 1000)
+	}
+	got := s.estimates(s.Encryption, 10000, 1e9)
+	if len(got) != 3 || got[0].Value != "none" || got[1].Value != "AES256" || got[2].Value != "SSE-C" {
+		t.Fatalf("Expecting none, AES256 and SSE-C by decreasing count got %+v", got)
+	}
+	e := got[1]
+	// 25% of 10000 objects and of 1GB, with the Wilson interval of 25/100
+	if e.Files != 2500 || e.Bytes != 250000000 || e.FilesLow != 1757 || e.FilesHigh != 3426 {
+		t.Errorf("Unexpected estimate %+v", e)
+	}
+}
+
+func TestCheckpointSavesPendingSamples(t *testing.T) {
+	defer func(p retryPolicy) { throttleRetries = p }(throttleRetries)
+	throttleRetries = retryPolicy{}
+	reportMutex = &sync.Mutex{}
+	report = map[string]*bucketCounter{"foo": newBucketCounter()}
+	svc := &s3HeadMock{s3ErrorsMock: &s3ErrorsMock{s3ListMock: &s3ListMock{objects: mockObjects(20), pageSize: 10}}}
+	// The requests are slowed down for the objects to still be queued once
+	// their pages are counted
+	objSampler = newObjectSampler(1, 50, 1)
+	defer func() { objSampler = nil }()
+	objSampler.setClient("foo", svc)
+	progress := newScanProgress()
+	if err := scanMock(svc, "foo", progress); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The checkpoint does not wait for the queue, each object is either
+	// counted or pending
+	cp := progress.checkpoint(report)
+	objSampler.close()
+	var counted uint64
+	if s := cp.Counters["foo"].Samples; s != nil {
+		counted = s.Sampled + s.Failed
+	}
+	if len(cp.SampleJobs) == 0 || counted+uint64(len(cp.SampleJobs)) != 20 {
+		t.Fatalf("Expecting the 20 objects counted or pending in the checkpoint got %d counted and %d pending", counted, len(cp.SampleJobs))
+	}
+
+	// The resumed scan only samples the pending objects, once the client of
+	// their bucket is set
+	dir, err := ioutil.TempDir("", "s3_reporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "checkpoint.json")
+	if err = saveCheckpoint(file, cp); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	loaded, err := loadCheckpoint(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	progress = newScanProgress()
+	report = progress.restore(loaded)
+	resumed := &s3HeadMock{s3ErrorsMock: &s3ErrorsMock{s3ListMock: &s3ListMock{objects: mockObjects(20), pageSize: 10}}}
+	objSampler = newObjectSampler(1, 0, 2)
+	objSampler.restore(loaded.SampleJobs)
+	if !objSampler.waiting("foo") {
+		t.Error("Expecting the objects of foo to wait for its client")
+	}
+	if jobs := objSampler.pendingJobs(func() {}); !reflect.DeepEqual(jobs, loaded.SampleJobs) {
+		t.Errorf("Expecting the restored objects to stay pending got %v", jobs)
+	}
+	// The bucket already scanned is only dispatched to set its client
+	pools := &scanOptions{bucketWorkers: 1, pageWorkers: 1, pageQueue: 5}
+	scanBuckets(nil, "us-east-1", resumed, []*string{aws.String("foo")}, nil, progress, &reportOptions{prefixDepth: 1}, pools)
+	objSampler.close()
+	s := report["foo"].sampleSnapshot()
+	if report["foo"].fileCount != 20 || len(progress.failures()) != 0 {
+		t.Errorf("Expecting the bucket not to be scanned again got %d files and failures %v", report["foo"].fileCount, progress.failures())
+	}
+	if resumed.heads != len(loaded.SampleJobs) || s == nil || s.Sampled+s.Failed != 20 || s.Failed != 1 {
+		t.Errorf("Expecting the %d pending objects sampled got %d requests and %+v", len(loaded.SampleJobs), resumed.heads, s)
+	}
+}
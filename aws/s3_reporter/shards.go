@@ -0,0 +1,154 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// scanOptions configures the concurrency of a scan
+type scanOptions struct {
+	// bucketWorkers is the number of buckets or inventories read in parallel
+	bucketWorkers int
+	// shardWorkers is the number of shards listed in parallel
+	shardWorkers int
+	// pageWorkers is the number of pages of objects counted in parallel
+	pageWorkers int
+	// pageQueue is the number of pages listed but not counted yet above which
+	// the listings block
+	pageQueue int
+	// shardBuckets lists the buckets which key space is split in shards
+	shardBuckets []string
+	// shardDelimiter is the delimiter used to find the prefixes of the shards
+	shardDelimiter string
+}
+
+// sharded returns true if the key space of the bucket must be split in shards
+func (o *scanOptions) sharded(bucket string) bool {
+	return stringInSlice(bucket, o.shardBuckets)
+}
+
+// shardKey returns the key identifying a shard of a bucket in the progress of
+// the scan. The key of the listing of the first level of the bucket is the
+// one with an empty prefix. Bucket names cannot contain any slash so the keys
+// cannot collide with the ones of the buckets.
+func shardKey(bucket, prefix string) string {
+	return bucket + "/" + prefix
+}
+
+// shardJob is a prefix of a bucket listed on its own by a shard worker
+type shardJob struct {
+	svc    s3iface.S3API
+	bucket *string
+	prefix string
+	group  *shardGroup
+}
+
+// shardGroup tracks the shards of a bucket still being listed so that the
+// bucket is flagged as done, or as failed, once all of them are over
+type shardGroup struct {
+	mutex     sync.Locker
+	bucket    string
+	remaining int
+	err       error
+}
+
+// add records n more shards to wait for
+func (g *shardGroup) add(n int) {
+	g.mutex.Lock()
+	g.remaining += n
+	g.mutex.Unlock()
+}
+
+// finish records the end of the listing of a shard. The last one flags the
+// bucket as done, or as failed if the listing of any of the shards failed.
+func (g *shardGroup) finish(prefix string, err error, progress *scanProgress) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error while listing the objects of bucket %s under %q: %s\n", g.bucket, prefix, err)
+		g.err = err
+	}
+	g.remaining--
+	if g.remaining > 0 {
+		return
+	}
+	if g.err != nil {
+		progress.markFailed(g.bucket, g.err)
+		return
+	}
+	progress.markDone(g.bucket)
+}
+
+// listShards lists the first level of a bucket using the delimiter and queues
+// each prefix found as a shard to be listed by the shard workers. The objects
+// of the first level are sent to the page channel. The shards already found
+// before a resume are queued first. The bucket is flagged as done or failed
+// once all its shards have been listed.
+func listShards(svc s3iface.S3API, bucketName *string, delimiter string, pageChan chan *s3.ListObjectsV2Output, shards chan *shardJob, progress *scanProgress) {
+	group := &shardGroup{mutex: &sync.Mutex{}, bucket: *bucketName, remaining: 1}
+	queue := func(prefixes []string) {
+		for _, prefix := range prefixes {
+			if progress.isDone(shardKey(*bucketName, prefix)) {
+				continue
+			}
+			group.add(1)
+			shards <- &shardJob{svc: svc, bucket: bucketName, prefix: prefix, group: group}
+		}
+	}
+	queue(progress.shards(*bucketName))
+
+	rootKey := shardKey(*bucketName, "")
+	if progress.isDone(rootKey) {
+		group.finish("", nil, progress)
+		return
+	}
+	err := throttleRetries.retry("listing the shards of bucket "+*bucketName, func() error {
+		params := s3.ListObjectsV2Input{Bucket: bucketName, Delimiter: aws.String(delimiter), EncodingType: aws.String("url")}
+		if token := progress.token(rootKey); token != "" {
+			log.Printf("Resuming the listing of the shards of bucket %s", *bucketName)
+			params.ContinuationToken = &token
+		}
+		var pageErr error
+		err := svc.ListObjectsV2Pages(&params,
+			func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+				var prefixes []string
+				for _, p := range page.CommonPrefixes {
+					// With the url encoding type, the prefixes are returned encoded
+					prefix, err := url.QueryUnescape(aws.StringValue(p.Prefix))
+					if err != nil {
+						pageErr = err
+						return false
+					}
+					prefixes = append(prefixes, prefix)
+				}
+				progress.pushPageAs(rootKey, page, pageChan, func() { progress.addShards(*bucketName, prefixes) })
+				// The shards are queued once the lock of the progress is released
+				// as the queue can be full
+				queue(prefixes)
+				return !lastPage
+			})
+		if err == nil {
+			err = pageErr
+		}
+		return err
+	})
+	group.finish("", err, progress)
+}
+
+// shardWorker lists the shards provided by the channel
+func shardWorker(shards chan *shardJob, wg *sync.WaitGroup, pageChan chan *s3.ListObjectsV2Output, progress *scanProgress) {
+	for s := range shards {
+		key := shardKey(*s.bucket, s.prefix)
+		err := throttleRetries.retry("listing the shard "+key, func() error {
+			params := s3.ListObjectsV2Input{Bucket: s.bucket, Prefix: aws.String(s.prefix)}
+			return listObjects(s.svc, &params, key, pageChan, progress)
+		})
+		s.group.finish(s.prefix, err, progress)
+	}
+	wg.Done()
+}
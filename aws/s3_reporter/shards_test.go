@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3KeySpaceMock serves the objects of each bucket in key order like S3 does,
+// with support for the prefix and the delimiter. Each call is slowed down by
+// latency and all the calls fail once failAfter calls have been made.
+type s3KeySpaceMock struct {
+	s3iface.S3API
+	objects   map[string][]*s3.Object
+	pageSize  int
+	latency   time.Duration
+	failAfter int32
+	calls     int32
+}
+
+func (m *s3KeySpaceMock) GetBucketLocation(*s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	return &s3.GetBucketLocationOutput{}, nil
+}
+
+func (m *s3KeySpaceMock) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	objs := m.objects[*input.Bucket]
+	prefix, delimiter := aws.StringValue(input.Prefix), aws.StringValue(input.Delimiter)
+	i := sort.Search(len(objs), func(i int) bool { return *objs[i].Key >= prefix })
+	if input.ContinuationToken != nil {
+		i, _ = strconv.Atoi(*input.ContinuationToken)
+	}
+	for {
+		if m.failAfter > 0 && atomic.AddInt32(&m.calls, 1) > m.failAfter {
+			return errors.New("SlowDown: please reduce your request rate")
+		}
+		time.Sleep(m.latency)
+		page := &s3.ListObjectsV2Output{Name: input.Bucket}
+		for n := 0; n < m.pageSize && i < len(objs) && strings.HasPrefix(*objs[i].Key, prefix); n++ {
+			key := *objs[i].Key
+			if j := strings.Index(key[len(prefix):], delimiter); delimiter != "" && j >= 0 {
+				cp := key[:len(prefix)+j+len(delimiter)]
+				page.CommonPrefixes = append(page.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(cp)})
+				for i < len(objs) && strings.HasPrefix(*objs[i].Key, cp) {
+					i++
+				}
+				continue
+			}
+			page.Contents = append(page.Contents, objs[i])
+			i++
+		}
+		lastPage := i == len(objs) || !strings.HasPrefix(*objs[i].Key, prefix)
+		if !lastPage {
+			page.NextContinuationToken = aws.String(strconv.Itoa(i))
+		}
+		if !fn(page, lastPage) || lastPage {
+			return nil
+		}
+	}
+}
+
+// keySpaceObjects returns the objects, sorted by key, of a bucket with the
+// given number of folders of n objects each and of n objects at its root
+func keySpaceObjects(folders, n int) []*s3.Object {
+	var res []*s3.Object
+	add := func(key string, i int) {
+		res = append(res, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(i * 1000)),
+			StorageClass: aws.String("STANDARD"),
+			LastModified: aws.Time(time.Date(2017, time.Month(i%12+1), 1, 0, 0, 0, 0, time.UTC)),
+		})
+	}
+	for f := 0; f < folders; f++ {
+		for i := 0; i < n; i++ {
+			add(fmt.Sprintf("dir%03d/file%06d.bin", f, i), i)
+		}
+	}
+	for i := 0; i < n; i++ {
+		add(fmt.Sprintf("file%06d.txt", i), i)
+	}
+	sort.Slice(res, func(i, j int) bool { return *res[i].Key < *res[j].Key })
+	return res
+}
+
+// scanKeySpace scans the buckets of the mock and returns the snapshots of
+// their counters. The counters already in the report are kept.
+func scanKeySpace(svc *s3KeySpaceMock, progress *scanProgress, pools *scanOptions) map[string]*counterSnapshot {
+	var buckets []*string
+	for b := range svc.objects {
+		bucket := b
+		buckets = append(buckets, &bucket)
+	}
+	scanBuckets(nil, "us-east-1", svc, buckets, nil, progress, &reportOptions{prefixDepth: 1}, pools)
+	res := make(map[string]*counterSnapshot)
+	for k, v := range report {
+		res[k] = v.snapshot()
+	}
+	return res
+}
+
+func TestShardedScan(t *testing.T) {
+	reportMutex = &sync.Mutex{}
+	svc := &s3KeySpaceMock{
+		objects:  map[string][]*s3.Object{"big": keySpaceObjects(10, 250), "small": keySpaceObjects(1, 20)},
+		pageSize: 100,
+	}
+	pools := &scanOptions{bucketWorkers: 2, shardWorkers: 4, pageWorkers: 2, pageQueue: 5, shardDelimiter: "/"}
+	report = make(map[string]*bucketCounter)
+	expected := scanKeySpace(svc, newScanProgress(), pools)
+	if expected["big"].FileCount != 2750 || expected["small"].FileCount != 40 {
+		t.Fatalf("Unexpected number of files %d and %d", expected["big"].FileCount, expected["small"].FileCount)
+	}
+
+	pools.shardBuckets = []string{"big"}
+	report = make(map[string]*bucketCounter)
+	progress := newScanProgress()
+	if res := scanKeySpace(svc, progress, pools); !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting %+v got %+v", expected, res)
+	}
+	if !progress.isDone("big") || len(progress.shards("big")) != 10 {
+		t.Errorf("Expecting bucket big to be done with 10 shards got %v", progress.shards("big"))
+	}
+
+	// The listing fails midway, the checkpoint is then used to resume it
+	svc.failAfter = 12
+	report = make(map[string]*bucketCounter)
+	progress = newScanProgress()
+	scanKeySpace(svc, progress, pools)
+	if _, ok := progress.failures()["big"]; !ok {
+		t.Fatalf("Expecting the listing of bucket big to fail got %v", progress.failures())
+	}
+	cp := progress.checkpoint(report)
+	if len(cp.Shards["big"]) == 0 {
+		t.Errorf("Expecting the shards found to be saved got %v", cp.Shards)
+	}
+	svc.failAfter = 0
+	progress = newScanProgress()
+	report = progress.restore(cp)
+	if res := scanKeySpace(svc, progress, pools); !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expecting %+v got %+v", expected, res)
+	}
+	if len(progress.failures()) != 0 {
+		t.Errorf("Expecting no failure got %v", progress.failures())
+	}
+}
+
+// BenchmarkScanBuckets scans 1 bucket of 20000 objects and 50 buckets of 200
+// objects with 20ms of latency for each page listed
+func BenchmarkScanBuckets(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	reportMutex = &sync.Mutex{}
+	svc := &s3KeySpaceMock{objects: map[string][]*s3.Object{"big": keySpaceObjects(20, 1000)}, pageSize: 1000, latency: 20 * time.Millisecond}
+	for i := 0; i < 50; i++ {
+		svc.objects[fmt.Sprintf("small%02d", i)] = keySpaceObjects(1, 100)
+	}
+	for _, bench := range []struct {
+		name  string
+		pools *scanOptions
+	}{
+		{"default", &scanOptions{bucketWorkers: 8, shardWorkers: 8, pageWorkers: 2, pageQueue: 100}},
+		{"sharded", &scanOptions{bucketWorkers: 8, shardWorkers: 8, pageWorkers: 2, pageQueue: 100, shardBuckets: []string{"big"}, shardDelimiter: "/"}},
+		{"sharded-more-workers", &scanOptions{bucketWorkers: 16, shardWorkers: 16, pageWorkers: 4, pageQueue: 100, shardBuckets: []string{"big"}, shardDelimiter: "/"}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				report = make(map[string]*bucketCounter)
+				scanKeySpace(svc, newScanProgress(), bench.pools)
+			}
+		})
+	}
+}
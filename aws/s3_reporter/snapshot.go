@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// snapshotVersion is the version of the format of the snapshot files
+const snapshotVersion = 1
+
+// runSnapshot is the content of the file saved at the end of a scan. It
+// contains the state of all the counters so that 2 runs can be compared with
+// the diff subcommand.
+type runSnapshot struct {
+	Version   int                         `json:"version"`
+	CreatedAt time.Time                   `json:"created_at"`
+	Buckets   map[string]*counterSnapshot `json:"buckets"`
+}
+
+// newRunSnapshot returns the snapshot of the given counters
+func newRunSnapshot(ctr map[string]*bucketCounter, createdAt time.Time) *runSnapshot {
+	s := runSnapshot{
+		Version:   snapshotVersion,
+		CreatedAt: createdAt,
+		Buckets:   make(map[string]*counterSnapshot, len(ctr)),
+	}
+	for k, v := range ctr {
+		s.Buckets[k] = v.snapshot()
+	}
+	return &s
+}
+
+// saveSnapshot writes a snapshot to the given file
+func saveSnapshot(filePath string, s *runSnapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filePath, data)
+}
+
+// loadSnapshot reads a snapshot previously written by saveSnapshot
+func loadSnapshot(filePath string) (*runSnapshot, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	s := runSnapshot{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	return &s, nil
+}
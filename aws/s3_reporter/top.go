@@ -0,0 +1,243 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// topEntry is an object ranked in the top lists
+type topEntry struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size_bytes"`
+	StorageClass string    `json:"storage_class"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// byteDays returns the size of the object multiplied by its age in days
+func (e *topEntry) byteDays() float64 {
+	return float64(e.Size) * now.Sub(e.LastModified).Hours() / 24
+}
+
+// topRanking orders the objects of a top list, the first one being the top one
+type topRanking func(a, b *topEntry) bool
+
+// The rankings tie on the bucket and the key so that the lists do not depend
+// on the order the objects are counted in
+func tieBreak(a, b *topEntry) bool {
+	if a.Bucket != b.Bucket {
+		return a.Bucket < b.Bucket
+	}
+	return a.Key < b.Key
+}
+
+var (
+	// largestFirst ranks the objects by size
+	largestFirst topRanking = func(a, b *topEntry) bool {
+		if a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return tieBreak(a, b)
+	}
+	// oldestFirst ranks the objects by last modification date
+	oldestFirst topRanking = func(a, b *topEntry) bool {
+		if !a.LastModified.Equal(b.LastModified) {
+			return a.LastModified.Before(b.LastModified)
+		}
+		return tieBreak(a, b)
+	}
+	// oldLargeFirst ranks the objects by size multiplied by age, so that the
+	// old and large objects come first
+	oldLargeFirst topRanking = func(a, b *topEntry) bool {
+		if sa, sb := a.byteDays(), b.byteDays(); sa != sb {
+			return sa > sb
+		}
+		return tieBreak(a, b)
+	}
+)
+
+// topList keeps the top entries of a ranking. The entries are stored in a
+// heap which root is the last of the top, so that it is the one replaced
+// when a better entry is added to a full list.
+type topList struct {
+	ranking topRanking
+	entries []*topEntry
+}
+
+// newTopList returns an empty list ordered by the given ranking
+func newTopList(r topRanking) *topList {
+	return &topList{ranking: r}
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface
+func (l *topList) Len() int {
+	return len(l.entries)
+}
+
+func (l *topList) Less(i, j int) bool {
+	return l.ranking(l.entries[j], l.entries[i])
+}
+
+func (l *topList) Swap(i, j int) {
+	l.entries[i], l.entries[j] = l.entries[j], l.entries[i]
+}
+
+func (l *topList) Push(x interface{}) {
+	l.entries = append(l.entries, x.(*topEntry))
+}
+
+func (l *topList) Pop() interface{} {
+	e := l.entries[len(l.entries)-1]
+	l.entries = l.entries[:len(l.entries)-1]
+	return e
+}
+
+// add adds the entry to the list if it ranks in the top n
+func (l *topList) add(e *topEntry, n int) {
+	if len(l.entries) < n {
+		heap.Push(l, e)
+		return
+	}
+	// The root of the heap is the last of the top
+	if n > 0 && l.ranking(e, l.entries[0]) {
+		l.entries[0] = e
+		heap.Fix(l, 0)
+	}
+}
+
+// sorted returns a copy of the entries, the top one first
+func (l *topList) sorted() []*topEntry {
+	res := make([]*topEntry, len(l.entries))
+	copy(res, l.entries)
+	sort.Slice(res, func(i, j int) bool { return l.ranking(res[i], res[j]) })
+	return res
+}
+
+// topObjects keeps the largest, the oldest and the oldest but largest objects
+// of a bucket
+type topObjects struct {
+	largest  *topList
+	oldest   *topList
+	oldLarge *topList
+}
+
+// newTopObjects returns empty top lists
+func newTopObjects() *topObjects {
+	return &topObjects{
+		largest:  newTopList(largestFirst),
+		oldest:   newTopList(oldestFirst),
+		oldLarge: newTopList(oldLargeFirst),
+	}
+}
+
+// add ranks the object in the top n of each list
+func (t *topObjects) add(e *topEntry, n int) {
+	t.largest.add(e, n)
+	t.oldest.add(e, n)
+	t.oldLarge.add(e, n)
+}
+
+// merge ranks the entries of the lists of src in the top n of each list. src
+// must not be in use anymore.
+func (t *topObjects) merge(src *topObjects, n int) {
+	for _, l := range []struct {
+		dst, src *topList
+	}{{t.largest, src.largest}, {t.oldest, src.oldest}, {t.oldLarge, src.oldLarge}} {
+		for _, e := range l.src.entries {
+			l.dst.add(e, n)
+		}
+	}
+}
+
+// topSnapshot is the serializable form of topObjects, each list being sorted
+type topSnapshot struct {
+	Largest  []*topEntry `json:"largest,omitempty"`
+	Oldest   []*topEntry `json:"oldest,omitempty"`
+	OldLarge []*topEntry `json:"oldest_largest,omitempty"`
+}
+
+// snapshot returns the sorted top lists. It returns nil if no object has
+// been ranked.
+func (t *topObjects) snapshot() *topSnapshot {
+	if t.largest.Len() == 0 {
+		return nil
+	}
+	return &topSnapshot{Largest: t.largest.sorted(), Oldest: t.oldest.sorted(), OldLarge: t.oldLarge.sorted()}
+}
+
+// restore rebuilds the top lists from their snapshot
+func (s *topSnapshot) restore() *topObjects {
+	t := newTopObjects()
+	for _, l := range []struct {
+		dst *topList
+		src []*topEntry
+	}{{t.largest, s.Largest}, {t.oldest, s.Oldest}, {t.oldLarge, s.OldLarge}} {
+		l.dst.entries = append(l.dst.entries, l.src...)
+		heap.Init(l.dst)
+	}
+	return t
+}
+
+// mergeTop returns the top n of the sorted lists of all the buckets. The top
+// n of each bucket contains all its objects that can rank in the global top n.
+func mergeTop(ctr map[string]*bucketCounter, n int) *topSnapshot {
+	largest, oldest, oldLarge := newTopList(largestFirst), newTopList(oldestFirst), newTopList(oldLargeFirst)
+	for _, c := range ctr {
+		s := c.topSnapshot()
+		if s == nil {
+			continue
+		}
+		for _, e := range s.Largest {
+			largest.add(e, n)
+		}
+		for _, e := range s.Oldest {
+			oldest.add(e, n)
+		}
+		for _, e := range s.OldLarge {
+			oldLarge.add(e, n)
+		}
+	}
+	if largest.Len() == 0 {
+		return nil
+	}
+	return &topSnapshot{Largest: largest.sorted(), Oldest: oldest.sorted(), OldLarge: oldLarge.sorted()}
+}
+
+// topTables builds the tables of the top lists. The bucket column is only
+// added for the lists spanning several buckets.
+func topTables(s *topSnapshot, scope string, withBucket bool) []*reportTable {
+	if s == nil {
+		return nil
+	}
+	table := func(title string, entries []*topEntry) *reportTable {
+		t := &reportTable{
+			title:   fmt.Sprintf("%s %s", title, scope),
+			headers: []string{"Key", "Size (bytes)", "Storage class", "Last modified", "Size x age (GB-days)"},
+		}
+		if withBucket {
+			t.headers = append([]string{"Bucket name"}, t.headers...)
+		}
+		for _, e := range entries {
+			row := []string{
+				e.Key,
+				strconv.FormatInt(e.Size, 10),
+				e.StorageClass,
+				e.LastModified.UTC().Format(time.RFC3339),
+				strconv.FormatFloat(e.byteDays()/1024/1024/1024, 'f', 4, 64),
+			}
+			if withBucket {
+				row = append([]string{e.Bucket}, row...)
+			}
+			t.rows = append(t.rows, row)
+		}
+		return t
+	}
+	return []*reportTable{
+		table("Largest objects", s.Largest),
+		table("Oldest objects", s.Oldest),
+		table("Oldest and largest objects", s.OldLarge),
+	}
+}
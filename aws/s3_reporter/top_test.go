@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// randomEntries returns n objects of random size and age spread over the
+// given buckets
+func randomEntries(n int, buckets ...string) []*topEntry {
+	r := rand.New(rand.NewSource(42))
+	res := make([]*topEntry, n)
+	for i := range res {
+		res[i] = &topEntry{
+			Bucket:       buckets[i%len(buckets)],
+			Key:          fmt.Sprintf("key%05d", i),
+			Size:         r.Int63n(1000),
+			StorageClass: "STANDARD",
+			LastModified: now.AddDate(0, 0, -r.Intn(100)),
+		}
+	}
+	return res
+}
+
+// expectedTop returns the first n entries according to the ranking
+func expectedTop(entries []*topEntry, ranking topRanking, n int) []*topEntry {
+	res := make([]*topEntry, len(entries))
+	copy(res, entries)
+	sort.Slice(res, func(i, j int) bool { return ranking(res[i], res[j]) })
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+func TestTopObjects(t *testing.T) {
+	entries := randomEntries(5000, "foo")
+	top := newTopObjects()
+	for _, e := range entries {
+		top.add(e, 10)
+	}
+
+	s := top.snapshot()
+	for _, d := range []struct {
+		name    string
+		ranking topRanking
+		got     []*topEntry
+	}{
+		{"largest", largestFirst, s.Largest},
+		{"oldest", oldestFirst, s.Oldest},
+		{"oldest largest", oldLargeFirst, s.OldLarge},
+	} {
+		if expected := expectedTop(entries, d.ranking, 10); !reflect.DeepEqual(d.got, expected) {
+			t.Errorf("%s: expecting %v got %v", d.name, expected, d.got)
+		}
+	}
+
+	// The lists survive a checkpoint
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	restored := &topSnapshot{}
+	if err = json.Unmarshal(data, restored); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	resumed := restored.restore()
+	more := randomEntries(100, "foo")
+	for i, e := range more {
+		e.Key = fmt.Sprintf("more%05d", i)
+		e.Size += 500
+		resumed.add(e, 10)
+	}
+	expected := expectedTop(append(entries, more...), largestFirst, 10)
+	var expectedKeys, keys []string
+	for i, e := range resumed.snapshot().Largest {
+		keys = append(keys, e.Key)
+		expectedKeys = append(expectedKeys, expected[i].Key)
+	}
+	if len(keys) != 10 || !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Expecting %v got %v", expectedKeys, keys)
+	}
+}
+
+func TestMergeTop(t *testing.T) {
+	setDateRanges(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	defer setDateRanges(time.Now())
+	entries := randomEntries(1000, "foo", "bar", "baz")
+	ctr := map[string]*bucketCounter{"foo": newBucketCounter(), "bar": newBucketCounter(), "baz": newBucketCounter(), "empty": newBucketCounter()}
+	for _, e := range entries {
+		ctr[e.Bucket].countTop(e, 5)
+	}
+	s := mergeTop(ctr, 5)
+	if expected := expectedTop(entries, oldLargeFirst, 5); !reflect.DeepEqual(s.OldLarge, expected) {
+		t.Errorf("Expecting %v got %v", expected, s.OldLarge)
+	}
+	if expected := expectedTop(entries, oldestFirst, 5); !reflect.DeepEqual(s.Oldest, expected) {
+		t.Errorf("Expecting %v got %v", expected, s.Oldest)
+	}
+	if ctr["empty"].topSnapshot() != nil || mergeTop(map[string]*bucketCounter{}, 5) != nil {
+		t.Error("Expecting no top list without object")
+	}
+
+	tables := topTables(&topSnapshot{Largest: []*topEntry{{
+		Bucket:       "foo",
+		Key:          "a/b.bin",
+		Size:         1073741824,
+		StorageClass: "GLACIER",
+		LastModified: time.Date(2018, 3, 6, 0, 0, 0, 0, time.UTC),
+	}}}, "of all the buckets", true)
+	if len(tables) != 3 || tables[0].title != "Largest objects of all the buckets" {
+		t.Fatalf("Unexpected tables %v", tables)
+	}
+	expectedRow := []string{"foo", "a/b.bin", "1073741824", "GLACIER", "2018-03-06T00:00:00Z", "10.0000"}
+	if !reflect.DeepEqual(tables[0].rows[0], expectedRow) {
+		t.Errorf("Expecting %v got %v", expectedRow, tables[0].rows[0])
+	}
+}
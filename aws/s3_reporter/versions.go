@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// hiddenStats contains the objects of a page that are not current objects:
+// noncurrent versions, delete markers and incomplete multipart uploads
+type hiddenStats struct {
+	noncurrent    []*s3.ObjectVersion
+	deleteMarkers uint64
+	uploads       []*multipartStat
+}
+
+// multipartStat is an incomplete multipart upload and the size of its parts
+type multipartStat struct {
+	initiated time.Time
+	size      int64
+}
+
+// count adds the hidden statistics to the counter of a bucket. The noncurrent
+// versions are filtered like the current ones; the delete markers and the
+// incomplete multipart uploads are always counted. They are counted in a
+// counter of their own merged once in the counter of the bucket.
+func (h *hiddenStats) count(bucket string) {
+	reportMutex.Lock()
+	currentReport := report[bucket]
+	reportMutex.Unlock()
+	local := newBucketCounter()
+	for _, v := range h.noncurrent {
+		if !keyFilters.match(bucket, decodeKey(aws.StringValue(v.Key)), aws.Int64Value(v.Size), aws.TimeValue(v.LastModified)) {
+			continue
+		}
+		local.countNoncurrent(aws.TimeValue(v.LastModified), aws.Int64Value(v.Size))
+	}
+	if h.deleteMarkers > 0 {
+		local.countDeleteMarkers(h.deleteMarkers)
+	}
+	for _, u := range h.uploads {
+		local.countMultipart(u.initiated, u.size)
+	}
+	currentReport.merge(local, *topCount)
+}
+
+// versionMarker encodes the markers of ListObjectVersions in a single
+// continuation token
+func versionMarker(keyMarker, versionIDMarker string) string {
+	return url.Values{"key-marker": {keyMarker}, "version-id-marker": {versionIDMarker}}.Encode()
+}
+
+// parseVersionMarker decodes a token produced by versionMarker
+func parseVersionMarker(token string) (string, string, error) {
+	v, err := url.ParseQuery(token)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid version marker %q: %s", token, err)
+	}
+	return v.Get("key-marker"), v.Get("version-id-marker"), nil
+}
+
+// splitVersions separates the current versions of a ListObjectVersions page,
+// returned as a page of objects, from the other versions and delete markers
+func splitVersions(out *s3.ListObjectVersionsOutput) (*s3.ListObjectsV2Output, *hiddenStats) {
+	page := &s3.ListObjectsV2Output{Name: out.Name}
+	hidden := &hiddenStats{deleteMarkers: uint64(len(out.DeleteMarkers))}
+	for _, v := range out.Versions {
+		if !aws.BoolValue(v.IsLatest) {
+			hidden.noncurrent = append(hidden.noncurrent, v)
+			continue
+		}
+		page.Contents = append(page.Contents, &s3.Object{
+			ETag:         v.ETag,
+			Key:          v.Key,
+			LastModified: v.LastModified,
+			Size:         v.Size,
+			StorageClass: v.StorageClass,
+		})
+	}
+	return page, hidden
+}
+
+// getMultipartUploads returns the multipart uploads of a bucket that have not
+// been completed nor aborted, with the size of the parts already uploaded. The
+// parts of the uploads of a page are listed before the next page is fetched;
+// the uploads completed or aborted in the meantime are skipped.
+func getMultipartUploads(svc s3iface.S3API, bucketName *string) ([]*multipartStat, error) {
+	var res []*multipartStat
+	var partsErr error
+	err := svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{Bucket: bucketName},
+		func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, u := range page.Uploads {
+				stat, err := getUploadParts(svc, bucketName, u)
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+					continue
+				}
+				if err != nil {
+					partsErr = err
+					return false
+				}
+				res = append(res, stat)
+			}
+			return !lastPage
+		})
+	if err == nil {
+		err = partsErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// getUploadParts returns the size of the parts already uploaded of a multipart
+// upload
+func getUploadParts(svc s3iface.S3API, bucketName *string, u *s3.MultipartUpload) (*multipartStat, error) {
+	stat := &multipartStat{initiated: aws.TimeValue(u.Initiated)}
+	err := svc.ListPartsPages(&s3.ListPartsInput{Bucket: bucketName, Key: u.Key, UploadId: u.UploadId},
+		func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, p := range page.Parts {
+				stat.size += aws.Int64Value(p.Size)
+			}
+			return !lastPage
+		})
+	return stat, err
+}
+
+// getBucketVersions gets the list of all the versions of the objects in a
+// bucket. The current versions are sent to the page channel like the objects
+// listed by getBucketObjects, the other versions, the delete markers and the
+// incomplete multipart uploads are counted separately. If the progress
+// contains a continuation token for the bucket, the listing starts from there.
+func getBucketVersions(svc s3iface.S3API, bucketName *string, pageChan chan *s3.ListObjectsV2Output, progress *scanProgress) error {
+	encodingType := "url"
+	params := s3.ListObjectVersionsInput{Bucket: bucketName, EncodingType: &encodingType}
+	var uploads []*multipartStat
+	if token := progress.token(*bucketName); token != "" {
+		log.Printf("Resuming the listing of the versions of bucket %s", *bucketName)
+		keyMarker, versionIDMarker, err := parseVersionMarker(token)
+		if err != nil {
+			return err
+		}
+		params.KeyMarker = &keyMarker
+		params.VersionIdMarker = &versionIDMarker
+	} else {
+		// The multipart uploads are counted with the first page of versions, so
+		// they are not counted again when resuming
+		var err error
+		if uploads, err = getMultipartUploads(svc, bucketName); err != nil {
+			return err
+		}
+	}
+	var pageErr error
+	err := svc.ListObjectVersionsPages(&params,
+		func(out *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			page, hidden := splitVersions(out)
+			page.Name = bucketName
+			if !lastPage {
+				// With the url encoding type, the markers are returned encoded
+				keyMarker, err := url.QueryUnescape(aws.StringValue(out.NextKeyMarker))
+				if err != nil {
+					pageErr = err
+					return false
+				}
+				page.NextContinuationToken = aws.String(versionMarker(keyMarker, aws.StringValue(out.NextVersionIdMarker)))
+			}
+			hidden.uploads, uploads = uploads, nil
+			progress.pushPageWith(page, pageChan, func() { hidden.count(*bucketName) })
+			return !lastPage
+		})
+	if err != nil {
+		return err
+	}
+	return pageErr
+}
+
+// ageSizeTable builds a table of sizes in bytes by date range, in the order
+// of the ranges. Returns nil if the map is empty.
+func ageSizeTable(ctr map[string]uint64, title, header string) *reportTable {
+	if len(ctr) == 0 {
+		return nil
+	}
+	t := reportTable{title: title, headers: []string{header, "Total size (GB)"}}
+	for _, r := range dateRangeLabels {
+		if v, ok := ctr[r]; ok {
+			t.rows = append(t.rows, []string{r, strconv.FormatFloat(bytesToGB(v), 'f', 4, 64)})
+		}
+	}
+	return &t
+}
+
+// hiddenSummaryTable builds the table of the storage used by noncurrent
+// versions, delete markers and incomplete multipart uploads of each bucket
+func hiddenSummaryTable(ctr map[string]*bucketCounter) *reportTable {
+	t := reportTable{
+		title:   "Noncurrent versions, delete markers and incomplete multipart uploads by buckets",
+		headers: []string{"Bucket name", "Noncurrent versions", "Noncurrent versions size (GB)", "Delete markers", "Incomplete multipart uploads", "Incomplete multipart uploads size (GB)"},
+	}
+	for _, k := range sortedKeys(ctr) {
+		v := ctr[k]
+		t.rows = append(t.rows, []string{
+			k,
+			strconv.FormatUint(v.noncurrent, 10),
+			strconv.FormatFloat(bytesToGB(v.noncurrentSize), 'f', 4, 64),
+			strconv.FormatUint(v.deleteMarkers, 10),
+			strconv.FormatUint(v.multipart, 10),
+			strconv.FormatFloat(bytesToGB(v.multipartSize), 'f', 4, 64),
+		})
+	}
+	return &t
+}
+
+// hiddenDetailsTables builds the tables of the age of the noncurrent versions
+// and of the incomplete multipart uploads of a bucket
+func hiddenDetailsTables(bucket string, ctr *bucketCounter) []*reportTable {
+	return []*reportTable{
+		ageSizeTable(ctr.noncurrentAge, fmt.Sprintf("Size of the noncurrent versions for bucket %s by age", bucket), "Age of the version"),
+		ageSizeTable(ctr.multipartAge, fmt.Sprintf("Size of the incomplete multipart uploads for bucket %s by age", bucket), "Age of the upload"),
+	}
+}
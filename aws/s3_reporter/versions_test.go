@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// s3VersionsMock serves 2 pages of versions and an incomplete multipart
+// upload of 2 parts. A second upload is completed before its parts are listed.
+// partsErr is returned when listing the parts of the first upload if set.
+type s3VersionsMock struct {
+	s3iface.S3API
+	versionCalls, uploadCalls int
+	keyMarkers                []string
+	partsErr                  error
+}
+
+func (m *s3VersionsMock) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	lastMod := aws.Time(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))
+	pages := []*s3.ListObjectVersionsOutput{
+		{
+			Name: input.Bucket,
+			Versions: []*s3.ObjectVersion{
+				{Key: aws.String("a%20b.txt"), IsLatest: aws.Bool(true), Size: aws.Int64(100), LastModified: lastMod, StorageClass: aws.String("STANDARD")},
+				{Key: aws.String("a%20b.txt"), IsLatest: aws.Bool(false), Size: aws.Int64(300), LastModified: lastMod, StorageClass: aws.String("STANDARD")},
+			},
+			NextKeyMarker:       aws.String("a%20b.txt"),
+			NextVersionIdMarker: aws.String("v1"),
+		},
+		{
+			Name:          input.Bucket,
+			Versions:      []*s3.ObjectVersion{{Key: aws.String("c.txt"), IsLatest: aws.Bool(false), Size: aws.Int64(700), LastModified: lastMod, StorageClass: aws.String("STANDARD")}},
+			DeleteMarkers: []*s3.DeleteMarkerEntry{{Key: aws.String("c.txt"), IsLatest: aws.Bool(true), LastModified: lastMod}},
+		},
+	}
+	start := 0
+	if input.KeyMarker != nil {
+		m.keyMarkers = append(m.keyMarkers, *input.KeyMarker+"/"+aws.StringValue(input.VersionIdMarker))
+		start = 1
+	}
+	for i := start; i < len(pages); i++ {
+		m.versionCalls++
+		if !fn(pages[i], i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *s3VersionsMock) ListMultipartUploadsPages(input *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool) error {
+	m.uploadCalls++
+	if fn(&s3.ListMultipartUploadsOutput{Uploads: []*s3.MultipartUpload{
+		{Key: aws.String("big.bin"), UploadId: aws.String("u1"), Initiated: aws.Time(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))},
+	}}, false) {
+		fn(&s3.ListMultipartUploadsOutput{Uploads: []*s3.MultipartUpload{
+			{Key: aws.String("done.bin"), UploadId: aws.String("u2"), Initiated: aws.Time(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))},
+		}}, true)
+	}
+	return nil
+}
+
+func (m *s3VersionsMock) ListPartsPages(input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
+	if *input.UploadId == "u2" {
+		return awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	if m.partsErr != nil {
+		return m.partsErr
+	}
+	fn(&s3.ListPartsOutput{Parts: []*s3.Part{{Size: aws.Int64(5000)}, {Size: aws.Int64(2000)}}}, true)
+	return nil
+}
+
+// scanVersionsMock runs the listing of the versions of a bucket through the
+// same channels as main
+func scanVersionsMock(svc s3iface.S3API, bucket string, progress *scanProgress) error {
+	var wg sync.WaitGroup
+	pageChan := make(chan *s3.ListObjectsV2Output, 10)
+	wg.Add(1)
+	go processPage(pageChan, &wg, progress)
+	err := getBucketVersions(svc, &bucket, pageChan, progress)
+	close(pageChan)
+	wg.Wait()
+	return err
+}
+
+func TestGetBucketVersions(t *testing.T) {
+	setDateRanges(time.Date(2018, 3, 16, 0, 0, 0, 0, time.UTC))
+	reportMutex = &sync.Mutex{}
+	report = map[string]*bucketCounter{"foo": newBucketCounter()}
+	svc := &s3VersionsMock{}
+	progress := newScanProgress()
+	if err := scanVersionsMock(svc, "foo", progress); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c := report["foo"]
+	if c.fileCount != 1 || c.sizeTotal != 100 {
+		t.Errorf("Expecting 1 current object of 100 bytes got %d objects of %d bytes", c.fileCount, c.sizeTotal)
+	}
+	if c.noncurrent != 2 || c.noncurrentSize != 1000 || c.noncurrentAge["1-2 year"] != 1000 {
+		t.Errorf("Expecting 2 noncurrent versions of 1000 bytes got %d versions of %d bytes by age %v", c.noncurrent, c.noncurrentSize, c.noncurrentAge)
+	}
+	if c.deleteMarkers != 1 {
+		t.Errorf("Expecting 1 delete marker got %d", c.deleteMarkers)
+	}
+	if c.multipart != 1 || c.multipartSize != 7000 || c.multipartAge["2-3 year"] != 7000 {
+		t.Errorf("Expecting 1 multipart upload of 7000 bytes got %d uploads of %d bytes by age %v", c.multipart, c.multipartSize, c.multipartAge)
+	}
+	if !progress.isDone("foo") {
+		t.Error("Expecting bucket foo to be done")
+	}
+	expected := c.snapshot()
+
+	// Resuming after the first page does not count the uploads again
+	report = map[string]*bucketCounter{"foo": newBucketCounter()}
+	report["foo"].increment(100, "STANDARD", ".txt", "a%20b.txt", time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), true)
+	report["foo"].countNoncurrent(time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC), 300)
+	report["foo"].countMultipart(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), 7000)
+	progress = newScanProgress()
+	progress.tokens["foo"] = versionMarker("a b.txt", "v1")
+	svc = &s3VersionsMock{}
+	if err := scanVersionsMock(svc, "foo", progress); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if svc.uploadCalls != 0 || svc.versionCalls != 1 {
+		t.Errorf("Expecting 1 page of versions and no uploads listed got %d and %d", svc.versionCalls, svc.uploadCalls)
+	}
+	if !reflect.DeepEqual(svc.keyMarkers, []string{"a b.txt/v1"}) {
+		t.Errorf("Unexpected markers %v", svc.keyMarkers)
+	}
+	if r := report["foo"].snapshot(); !reflect.DeepEqual(r, expected) {
+		t.Errorf("Expecting %v got %v", expected, r)
+	}
+
+	expectedRows := [][]string{{"foo", "2", "0.0000", "1", "1", "0.0000"}}
+	if tbl := hiddenSummaryTable(report); !reflect.DeepEqual(tbl.rows, expectedRows) {
+		t.Errorf("Expecting %v got %v", expectedRows, tbl.rows)
+	}
+	tables := hiddenDetailsTables("foo", report["foo"])
+	if len(tables) != 2 || tables[0].rows[0][0] != "1-2 year" || tables[1].rows[0][0] != "2-3 year" {
+		t.Errorf("Unexpected details tables %v", tables)
+	}
+}
+
+func TestGetMultipartUploadsError(t *testing.T) {
+	svc := &s3VersionsMock{partsErr: awserr.New("AccessDenied", "Access Denied", nil)}
+	if _, err := getMultipartUploads(svc, aws.String("foo")); err != svc.partsErr {
+		t.Errorf("Expecting %v got %v", svc.partsErr, err)
+	}
+}